@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// defaultConfigFile is read when --config is not given, relative to the home directory
+const defaultConfigFile = ".rabbit.go/config.yaml"
+
+// Flags that select the config file itself and are never read from it
+var configFileFlags = map[string]bool{"config": true, "profile": true}
+
+// loadConfigFile fills every flag the user did not set on the command line from the
+// config file. Keys match flag names; values under profiles.<name> override the
+// top-level values when --profile is given. A missing default config file is ignored.
+func loadConfigFile(cmd *cobra.Command, path, profile string) error {
+	explicit := path != ""
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			if profile != "" {
+				return fmt.Errorf("cannot locate config file for profile %q: %v", profile, err)
+			}
+			return nil
+		}
+		path = filepath.Join(home, defaultConfigFile)
+	}
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		if !explicit && profile == "" && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("error reading config file %s: %v", path, err)
+	}
+
+	settings := []*viper.Viper{v}
+	if profile != "" {
+		profileSettings := v.Sub("profiles." + profile)
+		if profileSettings == nil {
+			return fmt.Errorf("profile %q not found in %s", profile, path)
+		}
+		settings = []*viper.Viper{profileSettings, v}
+	}
+
+	var applyErr error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if applyErr != nil || flag.Changed || configFileFlags[flag.Name] {
+			return
+		}
+
+		for _, s := range settings {
+			if !s.IsSet(flag.Name) {
+				continue
+			}
+			if err := setFlagFromConfig(flag, s, flag.Name); err != nil {
+				applyErr = fmt.Errorf("invalid %q in %s: %v", flag.Name, path, err)
+			}
+			return
+		}
+	})
+	if applyErr != nil {
+		return applyErr
+	}
+
+	fmt.Printf("📄 Loaded settings from %s", path)
+	if profile != "" {
+		fmt.Printf(" (profile %s)", profile)
+	}
+	fmt.Println()
+	return nil
+}
+
+// setFlagFromConfig sets a flag from a config value, accepting either a single
+// value or a list for repeatable flags such as --local-port
+func setFlagFromConfig(flag *pflag.Flag, s *viper.Viper, key string) error {
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		return slice.Replace(s.GetStringSlice(key))
+	}
+	return flag.Value.Set(s.GetString(key))
+}
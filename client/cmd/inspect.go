@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"rabbit.go/client/internal/tunnel"
+)
+
+var inspectCmd = &cobra.Command{
+	Use:     "inspect",
+	Aliases: []string{"whoami"},
+	Short:   "Show what a token grants without opening a tunnel",
+	Long: `Ask the server to check a token and describe it: the team it belongs to, the
+remote ports and protocol assigned to it, when it expires and which local ports it
+may expose. No tunnel is opened and nothing is recorded against the token.`,
+	Example: `  rabbit.go inspect --server tunnel.example.com:9999 --token YOUR_TOKEN
+  rabbit.go whoami --profile db`,
+	SilenceUsage: true,
+	RunE:         runInspect,
+}
+
+func init() {
+	inspectCmd.Flags().StringVar(&serverAddress, "server", "rabbit.synehq.com", "Tunnel server address (host:port)")
+	inspectCmd.Flags().StringVar(&token, "token", "default", "Authentication token")
+	inspectCmd.Flags().DurationVar(&connectionTimeout, "timeout", 10*time.Second, "Connection timeout")
+
+	inspectCmd.Flags().BoolVar(&useTLS, "tls", false, "Connect to the server over TLS")
+	inspectCmd.Flags().StringVar(&tlsServerName, "server-name", "", "Server name to verify the TLS certificate against (defaults to the server host)")
+	inspectCmd.Flags().StringVar(&caCertFile, "ca-cert", "", "PEM file with CA certificates to trust for the server certificate")
+	inspectCmd.Flags().BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "Skip TLS certificate verification (testing only)")
+
+	inspectCmd.Flags().StringVar(&configFile, "config", "", "Config file to read settings from (default ~/.rabbit.go/config.yaml)")
+	inspectCmd.Flags().StringVar(&profileName, "profile", "", "Named profile in the config file to use")
+
+	rootCmd.AddCommand(inspectCmd)
+}
+
+func runInspect(cmd *cobra.Command, args []string) error {
+	if err := loadConfigFile(cmd, configFile, profileName); err != nil {
+		return err
+	}
+
+	info, err := tunnel.Inspect(tunnel.TunnelClientConfig{
+		ServerAddress:      serverAddress,
+		Token:              token,
+		ConnectionTimeout:  connectionTimeout,
+		UseTLS:             useTLS || caCertFile != "" || tlsServerName != "" || insecureSkipVerify,
+		ServerName:         tlsServerName,
+		CACertFile:         caCertFile,
+		InsecureSkipVerify: insecureSkipVerify,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("🔍 Token is valid on %s\n", serverAddress)
+	fmt.Printf("   Team: %s\n", info.TeamName)
+	fmt.Printf("   Token: %s\n", info.TokenName)
+	if len(info.Ports) == 0 {
+		fmt.Printf("   Ports: none assigned yet (one is allocated on first connect)\n")
+	}
+	for _, port := range info.Ports {
+		fmt.Printf("   Port: %d (%s)", port.Port, port.Protocol)
+		if port.Subdomain != "" {
+			fmt.Printf(" subdomain %s", port.Subdomain)
+		}
+		fmt.Println()
+	}
+	if info.ExpiresAt != nil {
+		fmt.Printf("   Expires: %s\n", info.ExpiresAt.Local().Format(time.RFC1123))
+	} else {
+		fmt.Printf("   Expires: never\n")
+	}
+	if len(info.AllowedLocalPorts) > 0 {
+		ports := make([]string, len(info.AllowedLocalPorts))
+		for i, port := range info.AllowedLocalPorts {
+			ports[i] = strconv.FormatInt(port, 10)
+		}
+		fmt.Printf("   Allowed local ports: %s\n", strings.Join(ports, ", "))
+	} else {
+		fmt.Printf("   Allowed local ports: any\n")
+	}
+	return nil
+}
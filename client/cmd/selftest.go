@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"rabbit.go/client/internal/tunnel"
+	proto "rabbit.go/protocol"
+)
+
+// Self-test limits. The server waits up to its data connection timeout (10s by
+// default) for the client, so pairing gets a little longer than that.
+const (
+	selfTestPairingTimeout  = 15 * time.Second
+	selfTestTransferTimeout = 60 * time.Second
+)
+
+// Self-test stages reported on failure
+const (
+	stageConnect        = "connect"
+	stageAuth           = "auth"
+	stagePortAssignment = "port assignment"
+	stageDataPairing    = "data pairing"
+	stageBridge         = "bridge"
+)
+
+var testPayloadSize int
+
+var tunnelTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Check a tunnel end to end through a local echo server",
+	Long: `Run a self-test of the full tunnel path before relying on it.
+
+The test starts an echo server on an ephemeral local port, opens a tunnel to it,
+connects to the tunnel's remote port through the server and checks that every byte
+comes back unchanged. It reports round-trip latency and throughput, or the stage
+that failed: connect, auth, port assignment, data pairing or bridge.`,
+	Example: `  rabbit.go tunnel test --server tunnel.example.com:9999 --token YOUR_TOKEN
+  rabbit.go tunnel test --profile staging --size 10485760`,
+	SilenceUsage: true,
+	RunE:         runTunnelTest,
+}
+
+func init() {
+	tunnelTestCmd.Flags().StringVar(&serverAddress, "server", "rabbit.synehq.com", "Tunnel server address (host:port)")
+	tunnelTestCmd.Flags().StringVar(&token, "token", "default", "Authentication token")
+	tunnelTestCmd.Flags().DurationVar(&connectionTimeout, "timeout", 10*time.Second, "Connection timeout")
+	tunnelTestCmd.Flags().IntVar(&testPayloadSize, "size", 1024*1024, "Bytes to echo through the tunnel for the throughput test")
+
+	tunnelTestCmd.Flags().BoolVar(&useTLS, "tls", false, "Connect to the server over TLS")
+	tunnelTestCmd.Flags().StringVar(&tlsServerName, "server-name", "", "Server name to verify the TLS certificate against (defaults to the server host)")
+	tunnelTestCmd.Flags().StringVar(&caCertFile, "ca-cert", "", "PEM file with CA certificates to trust for the server certificate")
+	tunnelTestCmd.Flags().BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "Skip TLS certificate verification (testing only)")
+
+	tunnelTestCmd.Flags().StringVar(&configFile, "config", "", "Config file to read settings from (default ~/.rabbit.go/config.yaml)")
+	tunnelTestCmd.Flags().StringVar(&profileName, "profile", "", "Named profile in the config file to use")
+}
+
+// selfTestError reports the self-test stage that failed
+type selfTestError struct {
+	stage string
+	err   error
+}
+
+func (e *selfTestError) Error() string {
+	return fmt.Sprintf("self-test failed at %s: %v", e.stage, e.err)
+}
+
+func runTunnelTest(cmd *cobra.Command, args []string) error {
+	if err := loadConfigFile(cmd, configFile, profileName); err != nil {
+		return err
+	}
+	if testPayloadSize <= 0 {
+		return fmt.Errorf("--size must be positive")
+	}
+
+	// Local echo server standing in for the tunneled service
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("error starting local echo server: %v", err)
+	}
+	defer echo.Close()
+
+	var accepted atomic.Int32
+	go serveEcho(echo, &accepted)
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+
+	fmt.Printf("🧪 Testing tunnel through %s (local echo server on port %s)\n", serverAddress, echoPort)
+
+	client, err := tunnel.NewTunnelClient(tunnel.TunnelClientConfig{
+		ServerAddress:      serverAddress,
+		PortMappings:       []tunnel.PortMapping{{LocalPort: echoPort}},
+		LocalHost:          "127.0.0.1",
+		Token:              token,
+		ConnectionTimeout:  connectionTimeout,
+		TCPNoDelay:         true,
+		UseTLS:             useTLS || caCertFile != "" || tlsServerName != "" || insecureSkipVerify,
+		ServerName:         tlsServerName,
+		CACertFile:         caCertFile,
+		InsecureSkipVerify: insecureSkipVerify,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating tunnel client: %v", err)
+	}
+
+	if err := client.Connect(); err != nil {
+		return &selfTestError{stage: handshakeStage(err), err: err}
+	}
+	defer client.Stop()
+
+	tunnels := client.Tunnels()
+	host, _, err := net.SplitHostPort(serverAddress)
+	if err != nil {
+		host = serverAddress
+	}
+	remoteAddr := net.JoinHostPort(host, tunnels[0].RemotePort)
+
+	conn, err := net.DialTimeout("tcp", remoteAddr, connectionTimeout)
+	if err != nil {
+		return &selfTestError{stage: stagePortAssignment, err: fmt.Errorf("remote port %s is not reachable: %v", remoteAddr, err)}
+	}
+	defer conn.Close()
+
+	// A small round trip first; it includes pairing the data connection
+	probe := []byte("rabbit.go self-test\n")
+	conn.SetDeadline(time.Now().Add(selfTestPairingTimeout))
+	start := time.Now()
+	if _, err := conn.Write(probe); err != nil {
+		return &selfTestError{stage: pairingOrBridge(&accepted), err: err}
+	}
+	reply := make([]byte, len(probe))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return &selfTestError{stage: pairingOrBridge(&accepted), err: fmt.Errorf("no echo from %s: %v", remoteAddr, err)}
+	}
+	latency := time.Since(start)
+	if !bytes.Equal(reply, probe) {
+		return &selfTestError{stage: stageBridge, err: fmt.Errorf("echoed bytes do not match")}
+	}
+
+	// Then a bulk transfer for throughput
+	payload := make([]byte, testPayloadSize)
+	rand.Read(payload)
+	conn.SetDeadline(time.Now().Add(selfTestTransferTimeout))
+	start = time.Now()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		writeErr <- err
+	}()
+
+	received := make([]byte, len(payload))
+	n, err := io.ReadFull(conn, received)
+	elapsed := time.Since(start)
+	if err != nil {
+		return &selfTestError{stage: stageBridge, err: fmt.Errorf("echo stopped after %d of %d bytes: %v", n, len(payload), err)}
+	}
+	if err := <-writeErr; err != nil {
+		return &selfTestError{stage: stageBridge, err: err}
+	}
+	if !bytes.Equal(received, payload) {
+		return &selfTestError{stage: stageBridge, err: fmt.Errorf("echoed bytes do not match")}
+	}
+
+	throughput := float64(len(payload)) / elapsed.Seconds() / (1024 * 1024)
+	fmt.Printf("\n✅ Self-test passed via %s\n", remoteAddr)
+	fmt.Printf("   Latency: %v (first round trip, including data pairing)\n", latency.Round(time.Millisecond))
+	fmt.Printf("   Throughput: %.2f MiB/s (%d bytes echoed in %v)\n", throughput, len(payload), elapsed.Round(time.Millisecond))
+	return nil
+}
+
+// handshakeStage maps a failed Connect to the stage that failed
+func handshakeStage(err error) string {
+	var handshakeErr *tunnel.HandshakeError
+	if !errors.As(err, &handshakeErr) {
+		return stageConnect
+	}
+	if handshakeErr.Code == proto.ErrCodePortAssignment {
+		return stagePortAssignment
+	}
+	return stageAuth
+}
+
+// pairingOrBridge tells a data connection that never reached the local service
+// apart from a bridge that broke after it did
+func pairingOrBridge(accepted *atomic.Int32) string {
+	if accepted.Load() == 0 {
+		return stageDataPairing
+	}
+	return stageBridge
+}
+
+// serveEcho echoes every connection accepted on l until l is closed
+func serveEcho(l net.Listener, accepted *atomic.Int32) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted.Add(1)
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"rabbit.go/client/internal/tunnel"
+)
+
+var sshConfig tunnel.TunnelConfig
+
+var sshCmd = &cobra.Command{
+	Use:   "ssh",
+	Short: "Forward a local port to a remote service through an SSH server",
+	Long: `Open a local port that forwards every connection to a remote host and port
+through an SSH server, like "ssh -L".
+
+The server's host key is checked against your known_hosts file. An unknown host
+or a changed key is refused with the key's fingerprint; check it out of band and
+add the printed line to known_hosts before retrying.
+
+Authentication tries each --auth method in order until the server accepts one:
+agent (keys held by the agent at SSH_AUTH_SOCK), publickey (the --ssh-key file),
+password and keyboard-interactive. Passwords are read from RABBIT_SSH_PASSWORD,
+or asked for on the terminal. A passphrase-protected key is decrypted with
+--key-passphrase or RABBIT_SSH_KEY_PASSPHRASE, or a passphrase asked for on the
+terminal.`,
+	Example: `  rabbit.go ssh --ssh-host bastion.example.com --ssh-user deploy \
+    --local-port 5432 --remote-host db.internal --remote-port 5432
+  rabbit.go ssh --ssh-host bastion.example.com --ssh-user deploy --auth agent,password \
+    --local-port 8080 --remote-port 80`,
+	SilenceUsage: true,
+	RunE:         runSSH,
+}
+
+func init() {
+	sshCmd.Flags().StringVar(&sshConfig.SSHHost, "ssh-host", "", "SSH server host")
+	sshCmd.Flags().StringVar(&sshConfig.SSHPort, "ssh-port", "22", "SSH server port")
+	sshCmd.Flags().StringVar(&sshConfig.SSHUser, "ssh-user", "", "SSH user")
+	sshCmd.Flags().StringVar(&sshConfig.SSHKeyPath, "ssh-key", "", "Private key file (default ~/.ssh/id_rsa)")
+	sshCmd.Flags().StringVar(&sshConfig.KeyPassphrase, "key-passphrase", "", "Passphrase of an encrypted --ssh-key (prefer RABBIT_SSH_KEY_PASSPHRASE or the prompt; flags are visible to other local users)")
+	sshCmd.Flags().StringSliceVar(&sshConfig.AuthMethods, "auth", tunnel.DefaultSSHAuthMethods, "Auth methods to try in order: agent, publickey, password, keyboard-interactive")
+	sshCmd.Flags().StringVar(&sshConfig.KnownHostsPath, "known-hosts", "", "known_hosts file to verify the server's host key against (default ~/.ssh/known_hosts)")
+	sshCmd.Flags().BoolVar(&sshConfig.InsecureIgnoreHostKey, "insecure", false, "Skip host key verification (testing only; allows man-in-the-middle attacks)")
+	sshCmd.Flags().StringVar(&sshConfig.LocalPort, "local-port", "", "Local port to listen on")
+	sshCmd.Flags().StringVar(&sshConfig.BindAddress, "bind", "localhost", "Local address to listen on")
+	sshCmd.Flags().StringVar(&sshConfig.RemoteHost, "remote-host", "localhost", "Host to forward to, as seen from the SSH server")
+	sshCmd.Flags().StringVar(&sshConfig.RemotePort, "remote-port", "", "Port to forward to")
+
+	sshCmd.MarkFlagRequired("ssh-host")
+	sshCmd.MarkFlagRequired("ssh-user")
+	sshCmd.MarkFlagRequired("local-port")
+	sshCmd.MarkFlagRequired("remote-port")
+
+	rootCmd.AddCommand(sshCmd)
+}
+
+func runSSH(cmd *cobra.Command, args []string) error {
+	sshConfig.Password = os.Getenv("RABBIT_SSH_PASSWORD")
+	if sshConfig.KeyPassphrase == "" {
+		sshConfig.KeyPassphrase = os.Getenv("RABBIT_SSH_KEY_PASSPHRASE")
+	}
+
+	t, err := tunnel.NewTunnel(sshConfig)
+	if err != nil {
+		return fmt.Errorf("error creating SSH tunnel: %v", err)
+	}
+	if err := t.Start(); err != nil {
+		return err
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+
+	fmt.Printf("\n🛑 Received interrupt signal...\n")
+	return t.Stop()
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"rabbit.go/client/internal/tunnel"
+)
+
+var (
+	statusQueryAddr string
+	statusJSON      bool
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the live status of a running tunnel client",
+	Long: `Query a tunnel client started with --status-addr and show whether it is
+connected, how often it has reconnected, the bytes it has carried and the
+connections it is bridging right now.`,
+	Example: `  rabbit.go tunnel --token YOUR_TOKEN --local-port 5432 --status-addr 127.0.0.1:4040
+  rabbit.go status --status-addr 127.0.0.1:4040
+  rabbit.go status --json`,
+	SilenceUsage: true,
+	RunE:         runStatus,
+}
+
+func init() {
+	statusCmd.Flags().StringVar(&statusQueryAddr, "status-addr", "127.0.0.1:4040", "Address the tunnel client serves its status on")
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print the raw JSON status")
+	statusCmd.Flags().DurationVar(&connectionTimeout, "timeout", 10*time.Second, "Connection timeout")
+
+	rootCmd.AddCommand(statusCmd)
+}
+
+func runStatus(cmd *cobra.Command, args []string) error {
+	client := &http.Client{Timeout: connectionTimeout}
+	resp, err := client.Get("http://" + statusQueryAddr + "/status")
+	if err != nil {
+		return fmt.Errorf("no tunnel client status at %s (was it started with --status-addr?): %v", statusQueryAddr, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status endpoint at %s returned %s", statusQueryAddr, resp.Status)
+	}
+
+	if statusJSON {
+		_, err := io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+
+	var status tunnel.Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("error reading status: %v", err)
+	}
+
+	if status.Connected {
+		fmt.Printf("🟢 Connected to %s (%s)\n", status.Server, status.Protocol)
+	} else {
+		fmt.Printf("🔴 Not connected to %s (%s)\n", status.Server, status.Protocol)
+	}
+	fmt.Printf("   Running since: %s (%v)\n", status.StartedAt.Local().Format(time.RFC1123), time.Since(status.StartedAt).Round(time.Second))
+	fmt.Printf("   Reconnects: %d\n", status.Reconnects)
+	for _, t := range status.Tunnels {
+		fmt.Printf("   Tunnel %s: local port %s → remote port %s\n", t.ID, t.LocalPort, t.RemotePort)
+	}
+	fmt.Printf("   Connections: %d total, %d active\n", status.TotalConnections, len(status.Connections))
+	if status.RefusedConns > 0 {
+		fmt.Printf("   Refused: %d connections over the concurrency limit\n", status.RefusedConns)
+	}
+	fmt.Printf("   Traffic: ↑%d ↓%d bytes\n", status.BytesToServer, status.BytesToLocal)
+	for _, c := range status.Connections {
+		fmt.Printf("   • %s local:%s", c.ID, c.LocalPort)
+		if c.ClientAddr != "" {
+			fmt.Printf(" from %s", c.ClientAddr)
+		}
+		fmt.Printf(" for %v (↑%d ↓%d bytes)\n", time.Since(c.StartedAt).Round(time.Second), c.BytesToServer, c.BytesToLocal)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,13 +15,40 @@ import (
 
 var (
 	serverAddress        string
-	localPort            string
+	localPorts           []string
+	remotePort           string
+	protocol             string
+	bind                 string
+	localHost            string
+	localSocket          string
 	token                string
 	maxReconnectAttempts int
 	initialRetryDelay    time.Duration
 	maxRetryDelay        time.Duration
+	retryJitter          float64
 	healthCheckInterval  time.Duration
+	heartbeatTimeout     time.Duration
 	connectionTimeout    time.Duration
+	tcpNoDelay           bool
+	tcpKeepAlive         time.Duration
+	useTLS               bool
+	tlsServerName        string
+	caCertFile           string
+	insecureSkipVerify   bool
+	localTLS             bool
+	localTLSCACertFile   string
+	localTLSSkipVerify   bool
+	compression          bool
+	multiplex            bool
+	proxyProtocol        string
+	requireLocal         bool
+	bridgeBufferSize     int
+	maxConnections       int
+	dataDialAttempts     int
+	localDialAttempts    int
+	statusAddr           string
+	configFile           string
+	profileName          string
 )
 
 func init() {
@@ -36,55 +64,184 @@ If the connection is lost, it will automatically attempt to reconnect.
 
 Why did the rabbit use a tunnel? To get to the other side of the firewall, of course! 🐇
 
+Settings can also come from a YAML config file (default ~/.rabbit.go/config.yaml) whose
+keys match the flag names. Named profiles under "profiles" are selected with --profile,
+and flags given on the command line always override file values:
+
+  server: tunnel.example.com:9999
+  profiles:
+    db:
+      token: mytoken123
+      local-port: [5432]
+    cache:
+      token: othertoken456
+      local-port: [6379]
+
+Run "rabbit.go tunnel test" to check the whole path end to end through a local echo server.
+
 Warning: excessive tunneling may result in finding Wonderland. Proceed with curiosity.
 `,
 		Example: `
   rabbit.go tunnel \
     --local-port 5432 \
+    --local-port 6379 \
     --token mytoken123 \
     --max-retries 5 \
     --initial-delay 2s \
-    --max-delay 30s`,
+    --max-delay 30s
+
+  rabbit.go tunnel --local-socket /var/run/docker.sock --token mytoken123
+
+  rabbit.go tunnel --profile db`,
 		RunE: runTunnel,
 	}
 
 	// Tunnel connection flags
 	tunnelCmd.Flags().StringVar(&serverAddress, "server", "rabbit.synehq.com", "Tunnel server address (host:port)")
-	tunnelCmd.Flags().StringVar(&localPort, "local-port", "5432", "Local port to tunnel")
+	tunnelCmd.Flags().StringArrayVar(&localPorts, "local-port", []string{"5432"}, "Local port to tunnel as port or port:remote-port (repeatable)")
+	tunnelCmd.Flags().StringVar(&remotePort, "remote-port", "", "Remote port to ask for with a single --local-port or --local-socket; must be one of the token's assigned ports")
+	tunnelCmd.Flags().StringVar(&protocol, "protocol", "tcp", "Protocol of the local service (tcp or udp); must match the token's port assignment")
+	tunnelCmd.Flags().StringVar(&bind, "bind", "", "Where the server listens for the tunnel: public, or loopback for consumers on the server host only (default: public if the token allows it)")
+	tunnelCmd.Flags().StringVar(&localHost, "local-host", "localhost", "Host running the local service, e.g. 10.0.0.5 to reach another machine on your network")
+	tunnelCmd.Flags().StringVar(&localSocket, "local-socket", "", "Unix socket of the local service, e.g. /var/run/docker.sock, instead of --local-port (tcp only)")
 	tunnelCmd.Flags().StringVar(&token, "token", "default", "Authentication token")
+	tunnelCmd.Flags().StringVar(&proxyProtocol, "proxy-protocol", "", "Send a PROXY protocol header (v1 or v2) to the local service with the real client address (tcp only)")
+	tunnelCmd.Flags().BoolVar(&compression, "compression", false, "Compress tunnel traffic if the server supports it (tcp only)")
+	tunnelCmd.Flags().BoolVar(&multiplex, "multiplex", false, "Carry all tunnel connections over one connection to the server if it supports it, instead of one connection each")
+	tunnelCmd.Flags().IntVar(&bridgeBufferSize, "buffer-size", 0, "Bytes per copy buffer for tunneled connections, e.g. 262144 for high-bandwidth, high-latency links (0 = Go's default copy)")
+	tunnelCmd.Flags().IntVar(&maxConnections, "max-connections", 0, "Maximum connections open to the local service at once; more wait up to 5s for a free slot, then are refused (0 = unlimited)")
+	tunnelCmd.Flags().BoolVar(&requireLocal, "require-local", false, "Only keep the tunnel up while the local service accepts connections, checked before connecting and every health interval (tcp only)")
+	tunnelCmd.Flags().StringVar(&statusAddr, "status-addr", "", "Serve live status as JSON on this address, e.g. 127.0.0.1:4040 (read it with \"rabbit.go status\")")
 
 	// Reconnection configuration flags
 	tunnelCmd.Flags().IntVar(&maxReconnectAttempts, "max-retries", 10, "Maximum reconnection attempts (0 = infinite)")
 	tunnelCmd.Flags().DurationVar(&initialRetryDelay, "initial-delay", 1*time.Second, "Initial delay between retry attempts")
 	tunnelCmd.Flags().DurationVar(&maxRetryDelay, "max-delay", 60*time.Second, "Maximum delay between retry attempts")
+	tunnelCmd.Flags().Float64Var(&retryJitter, "jitter", 0.5, "Fraction of each retry delay to randomize, from 0 (none) to 1 (anywhere between zero and the delay)")
 	tunnelCmd.Flags().DurationVar(&healthCheckInterval, "health-interval", 30*time.Second, "Health check interval")
+	tunnelCmd.Flags().DurationVar(&heartbeatTimeout, "heartbeat-timeout", 10*time.Second, "Time to wait for a heartbeat reply before reconnecting")
+	tunnelCmd.Flags().IntVar(&dataDialAttempts, "data-dial-attempts", 3, "Times to try the server's data connection for each tunneled connection before dropping it (1 = no retries)")
+	tunnelCmd.Flags().IntVar(&localDialAttempts, "local-dial-attempts", 2, "Times to try the local service for each tunneled connection before dropping it (1 = no retries)")
 	tunnelCmd.Flags().DurationVar(&connectionTimeout, "timeout", 10*time.Second, "Connection timeout")
+	tunnelCmd.Flags().BoolVar(&tcpNoDelay, "tcp-nodelay", true, "Send small writes at once instead of coalescing them (set false to enable Nagle's algorithm)")
+	tunnelCmd.Flags().DurationVar(&tcpKeepAlive, "tcp-keepalive", 30*time.Second, "TCP keepalive probe interval for connections to the server and local services (negative disables)")
+
+	// TLS flags
+	tunnelCmd.Flags().BoolVar(&useTLS, "tls", false, "Connect to the server over TLS")
+	tunnelCmd.Flags().StringVar(&tlsServerName, "server-name", "", "Server name to verify the TLS certificate against (defaults to the server host)")
+	tunnelCmd.Flags().StringVar(&caCertFile, "ca-cert", "", "PEM file with CA certificates to trust for the server certificate")
+	tunnelCmd.Flags().BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "Skip TLS certificate verification (testing only)")
+
+	// Local TLS flags
+	tunnelCmd.Flags().BoolVar(&localTLS, "local-tls", false, "Connect to the local service over TLS, e.g. an internal HTTPS app (tcp only)")
+	tunnelCmd.Flags().StringVar(&localTLSCACertFile, "local-tls-ca", "", "PEM file with CA certificates to trust for the local service's certificate")
+	tunnelCmd.Flags().BoolVar(&localTLSSkipVerify, "local-tls-skip-verify", false, "Skip verification of the local service's certificate, e.g. a self-signed one")
 
-	// Required flags
-	tunnelCmd.MarkFlagRequired("server")
+	// Config file flags
+	tunnelCmd.Flags().StringVar(&configFile, "config", "", "Config file to read settings from (default ~/.rabbit.go/config.yaml)")
+	tunnelCmd.Flags().StringVar(&profileName, "profile", "", "Named profile in the config file to use")
 
+	tunnelCmd.AddCommand(tunnelTestCmd)
 	rootCmd.AddCommand(tunnelCmd)
 }
 
 func runTunnel(cmd *cobra.Command, args []string) error {
+	// Fill flags not given on the command line from the config file
+	if err := loadConfigFile(cmd, configFile, profileName); err != nil {
+		return err
+	}
+	if serverAddress == "" {
+		return fmt.Errorf("a server address is required (--server or \"server\" in the config file)")
+	}
+
+	// Parse port mappings; a local socket replaces the default --local-port
+	var mappings []tunnel.PortMapping
+	if localSocket != "" {
+		if flag := cmd.Flags().Lookup("local-port"); flag.Changed || flag.Value.String() != flag.DefValue {
+			return fmt.Errorf("use either --local-port or --local-socket, not both")
+		}
+		localPorts = nil
+	}
+	for _, value := range localPorts {
+		local, remote, _ := strings.Cut(value, ":")
+		if local == "" {
+			return fmt.Errorf("invalid --local-port value %q", value)
+		}
+		mappings = append(mappings, tunnel.PortMapping{LocalPort: local, RemotePort: remote})
+	}
+
 	// Create tunnel client configuration
 	config := tunnel.TunnelClientConfig{
-		ServerAddress:        serverAddress,
-		LocalPort:            localPort,
-		Token:                token,
-		MaxReconnectAttempts: maxReconnectAttempts,
-		InitialRetryDelay:    initialRetryDelay,
-		MaxRetryDelay:        maxRetryDelay,
-		HealthCheckInterval:  healthCheckInterval,
-		ConnectionTimeout:    connectionTimeout,
+		ServerAddress:            serverAddress,
+		PortMappings:             mappings,
+		Protocol:                 protocol,
+		Bind:                     bind,
+		LocalHost:                localHost,
+		LocalSocket:              localSocket,
+		RequestedRemotePort:      remotePort,
+		Token:                    token,
+		MaxReconnectAttempts:     maxReconnectAttempts,
+		InitialRetryDelay:        initialRetryDelay,
+		MaxRetryDelay:            maxRetryDelay,
+		JitterFactor:             retryJitter,
+		HealthCheckInterval:      healthCheckInterval,
+		HeartbeatTimeout:         heartbeatTimeout,
+		ConnectionTimeout:        connectionTimeout,
+		TCPNoDelay:               tcpNoDelay,
+		TCPKeepAlive:             tcpKeepAlive,
+		UseTLS:                   useTLS || caCertFile != "" || tlsServerName != "" || insecureSkipVerify,
+		ServerName:               tlsServerName,
+		CACertFile:               caCertFile,
+		InsecureSkipVerify:       insecureSkipVerify,
+		LocalTLS:                 localTLS || localTLSCACertFile != "" || localTLSSkipVerify,
+		LocalTLSCACertFile:       localTLSCACertFile,
+		LocalTLSSkipVerify:       localTLSSkipVerify,
+		Compression:              compression,
+		Multiplex:                multiplex,
+		ProxyProtocol:            proxyProtocol,
+		LocalHealthCheck:         requireLocal,
+		BridgeBufferSize:         bridgeBufferSize,
+		MaxConcurrentConnections: maxConnections,
+		DataDialAttempts:         dataDialAttempts,
+		LocalDialAttempts:        localDialAttempts,
+		StatusAddr:               statusAddr,
 	}
 
 	fmt.Printf("🚀 Starting tunnel client with auto-reconnection...\n")
 	fmt.Printf("   Server: %s\n", config.ServerAddress)
-	fmt.Printf("   Local Port: %s\n", config.LocalPort)
+	for _, mapping := range config.PortMappings {
+		fmt.Printf("   Local Port: %s\n", mapping)
+	}
+	if config.LocalSocket != "" {
+		fmt.Printf("   Local Socket: %s\n", config.LocalSocket)
+	} else {
+		fmt.Printf("   Local Host: %s\n", config.LocalHost)
+	}
+	fmt.Printf("   Protocol: %s\n", protocol)
+	if config.Bind != "" {
+		fmt.Printf("   Bind: %s\n", config.Bind)
+	}
+	if config.UseTLS {
+		fmt.Printf("   TLS: enabled (verify: %v)\n", !config.InsecureSkipVerify)
+	}
+	if config.LocalTLS {
+		fmt.Printf("   Local TLS: enabled (verify: %v)\n", !config.LocalTLSSkipVerify)
+	}
+	if config.Compression {
+		fmt.Printf("   Compression: requested\n")
+	}
+	if config.Multiplex {
+		fmt.Printf("   Multiplexing: requested\n")
+	}
+	if config.ProxyProtocol != "" {
+		fmt.Printf("   PROXY protocol: %s\n", config.ProxyProtocol)
+	}
+	if config.LocalHealthCheck {
+		fmt.Printf("   Local Health Check: enabled\n")
+	}
 	fmt.Printf("   Max Retries: %d\n", config.MaxReconnectAttempts)
-	fmt.Printf("   Retry Delay: %v - %v\n", config.InitialRetryDelay, config.MaxRetryDelay)
-	fmt.Printf("   Health Check: %v\n", config.HealthCheckInterval)
+	fmt.Printf("   Retry Delay: %v - %v (jitter %.0f%%)\n", config.InitialRetryDelay, config.MaxRetryDelay, config.JitterFactor*100)
+	fmt.Printf("   Health Check: %v (heartbeat timeout %v)\n", config.HealthCheckInterval, config.HeartbeatTimeout)
 
 	// Create and start tunnel client
 	client, err := tunnel.NewTunnelClient(config)
@@ -103,9 +260,14 @@ func runTunnel(cmd *cobra.Command, args []string) error {
 	fmt.Printf("\n📡 Tunnel client is running with auto-reconnection.\n")
 	fmt.Printf("   Press Ctrl+C to stop.\n\n")
 
-	// Wait for interrupt signal
-	<-sigChan
-
-	fmt.Printf("\n🛑 Received interrupt signal...\n")
-	return client.Stop()
+	// Wait for interrupt signal, or for the client to give up
+	select {
+	case <-sigChan:
+		fmt.Printf("\n🛑 Received interrupt signal...\n")
+	case <-client.Done():
+	}
+	if err := client.Stop(); err != nil {
+		return err
+	}
+	return client.Err()
 }
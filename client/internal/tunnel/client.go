@@ -1,14 +1,23 @@
 package tunnel
 
 import (
-	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"rabbit.go/protocol"
 )
 
 // TunnelClient represents a tunnel client that connects to our custom tunnel server
@@ -18,32 +27,238 @@ type TunnelClient struct {
 	localConn      net.Conn
 	wg             sync.WaitGroup
 	stopSignal     chan struct{}
-	tunnelID       string
-	remotePort     string
+	tunnels        []ActiveTunnel
 	isConnected    bool
 	connectionMu   sync.RWMutex
 	reconnectCount int
 	stopped        bool // Prevent reconnect after user shutdown
+
+	// stopErr is set when the client stops for an error reconnecting cannot fix,
+	// e.g. a revoked token; done is closed once the client stops reconnecting
+	stopErr error
+	done    chan struct{}
+
+	// Heartbeat state for the current control connection
+	writeMu  sync.Mutex    // Serializes writes to the control connection
+	pongChan chan struct{} // Receives a signal for every PONG from the server
+
+	tlsConfig      *tls.Config // Set when UseTLS is enabled
+	localTLSConfig *tls.Config // Set when LocalTLS is enabled
+
+	compression string // Algorithm the server agreed to for data connections ("" = none)
+	multiplex   bool   // The server agreed to multiplexed data connections
+	sessionID   string // The server's id for the current control connection, shown in its logs
+
+	// setupKeys holds the idempotency key sent for each mapping, kept across
+	// reconnects so the server does not record a retried setup twice
+	setupKeys []string
+
+	buffers *sync.Pool // Copy buffers for data connections; nil uses io.Copy
+
+	connSlots chan struct{} // One token per open connection when MaxConcurrentConnections is set
+
+	// The multiplexed data connection, dialed on first use and again after it fails
+	muxMu sync.Mutex
+	mux   *protocol.MuxSession
+
+	// Traffic counters reported by Status
+	startedAt        time.Time
+	statsMu          sync.Mutex
+	activeConns      map[string]*connStats
+	totalConns       int64
+	refusedConns     int64 // Connections refused under MaxConcurrentConnections
+	finishedToServer int64 // Bytes of connections that have finished
+	finishedToLocal  int64
+
+	statusServer *http.Server // Set when StatusAddr is configured
+}
+
+// PortMapping describes a local port to expose through the tunnel
+type PortMapping struct {
+	LocalPort  string
+	RemotePort string // Optional: one of the token's assigned remote ports
+}
+
+// String formats the mapping as "local[:remote]"
+func (m PortMapping) String() string {
+	if m.RemotePort == "" {
+		return m.LocalPort
+	}
+	return m.LocalPort + ":" + m.RemotePort
+}
+
+// ActiveTunnel is a mapping the server has accepted and bound to a remote port
+type ActiveTunnel struct {
+	ID             string
+	LocalPort      string
+	RemotePort     string
+	ReconnectToken string // Presented on reconnect to get RemotePort back
 }
 
 // TunnelClientConfig holds configuration for our custom tunnel client
 type TunnelClientConfig struct {
 	ServerAddress        string
-	LocalPort            string
+	LocalPort            string        // Shorthand for a single entry in PortMappings
+	RequestedRemotePort  string        // Optional: remote port for the single mapping; must be assigned to the token
+	PortMappings         []PortMapping // Local ports to expose over one control connection
+	Protocol             string        // Transport of the local service: "tcp" (default) or "udp"
+	Bind                 string        // Where the server listens: "public", "loopback", or "" for the token's default
+	LocalHost            string        // Host running the local service (default "localhost")
+	LocalSocket          string        // Unix socket of the local service, instead of LocalPort or PortMappings (tcp only)
 	Token                string
 	MaxReconnectAttempts int           // Maximum number of reconnection attempts (0 = infinite)
 	InitialRetryDelay    time.Duration // Initial delay between reconnection attempts
 	MaxRetryDelay        time.Duration // Maximum delay between reconnection attempts
+	JitterFactor         float64       // Fraction of each retry delay randomized away, 0 (none) to 1 (full jitter)
 	HealthCheckInterval  time.Duration // Interval for health checks
+	HeartbeatTimeout     time.Duration // Maximum time to wait for a PONG after sending a PING
 	ConnectionTimeout    time.Duration // Timeout for connection attempts
+
+	// Socket options for connections to the server and to local services.
+	// TCPNoDelay sends small writes at once rather than letting the kernel coalesce
+	// them (Nagle's algorithm). TCPKeepAlive is the keepalive probe interval; 0
+	// uses Go's default of 15s and a negative value disables the probes.
+	TCPNoDelay   bool
+	TCPKeepAlive time.Duration
+
+	// TLS for control and data connections
+	UseTLS             bool   // Connect to the server over TLS
+	ServerName         string // Optional: name to verify the server certificate against (defaults to the server host)
+	CACertFile         string // Optional: PEM file with CA certificates to trust instead of the system pool
+	InsecureSkipVerify bool   // Skip server certificate verification (testing only)
+
+	// TLS for connections to local services, independent of the TLS settings for
+	// the server. The certificate is verified against LocalHost (tcp only).
+	LocalTLS           bool   // Connect to local services over TLS, e.g. an internal HTTPS app
+	LocalTLSCACertFile string // Optional: PEM file with CA certificates to trust for local services
+	LocalTLSSkipVerify bool   // Skip local certificate verification, e.g. for a self-signed certificate
+
+	// Compression asks the server to compress data connections; it only takes
+	// effect if the server supports it, and tcp tunnels are the only ones compressed
+	Compression bool
+
+	// Multiplex carries every data connection as a stream of one persistent
+	// connection to the server instead of dialing one per external peer. Servers
+	// that do not support it get a connection per peer as before.
+	Multiplex bool
+
+	// ProxyProtocol prepends a PROXY protocol header ("v1" or "v2") to every local
+	// connection so the local service sees the external client's address (tcp only)
+	ProxyProtocol string
+
+	// BridgeBufferSize copies data connections through pooled buffers of this many
+	// bytes, e.g. 256KB for high-bandwidth, high-latency links. 0 uses io.Copy,
+	// which can splice plain TCP connections in the kernel.
+	BridgeBufferSize int
+
+	// LocalHealthCheck probes every local port before connecting and on each health
+	// check; while a local service is unreachable the tunnel is not established, or
+	// is torn down and retried with the usual backoff (tcp only)
+	LocalHealthCheck bool
+
+	// StatusAddr serves the client's Status as JSON on GET /status at this address,
+	// e.g. 127.0.0.1:4040. Bytes of live connections are then counted as they pass,
+	// which keeps plain TCP from being spliced in the kernel.
+	StatusAddr string
+
+	// MaxConcurrentConnections caps the connections open to local services at
+	// once (0 = unlimited). A connection over the cap waits up to
+	// connectionQueueTimeout for another to finish and is refused after that.
+	MaxConcurrentConnections int
+
+	// DataDialAttempts and LocalDialAttempts are how many times the data
+	// connection to the server and the connection to the local service are tried
+	// for each external connection before it is dropped, so a momentary network
+	// blip does not kill it. Retries wait dialRetryDelay, doubling each time
+	// (defaults 3 and 2; 1 disables retries).
+	DataDialAttempts  int
+	LocalDialAttempts int
 }
 
+// Defaults for unset dial attempt settings, and the wait before the first retry
+const (
+	defaultDataDialAttempts  = 3
+	defaultLocalDialAttempts = 2
+	dialRetryDelay           = 100 * time.Millisecond
+)
+
+// connectionQueueTimeout is how long a connection waits for a free slot under
+// MaxConcurrentConnections. It is kept below the server's default data connection
+// timeout, so a queued connection still gets through.
+const connectionQueueTimeout = 5 * time.Second
+
 // NewTunnelClient creates a new tunnel client instance
 func NewTunnelClient(config TunnelClientConfig) (*TunnelClient, error) {
 	if config.Token == "" {
 		config.Token = "default"
 	}
 
+	if config.Protocol == "" {
+		config.Protocol = "tcp"
+	}
+	if config.Protocol != "tcp" && config.Protocol != "udp" {
+		return nil, fmt.Errorf("unsupported protocol %q (expected tcp or udp)", config.Protocol)
+	}
+	if config.Bind != "" && config.Bind != protocol.BindPublic && config.Bind != protocol.BindLoopback {
+		return nil, fmt.Errorf("unsupported bind %q (expected %s or %s)", config.Bind, protocol.BindPublic, protocol.BindLoopback)
+	}
+
+	if config.LocalSocket != "" {
+		if config.LocalPort != "" || len(config.PortMappings) > 0 {
+			return nil, fmt.Errorf("set either a local port or a local socket, not both")
+		}
+		if config.Protocol != "tcp" {
+			return nil, fmt.Errorf("local sockets are only supported for tcp tunnels")
+		}
+		// The socket path stands in for the local port in the handshake and logs
+		config.PortMappings = []PortMapping{{LocalPort: config.LocalSocket}}
+	}
+	if len(config.PortMappings) == 0 && config.LocalPort != "" {
+		config.PortMappings = []PortMapping{{LocalPort: config.LocalPort}}
+	}
+	if len(config.PortMappings) == 0 {
+		return nil, fmt.Errorf("a local port or a local socket is required")
+	}
+	if config.RequestedRemotePort != "" {
+		if port, err := strconv.Atoi(config.RequestedRemotePort); err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid remote port %q", config.RequestedRemotePort)
+		}
+		if len(config.PortMappings) != 1 {
+			return nil, fmt.Errorf("a remote port can only be requested for a single local port; use local:remote mappings instead")
+		}
+		mapping := &config.PortMappings[0]
+		if mapping.RemotePort != "" && mapping.RemotePort != config.RequestedRemotePort {
+			return nil, fmt.Errorf("local port %s asks for remote port %s, not %s", mapping.LocalPort, mapping.RemotePort, config.RequestedRemotePort)
+		}
+		mapping.RemotePort = config.RequestedRemotePort
+	}
+
+	if config.ProxyProtocol != "" {
+		if config.ProxyProtocol != ProxyProtocolV1 && config.ProxyProtocol != ProxyProtocolV2 {
+			return nil, fmt.Errorf("unsupported PROXY protocol version %q (expected v1 or v2)", config.ProxyProtocol)
+		}
+		if config.Protocol != "tcp" {
+			return nil, fmt.Errorf("the PROXY protocol is only supported for tcp tunnels")
+		}
+	}
+
+	if config.LocalHealthCheck && config.Protocol != "tcp" {
+		return nil, fmt.Errorf("local health checks are only supported for tcp tunnels")
+	}
+
+	if config.LocalTLS && config.Protocol != "tcp" {
+		return nil, fmt.Errorf("local TLS is only supported for tcp tunnels")
+	}
+
+	if config.LocalHost == "" {
+		config.LocalHost = "localhost"
+	}
+	if config.LocalSocket == "" {
+		if _, err := net.LookupHost(config.LocalHost); err != nil {
+			return nil, fmt.Errorf("cannot resolve local host %q: %v", config.LocalHost, err)
+		}
+	}
+
 	// Set default values for reconnection parameters
 	if config.MaxReconnectAttempts == 0 {
 		config.MaxReconnectAttempts = 10 // 0 means infinite, but we'll use 10 as default
@@ -54,21 +269,342 @@ func NewTunnelClient(config TunnelClientConfig) (*TunnelClient, error) {
 	if config.MaxRetryDelay == 0 {
 		config.MaxRetryDelay = 60 * time.Second
 	}
+	if config.BridgeBufferSize < 0 {
+		return nil, fmt.Errorf("bridge buffer size must not be negative")
+	}
+	if config.MaxConcurrentConnections < 0 {
+		return nil, fmt.Errorf("max concurrent connections must not be negative")
+	}
+	if config.DataDialAttempts < 0 || config.LocalDialAttempts < 0 {
+		return nil, fmt.Errorf("dial attempts must not be negative")
+	}
+	if config.DataDialAttempts == 0 {
+		config.DataDialAttempts = defaultDataDialAttempts
+	}
+	if config.LocalDialAttempts == 0 {
+		config.LocalDialAttempts = defaultLocalDialAttempts
+	}
+	if config.JitterFactor < 0 || config.JitterFactor > 1 {
+		return nil, fmt.Errorf("jitter factor must be between 0 and 1, got %v", config.JitterFactor)
+	}
 	if config.HealthCheckInterval == 0 {
 		config.HealthCheckInterval = 30 * time.Second
 	}
+	if config.HeartbeatTimeout == 0 {
+		config.HeartbeatTimeout = 10 * time.Second
+	}
 	if config.ConnectionTimeout == 0 {
 		config.ConnectionTimeout = 10 * time.Second
 	}
 
-	return &TunnelClient{
-		Config:     config,
-		stopSignal: make(chan struct{}),
-	}, nil
+	tc := &TunnelClient{
+		Config:      config,
+		stopSignal:  make(chan struct{}),
+		done:        make(chan struct{}),
+		startedAt:   time.Now(),
+		activeConns: make(map[string]*connStats),
+	}
+	for range config.PortMappings {
+		tc.setupKeys = append(tc.setupKeys, fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64()))
+	}
+	if config.BridgeBufferSize > 0 {
+		tc.buffers = &sync.Pool{New: func() interface{} {
+			buf := make([]byte, config.BridgeBufferSize)
+			return &buf
+		}}
+	}
+	if config.MaxConcurrentConnections > 0 {
+		tc.connSlots = make(chan struct{}, config.MaxConcurrentConnections)
+	}
+
+	if config.UseTLS {
+		tlsConfig, err := buildTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		tc.tlsConfig = tlsConfig
+	}
+
+	if config.LocalTLS {
+		localTLSConfig, err := buildLocalTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		tc.localTLSConfig = localTLSConfig
+	}
+
+	return tc, nil
+}
+
+// buildTLSConfig creates the TLS configuration used for control and data connections
+func buildTLSConfig(config TunnelClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(config.ServerAddress)
+		if err != nil {
+			host = config.ServerAddress
+		}
+		tlsConfig.ServerName = host
+	}
+
+	if config.CACertFile != "" {
+		pool, err := loadCertPool(config.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// buildLocalTLSConfig creates the TLS configuration used for connections to local services
+func buildLocalTLSConfig(config TunnelClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.LocalHost,
+		InsecureSkipVerify: config.LocalTLSSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.LocalSocket != "" {
+		tlsConfig.ServerName = "localhost"
+	}
+
+	if config.LocalTLSCACertFile != "" {
+		pool, err := loadCertPool(config.LocalTLSCACertFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertPool reads the PEM-encoded CA certificates in file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// dial opens a control or data connection to the tunnel server, over TLS when enabled
+func (tc *TunnelClient) dial() (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   tc.Config.ConnectionTimeout,
+		KeepAlive: tc.Config.TCPKeepAlive,
+	}
+
+	var conn net.Conn
+	var err error
+	if tc.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", tc.Config.ServerAddress, tc.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", tc.Config.ServerAddress)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tc.setNoDelay(conn)
+	return conn, nil
+}
+
+// dialLocal opens a connection to the local service for a port
+func (tc *TunnelClient) dialLocal(localPort string) (net.Conn, error) {
+	dialer := &net.Dialer{KeepAlive: tc.Config.TCPKeepAlive}
+	conn, err := dialer.Dial(tc.localNetwork(), tc.localAddress(localPort))
+	if err != nil {
+		return nil, err
+	}
+	tc.setNoDelay(conn)
+	return conn, nil
+}
+
+// setNoDelay applies TCPNoDelay to conn, or to the TCP connection under a TLS
+// connection. Unix socket connections are left alone.
+func (tc *TunnelClient) setNoDelay(conn net.Conn) {
+	for {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetNoDelay(tc.Config.TCPNoDelay)
+			return
+		}
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return
+		}
+		conn = wrapped.NetConn()
+	}
+}
+
+// localAddress returns the address of the local service for a port, or the path
+// of its Unix socket
+func (tc *TunnelClient) localAddress(localPort string) string {
+	if tc.Config.LocalSocket != "" {
+		return tc.Config.LocalSocket
+	}
+	return net.JoinHostPort(tc.Config.LocalHost, localPort)
+}
+
+// localNetwork returns the network to dial a tcp local service on
+func (tc *TunnelClient) localNetwork() string {
+	if tc.Config.LocalSocket != "" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// checkLocalServices dials every mapped local port and reports the first one that
+// does not accept connections
+func (tc *TunnelClient) checkLocalServices() error {
+	for _, mapping := range tc.Config.PortMappings {
+		addr := tc.localAddress(mapping.LocalPort)
+		conn, err := net.DialTimeout(tc.localNetwork(), addr, tc.Config.ConnectionTimeout)
+		if err != nil {
+			return fmt.Errorf("local service at %s is unreachable: %v", addr, err)
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// HandshakeError is a tunnel request the server rejected
+type HandshakeError struct {
+	Code      string // One of the protocol.ErrCode constants; empty for older servers
+	Message   string
+	SessionID string // The server's id for the failed session, to find it in the server logs
+}
+
+// Error implements error
+func (e *HandshakeError) Error() string {
+	if e.SessionID != "" {
+		return fmt.Sprintf("tunnel creation failed: %s (session %s)", e.Message, e.SessionID)
+	}
+	return fmt.Sprintf("tunnel creation failed: %s", e.Message)
+}
+
+// Terminal reports whether retrying the handshake cannot succeed, because the
+// server rejected the token or what it was asked for rather than being busy or
+// unreachable
+func (e *HandshakeError) Terminal() bool {
+	switch e.Code {
+	case protocol.ErrCodeAuthFailed, protocol.ErrCodeTokenRevoked, protocol.ErrCodeQuotaExceeded,
+		protocol.ErrCodeLocalPortDenied, protocol.ErrCodeBadRequest, protocol.ErrCodePublicBindDenied:
+		return true
+	}
+	return false
+}
+
+// SessionError is a session the server ended for a reason reconnecting cannot fix
+type SessionError struct {
+	Code    string // One of the protocol.ErrCode constants
+	Message string
+}
+
+// Error implements error
+func (e *SessionError) Error() string {
+	return fmt.Sprintf("server ended the session: %s", e.Message)
+}
+
+// Done is closed when the client has stopped for good: it was stopped, ran out of
+// reconnection attempts, or the server rejected it or ended its session. Err then
+// says why.
+func (tc *TunnelClient) Done() <-chan struct{} {
+	return tc.done
+}
+
+// Err returns the error that stopped the client once Done is closed: a terminal
+// *HandshakeError or a *SessionError. It is nil if the client was stopped or gave
+// up reconnecting.
+func (tc *TunnelClient) Err() error {
+	tc.connectionMu.RLock()
+	defer tc.connectionMu.RUnlock()
+
+	return tc.stopErr
+}
+
+// Connect opens a single control connection and requests the configured tunnels,
+// without automatic reconnection. It is meant for one-shot uses such as self-tests;
+// Stop closes the connection.
+func (tc *TunnelClient) Connect() error {
+	return tc.connect()
+}
+
+// Tunnels returns the tunnels opened on the current control connection
+func (tc *TunnelClient) Tunnels() []ActiveTunnel {
+	tc.connectionMu.RLock()
+	defer tc.connectionMu.RUnlock()
+
+	return append([]ActiveTunnel(nil), tc.tunnels...)
+}
+
+// Inspect asks the server what a token grants without opening a tunnel. Only the
+// server, token, timeout and TLS settings of config are used.
+func Inspect(config TunnelClientConfig) (*protocol.InspectResult, error) {
+	if config.ConnectionTimeout == 0 {
+		config.ConnectionTimeout = 10 * time.Second
+	}
+
+	tc := &TunnelClient{Config: config}
+	if config.UseTLS {
+		tlsConfig, err := buildTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		tc.tlsConfig = tlsConfig
+	}
+
+	conn, err := tc.dial()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to tunnel server: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(config.ConnectionTimeout))
+	if err := protocol.WriteMessage(conn, protocol.MsgInspect, protocol.Inspect{Token: config.Token}); err != nil {
+		return nil, fmt.Errorf("error sending inspect request: %v", err)
+	}
+
+	msgType, payload, err := readReply(conn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading server response: %v", err)
+	}
+
+	// Servers without inspection reject the request as a failed handshake
+	if msgType == protocol.MsgAuthResult {
+		return nil, fmt.Errorf("server does not support token inspection")
+	}
+	if msgType != protocol.MsgInspectResult {
+		return nil, fmt.Errorf("unexpected %s response from server", msgType)
+	}
+
+	var result protocol.InspectResult
+	if err := protocol.Decode(msgType, payload, &result); err != nil {
+		return nil, err
+	}
+	if !result.Success {
+		return nil, &HandshakeError{Code: result.Code, Message: result.Error}
+	}
+	return &result, nil
 }
 
 // Start starts the tunnel client with automatic reconnection
 func (tc *TunnelClient) Start() error {
+	if tc.Config.StatusAddr != "" {
+		if err := tc.startStatusServer(); err != nil {
+			return err
+		}
+	}
+
 	// Start with initial connection attempt
 	tc.wg.Add(1)
 	go tc.connectionManager()
@@ -79,6 +615,7 @@ func (tc *TunnelClient) Start() error {
 // connectionManager manages the tunnel connection with automatic reconnection
 func (tc *TunnelClient) connectionManager() {
 	defer tc.wg.Done()
+	defer close(tc.done)
 
 	attempt := 0
 	for {
@@ -95,6 +632,16 @@ func (tc *TunnelClient) connectionManager() {
 			if err := tc.connect(); err != nil {
 				fmt.Printf("❌ Connection failed: %v\n", err)
 
+				// Rejections that will not change on their own end the client
+				var handshakeErr *HandshakeError
+				if errors.As(err, &handshakeErr) && handshakeErr.Terminal() {
+					fmt.Printf("💥 The server rejected the tunnel request (%s). Not retrying.\n", handshakeErr.Code)
+					tc.connectionMu.Lock()
+					tc.stopErr = err
+					tc.connectionMu.Unlock()
+					return
+				}
+
 				// Check if we should stop trying
 				if tc.Config.MaxReconnectAttempts > 0 && attempt >= tc.Config.MaxReconnectAttempts {
 					fmt.Printf("💥 Maximum reconnection attempts (%d) reached. Stopping.\n", tc.Config.MaxReconnectAttempts)
@@ -124,10 +671,13 @@ func (tc *TunnelClient) connectionManager() {
 			} else {
 				// Connection successful, reset attempt counter
 				attempt = 0
+				tc.connectionMu.Lock()
 				tc.reconnectCount++
+				reconnectCount := tc.reconnectCount
+				tc.connectionMu.Unlock()
 
-				if tc.reconnectCount > 1 {
-					fmt.Printf("✅ Reconnected successfully! (reconnection #%d)\n", tc.reconnectCount-1)
+				if reconnectCount > 1 {
+					fmt.Printf("✅ Reconnected successfully! (reconnection #%d)\n", reconnectCount-1)
 				} else {
 					fmt.Printf("✅ Connected successfully!\n")
 				}
@@ -139,13 +689,17 @@ func (tc *TunnelClient) connectionManager() {
 				// Wait for connection to end
 				tc.waitForDisconnection()
 
-				// Before retrying, check if stopped
+				// Before retrying, check if stopped or told not to come back
 				tc.connectionMu.RLock()
-				if tc.stopped {
-					tc.connectionMu.RUnlock()
+				stopped, stopErr := tc.stopped, tc.stopErr
+				tc.connectionMu.RUnlock()
+				if stopped {
+					return
+				}
+				if stopErr != nil {
+					fmt.Printf("💥 %v. Not reconnecting.\n", stopErr)
 					return
 				}
-				tc.connectionMu.RUnlock()
 				fmt.Printf("🔌 Connection lost. Attempting to reconnect...\n")
 			}
 		}
@@ -154,62 +708,125 @@ func (tc *TunnelClient) connectionManager() {
 
 // connect establishes a connection to the tunnel server
 func (tc *TunnelClient) connect() error {
-	// Connect to tunnel server with timeout
-	dialer := &net.Dialer{
-		Timeout: tc.Config.ConnectionTimeout,
+	// Don't advertise a tunnel every connection through would fail on
+	if tc.Config.LocalHealthCheck {
+		if err := tc.checkLocalServices(); err != nil {
+			return err
+		}
 	}
 
-	conn, err := dialer.Dial("tcp", tc.Config.ServerAddress)
+	// Connect to tunnel server with timeout
+	conn, err := tc.dial()
 	if err != nil {
 		return fmt.Errorf("error connecting to tunnel server: %v", err)
 	}
 
+	// Tunnels from the previous session, whose reconnect tokens rebind each
+	// mapping to the remote port it had before
+	tc.connectionMu.RLock()
+	previous := tc.tunnels
+	tc.connectionMu.RUnlock()
+
 	// Send authentication and tunnel request
-	fmt.Fprintf(conn, "%s\n", tc.Config.Token)
-	fmt.Fprintf(conn, "%s\n", tc.Config.LocalPort)
+	auth := protocol.Auth{Token: tc.Config.Token}
+	if tc.Config.Compression && tc.Config.Protocol == "tcp" {
+		auth.Compression = protocol.CompressionAlgorithms
+	}
+	auth.Multiplex = tc.Config.Multiplex
+	for i, mapping := range tc.Config.PortMappings {
+		remotePort, _ := strconv.Atoi(mapping.RemotePort)
+		portMapping := protocol.PortMapping{
+			LocalPort:  mapping.LocalPort,
+			RemotePort: remotePort,
+			Protocol:   tc.Config.Protocol,
+			Bind:       tc.Config.Bind,
+		}
+		if i < len(tc.setupKeys) {
+			portMapping.IdempotencyKey = tc.setupKeys[i]
+		}
+		if i < len(previous) {
+			portMapping.ReconnectToken = previous[i].ReconnectToken
+		}
+		auth.Mappings = append(auth.Mappings, portMapping)
+	}
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := protocol.WriteMessage(conn, protocol.MsgAuth, auth); err != nil {
+		conn.Close()
+		return fmt.Errorf("error sending tunnel request: %v", err)
+	}
+	conn.SetWriteDeadline(time.Time{})
 
-	// Read response with timeout
+	// Read the server's response with timeout
 	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
+	msgType, payload, err := readReply(conn)
 	if err != nil {
 		conn.Close()
 		return fmt.Errorf("error reading server response: %v", err)
 	}
-	conn.SetReadDeadline(time.Time{}) // Clear deadline
-
-	response = strings.TrimSpace(response)
-	parts := strings.Split(response, ":")
 
-	if len(parts) < 1 || parts[0] != "SUCCESS" {
+	var result protocol.AuthResult
+	if msgType != protocol.MsgAuthResult {
 		conn.Close()
-		if len(parts) > 1 {
-			return fmt.Errorf("tunnel creation failed: %s", strings.Join(parts[1:], ":"))
-		}
-		return fmt.Errorf("tunnel creation failed: %s", response)
+		return fmt.Errorf("unexpected %s response from server", msgType)
 	}
-
-	if len(parts) < 3 {
+	if err := protocol.Decode(msgType, payload, &result); err != nil {
 		conn.Close()
-		return fmt.Errorf("invalid server response format: %s", response)
+		return err
 	}
+	if !result.Success {
+		conn.Close()
+		return &HandshakeError{Code: result.Code, Message: result.Error, SessionID: result.SessionID}
+	}
+	if len(result.Tunnels) != len(tc.Config.PortMappings) {
+		conn.Close()
+		return fmt.Errorf("server opened %d tunnels for %d ports", len(result.Tunnels), len(tc.Config.PortMappings))
+	}
+
+	tunnels := make([]ActiveTunnel, 0, len(result.Tunnels))
+	for _, t := range result.Tunnels {
+		tunnels = append(tunnels, ActiveTunnel{
+			ID:             t.TunnelID,
+			LocalPort:      t.LocalPort,
+			RemotePort:     strconv.Itoa(t.RemotePort),
+			ReconnectToken: t.ReconnectToken,
+		})
+	}
+	conn.SetReadDeadline(time.Time{}) // Clear deadline
 
 	// Update connection state
 	tc.connectionMu.Lock()
 	tc.controlConn = conn
-	tc.tunnelID = parts[1]
-	tc.remotePort = parts[2]
+	tc.pongChan = make(chan struct{}, 1)
+	tc.tunnels = tunnels
+	tc.compression = result.Compression
+	tc.multiplex = result.Multiplex
+	tc.sessionID = result.SessionID
 	tc.isConnected = true
 	tc.connectionMu.Unlock()
 
 	fmt.Printf("🎯 Tunnel established!\n")
-	fmt.Printf("   Tunnel ID: %s\n", tc.tunnelID)
-	fmt.Printf("   Local port %s → Remote port %s\n", tc.Config.LocalPort, tc.remotePort)
-	fmt.Printf("   Access via: %s (remote port %s)\n", tc.Config.ServerAddress, tc.remotePort)
+	if result.SessionID != "" {
+		fmt.Printf("   Session: %s\n", result.SessionID)
+	}
+	if result.Compression != "" {
+		fmt.Printf("   Compression: %s\n", result.Compression)
+	} else if tc.Config.Compression {
+		fmt.Printf("   Compression: not supported by server, sending uncompressed\n")
+	}
+	if result.Multiplex {
+		fmt.Printf("   Multiplexing: data connections share one connection\n")
+	} else if tc.Config.Multiplex {
+		fmt.Printf("   Multiplexing: not supported by server, dialing per connection\n")
+	}
+	for _, t := range tunnels {
+		fmt.Printf("   Tunnel ID: %s\n", t.ID)
+		fmt.Printf("   Local port %s → Remote port %s (%s)\n", t.LocalPort, t.RemotePort, tc.Config.Protocol)
+		fmt.Printf("   Access via: %s (remote port %s)\n", tc.Config.ServerAddress, t.RemotePort)
+	}
 
 	// Start handling tunnel connections
 	tc.wg.Add(1)
-	go tc.handleTunnelConnections()
+	go tc.handleTunnelConnections(conn)
 
 	return nil
 }
@@ -224,6 +841,12 @@ func (tc *TunnelClient) calculateBackoffDelay(attempt int) time.Duration {
 		delay = tc.Config.MaxRetryDelay
 	}
 
+	// Randomize the delay so clients that lost the same server don't all retry
+	// at once: 1 picks anywhere in [0, delay], 0.5 in [delay/2, delay]
+	if window := time.Duration(float64(delay) * tc.Config.JitterFactor); window > 0 {
+		delay -= rand.N(window + 1)
+	}
+
 	return delay
 }
 
@@ -231,6 +854,11 @@ func (tc *TunnelClient) calculateBackoffDelay(attempt int) time.Duration {
 func (tc *TunnelClient) healthMonitor() {
 	defer tc.wg.Done()
 
+	tc.connectionMu.RLock()
+	conn := tc.controlConn
+	pongChan := tc.pongChan
+	tc.connectionMu.RUnlock()
+
 	ticker := time.NewTicker(tc.Config.HealthCheckInterval)
 	defer ticker.Stop()
 
@@ -239,33 +867,69 @@ func (tc *TunnelClient) healthMonitor() {
 		case <-tc.stopSignal:
 			return
 		case <-ticker.C:
-			if !tc.isHealthy() {
-				fmt.Printf("🚨 Health check failed - connection appears dead\n")
+			tc.connectionMu.RLock()
+			current := tc.controlConn
+			tc.connectionMu.RUnlock()
+
+			// A newer connection has its own monitor
+			if current != conn {
+				return
+			}
+
+			if !tc.isHealthy(conn, pongChan) {
+				fmt.Printf("🚨 Health check failed - no PONG within %v, connection appears dead\n", tc.Config.HeartbeatTimeout)
 				tc.disconnect()
 				return
 			}
+
+			// Closing without a Disconnect keeps the remote port reserved for the
+			// reconnect once the local service is back
+			if tc.Config.LocalHealthCheck {
+				if err := tc.checkLocalServices(); err != nil {
+					fmt.Printf("🚨 Local health check failed - %v. Tearing down the tunnel until it is back\n", err)
+					tc.disconnect()
+					return
+				}
+			}
 		}
 	}
 }
 
-// isHealthy checks if the connection is healthy
-func (tc *TunnelClient) isHealthy() bool {
-	tc.connectionMu.RLock()
-	conn := tc.controlConn
-	connected := tc.isConnected
-	tc.connectionMu.RUnlock()
+// isHealthy sends a PING on the control connection and waits for the server's PONG
+func (tc *TunnelClient) isHealthy(conn net.Conn, pongChan chan struct{}) bool {
+	if conn == nil {
+		return false
+	}
+
+	// Discard any stale pong left over from a previous heartbeat
+	select {
+	case <-pongChan:
+	default:
+	}
 
-	if !connected || conn == nil {
+	if err := tc.writeControl(conn, protocol.MsgPing); err != nil {
 		return false
 	}
 
-	// Try to write a simple ping (this is a basic health check)
-	// In a more sophisticated implementation, you might have a proper ping/pong protocol
-	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	_, err := conn.Write([]byte{}) // Empty write to test connection
-	conn.SetWriteDeadline(time.Time{})
+	select {
+	case <-pongChan:
+		return true
+	case <-tc.stopSignal:
+		return true
+	case <-time.After(tc.Config.HeartbeatTimeout):
+		return false
+	}
+}
+
+// writeControl writes a single message without a payload to the control connection
+func (tc *TunnelClient) writeControl(conn net.Conn, msgType protocol.MessageType) error {
+	tc.writeMu.Lock()
+	defer tc.writeMu.Unlock()
 
-	return err == nil
+	conn.SetWriteDeadline(time.Now().Add(tc.Config.HeartbeatTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	return protocol.WriteMessage(conn, msgType, nil)
 }
 
 // waitForDisconnection waits until the connection is lost
@@ -300,108 +964,388 @@ func (tc *TunnelClient) disconnect() {
 	}
 }
 
+// readReply reads the server's reply to a handshake, printing any notices
+// that arrive before it
+func readReply(conn net.Conn) (protocol.MessageType, []byte, error) {
+	for {
+		msgType, payload, err := protocol.ReadFrame(conn)
+		if err != nil || msgType != protocol.MsgNotice {
+			return msgType, payload, err
+		}
+		printNotice(payload, "")
+	}
+}
+
+// printNotice shows an operator notice sent by the server
+func printNotice(payload []byte, session string) {
+	var notice protocol.Notice
+	if err := protocol.Decode(protocol.MsgNotice, payload, &notice); err != nil {
+		fmt.Printf("⚠️ %v\n", err)
+		return
+	}
+	fmt.Printf("📢 Server notice%s: %s\n", session, notice.Message)
+}
+
 // handleTunnelConnections handles incoming tunnel connection requests
-func (tc *TunnelClient) handleTunnelConnections() {
+func (tc *TunnelClient) handleTunnelConnections(conn net.Conn) {
 	defer tc.wg.Done()
 	defer tc.disconnect()
 
-	reader := bufio.NewReader(tc.controlConn)
+	tc.connectionMu.RLock()
+	pongChan := tc.pongChan
+	session := ""
+	if tc.sessionID != "" {
+		session = fmt.Sprintf(" [session %s]", tc.sessionID)
+	}
+	tc.connectionMu.RUnlock()
 
 	for {
 		select {
 		case <-tc.stopSignal:
 			return
 		default:
-			// Read connection request from server
-			line, err := reader.ReadString('\n')
+			// Read the next message from the server
+			msgType, payload, err := protocol.ReadFrame(conn)
 			if err != nil {
 				if !strings.Contains(err.Error(), "use of closed network connection") {
-					fmt.Printf("📡 Control connection error: %v\n", err)
+					fmt.Printf("📡 Control connection error%s: %v\n", session, err)
 				}
 				return
 			}
 
-			line = strings.TrimSpace(line)
-
-			if line == "CONNECT" {
-				// Read the connection ID
-				connIDLine, err := reader.ReadString('\n')
-				if err != nil {
-					fmt.Printf("❌ Error reading connection ID: %v\n", err)
-					return
+			switch msgType {
+			case protocol.MsgPong:
+				select {
+				case pongChan <- struct{}{}:
+				default:
 				}
 
-				connIDLine = strings.TrimSpace(connIDLine)
-				if !strings.HasPrefix(connIDLine, "CONN_ID:") {
-					fmt.Printf("⚠️ Invalid connection ID format: %s\n", connIDLine)
+			case protocol.MsgNewConn:
+				var newConn protocol.NewConn
+				if err := protocol.Decode(msgType, payload, &newConn); err != nil {
+					fmt.Printf("⚠️ %v\n", err)
 					continue
 				}
 
-				connID := strings.TrimPrefix(connIDLine, "CONN_ID:")
-				fmt.Printf("🔗 New connection %s → local:%s\n", connID, tc.Config.LocalPort)
+				// The remote port identifies which mapping the connection is for
+				localPort := tc.localPortFor(strconv.Itoa(newConn.RemotePort))
+				fmt.Printf("🔗 New connection %s → local:%s%s\n", newConn.ConnID, localPort, session)
 
 				// Handle this connection in a separate goroutine
 				tc.wg.Add(1)
-				go tc.handleDataConnection(connID)
+				go tc.handleDataConnection(newConn, localPort)
+
+			case protocol.MsgNotice:
+				printNotice(payload, session)
+
+			case protocol.MsgError:
+				var notice protocol.Error
+				if err := protocol.Decode(msgType, payload, &notice); err != nil {
+					fmt.Printf("⚠️ %v\n", err)
+					continue
+				}
+				fmt.Printf("⛔ Server ended the session%s: %s\n", session, notice.Error)
+
+				tc.connectionMu.Lock()
+				tc.stopErr = &SessionError{Code: notice.Code, Message: notice.Error}
+				tc.connectionMu.Unlock()
+				return
+
+			default:
+				fmt.Printf("⚠️ Ignoring unexpected %s message from server\n", msgType)
 			}
 		}
 	}
 }
 
+// localPortFor returns the local port mapped to a remote port, defaulting to the first mapping
+func (tc *TunnelClient) localPortFor(remotePort string) string {
+	tc.connectionMu.RLock()
+	defer tc.connectionMu.RUnlock()
+
+	for _, t := range tc.tunnels {
+		if t.RemotePort == remotePort {
+			return t.LocalPort
+		}
+	}
+	return tc.Config.PortMappings[0].LocalPort
+}
+
 // handleDataConnection handles a data connection by establishing a new connection to the server
-func (tc *TunnelClient) handleDataConnection(connID string) {
+func (tc *TunnelClient) handleDataConnection(request protocol.NewConn, localPort string) {
 	defer tc.wg.Done()
 
-	// Establish a new connection to the server for data transfer
-	dialer := &net.Dialer{
-		Timeout: tc.Config.ConnectionTimeout,
+	connID := request.ConnID
+
+	if !tc.acquireConnectionSlot() {
+		fmt.Printf("🚦 Refusing connection %s: %d connections already open\n", connID, tc.Config.MaxConcurrentConnections)
+		tc.statsMu.Lock()
+		tc.refusedConns++
+		tc.statsMu.Unlock()
+		return
 	}
+	defer tc.releaseConnectionSlot()
 
-	dataConn, err := dialer.Dial("tcp", tc.Config.ServerAddress)
+	dataConn, err := tc.retryDial("data connection for "+connID, tc.Config.DataDialAttempts, func() (net.Conn, error) {
+		return tc.openDataConnection(connID)
+	})
 	if err != nil {
-		fmt.Printf("❌ Error connecting for data transfer: %v\n", err)
+		fmt.Printf("❌ %v\n", err)
 		return
 	}
 	defer dataConn.Close()
 
-	// Send the connection ID to identify this data connection
-	fmt.Fprintf(dataConn, "DATA:%s\n", connID)
+	stats := tc.trackConnection(connID, localPort, request.ClientAddr)
+	defer tc.finishConnection(stats)
+
+	if tc.Config.Protocol == "udp" {
+		tc.relayDatagrams(connID, dataConn, localPort, stats)
+		return
+	}
 
 	// Connect to local service
-	localConn, err := net.Dial("tcp", net.JoinHostPort("localhost", tc.Config.LocalPort))
+	localConn, err := tc.retryDial("local connection for "+connID, tc.Config.LocalDialAttempts, func() (net.Conn, error) {
+		return tc.dialLocal(localPort)
+	})
 	if err != nil {
-		fmt.Printf("❌ Error connecting to local service on port %s: %v\n", tc.Config.LocalPort, err)
+		fmt.Printf("❌ Error connecting to local service at %s: %v\n", tc.localAddress(localPort), err)
 		return
 	}
 	defer localConn.Close()
 
+	// Announce the external client to the local service before any tunnel traffic
+	if tc.Config.ProxyProtocol != "" {
+		header, err := proxyHeader(tc.Config.ProxyProtocol, request.ClientAddr, request.ServerAddr)
+		if err == nil {
+			_, err = localConn.Write(header)
+		}
+		if err != nil {
+			fmt.Printf("❌ Error sending PROXY protocol header for %s: %v\n", connID, err)
+			return
+		}
+	}
+
+	// The PROXY protocol header, if any, goes ahead of the TLS handshake
+	if tc.localTLSConfig != nil {
+		tlsConn := tls.Client(localConn, tc.localTLSConfig)
+		tlsConn.SetDeadline(time.Now().Add(tc.Config.ConnectionTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			fmt.Printf("❌ TLS handshake with local service at %s failed: %v\n", tc.localAddress(localPort), err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		localConn = tlsConn
+	}
+
+	// Everything after the DataConn frame is compressed when negotiated
+	tc.connectionMu.RLock()
+	compression := tc.compression
+	tc.connectionMu.RUnlock()
+
+	var server io.ReadWriter = dataConn
+	var stream *protocol.CompressedStream
+	if compression != "" {
+		stream, err = protocol.NewCompressedStream(dataConn, compression)
+		if err != nil {
+			fmt.Printf("❌ Error setting up compression for %s: %v\n", connID, err)
+			return
+		}
+		server = stream
+	}
+
 	fmt.Printf("🌉 Bridging connection %s\n", connID)
 
 	// Copy data bidirectionally between local service and data connection
 	done := make(chan struct{}, 2)
-	var bytesToServer, bytesToLocal int64
+
+	// Errors from the direction still running when both connections are closed
+	// are caused by that close, not by either peer
+	var closing atomic.Bool
 
 	go func() {
 		defer func() { done <- struct{}{} }()
-		n, err := io.Copy(dataConn, localConn)
-		bytesToServer = n
-		if err != nil && err != io.EOF {
+		if _, err := tc.copy(server, localConn, &stats.toServer); err != nil && err != io.EOF && !closing.Load() {
 			fmt.Printf("⚠️ Error copying local→server: %v\n", err)
 		}
 	}()
 
 	go func() {
 		defer func() { done <- struct{}{} }()
-		n, err := io.Copy(localConn, dataConn)
-		bytesToLocal = n
-		if err != nil && err != io.EOF {
+		if _, err := tc.copy(localConn, server, &stats.toLocal); err != nil && err != io.EOF && !closing.Load() {
 			fmt.Printf("⚠️ Error copying server→local: %v\n", err)
 		}
 	}()
 
-	// Wait for one direction to finish
+	// Wait for one direction to finish, e.g. the local service closing its end,
+	// then close both connections to unblock the other, so neither goroutine
+	// outlives the connection and its bytes are counted before it is reported
+	<-done
+	closing.Store(true)
+	dataConn.Close()
+	localConn.Close()
 	<-done
-	fmt.Printf("✅ Connection %s finished (↑%d ↓%d bytes)\n", connID, bytesToServer, bytesToLocal)
+
+	if stream != nil {
+		fmt.Printf("✅ Connection %s finished (↑%d ↓%d bytes, ↑%d ↓%d on the wire)\n", connID,
+			stats.toServer.Load(), stats.toLocal.Load(), stream.WireBytesWritten(), stream.WireBytesRead())
+		return
+	}
+	fmt.Printf("✅ Connection %s finished (↑%d ↓%d bytes)\n", connID, stats.toServer.Load(), stats.toLocal.Load())
+}
+
+// retryDial calls dial up to attempts times until it succeeds, logging each
+// retry, and returns the last error if none did. The first retry waits
+// dialRetryDelay and each further one twice as long; stopping the client ends
+// the wait.
+func (tc *TunnelClient) retryDial(what string, attempts int, dial func() (net.Conn, error)) (net.Conn, error) {
+	delay := dialRetryDelay
+	for attempt := 1; ; attempt++ {
+		conn, err := dial()
+		if err == nil || attempt >= attempts {
+			return conn, err
+		}
+
+		fmt.Printf("🔁 Retrying %s in %v (attempt %d/%d failed: %v)\n", what, delay, attempt, attempts, err)
+		select {
+		case <-time.After(delay):
+		case <-tc.stopSignal:
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// acquireConnectionSlot takes one of the MaxConcurrentConnections slots, waiting
+// up to connectionQueueTimeout for one to free up. It reports false if none did
+// or the client is stopping.
+func (tc *TunnelClient) acquireConnectionSlot() bool {
+	if tc.connSlots == nil {
+		return true
+	}
+
+	select {
+	case tc.connSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(connectionQueueTimeout)
+	defer timer.Stop()
+	select {
+	case tc.connSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-tc.stopSignal:
+		return false
+	}
+}
+
+// releaseConnectionSlot frees a slot taken by acquireConnectionSlot
+func (tc *TunnelClient) releaseConnectionSlot() {
+	if tc.connSlots != nil {
+		<-tc.connSlots
+	}
+}
+
+// openDataConnection opens the data connection for connID: a stream of the
+// multiplexed connection when the server agreed to it, otherwise a connection of
+// its own identified by a DataConn frame
+func (tc *TunnelClient) openDataConnection(connID string) (net.Conn, error) {
+	tc.connectionMu.RLock()
+	multiplex := tc.multiplex
+	tc.connectionMu.RUnlock()
+
+	if multiplex {
+		session, err := tc.muxSession()
+		if err != nil {
+			return nil, err
+		}
+		stream, err := session.Open(connID)
+		if err != nil {
+			return nil, fmt.Errorf("error opening stream for %s: %v", connID, err)
+		}
+		return stream, nil
+	}
+
+	// Establish a new connection to the server for data transfer
+	dataConn, err := tc.dial()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting for data transfer: %v", err)
+	}
+
+	// Send the connection ID to identify this data connection
+	if err := protocol.WriteMessage(dataConn, protocol.MsgDataConn, protocol.DataConn{ConnID: connID}); err != nil {
+		dataConn.Close()
+		return nil, fmt.Errorf("error identifying data connection %s: %v", connID, err)
+	}
+	return dataConn, nil
+}
+
+// muxSession returns the multiplexed data connection, dialing it if there is none
+// yet or the last one failed
+func (tc *TunnelClient) muxSession() (*protocol.MuxSession, error) {
+	tc.muxMu.Lock()
+	defer tc.muxMu.Unlock()
+
+	if tc.mux != nil {
+		select {
+		case <-tc.mux.Done():
+		default:
+			return tc.mux, nil
+		}
+	}
+
+	conn, err := tc.dial()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting for data transfer: %v", err)
+	}
+	if err := protocol.WriteMessage(conn, protocol.MsgMuxConn, nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error opening multiplexed data connection: %v", err)
+	}
+
+	tc.mux = protocol.NewMuxSession(conn, true)
+	fmt.Printf("🔀 Opened multiplexed data connection\n")
+	return tc.mux, nil
+}
+
+// closeMux closes the multiplexed data connection, if one is open
+func (tc *TunnelClient) closeMux() {
+	tc.muxMu.Lock()
+	defer tc.muxMu.Unlock()
+
+	if tc.mux != nil {
+		tc.mux.Close()
+		tc.mux = nil
+	}
+}
+
+// copy copies src to dst through a pooled buffer when BridgeBufferSize is set, and
+// adds the bytes copied to counted: as they pass when the status endpoint is on,
+// otherwise once the copy ends
+func (tc *TunnelClient) copy(dst io.Writer, src io.Reader, counted *atomic.Int64) (int64, error) {
+	live := tc.Config.StatusAddr != ""
+	if live {
+		src = &countingReader{r: src, n: counted}
+	}
+
+	var n int64
+	var err error
+	if tc.buffers == nil {
+		n, err = io.Copy(dst, src)
+	} else {
+		buf := tc.buffers.Get().(*[]byte)
+		defer tc.buffers.Put(buf)
+
+		// Hide io.ReaderFrom, whose generic path copies through its own 32KB buffer
+		n, err = io.CopyBuffer(struct{ io.Writer }{dst}, src, *buf)
+	}
+
+	if !live {
+		counted.Add(n)
+	}
+	return n, err
 }
 
 // Stop stops the tunnel client
@@ -411,13 +1355,15 @@ func (tc *TunnelClient) Stop() error {
 	tc.connectionMu.Lock()
 	if tc.controlConn != nil {
 		// Send disconnect message to server
-		tc.controlConn.Write([]byte("DISCONNECT\n"))
+		tc.writeControl(tc.controlConn, protocol.MsgDisconnect)
 	}
 	tc.stopped = true
 	tc.connectionMu.Unlock()
 
 	tc.disconnect()
 	tc.wg.Wait()
+	tc.closeMux()
+	tc.stopStatusServer()
 
 	fmt.Printf("✅ Tunnel client stopped\n")
 	return nil
@@ -0,0 +1,175 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"rabbit.go/protocol"
+)
+
+// listen serves every connection to a new local listener with handle, each in a
+// goroutine of its own, and returns the listener's port
+func listen(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// serveDataConns plays the tunnel server: it reads the DataConn frame of each
+// data connection and then keeps the connection open, discarding what it is
+// sent, until the client closes it
+func serveDataConns(t *testing.T) string {
+	t.Helper()
+	return listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		if msgType, _, err := protocol.ReadFrame(conn); err != nil || msgType != protocol.MsgDataConn {
+			t.Errorf("expected a DataConn frame, got %s (%v)", msgType, err)
+			return
+		}
+		io.Copy(io.Discard, conn)
+	})
+}
+
+func newTestClient(t *testing.T, serverPort, localPort string, maxConns int) *TunnelClient {
+	t.Helper()
+	tc, err := NewTunnelClient(TunnelClientConfig{
+		ServerAddress:            net.JoinHostPort("127.0.0.1", serverPort),
+		LocalHost:                "127.0.0.1",
+		LocalPort:                localPort,
+		MaxConcurrentConnections: maxConns,
+		DataDialAttempts:         1,
+		LocalDialAttempts:        1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+// handleConnections runs handleDataConnection for n connections at once and
+// waits for all of them to finish
+func handleConnections(t *testing.T, tc *TunnelClient, localPort string, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		tc.wg.Add(1)
+		go tc.handleDataConnection(protocol.NewConn{ConnID: "conn-" + strconv.Itoa(i)}, localPort)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		tc.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("connections still open 10s later")
+	}
+}
+
+func TestLocalServiceClosingEndsTheConnection(t *testing.T) {
+	// The server keeps every data connection open, so only the local service
+	// closing can end the bridge
+	serverPort := serveDataConns(t)
+	localPort := listen(t, func(conn net.Conn) { conn.Close() })
+	tc := newTestClient(t, serverPort, localPort, 0)
+
+	before := runtime.NumGoroutine()
+	handleConnections(t, tc, localPort, 20)
+
+	// The fake server's goroutines end once they see the client's close
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%d goroutines before the connections, %d after:\n%s", before, n, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestBurstIsCappedAtMaxConcurrentConnections(t *testing.T) {
+	// Each local connection is held briefly, so the burst has to queue for slots;
+	// all of it fits well within connectionQueueTimeout
+	const burst, limit = 100, 10
+	var open, peak, served atomic.Int64
+	localPort := listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		n := open.Add(1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		open.Add(-1)
+		served.Add(1)
+	})
+	tc := newTestClient(t, serveDataConns(t), localPort, limit)
+
+	handleConnections(t, tc, localPort, burst)
+
+	if n := served.Load(); n != burst {
+		t.Errorf("local service saw %d of %d connections", n, burst)
+	}
+	if p := peak.Load(); p > limit {
+		t.Errorf("%d connections were open to the local service at once, limit %d", p, limit)
+	}
+	if status := tc.Status(); status.RefusedConns != 0 {
+		t.Errorf("%d connections were refused", status.RefusedConns)
+	}
+}
+
+func TestBackoffDelayIsJitteredAndCapped(t *testing.T) {
+	const initial, maxDelay = 100 * time.Millisecond, 3 * time.Second
+
+	for _, jitter := range []float64{1, 0.5} {
+		tc := &TunnelClient{Config: TunnelClientConfig{InitialRetryDelay: initial, MaxRetryDelay: maxDelay, JitterFactor: jitter}}
+		for attempt := 1; attempt <= 8; attempt++ {
+			// initial·2^(attempt-1) reaches the cap at attempt 6
+			ceiling := initial << (attempt - 1)
+			if ceiling > maxDelay {
+				ceiling = maxDelay
+			}
+			floor := ceiling - time.Duration(float64(ceiling)*jitter)
+
+			seen := map[time.Duration]bool{}
+			for i := 0; i < 1000; i++ {
+				delay := tc.calculateBackoffDelay(attempt)
+				if delay < floor || delay > ceiling {
+					t.Fatalf("jitter %v, attempt %d: delay %v outside [%v, %v]", jitter, attempt, delay, floor, ceiling)
+				}
+				seen[delay] = true
+			}
+			if len(seen) < 100 {
+				t.Errorf("jitter %v, attempt %d: only %d distinct delays in 1000 calls", jitter, attempt, len(seen))
+			}
+		}
+	}
+
+	tc := &TunnelClient{Config: TunnelClientConfig{InitialRetryDelay: initial, MaxRetryDelay: maxDelay}}
+	for attempt, want := range map[int]time.Duration{1: initial, 2: 2 * initial, 5: 16 * initial, 6: maxDelay, 20: maxDelay} {
+		for i := 0; i < 10; i++ {
+			if delay := tc.calculateBackoffDelay(attempt); delay != want {
+				t.Fatalf("no jitter, attempt %d: delay %v, want %v", attempt, delay, want)
+			}
+		}
+	}
+}
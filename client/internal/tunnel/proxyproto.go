@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// PROXY protocol versions accepted by TunnelClientConfig.ProxyProtocol
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader builds the PROXY protocol header announcing a tcp connection from
+// clientAddr to serverAddr. When either address is missing or they are of different
+// families, the header tells the local service to use the real connection addresses.
+func proxyHeader(version, clientAddr, serverAddr string) ([]byte, error) {
+	src, srcErr := netip.ParseAddrPort(clientAddr)
+	dst, dstErr := netip.ParseAddrPort(serverAddr)
+	known := srcErr == nil && dstErr == nil
+	if known {
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+		known = src.Addr().Is4() == dst.Addr().Is4()
+	}
+
+	switch version {
+	case ProxyProtocolV1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP4"
+		if src.Addr().Is6() {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			family, src.Addr(), dst.Addr(), src.Port(), dst.Port())), nil
+
+	case ProxyProtocolV2:
+		var header bytes.Buffer
+		header.Write(proxyV2Signature)
+		if !known {
+			// LOCAL command with no address block
+			header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return header.Bytes(), nil
+		}
+
+		// Version 2 PROXY command, then TCP over IPv4 (0x11) or IPv6 (0x21)
+		header.WriteByte(0x21)
+		var addrs []byte
+		if src.Addr().Is4() {
+			header.WriteByte(0x11)
+			srcIP, dstIP := src.Addr().As4(), dst.Addr().As4()
+			addrs = append(append(addrs, srcIP[:]...), dstIP[:]...)
+		} else {
+			header.WriteByte(0x21)
+			srcIP, dstIP := src.Addr().As16(), dst.Addr().As16()
+			addrs = append(append(addrs, srcIP[:]...), dstIP[:]...)
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+		addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+
+		binary.Write(&header, binary.BigEndian, uint16(len(addrs)))
+		header.Write(addrs)
+		return header.Bytes(), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version %q (expected v1 or v2)", version)
+	}
+}
@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	for _, tc := range []struct {
+		name, client, server, want string
+	}{
+		{"tcp4", "203.0.113.7:51234", "10.0.0.2:5432", "PROXY TCP4 203.0.113.7 10.0.0.2 51234 5432\r\n"},
+		{"tcp6", "[2001:db8::7]:51234", "[2001:db8::2]:5432", "PROXY TCP6 2001:db8::7 2001:db8::2 51234 5432\r\n"},
+		{"ipv4-mapped", "[::ffff:203.0.113.7]:51234", "10.0.0.2:5432", "PROXY TCP4 203.0.113.7 10.0.0.2 51234 5432\r\n"},
+		{"mixed families", "203.0.113.7:51234", "[2001:db8::2]:5432", "PROXY UNKNOWN\r\n"},
+		{"missing address", "", "10.0.0.2:5432", "PROXY UNKNOWN\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header, err := proxyHeader(ProxyProtocolV1, tc.client, tc.server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(header) != tc.want {
+				t.Errorf("header %q, want %q", header, tc.want)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	signature := []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+	for _, tc := range []struct {
+		name, client, server string
+		// command is the version/command byte, then the family byte, the length
+		// field and the address block
+		command, family byte
+		length          []byte
+		addrs           []byte
+	}{
+		{
+			name: "tcp4", client: "203.0.113.7:51234", server: "10.0.0.2:5432",
+			command: 0x21, family: 0x11, length: []byte{0x00, 0x0c},
+			addrs: []byte{
+				203, 0, 113, 7, // source address
+				10, 0, 0, 2, // destination address
+				0xc8, 0x22, // source port 51234
+				0x15, 0x38, // destination port 5432
+			},
+		},
+		{
+			name: "tcp6", client: "[2001:db8::7]:51234", server: "[2001:db8::2]:5432",
+			command: 0x21, family: 0x21, length: []byte{0x00, 0x24},
+			addrs: []byte{
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x07,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02,
+				0xc8, 0x22,
+				0x15, 0x38,
+			},
+		},
+		{
+			// LOCAL with an unspecified family and no address block
+			name: "mixed families", client: "203.0.113.7:51234", server: "[2001:db8::2]:5432",
+			command: 0x20, family: 0x00, length: []byte{0x00, 0x00},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header, err := proxyHeader(ProxyProtocolV2, tc.client, tc.server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(header) != 16+len(tc.addrs) {
+				t.Fatalf("header is %d bytes, want %d: % x", len(header), 16+len(tc.addrs), header)
+			}
+			if !bytes.Equal(header[:12], signature) {
+				t.Errorf("signature % x, want % x", header[:12], signature)
+			}
+			if header[12] != tc.command {
+				t.Errorf("version/command byte %#x, want %#x", header[12], tc.command)
+			}
+			if header[13] != tc.family {
+				t.Errorf("family byte %#x, want %#x", header[13], tc.family)
+			}
+			if !bytes.Equal(header[14:16], tc.length) {
+				t.Errorf("length field % x, want % x", header[14:16], tc.length)
+			}
+			if !bytes.Equal(header[16:], tc.addrs) {
+				t.Errorf("address block % x, want % x", header[16:], tc.addrs)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderRejectsUnknownVersion(t *testing.T) {
+	header, err := proxyHeader("v3", "203.0.113.7:51234", "10.0.0.2:5432")
+	if err == nil || !strings.Contains(err.Error(), `"v3"`) {
+		t.Errorf("got %q, %v; want an unsupported version error", header, err)
+	}
+}
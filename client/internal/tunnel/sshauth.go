@@ -0,0 +1,166 @@
+package tunnel
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// SSH authentication methods for TunnelConfig.AuthMethods
+const (
+	SSHAuthAgent               = "agent"                // Keys held by the agent at SSH_AUTH_SOCK
+	SSHAuthPublicKey           = "publickey"            // The private key file at SSHKeyPath
+	SSHAuthPassword            = "password"             // Password, or a prompt on a terminal
+	SSHAuthKeyboardInteractive = "keyboard-interactive" // Server-driven prompts, e.g. for one-time codes
+)
+
+// DefaultSSHAuthMethods are tried when TunnelConfig.AuthMethods is empty
+var DefaultSSHAuthMethods = []string{SSHAuthAgent, SSHAuthPublicKey}
+
+// errNoTerminal is returned by promptSecret when there is no terminal to ask on
+var errNoTerminal = errors.New("standard input is not a terminal")
+
+// authMethods builds the client's auth methods in the configured order. Methods
+// that are unavailable here, such as the agent without SSH_AUTH_SOCK, are skipped
+// as long as another remains. The returned function releases the agent connection
+// once the handshake is done.
+func (t *Tunnel) authMethods() ([]ssh.AuthMethod, func(), error) {
+	var methods []ssh.AuthMethod
+	var skipped []string
+	closeAgent := func() {}
+
+	for _, name := range t.Config.AuthMethods {
+		switch name {
+		case SSHAuthAgent:
+			sock := os.Getenv("SSH_AUTH_SOCK")
+			if sock == "" {
+				skipped = append(skipped, "agent: SSH_AUTH_SOCK is not set")
+				continue
+			}
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				skipped = append(skipped, fmt.Sprintf("agent: %v", err))
+				continue
+			}
+			closeAgent = func() { conn.Close() }
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+
+		case SSHAuthPublicKey:
+			key, err := os.ReadFile(t.Config.SSHKeyPath)
+			if err != nil {
+				skipped = append(skipped, fmt.Sprintf("publickey: error reading SSH key: %v", err))
+				continue
+			}
+			signer, err := t.parsePrivateKey(key)
+			if errors.Is(err, errNoTerminal) {
+				skipped = append(skipped, fmt.Sprintf("publickey: %s is passphrase-protected and no passphrase was given", t.Config.SSHKeyPath))
+				continue
+			}
+			if err != nil {
+				closeAgent()
+				return nil, nil, err
+			}
+			methods = append(methods, ssh.PublicKeys(signer))
+
+		case SSHAuthPassword:
+			methods = append(methods, ssh.PasswordCallback(t.password))
+
+		case SSHAuthKeyboardInteractive:
+			methods = append(methods, ssh.KeyboardInteractive(t.answerChallenge))
+
+		default:
+			closeAgent()
+			return nil, nil, fmt.Errorf("unknown SSH auth method %q", name)
+		}
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, fmt.Errorf("no SSH auth method is available: %s", strings.Join(skipped, "; "))
+	}
+	for _, reason := range skipped {
+		fmt.Printf("⚠️ Skipping SSH auth method %s\n", reason)
+	}
+	return methods, closeAgent, nil
+}
+
+// parsePrivateKey parses a private key file. A passphrase-protected key is
+// decrypted with KeyPassphrase, or a passphrase asked for on the terminal.
+func (t *Tunnel) parsePrivateKey(key []byte) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		if err != nil {
+			return nil, fmt.Errorf("error parsing SSH key: %v", err)
+		}
+		return signer, nil
+	}
+
+	passphrase := t.Config.KeyPassphrase
+	if passphrase == "" {
+		passphrase, err = promptSecret(fmt.Sprintf("Enter passphrase for key '%s': ", t.Config.SSHKeyPath))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	if errors.Is(err, x509.IncorrectPasswordError) {
+		return nil, fmt.Errorf("incorrect passphrase for SSH key %s", t.Config.SSHKeyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing SSH key: %v", err)
+	}
+	return signer, nil
+}
+
+// password returns the configured password, or asks for it on a terminal
+func (t *Tunnel) password() (string, error) {
+	if t.Config.Password != "" {
+		return t.Config.Password, nil
+	}
+	return promptSecret(fmt.Sprintf("%s@%s's password: ", t.Config.SSHUser, t.Config.SSHHost))
+}
+
+// answerChallenge answers keyboard-interactive questions. A single hidden question
+// is taken to be the password; anything else is asked on the terminal.
+func (t *Tunnel) answerChallenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	if len(questions) == 1 && !echos[0] && t.Config.Password != "" {
+		return []string{t.Config.Password}, nil
+	}
+
+	if instruction != "" {
+		fmt.Println(instruction)
+	}
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		answer, err := promptSecret(question)
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = answer
+	}
+	return answers, nil
+}
+
+// promptSecret reads a line from the terminal without echoing it
+func promptSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("cannot prompt for %q: %w", prompt, errNoTerminal)
+	}
+
+	fmt.Print(prompt)
+	secret, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("error reading from terminal: %v", err)
+	}
+	return string(secret), nil
+}
@@ -0,0 +1,81 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	// Make sure no passphrase can be asked for, whatever the test runs on
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() {
+		os.Stdin = previous
+		stdin.Close()
+	})
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedBlock, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "test key", []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainBlock, err := ssh.MarshalPrivateKey(priv, "test key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, plain := pem.EncodeToMemory(encryptedBlock), pem.EncodeToMemory(plainBlock)
+
+	for _, tc := range []struct {
+		name       string
+		key        []byte
+		passphrase string
+		wantErr    string // empty when the key should parse
+	}{
+		{"encrypted with passphrase", encrypted, "correct horse", ""},
+		{"encrypted with wrong passphrase", encrypted, "battery staple", "incorrect passphrase for SSH key id_test"},
+		{"encrypted without passphrase", encrypted, "", "not a terminal"},
+		{"unencrypted", plain, "", ""},
+		{"unencrypted ignores passphrase", plain, "correct horse", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tunnel := &Tunnel{Config: TunnelConfig{SSHKeyPath: "id_test", KeyPassphrase: tc.passphrase}}
+			signer, err := tunnel.parsePrivateKey(tc.key)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := signer.PublicKey(); string(got.Marshal()) != string(want.Marshal()) {
+				t.Errorf("parsed key %s, want %s", ssh.FingerprintSHA256(got), ssh.FingerprintSHA256(want))
+			}
+		})
+	}
+
+	// authMethods skips the key rather than failing when it cannot ask
+	tunnel := &Tunnel{Config: TunnelConfig{SSHKeyPath: "id_test"}}
+	if _, err := tunnel.parsePrivateKey(encrypted); !errors.Is(err, errNoTerminal) {
+		t.Errorf("missing passphrase error %v is not errNoTerminal", err)
+	}
+}
@@ -0,0 +1,180 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Status is a snapshot of a running client, served as JSON on StatusAddr
+type Status struct {
+	Connected        bool               `json:"connected"`
+	Server           string             `json:"server"`
+	Protocol         string             `json:"protocol"`
+	SessionID        string             `json:"session_id,omitempty"` // The server's id for the current control connection
+	StartedAt        time.Time          `json:"started_at"`
+	Reconnects       int                `json:"reconnects"` // Successful reconnects after the first connection
+	Tunnels          []TunnelStatus     `json:"tunnels"`
+	TotalConnections int64              `json:"total_connections"`
+	RefusedConns     int64              `json:"refused_connections,omitempty"` // Refused at MaxConcurrentConnections
+	BytesToServer    int64              `json:"bytes_to_server"`               // Across all connections, including finished ones
+	BytesToLocal     int64              `json:"bytes_to_local"`
+	Connections      []ConnectionStatus `json:"connections"` // Connections currently bridged
+}
+
+// TunnelStatus is one tunnel open on the current control connection
+type TunnelStatus struct {
+	ID         string `json:"id"`
+	LocalPort  string `json:"local_port"`
+	RemotePort string `json:"remote_port"`
+}
+
+// ConnectionStatus is one connection currently bridged to a local service
+type ConnectionStatus struct {
+	ID            string    `json:"id"`
+	LocalPort     string    `json:"local_port"`
+	ClientAddr    string    `json:"client_addr,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	BytesToServer int64     `json:"bytes_to_server"`
+	BytesToLocal  int64     `json:"bytes_to_local"`
+}
+
+// connStats are the traffic counters of one bridged connection
+type connStats struct {
+	id         string
+	localPort  string
+	clientAddr string
+	startedAt  time.Time
+	toServer   atomic.Int64
+	toLocal    atomic.Int64
+}
+
+// countingReader adds the bytes read through it to a counter as they pass
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// trackConnection registers a connection for Status until finishConnection
+func (tc *TunnelClient) trackConnection(id, localPort, clientAddr string) *connStats {
+	stats := &connStats{
+		id:         id,
+		localPort:  localPort,
+		clientAddr: clientAddr,
+		startedAt:  time.Now(),
+	}
+
+	tc.statsMu.Lock()
+	tc.activeConns[id] = stats
+	tc.totalConns++
+	tc.statsMu.Unlock()
+
+	return stats
+}
+
+// finishConnection folds a finished connection's bytes into the client totals
+func (tc *TunnelClient) finishConnection(stats *connStats) {
+	tc.statsMu.Lock()
+	delete(tc.activeConns, stats.id)
+	tc.finishedToServer += stats.toServer.Load()
+	tc.finishedToLocal += stats.toLocal.Load()
+	tc.statsMu.Unlock()
+}
+
+// Status returns a snapshot of the client's connection state and traffic counters
+func (tc *TunnelClient) Status() Status {
+	tc.connectionMu.RLock()
+	status := Status{
+		Connected: tc.isConnected,
+		Server:    tc.Config.ServerAddress,
+		Protocol:  tc.Config.Protocol,
+		StartedAt: tc.startedAt,
+		Tunnels:   []TunnelStatus{},
+	}
+	if tc.reconnectCount > 1 {
+		status.Reconnects = tc.reconnectCount - 1
+	}
+	if tc.isConnected {
+		status.SessionID = tc.sessionID
+		for _, t := range tc.tunnels {
+			status.Tunnels = append(status.Tunnels, TunnelStatus{ID: t.ID, LocalPort: t.LocalPort, RemotePort: t.RemotePort})
+		}
+	}
+	tc.connectionMu.RUnlock()
+
+	tc.statsMu.Lock()
+	status.TotalConnections = tc.totalConns
+	status.RefusedConns = tc.refusedConns
+	status.BytesToServer = tc.finishedToServer
+	status.BytesToLocal = tc.finishedToLocal
+	status.Connections = make([]ConnectionStatus, 0, len(tc.activeConns))
+	for _, stats := range tc.activeConns {
+		conn := ConnectionStatus{
+			ID:            stats.id,
+			LocalPort:     stats.localPort,
+			ClientAddr:    stats.clientAddr,
+			StartedAt:     stats.startedAt,
+			BytesToServer: stats.toServer.Load(),
+			BytesToLocal:  stats.toLocal.Load(),
+		}
+		status.BytesToServer += conn.BytesToServer
+		status.BytesToLocal += conn.BytesToLocal
+		status.Connections = append(status.Connections, conn)
+	}
+	tc.statsMu.Unlock()
+
+	sort.Slice(status.Connections, func(i, j int) bool {
+		return status.Connections[i].StartedAt.Before(status.Connections[j].StartedAt)
+	})
+	return status
+}
+
+// startStatusServer serves GET /status on StatusAddr until Stop
+func (tc *TunnelClient) startStatusServer() error {
+	listener, err := net.Listen("tcp", tc.Config.StatusAddr)
+	if err != nil {
+		return fmt.Errorf("error starting status endpoint: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tc.Status())
+	})
+
+	tc.statusServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go tc.statusServer.Serve(listener)
+
+	fmt.Printf("📊 Status available at http://%s/status\n", listener.Addr())
+	return nil
+}
+
+// stopStatusServer shuts the status endpoint down, if it was started
+func (tc *TunnelClient) stopStatusServer() {
+	if tc.statusServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tc.statusServer.Shutdown(ctx)
+}
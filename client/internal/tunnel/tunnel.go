@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -10,6 +11,7 @@ import (
 	"sync"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // TunnelConfig holds configuration for SSH tunneling
@@ -22,6 +24,26 @@ type TunnelConfig struct {
 	RemoteHost  string
 	RemotePort  string
 	BindAddress string
+
+	// KnownHostsPath is the OpenSSH known_hosts file the server's host key is
+	// verified against (default ~/.ssh/known_hosts)
+	KnownHostsPath string
+
+	// InsecureIgnoreHostKey skips host key verification, leaving the tunnel open
+	// to man-in-the-middle attacks (testing only)
+	InsecureIgnoreHostKey bool
+
+	// AuthMethods lists the SSHAuth* methods to try, in order, until the server
+	// accepts one (default DefaultSSHAuthMethods)
+	AuthMethods []string
+
+	// Password is used by the password and keyboard-interactive methods; when
+	// empty they prompt on the terminal
+	Password string
+
+	// KeyPassphrase decrypts a passphrase-protected SSHKeyPath; when empty the
+	// passphrase is asked for on the terminal
+	KeyPassphrase string
 }
 
 // Tunnel represents an SSH tunnel instance
@@ -31,52 +53,67 @@ type Tunnel struct {
 	listener   net.Listener
 	wg         sync.WaitGroup
 	stopSignal chan struct{}
+
+	// conns holds the local and remote side of every forwarded connection, so
+	// Stop can close them instead of waiting on a copy that never returns
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+	stopped bool // Set by Stop; no connection is tracked after it. Guarded by connsMu.
 }
 
 // NewTunnel creates a new SSH tunnel instance
 func NewTunnel(config TunnelConfig) (*Tunnel, error) {
-	if config.SSHKeyPath == "" {
+	if config.SSHKeyPath == "" || (config.KnownHostsPath == "" && !config.InsecureIgnoreHostKey) {
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
 			return nil, fmt.Errorf("error getting home directory: %v", err)
 		}
-		config.SSHKeyPath = filepath.Join(homeDir, ".ssh", "id_rsa")
+		if config.SSHKeyPath == "" {
+			config.SSHKeyPath = filepath.Join(homeDir, ".ssh", "id_rsa")
+		}
+		if config.KnownHostsPath == "" {
+			config.KnownHostsPath = filepath.Join(homeDir, ".ssh", "known_hosts")
+		}
 	}
 
 	if config.BindAddress == "" {
 		config.BindAddress = "localhost"
 	}
+	if len(config.AuthMethods) == 0 {
+		config.AuthMethods = DefaultSSHAuthMethods
+	}
 
 	return &Tunnel{
 		Config:     config,
 		stopSignal: make(chan struct{}),
+		conns:      make(map[net.Conn]struct{}),
 	}, nil
 }
 
 // Start starts the SSH tunnel
 func (t *Tunnel) Start() error {
-	// Read private key
-	key, err := os.ReadFile(t.Config.SSHKeyPath)
+	auth, closeAgent, err := t.authMethods()
 	if err != nil {
-		return fmt.Errorf("error reading SSH key: %v", err)
+		return err
 	}
+	defer closeAgent()
 
-	signer, err := ssh.ParsePrivateKey(key)
+	address := net.JoinHostPort(t.Config.SSHHost, t.Config.SSHPort)
+	hostKeyCallback, hostKeyAlgorithms, err := t.hostKeyCallback(address)
 	if err != nil {
-		return fmt.Errorf("error parsing SSH key: %v", err)
+		return err
 	}
 
 	// Configure SSH client
 	config := &ssh.ClientConfig{
-		User: t.Config.SSHUser,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User:              t.Config.SSHUser,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
 	}
 
 	// Connect to SSH server
-	client, err := ssh.Dial("tcp", net.JoinHostPort(t.Config.SSHHost, t.Config.SSHPort), config)
+	client, err := ssh.Dial("tcp", address, config)
 	if err != nil {
 		return fmt.Errorf("error connecting to SSH server: %v", err)
 	}
@@ -101,6 +138,72 @@ func (t *Tunnel) Start() error {
 	return nil
 }
 
+// hostKeyCallback verifies the server's host key against the known_hosts file.
+// Unknown hosts and changed keys are refused with the key's fingerprint, so the
+// user can check it and add the host. It also returns the host key algorithms to
+// ask the server for: those of the keys on file for address, so a server with
+// several host keys presents one that can be checked.
+func (t *Tunnel) hostKeyCallback(address string) (ssh.HostKeyCallback, []string, error) {
+	if t.Config.InsecureIgnoreHostKey {
+		fmt.Printf("⚠️ SSH host key verification is disabled\n")
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+
+	path := t.Config.KnownHostsPath
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading known_hosts file: %v", err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		if len(keyErr.Want) == 0 {
+			return fmt.Errorf("host %s is not in %s (%s key %s); after checking the fingerprint, add it with:\n  %s",
+				hostname, path, key.Type(), fingerprint, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		}
+		return fmt.Errorf("host key for %s does not match %s:%d (got %s key %s); the server may have been reinstalled, or someone may be intercepting the connection",
+			hostname, keyErr.Want[0].Filename, keyErr.Want[0].Line, key.Type(), fingerprint)
+	}, knownHostKeyAlgorithms(callback, address), nil
+}
+
+// probeKey matches no known_hosts entry, so checking it lists the keys on file
+type probeKey struct{}
+
+func (probeKey) Type() string                                 { return "probe" }
+func (probeKey) Marshal() []byte                              { return []byte("probe") }
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("probe key") }
+
+// knownHostKeyAlgorithms returns the host key algorithms of the keys known_hosts
+// has for address, or nil (the library default) when it has none
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, address string) []string {
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(address, &net.TCPAddr{}, probeKey{}), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, known := range keyErr.Want {
+		keyType := known.Key.Type()
+		if seen[keyType] {
+			continue
+		}
+		seen[keyType] = true
+		// RSA keys are also signed with the SHA-2 algorithms, which servers prefer
+		if keyType == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, keyType)
+	}
+	return algorithms
+}
+
 // handleConnections handles incoming connections to the tunnel
 func (t *Tunnel) handleConnections() {
 	defer t.wg.Done()
@@ -125,6 +228,10 @@ func (t *Tunnel) handleConnections() {
 			go func() {
 				defer t.wg.Done()
 				defer local.Close()
+				if !t.trackConn(local) {
+					return
+				}
+				defer t.untrackConn(local)
 
 				// Open connection to remote server through SSH tunnel
 				remote, err := t.client.Dial("tcp", net.JoinHostPort(t.Config.RemoteHost, t.Config.RemotePort))
@@ -133,29 +240,70 @@ func (t *Tunnel) handleConnections() {
 					return
 				}
 				defer remote.Close()
+				if !t.trackConn(remote) {
+					return
+				}
+				defer t.untrackConn(remote)
 
-				// Copy data bidirectionally
-				t.wg.Add(2)
+				// Copy data bidirectionally until either side closes, then close
+				// both so the other copy returns too
+				done := make(chan struct{}, 2)
 				go func() {
-					defer t.wg.Done()
+					defer func() { done <- struct{}{} }()
 					io.Copy(local, remote)
 				}()
 				go func() {
-					defer t.wg.Done()
+					defer func() { done <- struct{}{} }()
 					io.Copy(remote, local)
 				}()
+				<-done
+				local.Close()
+				remote.Close()
+				<-done
 			}()
 		}
 	}
 }
 
-// Stop stops the SSH tunnel
+// trackConn records a forwarded connection so Stop can close it. It returns
+// false once the tunnel is stopping, and the caller should give the connection up.
+func (t *Tunnel) trackConn(conn net.Conn) bool {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+// untrackConn forgets a connection recorded by trackConn
+func (t *Tunnel) untrackConn(conn net.Conn) {
+	t.connsMu.Lock()
+	delete(t.conns, conn)
+	t.connsMu.Unlock()
+}
+
+// Stop stops the SSH tunnel. Forwarded connections are closed on both sides, so
+// their copies return even if closing the SSH client does not reach them.
 func (t *Tunnel) Stop() error {
 	close(t.stopSignal)
 
 	if t.listener != nil {
 		t.listener.Close()
 	}
+
+	t.connsMu.Lock()
+	t.stopped = true
+	conns := make([]net.Conn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.connsMu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+
 	if t.client != nil {
 		t.client.Close()
 	}
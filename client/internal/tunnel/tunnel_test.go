@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	const address = "ssh.example.com:22"
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 22}
+	known, other := newHostKey(t), newHostKey(t)
+
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, known)
+	if err := os.WriteFile(path, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tunnel := &Tunnel{Config: TunnelConfig{KnownHostsPath: path}}
+
+	callback, algorithms, err := tunnel.hostKeyCallback(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(algorithms) != 1 || algorithms[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("host key algorithms %v, want [%s]", algorithms, ssh.KeyAlgoED25519)
+	}
+
+	t.Run("known host", func(t *testing.T) {
+		if err := callback(address, remote, known); err != nil {
+			t.Errorf("known host key refused: %v", err)
+		}
+	})
+
+	t.Run("unknown host", func(t *testing.T) {
+		err := callback("other.example.com:22", remote, known)
+		if err == nil {
+			t.Fatal("unknown host accepted")
+		}
+		if !strings.Contains(err.Error(), "not in "+path) || !strings.Contains(err.Error(), ssh.FingerprintSHA256(known)) {
+			t.Errorf("error %q does not name the known_hosts file and the SHA256 fingerprint", err)
+		}
+	})
+
+	t.Run("mismatched key", func(t *testing.T) {
+		err := callback(address, remote, other)
+		if err == nil {
+			t.Fatal("changed host key accepted")
+		}
+		if !strings.Contains(err.Error(), "does not match "+path+":1") || !strings.Contains(err.Error(), ssh.FingerprintSHA256(other)) {
+			t.Errorf("error %q does not name the known_hosts line and the offered key's fingerprint", err)
+		}
+	})
+
+	t.Run("insecure", func(t *testing.T) {
+		// No known_hosts file is read at all
+		insecure := &Tunnel{Config: TunnelConfig{KnownHostsPath: filepath.Join(t.TempDir(), "missing"), InsecureIgnoreHostKey: true}}
+		callback, algorithms, err := insecure.hostKeyCallback(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if algorithms != nil {
+			t.Errorf("host key algorithms %v, want the library default", algorithms)
+		}
+		if err := callback("other.example.com:22", remote, other); err != nil {
+			t.Errorf("unknown host refused with verification disabled: %v", err)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// maxDatagramSize is the largest UDP payload that can be relayed
+	maxDatagramSize = 65535
+
+	// udpSessionIdleTimeout closes a UDP session after this long without traffic
+	udpSessionIdleTimeout = 60 * time.Second
+)
+
+// relayDatagrams relays length-prefixed datagrams between a data connection and
+// the local UDP service until either side closes or the session goes idle
+func (tc *TunnelClient) relayDatagrams(connID string, dataConn net.Conn, localPort string, stats *connStats) {
+	localConn, err := net.Dial("udp", tc.localAddress(localPort))
+	if err != nil {
+		fmt.Printf("❌ Error connecting to local udp service at %s: %v\n", tc.localAddress(localPort), err)
+		return
+	}
+	defer localConn.Close()
+
+	fmt.Printf("🌉 Relaying udp session %s\n", connID)
+
+	done := make(chan struct{}, 2)
+	var datagramsToServer, datagramsToLocal int64
+
+	// Local service → server
+	go func() {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			localConn.SetReadDeadline(time.Now().Add(udpSessionIdleTimeout))
+			n, err := localConn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					if !strings.Contains(err.Error(), "use of closed network connection") {
+						fmt.Printf("⚠️ Error reading from local udp service: %v\n", err)
+					}
+				}
+				return
+			}
+			if err := writeDatagram(dataConn, buf[:n]); err != nil {
+				return
+			}
+			datagramsToServer++
+			stats.toServer.Add(int64(n))
+		}
+	}()
+
+	// Server → local service
+	go func() {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := readDatagram(dataConn, buf)
+			if err != nil {
+				if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+					fmt.Printf("⚠️ Error reading datagram from server: %v\n", err)
+				}
+				return
+			}
+			if _, err := localConn.Write(buf[:n]); err != nil {
+				fmt.Printf("⚠️ Error writing to local udp service: %v\n", err)
+				return
+			}
+			datagramsToLocal++
+			stats.toLocal.Add(int64(n))
+		}
+	}()
+
+	// Wait for one direction to finish, then unblock the other
+	<-done
+	dataConn.Close()
+	localConn.Close()
+	<-done
+	fmt.Printf("✅ UDP session %s finished (↑%d ↓%d datagrams)\n", connID, datagramsToServer, datagramsToLocal)
+}
+
+// writeDatagram writes a datagram to a stream as a 2-byte big-endian length followed by the payload
+func writeDatagram(w io.Writer, packet []byte) error {
+	if len(packet) > maxDatagramSize {
+		return fmt.Errorf("datagram too large: %d bytes", len(packet))
+	}
+
+	frame := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(frame, uint16(len(packet)))
+	copy(frame[2:], packet)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads a single length-prefixed datagram from a stream into buf
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(buf) {
+		return 0, fmt.Errorf("datagram too large: %d bytes", n)
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Compression algorithms that can be negotiated for data connections
+const (
+	CompressionFlate = "flate"
+	CompressionGzip  = "gzip"
+)
+
+// CompressionAlgorithms lists the supported algorithms, most preferred first
+var CompressionAlgorithms = []string{CompressionFlate, CompressionGzip}
+
+// NegotiateCompression picks the first offered algorithm that is supported, or ""
+// when there is none in common
+func NegotiateCompression(offered []string) string {
+	for _, algorithm := range offered {
+		for _, supported := range CompressionAlgorithms {
+			if algorithm == supported {
+				return algorithm
+			}
+		}
+	}
+	return ""
+}
+
+// flushWriteCloser is a compressing writer that can push out buffered data
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// CompressedStream compresses everything written to a data connection and
+// decompresses everything read from it. Reads and writes may run concurrently.
+type CompressedStream struct {
+	conn      io.ReadWriter
+	algorithm string
+	writer    flushWriteCloser
+	reader    io.Reader // Created on first Read, since gzip blocks until its header arrives
+
+	wireRead    atomic.Int64
+	wireWritten atomic.Int64
+}
+
+// NewCompressedStream wraps the raw traffic of a data connection with algorithm
+func NewCompressedStream(conn io.ReadWriter, algorithm string) (*CompressedStream, error) {
+	s := &CompressedStream{conn: conn, algorithm: algorithm}
+
+	switch algorithm {
+	case CompressionFlate:
+		w, err := flate.NewWriter(wireWriter{s}, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		s.writer = w
+	case CompressionGzip:
+		s.writer = gzip.NewWriter(wireWriter{s})
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+
+	return s, nil
+}
+
+// Write compresses p and flushes it, so interactive protocols are not held back
+// waiting for a compression block to fill
+func (s *CompressedStream) Write(p []byte) (int, error) {
+	n, err := s.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, s.writer.Flush()
+}
+
+// Read decompresses data from the connection
+func (s *CompressedStream) Read(p []byte) (int, error) {
+	if s.reader == nil {
+		switch s.algorithm {
+		case CompressionFlate:
+			s.reader = flate.NewReader(wireReader{s})
+		case CompressionGzip:
+			r, err := gzip.NewReader(wireReader{s})
+			if err != nil {
+				return 0, err
+			}
+			s.reader = r
+		}
+	}
+
+	n, err := s.reader.Read(p)
+	// Peers close the connection without ending the compressed stream
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// WireBytesRead returns the number of compressed bytes read from the connection
+func (s *CompressedStream) WireBytesRead() int64 {
+	return s.wireRead.Load()
+}
+
+// WireBytesWritten returns the number of compressed bytes written to the connection
+func (s *CompressedStream) WireBytesWritten() int64 {
+	return s.wireWritten.Load()
+}
+
+// wireReader reads compressed bytes from the connection, counting them
+type wireReader struct{ s *CompressedStream }
+
+func (r wireReader) Read(p []byte) (int, error) {
+	n, err := r.s.conn.Read(p)
+	r.s.wireRead.Add(int64(n))
+	return n, err
+}
+
+// wireWriter writes compressed bytes to the connection, counting them
+type wireWriter struct{ s *CompressedStream }
+
+func (w wireWriter) Write(p []byte) (int, error) {
+	n, err := w.s.conn.Write(p)
+	w.s.wireWritten.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,3 @@
+module rabbit.go/protocol
+
+go 1.21
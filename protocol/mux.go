@@ -0,0 +1,512 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A multiplexed data connection carries many tunnel connections as streams, so a
+// busy tunnel does not pay for a dial and handshake per external peer. It starts
+// with a MuxConn frame; everything after it is mux frames: a one-byte kind, a
+// big-endian uint32 stream id and a uint32 payload length, then the payload. The
+// client opens a stream per NewConn, naming the pending connection in the open
+// frame, and the server pairs the stream with it as it would a data connection.
+// Each stream has its own receive window, so a peer that stops reading one
+// stream holds up only that stream.
+
+// Mux frame kinds
+const (
+	muxOpen   byte = iota + 1 // Opens a stream; the payload is the connection id
+	muxData                   // Stream data
+	muxWindow                 // Grants the peer a big-endian uint32 more bytes of send window
+	muxClose                  // The sender has closed the stream
+	muxReset                  // The stream is unknown to the sender; writes to it fail
+)
+
+const (
+	// muxHeaderSize is the size of the kind byte, stream id and payload length
+	muxHeaderSize = 9
+
+	// MuxWindow is the number of bytes a stream can have in flight unread
+	MuxWindow = 256 * 1024
+
+	// muxMaxPayload bounds a mux frame so streams share the connection fairly
+	muxMaxPayload = 16 * 1024
+
+	// muxAcceptBacklog bounds the streams opened by the peer but not yet accepted
+	muxAcceptBacklog = 256
+)
+
+var (
+	// ErrMuxClosed is returned for streams of a multiplexed connection that has closed
+	ErrMuxClosed = errors.New("multiplexed connection closed")
+
+	// ErrStreamReset is returned when writing to a stream the peer has closed
+	ErrStreamReset = errors.New("stream reset by peer")
+)
+
+// MuxSession multiplexes streams over one connection. The client side opens
+// streams and the server side accepts them.
+type MuxSession struct {
+	conn    net.Conn
+	writeMu sync.Mutex // Serializes frames written to conn
+
+	mu      sync.Mutex
+	streams map[uint32]*MuxStream
+	nextID  uint32
+
+	accept    chan *MuxStream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMuxSession starts multiplexing conn, whose MuxConn frame has already been
+// exchanged. client is true on the side that opens streams.
+func NewMuxSession(conn net.Conn, client bool) *MuxSession {
+	s := &MuxSession{
+		conn:    conn,
+		streams: make(map[uint32]*MuxStream),
+		nextID:  2,
+		accept:  make(chan *MuxStream, muxAcceptBacklog),
+		done:    make(chan struct{}),
+	}
+	// Each side numbers its streams apart from the other's
+	if client {
+		s.nextID = 1
+	}
+	go s.readFrames()
+	return s
+}
+
+// Open opens a stream named after the pending connection it carries
+func (s *MuxSession) Open(name string) (*MuxStream, error) {
+	if len(name) > muxMaxPayload {
+		return nil, fmt.Errorf("stream name too long: %d bytes", len(name))
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return nil, ErrMuxClosed
+	default:
+	}
+	if s.nextID > math.MaxUint32-2 {
+		s.mu.Unlock()
+		return nil, errors.New("multiplexed connection ran out of stream ids")
+	}
+	stream := newMuxStream(s, s.nextID, name)
+	s.streams[stream.id] = stream
+	s.nextID += 2
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxOpen, stream.id, []byte(name)); err != nil {
+		s.remove(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the next stream opened by the peer
+func (s *MuxSession) Accept() (*MuxStream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, ErrMuxClosed
+	}
+}
+
+// Done is closed once the session has closed
+func (s *MuxSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close closes the connection and every stream on it
+func (s *MuxSession) Close() error {
+	err := ErrMuxClosed
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.conn.Close()
+
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*MuxStream)
+		s.mu.Unlock()
+
+		for _, stream := range streams {
+			stream.fail(ErrMuxClosed)
+		}
+	})
+	return err
+}
+
+// readFrames dispatches incoming frames to their streams until the connection fails
+func (s *MuxSession) readFrames() {
+	defer s.Close()
+
+	var header [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+			return
+		}
+		kind := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:])
+		if length > muxMaxPayload {
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		stream := s.streams[id]
+		s.mu.Unlock()
+
+		switch kind {
+		case muxOpen:
+			if stream != nil {
+				return // The peer reused a live stream id
+			}
+			stream = newMuxStream(s, id, string(payload))
+			s.mu.Lock()
+			s.streams[id] = stream
+			s.mu.Unlock()
+			select {
+			case s.accept <- stream:
+			default:
+				s.remove(id)
+				s.resetAsync(id)
+			}
+
+		case muxData:
+			if stream == nil {
+				s.resetAsync(id)
+				continue
+			}
+			if !stream.receive(payload) {
+				// The peer overran the window it was granted
+				s.remove(id)
+				stream.fail(ErrStreamReset)
+				s.resetAsync(id)
+			}
+
+		case muxWindow:
+			if stream != nil && len(payload) == 4 {
+				stream.grant(binary.BigEndian.Uint32(payload))
+			}
+
+		case muxClose:
+			if stream != nil {
+				stream.remoteClose()
+			}
+
+		case muxReset:
+			if stream != nil {
+				s.remove(id)
+				stream.fail(ErrStreamReset)
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+// resetAsync tells the peer a stream is gone without blocking the frame reader on
+// a write, which could otherwise deadlock with a peer doing the same
+func (s *MuxSession) resetAsync(id uint32) {
+	go s.writeFrame(muxReset, id, nil)
+}
+
+// writeFrame writes a mux frame in one write
+func (s *MuxSession) writeFrame(kind byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:muxHeaderSize], uint32(len(payload)))
+	copy(frame[muxHeaderSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.done:
+		return ErrMuxClosed
+	default:
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+// remove forgets a stream, so further data for it is answered with a reset
+func (s *MuxSession) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// MuxStream is one tunnel connection carried by a MuxSession. Closing it closes
+// it in both directions. Reads and writes may run concurrently.
+type MuxStream struct {
+	session *MuxSession
+	id      uint32
+	name    string
+
+	mu            sync.Mutex
+	buf           []byte // Received but not yet read
+	unacked       int    // Bytes read since the peer's window was last extended
+	sendWindow    int    // Bytes that may be written before the peer extends the window
+	remoteClosed  bool   // Reads return EOF once buf is drained; writes fail
+	closed        bool
+	err           error // Set when the stream was reset or the session closed
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readable chan struct{} // Signalled when a blocked Read may make progress
+	writable chan struct{} // Signalled when a blocked Write may make progress
+}
+
+func newMuxStream(s *MuxSession, id uint32, name string) *MuxStream {
+	return &MuxStream{
+		session:    s,
+		id:         id,
+		name:       name,
+		sendWindow: MuxWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// Name returns the connection id the stream was opened for
+func (st *MuxStream) Name() string {
+	return st.name
+}
+
+// Read implements net.Conn
+func (st *MuxStream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for {
+		if st.closed {
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(st.buf) > 0 {
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+			st.unacked += n
+
+			// Extend the peer's window in large steps rather than per read
+			var grant int
+			if st.unacked >= MuxWindow/2 && !st.remoteClosed && st.err == nil {
+				grant, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+
+			if grant > 0 {
+				var payload [4]byte
+				binary.BigEndian.PutUint32(payload[:], uint32(grant))
+				st.session.writeFrame(muxWindow, st.id, payload[:])
+			}
+			return n, nil
+		}
+		if st.remoteClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := waitMux(st.readable, deadline); err != nil {
+			return 0, err
+		}
+		st.mu.Lock()
+	}
+}
+
+// Write implements net.Conn, blocking while the peer's window is full
+func (st *MuxStream) Write(p []byte) (int, error) {
+	written := 0
+	st.mu.Lock()
+	for written < len(p) {
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return written, ErrStreamReset
+		}
+
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := waitMux(st.writable, deadline); err != nil {
+				return written, err
+			}
+			st.mu.Lock()
+			continue
+		}
+
+		n := min(len(p)-written, st.sendWindow, muxMaxPayload)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(muxData, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+		st.mu.Lock()
+	}
+	st.mu.Unlock()
+	return written, nil
+}
+
+// Close implements net.Conn, telling the peer the stream is finished
+func (st *MuxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	notify := st.err == nil && !st.remoteClosed
+	st.mu.Unlock()
+
+	st.signal()
+	st.session.remove(st.id)
+	if notify {
+		return st.session.writeFrame(muxClose, st.id, nil)
+	}
+	return nil
+}
+
+// LocalAddr implements net.Conn with the address of the multiplexed connection
+func (st *MuxStream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn with the address of the multiplexed connection
+func (st *MuxStream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+// SetDeadline implements net.Conn
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline, st.writeDeadline = t, t
+	st.mu.Unlock()
+	st.signal()
+	return nil
+}
+
+// SetReadDeadline implements net.Conn
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	st.signal()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.signal()
+	return nil
+}
+
+// receive buffers data from the peer, reporting false if it overruns the window
+func (st *MuxStream) receive(data []byte) bool {
+	st.mu.Lock()
+	if len(st.buf)+st.unacked+len(data) > MuxWindow {
+		st.mu.Unlock()
+		return false
+	}
+	st.buf = append(st.buf, data...)
+	st.mu.Unlock()
+	notify(st.readable)
+	return true
+}
+
+// grant extends the window the peer allows this side to write
+func (st *MuxStream) grant(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += int(n)
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+// remoteClose records that the peer closed the stream
+func (st *MuxStream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	st.mu.Unlock()
+	st.signal()
+}
+
+// fail ends the stream with err
+func (st *MuxStream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	st.signal()
+}
+
+// signal wakes blocked reads and writes to re-check the stream's state
+func (st *MuxStream) signal() {
+	notify(st.readable)
+	notify(st.writable)
+}
+
+// notify signals ch without blocking; one pending signal is enough to wake a waiter
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// waitMux blocks until ch is signalled or the deadline passes
+func waitMux(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
@@ -0,0 +1,265 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newMuxPair returns the client and server sessions of one multiplexed connection
+func newMuxPair(t *testing.T) (*MuxSession, *MuxSession) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	client, server := NewMuxSession(clientConn, true), NewMuxSession(serverConn, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// accept accepts the next stream and checks it is the one named name
+func accept(t *testing.T, s *MuxSession, name string) *MuxStream {
+	t.Helper()
+	stream, err := s.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if stream.Name() != name {
+		t.Fatalf("accepted stream %q, want %q", stream.Name(), name)
+	}
+	return stream
+}
+
+// muxFrame encodes a raw mux frame
+func muxFrame(kind byte, id uint32, payload []byte) []byte {
+	frame := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestMuxStreamsCarryDataBothWays(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	// The server echoes every stream back
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	// Several streams at once, each sending several windows' worth
+	const streams, size = 8, 4 * MuxWindow
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			stream, err := client.Open(name)
+			if err != nil {
+				t.Errorf("Open: %v", err)
+				return
+			}
+			defer stream.Close()
+
+			sent := make([]byte, size)
+			rand.Read(sent)
+			go func() {
+				if _, err := stream.Write(sent); err != nil {
+					t.Errorf("stream %s: write: %v", name, err)
+				}
+			}()
+			got := make([]byte, size)
+			if _, err := io.ReadFull(stream, got); err != nil {
+				t.Errorf("stream %s: read: %v", name, err)
+				return
+			}
+			if !bytes.Equal(got, sent) {
+				t.Errorf("stream %s: echo differs from what was sent", name)
+			}
+		}("conn-" + strconv.Itoa(i))
+	}
+	wg.Wait()
+}
+
+func TestMuxWindowHoldsUpOnlyTheStalledStream(t *testing.T) {
+	client, server := newMuxPair(t)
+	stalled, err := client.Open("stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stalledPeer := accept(t, server, "stalled")
+	other, err := client.Open("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPeer := accept(t, server, "other")
+
+	// A full window is taken unread; the next byte waits for the peer
+	if n, err := stalled.Write(make([]byte, MuxWindow)); n != MuxWindow || err != nil {
+		t.Fatalf("writing one window: %d, %v", n, err)
+	}
+	stalled.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := stalled.Write([]byte{1}); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("writing past the window: %d, %v; want a deadline error", n, err)
+	}
+
+	// The other stream is unaffected
+	go other.Write([]byte("hello"))
+	got := make([]byte, 5)
+	otherPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(otherPeer, got); err != nil || string(got) != "hello" {
+		t.Fatalf("other stream: got %q, %v", got, err)
+	}
+
+	// Reading half the window grants it back to the writer
+	if _, err := io.ReadFull(stalledPeer, make([]byte, MuxWindow/2)); err != nil {
+		t.Fatal(err)
+	}
+	stalled.SetWriteDeadline(time.Now().Add(time.Second))
+	if n, err := stalled.Write(make([]byte, MuxWindow/2)); n != MuxWindow/2 || err != nil {
+		t.Errorf("writing after the window was extended: %d, %v", n, err)
+	}
+}
+
+func TestMuxStreamClose(t *testing.T) {
+	client, server := newMuxPair(t)
+	stream, err := client.Open("conn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := accept(t, server, "conn")
+
+	// Data written before the close is read before EOF
+	if _, err := stream.Write([]byte("last words")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(peer)
+	if err != nil || string(got) != "last words" {
+		t.Fatalf("peer read %q, %v; want the data then EOF", got, err)
+	}
+	if _, err := peer.Write([]byte("reply")); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("writing to a stream the peer closed: %v, want ErrStreamReset", err)
+	}
+
+	// The closed stream itself can no longer be used
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("reading a closed stream: %v, want net.ErrClosed", err)
+	}
+	if _, err := stream.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("writing a closed stream: %v, want net.ErrClosed", err)
+	}
+}
+
+func TestMuxResetsUnknownStream(t *testing.T) {
+	conn, raw := net.Pipe()
+	s := NewMuxSession(conn, false)
+	defer s.Close()
+	defer raw.Close()
+
+	go raw.Write(muxFrame(muxData, 7, []byte("stray")))
+
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, muxHeaderSize)
+	if _, err := io.ReadFull(raw, reply); err != nil {
+		t.Fatalf("no reply to data for an unknown stream: %v", err)
+	}
+	if want := muxFrame(muxReset, 7, nil); !bytes.Equal(reply, want) {
+		t.Errorf("reply % x, want a reset % x", reply, want)
+	}
+}
+
+func TestMuxResetFailsStream(t *testing.T) {
+	conn, raw := net.Pipe()
+	s := NewMuxSession(conn, true)
+	defer s.Close()
+	defer raw.Close()
+
+	opened := make(chan *MuxStream, 1)
+	go func() {
+		stream, err := s.Open("conn")
+		if err != nil {
+			t.Errorf("Open: %v", err)
+		}
+		opened <- stream
+	}()
+	header := make([]byte, muxHeaderSize)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadFull(raw, make([]byte, binary.BigEndian.Uint32(header[5:])))
+	stream := <-opened
+
+	if _, err := raw.Write(muxFrame(muxReset, binary.BigEndian.Uint32(header[1:5]), nil)); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("reading a reset stream: %v, want ErrStreamReset", err)
+	}
+	if _, err := stream.Write([]byte("x")); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("writing a reset stream: %v, want ErrStreamReset", err)
+	}
+}
+
+func TestMuxSessionCloseEndsStreams(t *testing.T) {
+	client, server := newMuxPair(t)
+	stream, err := client.Open("conn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := accept(t, server, "conn")
+
+	// A read blocked on the stream is woken by the close
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	client.Close()
+
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, ErrMuxClosed) {
+			t.Errorf("blocked read: %v, want ErrMuxClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked read not woken by the session closing")
+	}
+	if _, err := client.Open("another"); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("Open on a closed session: %v, want ErrMuxClosed", err)
+	}
+	if _, err := client.Accept(); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("Accept on a closed session: %v, want ErrMuxClosed", err)
+	}
+
+	// The peer sees the connection go and ends its streams too
+	select {
+	case <-server.Done():
+	case <-time.After(time.Second):
+		t.Fatal("peer session still open")
+	}
+	if _, err := peer.Write([]byte("x")); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("writing on the peer: %v, want ErrMuxClosed", err)
+	}
+}
@@ -0,0 +1,323 @@
+// Package protocol implements the framed wire protocol spoken between the tunnel
+// client and server on control and data connections.
+//
+// Every message is a frame: a one-byte message type, a big-endian uint32 payload
+// length, then the payload. Payloads are JSON so fields can be added without
+// breaking older peers. A data connection starts with a single DataConn frame,
+// after which the connection carries raw tunnel traffic, compressed when the
+// handshake negotiated an algorithm. A multiplexed data connection instead starts
+// with a MuxConn frame and carries many tunnel connections as streams; see MuxSession.
+//
+// The package is a module of its own, required by both the client and server
+// modules through a replace directive.
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MessageType identifies the kind of message carried by a frame
+type MessageType byte
+
+const (
+	// MsgAuth is sent by the client to authenticate and request tunnels
+	MsgAuth MessageType = iota + 1
+	// MsgAuthResult is the server's reply to MsgAuth
+	MsgAuthResult
+	// MsgNewConn asks the client to open a data connection for a new external peer
+	MsgNewConn
+	// MsgDataConn is the first frame on a data connection and names the pending connection
+	MsgDataConn
+	// MsgPing is a client heartbeat
+	MsgPing
+	// MsgPong answers MsgPing
+	MsgPong
+	// MsgDisconnect tells the server the client is shutting down
+	MsgDisconnect
+	// MsgInspect asks what a token grants without opening a tunnel
+	MsgInspect
+	// MsgInspectResult is the server's reply to MsgInspect
+	MsgInspectResult
+	// MsgError tells the client why the server is ending its session; the client
+	// should not reconnect
+	MsgError
+	// MsgMuxConn is the first frame on a multiplexed data connection
+	MsgMuxConn
+	// MsgNotice carries an operator message for the client to show; it may arrive
+	// at any point on a control connection and needs no reply
+	MsgNotice
+)
+
+// headerSize is the size of the type byte plus the payload length
+const headerSize = 5
+
+// MaxPayloadSize bounds a single frame so a peer cannot force a huge allocation
+const MaxPayloadSize = 64 * 1024
+
+// ErrFrameTooLarge is returned by ReadFrameLimit for a frame whose declared
+// payload exceeds the limit. Nothing past the header has been read, so the
+// connection cannot be read from any further.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ErrPartialFrame is returned by ReadFrameLimit when reading fails after part of
+// a frame was consumed, wrapping the underlying error. The stream is then out of
+// step with the frame boundaries, so unlike a timeout before the first byte it
+// cannot be retried.
+var ErrPartialFrame = errors.New("partial frame")
+
+// String returns a readable name for the message type
+func (t MessageType) String() string {
+	switch t {
+	case MsgAuth:
+		return "Auth"
+	case MsgAuthResult:
+		return "AuthResult"
+	case MsgNewConn:
+		return "NewConn"
+	case MsgDataConn:
+		return "DataConn"
+	case MsgPing:
+		return "Ping"
+	case MsgPong:
+		return "Pong"
+	case MsgDisconnect:
+		return "Disconnect"
+	case MsgInspect:
+		return "Inspect"
+	case MsgInspectResult:
+		return "InspectResult"
+	case MsgError:
+		return "Error"
+	case MsgMuxConn:
+		return "MuxConn"
+	case MsgNotice:
+		return "Notice"
+	default:
+		return fmt.Sprintf("MessageType(%d)", byte(t))
+	}
+}
+
+// PortMapping is a local port the client wants to expose
+type PortMapping struct {
+	LocalPort  string `json:"local_port"`
+	RemotePort int    `json:"remote_port,omitempty"` // 0 lets the server pick
+	Protocol   string `json:"protocol,omitempty"`    // tcp (default) or udp
+
+	// ReconnectToken is the token issued for this mapping in the previous session.
+	// A valid one rebinds the mapping to the same remote port.
+	ReconnectToken string `json:"reconnect_token,omitempty"`
+
+	// IdempotencyKey identifies this mapping's tunnel setup across retries, so a
+	// server that already opened a session for it reuses that session instead of
+	// recording another. Optional; at most 255 bytes.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Bind asks for the tunnel to listen publicly (BindPublic) or for same-host
+	// consumers only (BindLoopback). Empty leaves it to the token: public when the
+	// token may bind publicly, loopback otherwise.
+	Bind string `json:"bind,omitempty"`
+}
+
+// Values of PortMapping.Bind
+const (
+	BindPublic   = "public"
+	BindLoopback = "loopback"
+)
+
+// Auth authenticates a control connection and requests one tunnel per mapping
+type Auth struct {
+	Token    string        `json:"token"`
+	Mappings []PortMapping `json:"mappings"`
+
+	// Compression lists the data connection compression algorithms the client
+	// supports, most preferred first (empty = no compression)
+	Compression []string `json:"compression,omitempty"`
+
+	// Multiplex asks to carry data connections as streams of one multiplexed
+	// connection instead of dialing one per external peer
+	Multiplex bool `json:"multiplex,omitempty"`
+}
+
+// TunnelInfo describes a tunnel the server opened for a mapping
+type TunnelInfo struct {
+	TunnelID   string `json:"tunnel_id"`
+	LocalPort  string `json:"local_port"`
+	RemotePort int    `json:"remote_port"`
+
+	// ReconnectToken rebinds the mapping to this remote port when presented on
+	// the next handshake, e.g. after a server restart
+	ReconnectToken string `json:"reconnect_token,omitempty"`
+}
+
+// Codes identifying why a handshake failed or the server ended a session
+const (
+	ErrCodeBadRequest       = "bad_request"              // Malformed or invalid Auth message
+	ErrCodeRateLimited      = "rate_limited"             // Rejected by the server's security checks
+	ErrCodeAuthFailed       = "auth_failed"              // Unknown, revoked or expired token
+	ErrCodePortAssignment   = "port_assignment"          // No usable remote port for a mapping
+	ErrCodeLocalPortDenied  = "local_port_not_permitted" // The token may not expose a requested local port
+	ErrCodeQuotaExceeded    = "quota_exceeded"           // The team is at its tunnel or daily connection quota
+	ErrCodeHandshakeTimeout = "handshake_timeout"        // The first frame did not arrive within the server's handshake timeout
+	ErrCodeTokenRevoked     = "token_revoked"            // The session's token was revoked by an administrator
+	ErrCodeTunnelActive     = "tunnel_active"            // Another client is connected to the requested tunnel
+	ErrCodeReconnectLimited = "reconnect_limited"        // The token authenticated too often recently; retry after backing off
+	ErrCodePublicBindDenied = "public_bind_denied"       // The token's tunnels may only listen on loopback
+)
+
+// AuthResult reports whether authentication succeeded. Tunnels are listed in
+// the order their mappings were requested.
+type AuthResult struct {
+	Success bool         `json:"success"`
+	Error   string       `json:"error,omitempty"`
+	Code    string       `json:"code,omitempty"` // One of the ErrCode constants when Success is false
+	Tunnels []TunnelInfo `json:"tunnels,omitempty"`
+
+	// Compression is the algorithm both sides use on data connections, or
+	// empty when traffic is not compressed
+	Compression string `json:"compression,omitempty"`
+
+	// Multiplex is true when the server accepts multiplexed data connections
+	Multiplex bool `json:"multiplex,omitempty"`
+
+	// SessionID identifies the control connection in the server's logs, so
+	// client and server log lines for its tunnels can be matched up
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// Inspect asks the server to describe a token. The server closes the connection
+// after replying; no tunnel or session is created.
+type Inspect struct {
+	Token string `json:"token"`
+}
+
+// InspectedPort is a remote port assigned to an inspected token
+type InspectedPort struct {
+	Port      int    `json:"port"`
+	Protocol  string `json:"protocol"`
+	Subdomain string `json:"subdomain,omitempty"`
+}
+
+// InspectResult describes the token sent in Inspect
+type InspectResult struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"` // One of the ErrCode constants when Success is false
+
+	TeamName          string          `json:"team_name,omitempty"`
+	TokenName         string          `json:"token_name,omitempty"`
+	Ports             []InspectedPort `json:"ports,omitempty"` // Primary port first
+	ExpiresAt         *time.Time      `json:"expires_at,omitempty"`
+	AllowedLocalPorts []int64         `json:"allowed_local_ports,omitempty"`
+}
+
+// Error ends a session the server will not serve again, e.g. because its token
+// was revoked. The server closes the control connection after sending it.
+type Error struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"` // One of the ErrCode constants
+}
+
+// Notice is an operator message, e.g. about a maintenance window. Clients show
+// it and otherwise carry on.
+type Notice struct {
+	Message string `json:"message"`
+}
+
+// NewConn asks the client to open a data connection for an external peer
+type NewConn struct {
+	ConnID     string `json:"conn_id"`
+	RemotePort int    `json:"remote_port"`
+
+	// Addresses of the external peer and of the server endpoint it connected to,
+	// as host:port, so the client can announce them with the PROXY protocol
+	ClientAddr string `json:"client_addr,omitempty"`
+	ServerAddr string `json:"server_addr,omitempty"`
+}
+
+// DataConn identifies the pending connection a data connection belongs to
+type DataConn struct {
+	ConnID string `json:"conn_id"`
+}
+
+// WriteFrame writes a single frame in one write so concurrent writers that
+// serialize their calls never interleave partial frames
+func WriteFrame(w io.Writer, msgType MessageType, payload []byte) error {
+	if len(payload) > MaxPayloadSize {
+		return fmt.Errorf("%s payload too large: %d bytes", msgType, len(payload))
+	}
+
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = byte(msgType)
+	binary.BigEndian.PutUint32(frame[1:headerSize], uint32(len(payload)))
+	copy(frame[headerSize:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a single frame of up to MaxPayloadSize bytes. It never reads
+// past the end of the frame, so the reader can be handed over to raw traffic
+// afterwards.
+func ReadFrame(r io.Reader) (MessageType, []byte, error) {
+	return ReadFrameLimit(r, MaxPayloadSize)
+}
+
+// ReadFrameLimit reads a single frame like ReadFrame, rejecting payloads over
+// limit bytes with ErrFrameTooLarge before any of the payload is read or
+// buffered. A limit of zero or above MaxPayloadSize means MaxPayloadSize.
+func ReadFrameLimit(r io.Reader, limit int) (MessageType, []byte, error) {
+	if limit <= 0 || limit > MaxPayloadSize {
+		limit = MaxPayloadSize
+	}
+
+	var header [headerSize]byte
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		if n > 0 {
+			return 0, nil, fmt.Errorf("%w: read %d of %d header bytes: %w", ErrPartialFrame, n, headerSize, err)
+		}
+		return 0, nil, err
+	}
+
+	msgType := MessageType(header[0])
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > uint32(limit) {
+		return 0, nil, fmt.Errorf("%w: %s payload of %d bytes exceeds the %d byte limit", ErrFrameTooLarge, msgType, length, limit)
+	}
+
+	payload := make([]byte, length)
+	if n, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			// The stream ended mid-frame, right after the header
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, fmt.Errorf("%w: read %d of %d %s payload bytes: %w", ErrPartialFrame, n, length, msgType, err)
+	}
+	return msgType, payload, nil
+}
+
+// WriteMessage encodes msg as JSON and writes it as a frame. A nil msg writes an
+// empty payload, as used by Ping, Pong and Disconnect.
+func WriteMessage(w io.Writer, msgType MessageType, msg interface{}) error {
+	var payload []byte
+	if msg != nil {
+		var err error
+		payload, err = json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", msgType, err)
+		}
+	}
+	return WriteFrame(w, msgType, payload)
+}
+
+// Decode decodes a frame payload into msg
+func Decode(msgType MessageType, payload []byte, msg interface{}) error {
+	if err := json.Unmarshal(payload, msg); err != nil {
+		return fmt.Errorf("invalid %s message: %w", msgType, err)
+	}
+	return nil
+}
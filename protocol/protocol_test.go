@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+// timeoutError is a net.Error reporting a timeout, as a read deadline produces
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// stallingReader returns data, then times out on every later read
+type stallingReader struct {
+	data []byte
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, timeoutError{}
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func frame(t *testing.T, msgType MessageType, payload []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, msgType, payload); err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// header returns a frame header declaring a payload of length bytes
+func header(msgType MessageType, length uint32) []byte {
+	h := make([]byte, headerSize)
+	h[0] = byte(msgType)
+	binary.BigEndian.PutUint32(h[1:], length)
+	return h
+}
+
+func TestReadFrameTimeoutBeforeFrame(t *testing.T) {
+	_, _, err := ReadFrame(&stallingReader{})
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if errors.Is(err, ErrPartialFrame) {
+		t.Errorf("timeout before any byte was read reported as a partial frame: %v", err)
+	}
+}
+
+func TestReadFrameTimeoutMidFrame(t *testing.T) {
+	full := frame(t, MsgPing, []byte(`{"a":1}`))
+
+	for _, cut := range []int{1, headerSize - 1, headerSize, len(full) - 1} {
+		_, _, err := ReadFrame(&stallingReader{data: full[:cut]})
+
+		if !errors.Is(err, ErrPartialFrame) {
+			t.Errorf("timeout after %d bytes: got %v, want ErrPartialFrame", cut, err)
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("timeout after %d bytes: %v no longer wraps the timeout", cut, err)
+		}
+	}
+}
+
+func TestReadFrameRoundTrip(t *testing.T) {
+	r := bytes.NewReader(append(frame(t, MsgNotice, []byte("hello")), frame(t, MsgPong, nil)...))
+
+	msgType, payload, err := ReadFrame(r)
+	if err != nil || msgType != MsgNotice || string(payload) != "hello" {
+		t.Fatalf("first frame: got %s %q %v", msgType, payload, err)
+	}
+	msgType, payload, err = ReadFrame(r)
+	if err != nil || msgType != MsgPong || len(payload) != 0 {
+		t.Fatalf("second frame: got %s %q %v", msgType, payload, err)
+	}
+	if _, _, err := ReadFrame(r); err != io.EOF {
+		t.Errorf("after the last frame: got %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameLimitRejectsOversizedFrame(t *testing.T) {
+	for _, tc := range []struct {
+		limit  int
+		length uint32
+	}{
+		{1024, 1025},
+		{1024, MaxPayloadSize},
+		{0, MaxPayloadSize + 1},
+		{0, 10 << 20},
+		{MaxPayloadSize * 2, 1<<32 - 1},
+	} {
+		rest := []byte("next frame")
+		r := bytes.NewReader(append(header(MsgAuth, tc.length), rest...))
+
+		_, payload, err := ReadFrameLimit(r, tc.limit)
+		if !errors.Is(err, ErrFrameTooLarge) {
+			t.Errorf("%d bytes with limit %d: got %v, want ErrFrameTooLarge", tc.length, tc.limit, err)
+		}
+		if payload != nil {
+			t.Errorf("%d bytes with limit %d: returned a %d byte payload", tc.length, tc.limit, len(payload))
+		}
+		if r.Len() != len(rest) {
+			t.Errorf("%d bytes with limit %d: read %d bytes past the header", tc.length, tc.limit, len(rest)-r.Len())
+		}
+	}
+}
+
+func TestReadFrameLimitAllocatesNothingForOversizedFrame(t *testing.T) {
+	const runs = 100
+	frame := header(MsgAuth, MaxPayloadSize)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < runs; i++ {
+		if _, _, err := ReadFrameLimit(bytes.NewReader(frame), 1024); !errors.Is(err, ErrFrameTooLarge) {
+			t.Fatalf("got %v, want ErrFrameTooLarge", err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+
+	// Only the errors are allocated, far less than one declared payload per run
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > runs*1024 {
+		t.Errorf("rejecting %d frames declaring %d bytes allocated %d bytes", runs, MaxPayloadSize, allocated)
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	full := frame(t, MsgNotice, []byte("hello, world"))
+
+	for _, data := range [][]byte{
+		full[:2],                          // Part of the header
+		full[:headerSize],                 // The header alone
+		full[:len(full)-1],                // All but the last payload byte
+		header(MsgNotice, MaxPayloadSize), // A full size payload that never arrives
+	} {
+		_, payload, err := ReadFrame(bytes.NewReader(data))
+		if !errors.Is(err, ErrPartialFrame) || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("frame cut after %d bytes: got %v, want ErrPartialFrame wrapping io.ErrUnexpectedEOF", len(data), err)
+		}
+		if payload != nil {
+			t.Errorf("frame cut after %d bytes: returned a %d byte payload", len(data), len(payload))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/joho/godotenv"
+	"github.com/spf13/cobra"
+)
+
+// reloadableSettings maps the config file keys the server re-reads on SIGHUP to
+// the flags they stand in for
+var reloadableSettings = map[string]string{
+	"LOG_LEVEL":            "log-level",
+	"MAX_CONNS_PER_IP":     "max-conns-per-ip",
+	"MAX_CONNS_PER_HOUR":   "max-conns-per-hour",
+	"MAX_GLOBAL_CONNS":     "max-global-conns",
+	"MAX_CONNS_PER_TUNNEL": "max-conns-per-tunnel",
+	"DATA_CONN_TIMEOUT":    "data-conn-timeout",
+	"TUNNEL_IDLE_TIMEOUT":  "tunnel-idle-timeout",
+	"MAX_TUNNEL_LIFETIME":  "max-tunnel-lifetime",
+	"NOTICE":               "notice",
+	"NOTICE_FILE":          "notice-file",
+}
+
+// fixedFlags returns the reloadable flags given on the command line. They keep
+// their value for the life of the process, whatever the config file says.
+func fixedFlags(cmd *cobra.Command) map[string]bool {
+	fixed := make(map[string]bool)
+	for _, flag := range reloadableSettings {
+		if cmd.Flags().Changed(flag) {
+			fixed[flag] = true
+		}
+	}
+	return fixed
+}
+
+// applyConfigFile sets the reloadable flags from their keys in the config file at
+// path. A flag whose key is missing goes back to its default, so deleting a line
+// undoes it on the next reload. A missing file leaves every flag at its default.
+func applyConfigFile(cmd *cobra.Command, path string, fixed map[string]bool) error {
+	values, err := godotenv.Read(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error reading config file %s: %v", path, err)
+	}
+
+	keys := make([]string, 0, len(reloadableSettings))
+	for key := range reloadableSettings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := reloadableSettings[key]
+		if fixed[name] {
+			continue
+		}
+		flag := cmd.Flags().Lookup(name)
+		value, ok := values[key]
+		if !ok {
+			value = flag.DefValue
+		}
+		if err := flag.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid %s in %s: %v", key, path, err)
+		}
+	}
+	return nil
+}
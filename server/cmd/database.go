@@ -2,12 +2,15 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/user"
 	"strconv"
 	"text/tabwriter"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 
 	"rabbit.go/internal/database"
@@ -23,11 +26,34 @@ var databaseCmd = &cobra.Command{
 }
 
 var migrateCmd = &cobra.Command{
-	Use:   "migrate <path>",
+	Use:   "migrate <dir>",
 	Short: "Run database migrations",
-	Long:  `Create database tables and run migrations.`,
-	Args:  cobra.ExactArgs(1),
+	Long: `Apply the numbered migrations in a directory, such as internal/database/migrations.
+
+Migration files are named NNNN_name.up.sql, with an optional NNNN_name.down.sql that
+reverses it. Applied versions are recorded in the schema_migrations table and each
+migration runs in its own transaction. By default every pending migration is applied;
+--to migrates up or down to a version and --rollback reverts the latest one.`,
+	Example: `  rabbit.go database migrate internal/database/migrations
+  rabbit.go database migrate internal/database/migrations --to 1
+  rabbit.go database migrate internal/database/migrations --rollback`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
+			return err
+		}
+		migrateTo, _ := cmd.Flags().GetInt("to")
+		migrateRollback, _ := cmd.Flags().GetBool("rollback")
+		if migrateRollback && cmd.Flags().Changed("to") {
+			return fmt.Errorf("--to and --rollback cannot be used together")
+		}
+
+		migrations, err := database.LoadMigrations(args[0])
+		if err != nil {
+			return err
+		}
+
 		config := database.GetConfigFromEnv()
 		db, err := database.NewDatabase(config)
 		if err != nil {
@@ -35,28 +61,67 @@ var migrateCmd = &cobra.Command{
 		}
 		defer db.Close()
 
-		fmt.Println("Running database migrations...")
+		applied, err := db.AppliedMigrations()
+		if err != nil {
+			return err
+		}
 
-		// // Clean up the database
-		// fmt.Println("Cleaning up the database...")
-		// if err := db.CleanUp(); err != nil {
-		// 	return fmt.Errorf("failed to clean up database: %w", err)
-		// }
+		target := migrations[len(migrations)-1].Version
+		switch {
+		case migrateRollback:
+			if len(applied) == 0 {
+				return fmt.Errorf("no migrations have been applied")
+			}
+			target = 0
+			if len(applied) > 1 {
+				target = applied[len(applied)-2]
+			}
+		case cmd.Flags().Changed("to"):
+			if migrateTo < 0 {
+				return fmt.Errorf("--to must be 0 or a migration version")
+			}
+			target = migrateTo
+		}
+
+		from := currentVersion(applied)
+		if !asJSON {
+			fmt.Printf("Running database migrations (version %d → %d)...\n", from, target)
+		}
 
-		if err := db.RunMigrations(args[0]); err != nil {
+		if err := db.MigrateTo(migrations, target); err != nil {
 			return fmt.Errorf("migration failed: %w", err)
 		}
 
-		fmt.Println("Database migrations completed successfully!")
+		applied, err = db.AppliedMigrations()
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(map[string]int{"from_version": from, "version": currentVersion(applied)})
+		}
+		fmt.Printf("Database migrations completed successfully! Schema version: %d\n", currentVersion(applied))
 		return nil
 	},
 }
 
+// currentVersion returns the newest applied migration version, or 0 if none
+func currentVersion(applied []int) int {
+	if len(applied) == 0 {
+		return 0
+	}
+	return applied[len(applied)-1]
+}
+
 var listTeamsCmd = &cobra.Command{
 	Use:   "list-teams",
 	Short: "List all teams with their tokens and ports",
 	Long:  `Display all teams along with their associated tokens and port assignments.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
+			return err
+		}
+
 		config := database.GetConfigFromEnv()
 		db, err := database.NewDatabase(config)
 		if err != nil {
@@ -86,7 +151,14 @@ var listTeamsCmd = &cobra.Command{
 		defer rows.Close()
 
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-		fmt.Fprintln(w, "TEAM NAME\tTEAM ID\tTOKEN NAME\tPORT\tPROTOCOL\tCREATED\tLAST USED\tEXPIRES")
+		if !asJSON {
+			fmt.Fprintln(w, "TEAM NAME\tTEAM ID\tTOKEN NAME\tPORT\tPROTOCOL\tCREATED\tLAST USED\tEXPIRES")
+		}
+
+		// Rows are flattened team × token × port; JSON output nests them again
+		teams := []*teamListing{}
+		teamsByID := make(map[string]*teamListing)
+		tokensByID := make(map[string]*tokenListing)
 
 		for rows.Next() {
 			var teamID, teamName, teamDesc, teamCreated string
@@ -103,6 +175,34 @@ var listTeamsCmd = &cobra.Command{
 				return fmt.Errorf("failed to scan row: %w", err)
 			}
 
+			if asJSON {
+				team := teamsByID[teamID]
+				if team == nil {
+					team = &teamListing{ID: teamID, Name: teamName, Description: teamDesc,
+						CreatedAt: parseTimestamp(&teamCreated), Tokens: []*tokenListing{}}
+					teamsByID[teamID] = team
+					teams = append(teams, team)
+				}
+				if tokenID == nil {
+					continue
+				}
+				listing := tokensByID[*tokenID]
+				if listing == nil {
+					listing = &tokenListing{ID: *tokenID, CreatedAt: parseTimestamp(tokenCreated),
+						ExpiresAt: parseTimestamp(tokenExpires), LastUsedAt: parseTimestamp(tokenLastUsed),
+						Ports: []portListing{}}
+					if tokenName != nil {
+						listing.Name = *tokenName
+					}
+					tokensByID[*tokenID] = listing
+					team.Tokens = append(team.Tokens, listing)
+				}
+				if port != nil && protocol != nil {
+					listing.Ports = append(listing.Ports, portListing{Port: *port, Protocol: *protocol})
+				}
+				continue
+			}
+
 			// Format output
 			portStr := "N/A"
 			protocolStr := "N/A"
@@ -148,17 +248,67 @@ var listTeamsCmd = &cobra.Command{
 				expiresStr,
 			)
 		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to query teams: %w", err)
+		}
 
+		if asJSON {
+			return printJSON(teams)
+		}
 		w.Flush()
 		return nil
 	},
 }
 
+// teamListing is a team as printed by list-teams --output json
+type teamListing struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	CreatedAt   *time.Time      `json:"created_at"`
+	Tokens      []*tokenListing `json:"tokens"`
+}
+
+// tokenListing is an active token of a team in list-teams --output json
+type tokenListing struct {
+	ID         string        `json:"id"`
+	Name       string        `json:"name"`
+	CreatedAt  *time.Time    `json:"created_at"`
+	ExpiresAt  *time.Time    `json:"expires_at"`   // null when the token never expires
+	LastUsedAt *time.Time    `json:"last_used_at"` // null when the token was never used
+	Ports      []portListing `json:"ports"`
+}
+
+// portListing is a port assigned to a token in list-teams --output json
+type portListing struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// parseTimestamp parses a timestamp column scanned into a string, or returns nil
+// for NULL or a value that does not parse
+func parseTimestamp(value *string) *time.Time {
+	if value == nil {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, *value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
 var statsCmd = &cobra.Command{
 	Use:   "stats",
 	Short: "Show database statistics",
-	Long:  `Display statistics about teams, tokens, connections, and system health.`,
+	Long: `Display statistics about teams, tokens, connections, and system health. With
+--output json only the statistics are printed, as one object.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
+			return err
+		}
+
 		config := database.GetConfigFromEnv()
 		db, err := database.NewDatabase(config)
 		if err != nil {
@@ -169,9 +319,17 @@ var statsCmd = &cobra.Command{
 		service := database.NewService(db)
 		ctx := context.Background()
 
+		if asJSON {
+			stats, err := service.GetDatabaseStats(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to get database stats: %w", err)
+			}
+			return printJSON(stats)
+		}
+
 		// Health check
 		fmt.Println("🔍 Running health check...")
-		if err := service.HealthCheck(ctx); err != nil {
+		if err := service.HealthCheck(ctx).Err(); err != nil {
 			fmt.Printf("❌ Health check failed: %v\n", err)
 		} else {
 			fmt.Println("✅ System healthy")
@@ -198,8 +356,73 @@ var statsCmd = &cobra.Command{
 var healthCmd = &cobra.Command{
 	Use:   "health",
 	Short: "Check database health",
-	Long:  `Verify connectivity to PostgreSQL and Redis databases.`,
+	Long: `Verify connectivity to PostgreSQL and Redis databases. Each is checked on its
+own, and the command fails if either is unhealthy.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		defer cancel()
+
+		if !asJSON {
+			fmt.Println("🔍 Checking database health...")
+		}
+		report := database.CheckHealth(ctx, database.GetConfigFromEnv())
+
+		if asJSON {
+			if err := printJSON(report); err != nil {
+				return err
+			}
+			return report.Err()
+		}
+
+		for _, check := range []struct {
+			name   string
+			result database.HealthCheck
+		}{
+			{"PostgreSQL", report.Checks.Postgres},
+			{"Redis", report.Checks.Redis},
+			{"Query", report.Checks.Query},
+		} {
+			if check.result.Status == "ok" {
+				fmt.Printf("✅ %-10s ok (%.1fms)\n", check.name, check.result.LatencyMS)
+			} else {
+				fmt.Printf("❌ %-10s %s\n", check.name, check.result.Error)
+			}
+		}
+		if err := report.Err(); err != nil {
+			return err
+		}
+
+		fmt.Println("✅ All database connections are healthy!")
+		return nil
+	},
+}
+
+// healthCheckTimeout bounds the health command, so an unreachable host fails it
+// rather than hanging
+const healthCheckTimeout = 10 * time.Second
+
+var revokeTokenCmd = &cobra.Command{
+	Use:   "revoke-token <token-id>",
+	Short: "Revoke a token and release its ports",
+	Long: `Deactivate a token so it can no longer authenticate and release its port assignments.
+Tunnels already open on a running server are closed when the token is revoked through
+the API (DELETE /api/v1/tokens/:tokenId); this command only updates the database.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
+			return err
+		}
+		tokenID, err := uuid.Parse(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid token id: %w", err)
+		}
+
 		config := database.GetConfigFromEnv()
 		db, err := database.NewDatabase(config)
 		if err != nil {
@@ -210,24 +433,489 @@ var healthCmd = &cobra.Command{
 		service := database.NewService(db)
 		ctx := context.Background()
 
-		fmt.Println("🔍 Checking database health...")
+		assignments, err := service.RevokeToken(ctx, tokenID)
+		if err != nil {
+			recordAudit(service, database.AuditTokenRevoke, tokenID.String(), err, nil)
+			return fmt.Errorf("failed to revoke token: %w", err)
+		}
+		recordAudit(service, database.AuditTokenRevoke, tokenID.String(), nil, map[string]any{"released_ports": portNumbers(assignments)})
 
-		if err := service.HealthCheck(ctx); err != nil {
-			fmt.Printf("❌ Health check failed: %v\n", err)
+		if asJSON {
+			return printJSON(map[string]any{"token_id": tokenID, "released_ports": assignments})
+		}
+		fmt.Printf("🔒 Token %s revoked\n", tokenID)
+		for _, pa := range assignments {
+			fmt.Printf("   Released port %d/%s\n", pa.Port, pa.Protocol)
+		}
+		return nil
+	},
+}
+
+var createTeamCmd = &cobra.Command{
+	Use:   "create-team <name>",
+	Short: "Create a team",
+	Long:  `Create a team that tokens can be generated for. Team names must be unique.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
 			return err
 		}
+		description, _ := cmd.Flags().GetString("description")
 
-		fmt.Println("✅ All database connections are healthy!")
+		config := database.GetConfigFromEnv()
+		db, err := database.NewDatabase(config)
+		if err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
+		defer db.Close()
+
+		service := database.NewService(db)
+		ctx := context.Background()
+
+		team, err := service.CreateTeam(ctx, args[0], description)
+		if err != nil {
+			recordAudit(service, database.AuditTeamCreate, "", err, map[string]any{"name": args[0]})
+			return fmt.Errorf("failed to create team: %w", err)
+		}
+		recordAudit(service, database.AuditTeamCreate, team.ID, nil, map[string]any{"name": team.Name})
+
+		if asJSON {
+			return printJSON(team)
+		}
+		fmt.Printf("✅ Team %s created\n", team.Name)
+		fmt.Printf("   Team ID: %s\n", team.ID)
+		return nil
+	},
+}
+
+var deleteTeamCmd = &cobra.Command{
+	Use:   "delete-team <team-id>",
+	Short: "Delete a team, deactivating its tokens and releasing its ports",
+	Long: `Soft-delete a team, deactivate all of its tokens and release all of its port
+assignments in one transaction. Tunnels already open on a running server are closed
+when the team is deleted through the API (DELETE /api/v1/teams/:teamId); this command
+only updates the database.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
+			return err
+		}
+		teamID := args[0]
+
+		config := database.GetConfigFromEnv()
+		db, err := database.NewDatabase(config)
+		if err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
+		defer db.Close()
+
+		service := database.NewService(db)
+		ctx := context.Background()
+
+		assignments, tokens, err := service.DeactivateTeam(ctx, teamID)
+		if err != nil {
+			recordAudit(service, database.AuditTeamDelete, teamID, err, nil)
+			return fmt.Errorf("failed to delete team: %w", err)
+		}
+		recordAudit(service, database.AuditTeamDelete, teamID, nil, map[string]any{
+			"deactivated_tokens": tokens,
+			"released_ports":     portNumbers(assignments),
+		})
+
+		if asJSON {
+			return printJSON(map[string]any{
+				"team_id":            teamID,
+				"deactivated_tokens": tokens,
+				"released_ports":     assignments,
+			})
+		}
+		fmt.Printf("🗑️  Team %s deleted\n", teamID)
+		fmt.Printf("   Deactivated %d token(s)\n", tokens)
+		for _, pa := range assignments {
+			fmt.Printf("   Released port %d/%s\n", pa.Port, pa.Protocol)
+		}
+		return nil
+	},
+}
+
+var reclaimPortsCmd = &cobra.Command{
+	Use:   "reclaim-ports",
+	Short: "Free ports held by inactive tokens or deleted teams",
+	Long: `Delete port assignments whose token is inactive or whose team has been deleted,
+and release Redis port locks that never expire. Reserved assignments are kept unless
+--include-reserved is given. A running server also reclaims unreserved ports on every
+token cleanup pass.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
+			return err
+		}
+		includeReserved, _ := cmd.Flags().GetBool("include-reserved")
+
+		config := database.GetConfigFromEnv()
+		db, err := database.NewDatabase(config)
+		if err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
+		defer db.Close()
+
+		service := database.NewService(db)
+		ctx := context.Background()
+
+		assignments, locks, err := service.ReclaimOrphanedPorts(ctx, includeReserved)
+		if asJSON {
+			// Ports freed before a failure are still reported
+			if printErr := printJSON(map[string]any{"freed_ports": assignments, "released_locks": locks}); printErr != nil {
+				return printErr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to reclaim ports: %w", err)
+			}
+			return nil
+		}
+		for _, pa := range assignments {
+			fmt.Printf("   Freed port %d/%s (team %s)\n", pa.Port, pa.Protocol, pa.TeamID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to reclaim ports: %w", err)
+		}
+
+		fmt.Printf("♻️  Freed %d port(s) and released %d stale port lock(s)\n", len(assignments), locks)
+		return nil
+	},
+}
+
+var checkPortsCmd = &cobra.Command{
+	Use:   "check-ports",
+	Short: "Report ports assigned more than once or outside the port range",
+	Long: `Report ports that more than one active assignment would listen on, such as a
+tcp and an http assignment on the same port, and assignments outside the tunnel
+port range (10000-65535). With --repair, every assignment in a conflict but the
+oldest, and every out-of-range assignment, is moved to a free port. A client
+tunneling a moved token gets its new port the next time it connects.`,
+	Example: `  rabbit.go database check-ports
+  rabbit.go database check-ports --repair`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
+			return err
+		}
+		repair, _ := cmd.Flags().GetBool("repair")
+
+		config := database.GetConfigFromEnv()
+		db, err := database.NewDatabase(config)
+		if err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
+		defer db.Close()
+
+		service := database.NewService(db)
+		conflicts, moves, err := service.CheckPorts(context.Background(), repair)
+		if asJSON {
+			// Moves made before a failure are still reported
+			if conflicts == nil {
+				conflicts = []database.PortConflict{}
+			}
+			if moves == nil {
+				moves = []database.PortMove{}
+			}
+			if printErr := printJSON(map[string]any{"conflicts": conflicts, "moved": moves}); printErr != nil {
+				return printErr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to check ports: %w", err)
+			}
+			return nil
+		}
+
+		for _, conflict := range conflicts {
+			if conflict.Reason == "out_of_range" {
+				fmt.Printf("⚠️  Port %d/%s is outside the port range\n", conflict.Port, conflict.Transport)
+			} else {
+				fmt.Printf("⚠️  Port %d/%s is assigned %d times\n", conflict.Port, conflict.Transport, len(conflict.Assignments))
+			}
+			for _, pa := range conflict.Assignments {
+				fmt.Printf("   %s token %s (team %s, %s, assigned %s)\n",
+					pa.Protocol, pa.TokenID, pa.TeamID, pa.ID, pa.CreatedAt.Format(time.RFC3339))
+			}
+		}
+		for _, move := range moves {
+			fmt.Printf("   Moved token %s from port %d to %d/%s\n", move.Assignment.TokenID, move.OldPort, move.Assignment.Port, move.Assignment.Protocol)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check ports: %w", err)
+		}
+
+		switch {
+		case len(conflicts) == 0:
+			fmt.Printf("✅ No port conflicts found\n")
+		case repair:
+			fmt.Printf("🔧 Resolved %d conflict(s) by moving %d assignment(s)\n", len(conflicts), len(moves))
+		default:
+			fmt.Printf("❌ Found %d port conflict(s); run with --repair to move the newer assignments\n", len(conflicts))
+		}
+		return nil
+	},
+}
+
+// Port range utilization from which the ports command warns, in percent
+const (
+	portUtilizationWarn     = 80
+	portUtilizationCritical = 95
+)
+
+var portsCmd = &cobra.Command{
+	Use:   "ports",
+	Short: "Show which ports of the port range are assigned, reserved, locked and free",
+	Long: `Print the active port assignments with their team and token, the port ranges
+reserved for teams and the ports locked in Redis, followed by how many ports of
+the tunnel port range (10000-65535) are free and how much of it is in use. A port
+counts as used when it is assigned or locked for either transport.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
+			return err
+		}
+
+		config := database.GetConfigFromEnv()
+		db, err := database.NewDatabase(config)
+		if err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
+		defer db.Close()
+
+		service := database.NewService(db)
+		usage, err := service.ListPortUsage(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to get port usage: %w", err)
+		}
+
+		if asJSON {
+			return printJSON(usage)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PORT\tPROTOCOL\tSTATE\tTEAM\tTOKEN")
+		for _, ap := range usage.Assigned {
+			fmt.Fprintf(w, "%d\t%s\tassigned\t%s (%s)\t%s (%s)\n", ap.Port, ap.Protocol, ap.TeamName, ap.TeamID, ap.TokenName, ap.TokenID)
+		}
+		for _, lock := range usage.Locked {
+			fmt.Fprintf(w, "%d\t-\tlocked\t-\t%s\n", lock.Port, lock.TokenID)
+		}
+		w.Flush()
+
+		if len(usage.Reserved) > 0 {
+			fmt.Println()
+			w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "RESERVED RANGE\tPORTS\tTEAM")
+			for _, pr := range usage.Reserved {
+				fmt.Fprintf(w, "%d-%d\t%d\t%s\n", pr.StartPort, pr.EndPort, pr.EndPort-pr.StartPort+1, pr.TeamID)
+			}
+			w.Flush()
+		}
+
+		fmt.Printf("\n📊 Port range %d-%d: %d assigned, %d locked, %d reserved range(s), %d of %d free\n",
+			usage.RangeStart, usage.RangeEnd, len(usage.Assigned), len(usage.Locked), len(usage.Reserved), usage.Free, usage.Total)
+		if usage.LocksUnavailable {
+			fmt.Println("⚠️  Redis is unavailable; port locks are not counted")
+		}
+		switch {
+		case usage.Utilization >= portUtilizationCritical:
+			fmt.Printf("❌ Utilization: %.1f%% - the port range is nearly exhausted\n", usage.Utilization)
+		case usage.Utilization >= portUtilizationWarn:
+			fmt.Printf("⚠️  Utilization: %.1f%%\n", usage.Utilization)
+		default:
+			fmt.Printf("✅ Utilization: %.1f%%\n", usage.Utilization)
+		}
+		return nil
+	},
+}
+
+var aggregateStatsCmd = &cobra.Command{
+	Use:   "aggregate-stats",
+	Short: "Roll connection logs up into daily connection stats",
+	Long: `Recompute the per-team daily totals in connection_stats from connection_logs.
+Every day with a connection that started or ended since --since is recomputed in
+full, so the command can be run as often as needed, e.g. from cron when the server
+runs with --stats-interval 0. --all rebuilds every day ever logged.`,
+	Example: `  rabbit.go database aggregate-stats
+  rabbit.go database aggregate-stats --since 2024-01-01
+  rabbit.go database aggregate-stats --all`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
+			return err
+		}
+		sinceFlag, _ := cmd.Flags().GetString("since")
+		all, _ := cmd.Flags().GetBool("all")
+
+		// Yesterday by default, so a daily run also settles the day that just ended
+		now := time.Now()
+		since := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.Local)
+		switch {
+		case all:
+			since = time.Time{}
+		case sinceFlag != "":
+			parsed, err := time.ParseInLocation("2006-01-02", sinceFlag, time.Local)
+			if err != nil {
+				return fmt.Errorf("invalid --since date %q (use YYYY-MM-DD): %w", sinceFlag, err)
+			}
+			since = parsed
+		}
+
+		config := database.GetConfigFromEnv()
+		db, err := database.NewDatabase(config)
+		if err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
+		defer db.Close()
+
+		service := database.NewService(db)
+		days, err := service.AggregateConnectionStats(context.Background(), since)
+		if err != nil {
+			return err
+		}
+
+		if asJSON {
+			report := map[string]any{"days": days, "since": nil}
+			if !all {
+				report["since"] = since.Format("2006-01-02")
+			}
+			return printJSON(report)
+		}
+		if all {
+			fmt.Printf("📊 Aggregated %d team-day(s) of connection stats\n", days)
+		} else {
+			fmt.Printf("📊 Aggregated %d team-day(s) of connection stats with activity since %s\n", days, since.Format("2006-01-02"))
+		}
+		return nil
+	},
+}
+
+var reserveRangeCmd = &cobra.Command{
+	Use:   "reserve-range <team-id> <start-port> <end-port>",
+	Short: "Reserve a block of ports for a team",
+	Long: `Reserve the ports from start-port to end-port, inclusive, for a team. The team's
+new tokens are given ports from the range first, and other teams are never given a
+port inside it. The range may not overlap another team's range or contain ports
+already assigned to another team. Existing assignments are not moved.`,
+	Example: `  rabbit.go database reserve-range 4d6f0b2c 15000 15010`,
+	Args:    cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := outputJSON(cmd)
+		if err != nil {
+			return err
+		}
+		teamID := args[0]
+		start, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid start port %q", args[1])
+		}
+		end, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid end port %q", args[2])
+		}
+
+		config := database.GetConfigFromEnv()
+		db, err := database.NewDatabase(config)
+		if err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
+		defer db.Close()
+
+		service := database.NewService(db)
+		pr, err := service.ReservePortRange(context.Background(), teamID, start, end)
+		recordAudit(service, database.AuditTeamReserveRange, teamID, err, map[string]any{"start_port": start, "end_port": end})
+		if err != nil {
+			return fmt.Errorf("failed to reserve port range: %w", err)
+		}
+
+		if asJSON {
+			return printJSON(pr)
+		}
+		fmt.Printf("📌 Ports %d-%d reserved for team %s\n", pr.StartPort, pr.EndPort, pr.TeamID)
+		fmt.Printf("   Range ID: %s\n", pr.ID)
 		return nil
 	},
 }
 
 func init() {
 	// Add subcommands to database command
+	databaseCmd.PersistentFlags().StringP("output", "o", "table", "Output format: table or json")
 	databaseCmd.AddCommand(migrateCmd)
 	databaseCmd.AddCommand(listTeamsCmd)
 	databaseCmd.AddCommand(statsCmd)
 	databaseCmd.AddCommand(healthCmd)
+	databaseCmd.AddCommand(revokeTokenCmd)
+	databaseCmd.AddCommand(createTeamCmd)
+	databaseCmd.AddCommand(deleteTeamCmd)
+	databaseCmd.AddCommand(reclaimPortsCmd)
+	databaseCmd.AddCommand(checkPortsCmd)
+	databaseCmd.AddCommand(portsCmd)
+	databaseCmd.AddCommand(aggregateStatsCmd)
+	databaseCmd.AddCommand(reserveRangeCmd)
+
+	migrateCmd.Flags().Int("to", 0, "Migrate up or down to this version (0 rolls back every migration)")
+	migrateCmd.Flags().Bool("rollback", false, "Roll back the latest applied migration")
+	createTeamCmd.Flags().String("description", "", "Team description")
+	reclaimPortsCmd.Flags().Bool("include-reserved", false, "Also reclaim reserved port assignments")
+	checkPortsCmd.Flags().Bool("repair", false, "Move the newer assignments of each conflicting port, and out-of-range ones, to free ports")
+	aggregateStatsCmd.Flags().String("since", "", "Recompute days with connection activity since this date, YYYY-MM-DD (default yesterday)")
+	aggregateStatsCmd.Flags().Bool("all", false, "Recompute every day ever logged")
 	// Add database command to root
 	rootCmd.AddCommand(databaseCmd)
 }
+
+// recordAudit records an action taken by a database command in the audit log,
+// as the operating system user running it. A failure to record it is reported
+// on stderr but does not fail the command, which has already acted.
+func recordAudit(service *database.Service, action, target string, actionErr error, metadata map[string]any) {
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor += ":" + u.Username
+	} else if name := os.Getenv("USER"); name != "" {
+		actor += ":" + name
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	event := database.NewAuditEvent(actor, action, target, actionErr, metadata)
+	if err := service.RecordAuditEvent(ctx, event); err != nil {
+		fmt.Fprintf(os.Stderr, "⚠️  Failed to record %s in the audit log: %v\n", action, err)
+	}
+}
+
+// portNumbers lists the ports of assignments
+func portNumbers(assignments []database.PortAssignment) []int {
+	ports := make([]int, 0, len(assignments))
+	for _, pa := range assignments {
+		ports = append(ports, pa.Port)
+	}
+	return ports
+}
+
+// outputJSON reports whether --output asks for JSON instead of the default table
+// and text output
+func outputJSON(cmd *cobra.Command) (bool, error) {
+	output, _ := cmd.Flags().GetString("output")
+	switch output {
+	case "table":
+		return false, nil
+	case "json":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid --output %q (use table or json)", output)
+	}
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -1,11 +1,15 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"rabbit.go/internal/middleware"
 	"rabbit.go/internal/server"
 
 	"github.com/spf13/cobra"
@@ -16,6 +20,48 @@ var (
 	controlPort string
 	logLevel    string
 	apiPort     string
+	httpPort    string
+	domain      string
+	tlsCertFile string
+	tlsKeyFile  string
+	configFile  string
+
+	tunnelIdleTimeout    time.Duration
+	maxTunnelLifetime    time.Duration
+	tokenCleanupInterval time.Duration
+	statsInterval        time.Duration
+	compression          bool
+	dataConnTimeout      time.Duration
+	controlWriteTimeout  time.Duration
+	maxControlMessage    int
+	maxConnsPerTunnel    int
+	detectHTTP           bool
+	accessLogFile        string
+	notice               string
+	noticeFile           string
+	maxRequestBody       int64
+	generateRateLimit    int
+	bridgeBufferSize     int
+	reassignBusyPorts    bool
+	allowTakeover        bool
+	maxReconnects        int
+	pendingRegistry      string
+	instanceID           string
+	dbConnectAttempts    int
+	dbConnectBackoff     time.Duration
+	shutdownTimeout      time.Duration
+
+	maxConnsPerIP    int
+	maxConnsPerHour  int
+	maxGlobalConns   int
+	handshakeTimeout time.Duration
+	tcpKeepAlive     time.Duration
+	tcpNoDelay       bool
+	geoIPDatabase    string
+	asnDatabase      string
+	blockedCountries []string
+	allowedCountries []string
+	blockedASNs      []uint
 )
 
 func init() {
@@ -30,8 +76,9 @@ Examples:
   # Start server with tunnel and API endpoints
   rabbit.go server --bind 0.0.0.0 --port 9999 --api-port 8080
   
-  # Generate tokens via API instead of CLI
+  # Generate tokens via API instead of CLI (set API_ADMIN_KEY to require the bearer key)
   curl -X POST http://localhost:8080/api/v1/tokens/generate \
+    -H "Authorization: Bearer $API_ADMIN_KEY" \
     -H "Content-Type: application/json" \
     -d '{"team_id":"your-team-id","name":"my-token","description":"API generated token"}'`,
 		RunE: runServer,
@@ -40,22 +87,62 @@ Examples:
 	serverCmd.Flags().StringVar(&bindAddress, "bind", "0.0.0.0", "Address to bind the control server to")
 	serverCmd.Flags().StringVar(&controlPort, "port", "9999", "Control port for tunnel connections")
 	serverCmd.Flags().StringVar(&apiPort, "api-port", "8080", "HTTP API port for management endpoints")
+	serverCmd.Flags().Int64Var(&maxRequestBody, "max-request-body", server.DefaultMaxRequestBodyBytes, "Largest API request body in bytes; larger requests get a 413")
+	serverCmd.Flags().IntVar(&generateRateLimit, "generate-rate-limit", server.DefaultGenerateRateLimit, "Token generation API requests allowed per client IP per minute; more get a 429 (0 = unlimited)")
+	serverCmd.Flags().StringVar(&httpPort, "http-port", "", "Shared HTTP(S) port for subdomain-routed tunnels, e.g. 443 (empty disables)")
+	serverCmd.Flags().StringVar(&domain, "domain", "", "Base domain for subdomain routing; tunnels are reached at <subdomain>.<domain>")
+	serverCmd.Flags().StringVar(&tlsCertFile, "tls-cert", "", "TLS certificate file for control and data connections (enables TLS with --tls-key)")
+	serverCmd.Flags().StringVar(&tlsKeyFile, "tls-key", "", "TLS private key file for control and data connections")
+	serverCmd.Flags().DurationVar(&tunnelIdleTimeout, "tunnel-idle-timeout", 0, "Close tunnels with no active connections for this long, e.g. 30m (0 disables)")
+	serverCmd.Flags().DurationVar(&maxTunnelLifetime, "max-tunnel-lifetime", 0, "Close tunnels this long after creation regardless of activity, e.g. 12h; clients reconnect with a fresh session (0 disables)")
+	serverCmd.Flags().DurationVar(&tokenCleanupInterval, "token-cleanup-interval", 5*time.Minute, "How often expired tokens are deactivated and their ports released (0 disables)")
+	serverCmd.Flags().DurationVar(&statsInterval, "stats-interval", time.Hour, "How often connection logs are rolled up into the daily connection_stats (0 disables)")
+	serverCmd.Flags().BoolVar(&compression, "compression", true, "Let clients that ask for it compress tcp data connections")
+	serverCmd.Flags().DurationVar(&dataConnTimeout, "data-conn-timeout", server.DefaultDataConnTimeout, "How long an external connection waits for the client's data connection")
+	serverCmd.Flags().DurationVar(&controlWriteTimeout, "control-write-timeout", server.DefaultControlWriteTimeout, "How long a write to a client's control connection may block before the connection is closed")
+	serverCmd.Flags().IntVar(&maxControlMessage, "max-control-message", server.DefaultMaxControlMessage, "Largest frame payload in bytes a client may send on a control connection; larger ones close the connection")
+	serverCmd.Flags().IntVar(&maxConnsPerTunnel, "max-conns-per-tunnel", 0, "Maximum concurrent external connections per tcp tunnel; further ones are closed (0 = unlimited)")
+	serverCmd.Flags().BoolVar(&detectHTTP, "detect-http", true, "Log tcp tunnel connections that start with an HTTP request as protocol http, with the request's path and user agent")
+	serverCmd.Flags().StringVar(&accessLogFile, "access-log", "", "File to append a Combined Log Format line to for every HTTP request made through a tunnel (empty disables)")
+	serverCmd.Flags().StringVar(&notice, "notice", "", "Message, e.g. about a maintenance window, sent to clients when they connect and shown by them (empty sends nothing)")
+	serverCmd.Flags().StringVar(&noticeFile, "notice-file", "", "File to read the notice from instead of --notice; it is reread on reload")
+	serverCmd.Flags().IntVar(&bridgeBufferSize, "bridge-buffer-size", server.DefaultBridgeBufferSize, "Bytes per copy buffer for bridged connections; raise it, e.g. to 262144, for high-bandwidth, high-latency links")
+	serverCmd.Flags().BoolVar(&reassignBusyPorts, "reassign-busy-ports", false, "Move a tunnel to another free port when its assigned port is bound by another process (default fails the request)")
+	serverCmd.Flags().BoolVar(&allowTakeover, "allow-takeover", true, "Let a client take over a tunnel another client with the same token is connected to; false rejects it with \"tunnel already active\"")
+	serverCmd.Flags().IntVar(&maxReconnects, "max-reconnects-per-minute", 30, "Handshakes one token may make per minute before further ones are rejected as reconnecting too fast (0 = unlimited)")
+	serverCmd.Flags().StringVar(&pendingRegistry, "pending-registry", server.PendingRegistryMemory, "Where pending data connections are registered: memory, or redis to record which instance holds each (data connections are not routed between instances)")
+	serverCmd.Flags().StringVar(&instanceID, "instance-id", "", "Identifies this server instance in shared state (defaults to the hostname)")
+	serverCmd.Flags().IntVar(&dbConnectAttempts, "db-connect-attempts", server.DefaultDBConnectAttempts, "Attempts to reach PostgreSQL and Redis at startup before giving up")
+	serverCmd.Flags().DurationVar(&dbConnectBackoff, "db-connect-backoff", server.DefaultDBConnectBackoff, "Wait after the first failed database attempt, doubled after each further one (max 30s)")
+	serverCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long a shutdown waits for tunnel connections and API requests to finish before closing them")
 	serverCmd.Flags().StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn, error)")
+	serverCmd.Flags().StringVar(&configFile, "config", ".env", "Env file with the settings reloaded on SIGHUP (LOG_LEVEL, MAX_CONNS_PER_IP, DATA_CONN_TIMEOUT, ...); flags given on the command line take precedence")
+
+	// Security middleware flags
+	defaults := middleware.DefaultSecurityConfig()
+	serverCmd.Flags().IntVar(&maxConnsPerIP, "max-conns-per-ip", defaults.MaxConnectionsPerIP, "Maximum concurrent connections per client IP")
+	serverCmd.Flags().IntVar(&maxConnsPerHour, "max-conns-per-hour", defaults.MaxConnectionsPerHour, "Maximum new connections per client IP per hour")
+	serverCmd.Flags().IntVar(&maxGlobalConns, "max-global-conns", defaults.MaxGlobalConnections, "Maximum concurrent connections across all clients")
+	serverCmd.Flags().StringVar(&geoIPDatabase, "geoip-db", "", "MaxMind GeoLite2 Country or City .mmdb file for --blocked-countries and --allowed-countries")
+	serverCmd.Flags().StringVar(&asnDatabase, "asn-db", "", "MaxMind GeoLite2 ASN .mmdb file for --blocked-asns")
+	serverCmd.Flags().StringSliceVar(&blockedCountries, "blocked-countries", nil, "ISO country codes whose connections are rejected, e.g. KP,IR (needs --geoip-db)")
+	serverCmd.Flags().StringSliceVar(&allowedCountries, "allowed-countries", nil, "Only accept connections from these ISO country codes (needs --geoip-db)")
+	serverCmd.Flags().UintSliceVar(&blockedASNs, "blocked-asns", nil, "Autonomous system numbers whose connections are rejected, e.g. 64496,64511 (needs --asn-db)")
+	serverCmd.Flags().DurationVar(&handshakeTimeout, "handshake-timeout", defaults.HandshakeTimeout, "How long a new control or data connection has to send its first message before it is closed")
+	serverCmd.Flags().DurationVar(&tcpKeepAlive, "tcp-keepalive", defaults.KeepAlive, "TCP keepalive probe interval; quiet connections stay open while the peer answers (0 closes connections idle for 5m instead)")
+	serverCmd.Flags().BoolVar(&tcpNoDelay, "tcp-nodelay", true, "Send small writes at once instead of coalescing them (set false to enable Nagle's algorithm)")
 
 	rootCmd.AddCommand(serverCmd)
 }
 
 func runServer(cmd *cobra.Command, args []string) error {
-	// Create server configuration
-	config := server.Config{
-		BindAddress: bindAddress,
-		ControlPort: controlPort,
-		LogLevel:    logLevel,
-		APIPort:     apiPort,
+	fixed := fixedFlags(cmd)
+	if err := applyConfigFile(cmd, configFile, fixed); err != nil {
+		return err
 	}
 
 	// Create and start server
-	srv, err := server.NewServer(config)
+	srv, err := server.NewServer(serverConfig())
 	if err != nil {
 		return fmt.Errorf("error creating server: %v", err)
 	}
@@ -64,25 +151,104 @@ func runServer(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("error starting server: %v", err)
 	}
 
-	// Handle interrupt signal for graceful shutdown
+	// Handle interrupt signal for graceful shutdown, and SIGHUP to reload settings
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 
 	fmt.Printf("Tunnel server is running on %s:%s\n", bindAddress, controlPort)
+	if httpPort != "" {
+		fmt.Printf("Subdomain routing for *.%s is running on %s:%s\n", domain, bindAddress, httpPort)
+	}
 	if apiPort != "" {
 		fmt.Printf("API server is running on %s:%s\n", bindAddress, apiPort)
 		fmt.Printf("API endpoints:\n")
 		fmt.Printf("  POST http://%s:%s/api/v1/tokens/generate - Generate new token\n", bindAddress, apiPort)
 		fmt.Printf("  GET  http://%s:%s/api/v1/teams/:teamId/tokens - Get token details\n", bindAddress, apiPort)
 		fmt.Printf("  GET  http://%s:%s/api/v1/teams - List teams with tokens\n", bindAddress, apiPort)
+		fmt.Printf("  POST http://%s:%s/api/v1/teams - Create a team\n", bindAddress, apiPort)
+		fmt.Printf("  DELETE http://%s:%s/api/v1/teams/:teamId - Delete a team\n", bindAddress, apiPort)
+		fmt.Printf("  PUT  http://%s:%s/api/v1/teams/:teamId/quota - Set a team's quotas\n", bindAddress, apiPort)
+		fmt.Printf("  GET  http://%s:%s/api/v1/teams/:teamId/connections - List connection logs\n", bindAddress, apiPort)
 		fmt.Printf("  GET  http://%s:%s/api/v1/health - Health check\n", bindAddress, apiPort)
+		fmt.Printf("  GET  http://%s:%s/api/v1/usage - A team's own usage (tunnel token)\n", bindAddress, apiPort)
+		fmt.Printf("  GET  http://%s:%s/api/v1/tunnels - Live tunnels\n", bindAddress, apiPort)
 		fmt.Printf("  GET  http://%s:%s/api/v1/stats - Database statistics\n", bindAddress, apiPort)
+		fmt.Printf("  GET  http://%s:%s/api/v1/security - Security statistics\n", bindAddress, apiPort)
+		fmt.Printf("  GET  ws://%s:%s/api/v1/events - Live event stream (WebSocket)\n", bindAddress, apiPort)
 	}
-	fmt.Printf("Press Ctrl+C to stop.\n")
+	fmt.Printf("Press Ctrl+C to stop; send SIGHUP to reload settings from %s.\n", configFile)
 
-	// Wait for interrupt signal
-	<-sigChan
+	// Wait for interrupt signal, reloading settings from the config file on SIGHUP
+	for {
+		select {
+		case <-hupChan:
+			if err := applyConfigFile(cmd, configFile, fixed); err != nil {
+				slog.Error("config reload failed; keeping the current settings", "error", err)
+				continue
+			}
+			if err := srv.Reload(serverConfig()); err != nil {
+				slog.Error("config reload failed; keeping the current settings", "error", err)
+			}
+		case <-sigChan:
+			fmt.Printf("\nStopping server...\n")
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			return srv.Shutdown(ctx)
+		}
+	}
+}
+
+// serverConfig builds the server configuration from the flags
+func serverConfig() server.Config {
+	// Create security configuration
+	securityConfig := middleware.DefaultSecurityConfig()
+	securityConfig.MaxConnectionsPerIP = maxConnsPerIP
+	securityConfig.MaxConnectionsPerHour = maxConnsPerHour
+	securityConfig.MaxGlobalConnections = maxGlobalConns
+	securityConfig.HandshakeTimeout = handshakeTimeout
+	securityConfig.KeepAlive = tcpKeepAlive
+	securityConfig.GeoIPDatabase = geoIPDatabase
+	securityConfig.ASNDatabase = asnDatabase
+	securityConfig.BlockedCountries = blockedCountries
+	securityConfig.AllowedCountries = allowedCountries
+	securityConfig.BlockedASNs = blockedASNs
+
+	return server.Config{
+		BindAddress: bindAddress,
+		ControlPort: controlPort,
+		LogLevel:    logLevel,
+		APIPort:     apiPort,
+		HTTPPort:    httpPort,
+		Domain:      domain,
+		TLSCertFile: tlsCertFile,
+		TLSKeyFile:  tlsKeyFile,
+		Security:    &securityConfig,
 
-	fmt.Printf("\nStopping server...\n")
-	return srv.Stop()
+		TunnelIdleTimeout:    tunnelIdleTimeout,
+		MaxTunnelLifetime:    maxTunnelLifetime,
+		TokenCleanupInterval: tokenCleanupInterval,
+		StatsInterval:        statsInterval,
+		Compression:          compression,
+		DataConnTimeout:      dataConnTimeout,
+		ControlWriteTimeout:  controlWriteTimeout,
+		MaxControlMessage:    maxControlMessage,
+		MaxConnsPerTunnel:    maxConnsPerTunnel,
+		DetectHTTP:           detectHTTP,
+		AccessLog:            accessLogFile,
+		Notice:               notice,
+		NoticeFile:           noticeFile,
+		MaxRequestBodyBytes:  maxRequestBody,
+		GenerateRateLimit:    generateRateLimit,
+		BridgeBufferSize:     bridgeBufferSize,
+		ReassignBusyPorts:    reassignBusyPorts,
+		AllowTakeover:        allowTakeover,
+		ReconnectsPerMinute:  maxReconnects,
+		TCPNoDelay:           tcpNoDelay,
+		PendingRegistry:      pendingRegistry,
+		InstanceID:           instanceID,
+		DBConnectAttempts:    dbConnectAttempts,
+		DBConnectBackoff:     dbConnectBackoff,
+	}
 }
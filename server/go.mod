@@ -10,10 +10,20 @@ require (
 	github.com/spf13/cobra v1.8.0
 )
 
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/oschwald/maxminddb-golang v1.13.1
+)
+
+require golang.org/x/sys v0.21.0 // indirect
+
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/joho/godotenv v1.5.1
 	github.com/spf13/pflag v1.0.5 // indirect
+	rabbit.go/protocol v0.0.0-00010101000000-000000000000
 )
+
+replace rabbit.go/protocol => ../protocol
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// redisBreakerCooldown is how long optional Redis calls are skipped after a failure
+// before Redis is tried again
+const redisBreakerCooldown = 30 * time.Second
+
+// ErrRedisUnavailable is returned by optional Redis calls skipped while Redis is down
+var ErrRedisUnavailable = errors.New("redis unavailable")
+
+// redisBreaker is a circuit breaker for Redis calls that are only an optimization,
+// such as port locks. After a failure it opens for a cooldown so callers skip Redis
+// instead of each waiting out its own timeout; the first call after the cooldown
+// probes Redis again. The zero value is closed.
+type redisBreaker struct {
+	what      string // What is skipped while the breaker is open, for logs
+	mu        sync.Mutex
+	openUntil time.Time
+	open      bool
+}
+
+// allow reports whether a Redis call should be attempted
+func (b *redisBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open || !time.Now().Before(b.openUntil)
+}
+
+// record updates the breaker with the outcome of a Redis call
+func (b *redisBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.open {
+			b.open = false
+			slog.Info("Redis is reachable again; " + b.what + " re-enabled")
+		}
+		return
+	}
+
+	if !b.open {
+		slog.Warn("Redis call failed; continuing without "+b.what, "cooldown", redisBreakerCooldown, "error", err)
+	}
+	b.open = true
+	b.openUntil = time.Now().Add(redisBreakerCooldown)
+}
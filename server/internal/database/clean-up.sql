@@ -33,6 +33,7 @@ DROP INDEX IF EXISTS idx_team_tokens_active;
 DROP INDEX IF EXISTS idx_port_assignments_team_id;
 DROP INDEX IF EXISTS idx_port_assignments_token_id;
 DROP INDEX IF EXISTS idx_port_assignments_port;
+DROP INDEX IF EXISTS idx_port_assignments_subdomain;
 DROP INDEX IF EXISTS idx_connection_sessions_team_id;
 DROP INDEX IF EXISTS idx_connection_sessions_token_id;
 DROP INDEX IF EXISTS idx_connection_sessions_status;
@@ -4,8 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,19 +24,92 @@ type Database struct {
 	DB    *sql.DB
 	Redis *redis.Client
 	ctx   context.Context
+
+	// portLocks guards the Redis port lock calls, which Postgres can do without
+	portLocks redisBreaker
+
+	// pendingConns guards the shared pending connection calls, which only
+	// inform other instances
+	pendingConns redisBreaker
+
+	keyPrefix  string
+	sessionTTL time.Duration
+
+	// Token expiry policy in days; see Config
+	tokenDefaultExpiryDays int
+	tokenMaxExpiryDays     int
 }
 
+// defaultSessionTTL is how long an active session is kept in Redis unless
+// SESSION_TIMEOUT says otherwise
+const defaultSessionTTL = 24 * time.Hour
+
+// PostgreSQL pool defaults, overridable through DB_MAX_OPEN_CONNS,
+// DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME
+const (
+	defaultMaxOpenConns    = 25
+	defaultMaxIdleConns    = 5
+	defaultConnMaxLifetime = 5 * time.Minute
+	defaultConnMaxIdleTime = time.Minute
+)
+
 // Config holds database configuration
 type Config struct {
 	PostgresURL string
 	RedisURL    string
 	RedisDB     int
+
+	// KeyPrefix is prepended to every Redis key, so several environments can
+	// share one Redis without seeing each other's keys
+	KeyPrefix string
+
+	// SessionTTL is how long an active session is kept in Redis; 0 means 24h
+	SessionTTL time.Duration
+
+	// PostgreSQL connection pool. As with database/sql, 0 means no limit for
+	// MaxOpenConns and the two durations, and no idle connections for MaxIdleConns.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// TokenDefaultExpiryDays is the expiry given to tokens requested without one;
+	// 0 leaves them without expiry unless TokenMaxExpiryDays is set, in which
+	// case they get the maximum. TokenMaxExpiryDays is the longest expiry a token
+	// may be given; 0 means no limit.
+	TokenDefaultExpiryDays int
+	TokenMaxExpiryDays     int
+}
+
+// Validate checks the pool settings, so a bad value fails startup instead of being
+// silently adjusted by database/sql
+func (c Config) Validate() error {
+	if c.MaxOpenConns < 0 || c.MaxIdleConns < 0 {
+		return fmt.Errorf("database pool sizes must not be negative (max open %d, max idle %d)", c.MaxOpenConns, c.MaxIdleConns)
+	}
+	if c.MaxOpenConns > 0 && c.MaxIdleConns > c.MaxOpenConns {
+		return fmt.Errorf("DB_MAX_IDLE_CONNS (%d) must not exceed DB_MAX_OPEN_CONNS (%d)", c.MaxIdleConns, c.MaxOpenConns)
+	}
+	if c.ConnMaxLifetime < 0 || c.ConnMaxIdleTime < 0 {
+		return fmt.Errorf("database connection lifetimes must not be negative")
+	}
+	if c.TokenDefaultExpiryDays < 0 || c.TokenMaxExpiryDays < 0 {
+		return fmt.Errorf("token expiry days must not be negative")
+	}
+	if c.TokenMaxExpiryDays > 0 && c.TokenDefaultExpiryDays > c.TokenMaxExpiryDays {
+		return fmt.Errorf("TOKEN_DEFAULT_EXPIRY_DAYS (%d) must not exceed TOKEN_MAX_EXPIRY_DAYS (%d)", c.TokenDefaultExpiryDays, c.TokenMaxExpiryDays)
+	}
+	return nil
 }
 
 // NewDatabase creates a new database instance
 func NewDatabase(config Config) (*Database, error) {
 	ctx := context.Background()
 
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
 	// Connect to PostgreSQL
 	db, err := sql.Open("postgres", config.PostgresURL)
 	if err != nil {
@@ -40,17 +118,20 @@ func NewDatabase(config Config) (*Database, error) {
 
 	// Test PostgreSQL connection
 	if err := db.PingContext(ctx); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping PostgreSQL: %w", err)
 	}
 
 	// Configure connection pool
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(5 * time.Minute)
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
 
 	// Connect to Redis
 	opt, err := redis.ParseURL(config.RedisURL)
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
 	}
 
@@ -62,16 +143,146 @@ func NewDatabase(config Config) (*Database, error) {
 
 	// Test Redis connection
 	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		db.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
+	sessionTTL := config.SessionTTL
+	if sessionTTL <= 0 {
+		sessionTTL = defaultSessionTTL
+	}
+
 	return &Database{
-		DB:    db,
-		Redis: rdb,
-		ctx:   ctx,
+		DB:         db,
+		Redis:      rdb,
+		ctx:        ctx,
+		keyPrefix:  config.KeyPrefix,
+		sessionTTL: sessionTTL,
+
+		portLocks:    redisBreaker{what: "port locks"},
+		pendingConns: redisBreaker{what: "shared pending connections"},
+
+		tokenDefaultExpiryDays: config.TokenDefaultExpiryDays,
+		tokenMaxExpiryDays:     config.TokenMaxExpiryDays,
 	}, nil
 }
 
+// HealthReport is the result of checking PostgreSQL and Redis. Each check runs
+// on its own, so one dependency being down does not hide the state of the other.
+type HealthReport struct {
+	Status string       `json:"status"` // healthy or unhealthy
+	Checks HealthChecks `json:"checks"`
+}
+
+// HealthChecks holds the individual checks of a HealthReport
+type HealthChecks struct {
+	Postgres HealthCheck `json:"postgres"` // PostgreSQL ping
+	Redis    HealthCheck `json:"redis"`    // Redis ping
+	Query    HealthCheck `json:"query"`    // A query against the Team table
+}
+
+// HealthCheck is the outcome of one check
+type HealthCheck struct {
+	Status    string  `json:"status"` // ok or fail
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+
+	err error
+}
+
+// Healthy reports whether every check passed
+func (r *HealthReport) Healthy() bool {
+	return r.Status == "healthy"
+}
+
+// Err returns the first failed check as an error, or nil when healthy
+func (r *HealthReport) Err() error {
+	switch {
+	case r.Checks.Postgres.err != nil:
+		return fmt.Errorf("database connection failed: %w", r.Checks.Postgres.err)
+	case r.Checks.Redis.err != nil:
+		return fmt.Errorf("redis connection failed: %w", r.Checks.Redis.err)
+	case r.Checks.Query.err != nil:
+		return fmt.Errorf("database query failed: %w", r.Checks.Query.err)
+	}
+	return nil
+}
+
+// runHealthCheck times fn and records its outcome
+func runHealthCheck(fn func() error) HealthCheck {
+	start := time.Now()
+	err := fn()
+	check := HealthCheck{
+		Status:    "ok",
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		err:       err,
+	}
+	if err != nil {
+		check.Status = "fail"
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// checkHealth pings PostgreSQL and Redis and runs a query against the Team table.
+// A nil db or rdb is reported as a failed check with dbErr or redisErr.
+func checkHealth(ctx context.Context, db *sql.DB, dbErr error, rdb *redis.Client, redisErr error) *HealthReport {
+	report := &HealthReport{Status: "healthy"}
+
+	report.Checks.Postgres = runHealthCheck(func() error {
+		if db == nil {
+			return dbErr
+		}
+		return db.PingContext(ctx)
+	})
+	report.Checks.Redis = runHealthCheck(func() error {
+		if rdb == nil {
+			return redisErr
+		}
+		return rdb.Ping(ctx).Err()
+	})
+	if report.Checks.Postgres.err != nil {
+		report.Checks.Query = runHealthCheck(func() error {
+			return errors.New("skipped: postgres unreachable")
+		})
+	} else {
+		report.Checks.Query = runHealthCheck(func() error {
+			var count int
+			return db.QueryRowContext(ctx, "SELECT COUNT(*) FROM public.\"Team\"").Scan(&count)
+		})
+	}
+
+	if report.Err() != nil {
+		report.Status = "unhealthy"
+	}
+	return report
+}
+
+// CheckHealth connects to PostgreSQL and Redis and checks them like
+// Service.HealthCheck, without NewDatabase failing as soon as one is unreachable
+func CheckHealth(ctx context.Context, config Config) *HealthReport {
+	// sql.Open only validates its arguments; connecting happens on the first ping
+	db, dbErr := sql.Open("postgres", config.PostgresURL)
+	if dbErr == nil {
+		defer db.Close()
+	} else {
+		db = nil
+	}
+
+	var rdb *redis.Client
+	opt, redisErr := redis.ParseURL(config.RedisURL)
+	if redisErr == nil {
+		if config.RedisDB > 0 {
+			opt.DB = config.RedisDB
+		}
+		rdb = redis.NewClient(opt)
+		defer rdb.Close()
+	}
+
+	return checkHealth(ctx, db, dbErr, rdb, redisErr)
+}
+
 // Close closes all database connections
 func (d *Database) Close() error {
 	if err := d.Redis.Close(); err != nil {
@@ -104,23 +315,13 @@ func (d *Database) CleanUp() error {
 	return nil
 }
 
-// RunMigrations runs the database migrations
-func (d *Database) RunMigrations(path string) error {
-	migrationFile := path
-
-	// Read migration file
-	migrationSQL, err := os.ReadFile(migrationFile)
+// RunMigrations applies every pending migration in dir
+func (d *Database) RunMigrations(dir string) error {
+	migrations, err := LoadMigrations(dir)
 	if err != nil {
-		return fmt.Errorf("failed to read migration file: %w", err)
-	}
-
-	// Execute migration
-	_, err = d.DB.ExecContext(d.ctx, string(migrationSQL))
-	if err != nil {
-		return fmt.Errorf("failed to run migrations: %w", err)
+		return err
 	}
-
-	return nil
+	return d.MigrateTo(migrations, migrations[len(migrations)-1].Version)
 }
 
 // GetConfigFromEnv loads database configuration from environment variables
@@ -132,11 +333,36 @@ func GetConfigFromEnv() Config {
 		// where environment variables are passed via --env-file or -e flags
 	}
 
-	return Config{
+	config := Config{
 		PostgresURL: getEnvOrDefault("DATABASE_URL", "postgres://localhost/syne_tunneler?sslmode=disable"),
 		RedisURL:    getEnvOrDefault("REDIS_URL", "redis://localhost:6379"),
 		RedisDB:     0,
+		SessionTTL:  defaultSessionTTL,
+
+		MaxOpenConns:    getEnvIntOrDefault("DB_MAX_OPEN_CONNS", defaultMaxOpenConns),
+		MaxIdleConns:    getEnvIntOrDefault("DB_MAX_IDLE_CONNS", defaultMaxIdleConns),
+		ConnMaxLifetime: getEnvDurationOrDefault("DB_CONN_MAX_LIFETIME", defaultConnMaxLifetime),
+		ConnMaxIdleTime: getEnvDurationOrDefault("DB_CONN_MAX_IDLE_TIME", defaultConnMaxIdleTime),
+
+		TokenDefaultExpiryDays: getEnvIntOrDefault("TOKEN_DEFAULT_EXPIRY_DAYS", 0),
+		TokenMaxExpiryDays:     getEnvIntOrDefault("TOKEN_MAX_EXPIRY_DAYS", 0),
+	}
+
+	// RABBIT_ENV namespaces the Redis keys, e.g. staging:session:<id>
+	if env := os.Getenv("RABBIT_ENV"); env != "" {
+		config.KeyPrefix = env + ":"
+	}
+
+	if value := os.Getenv("SESSION_TIMEOUT"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			slog.Warn("invalid SESSION_TIMEOUT, using the default", "value", value, "default", defaultSessionTTL.String())
+		} else {
+			config.SessionTTL = ttl
+		}
 	}
+
+	return config
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -146,6 +372,36 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvIntOrDefault reads a non-negative integer, warning about and ignoring
+// values that do not parse
+func getEnvIntOrDefault(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		slog.Warn("invalid "+key+", using the default", "value", value, "default", defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// getEnvDurationOrDefault reads a non-negative duration such as 5m, warning about
+// and ignoring values that do not parse
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		slog.Warn("invalid "+key+", using the default", "value", value, "default", defaultValue.String())
+		return defaultValue
+	}
+	return d
+}
+
 // Utility functions for common database operations
 
 // BeginTx starts a new transaction
@@ -179,24 +435,34 @@ func (d *Database) WithTx(ctx context.Context, fn func(*sql.Tx) error) error {
 
 // Redis helper methods
 
+// KeyPrefix returns the prefix of every Redis key, empty unless RABBIT_ENV is set
+func (d *Database) KeyPrefix() string {
+	return d.keyPrefix
+}
+
+// key builds a Redis key within the configured prefix
+func (d *Database) key(format string, args ...any) string {
+	return d.keyPrefix + fmt.Sprintf(format, args...)
+}
+
 // SetCache sets a value in Redis cache with expiration
 func (d *Database) SetCache(key string, value interface{}, expiration time.Duration) error {
-	return d.Redis.Set(d.ctx, key, value, expiration).Err()
+	return d.Redis.Set(d.ctx, d.keyPrefix+key, value, expiration).Err()
 }
 
 // GetCache gets a value from Redis cache
 func (d *Database) GetCache(key string) (string, error) {
-	return d.Redis.Get(d.ctx, key).Result()
+	return d.Redis.Get(d.ctx, d.keyPrefix+key).Result()
 }
 
 // DeleteCache deletes a key from Redis cache
 func (d *Database) DeleteCache(key string) error {
-	return d.Redis.Del(d.ctx, key).Err()
+	return d.Redis.Del(d.ctx, d.keyPrefix+key).Err()
 }
 
 // SetActiveSession sets an active connection session in Redis
 func (d *Database) SetActiveSession(sessionID uuid.UUID, data interface{}) error {
-	key := fmt.Sprintf("session:%s", sessionID.String())
+	key := d.key("session:%s", sessionID.String())
 
 	// Serialize data to JSON before storing in Redis
 	jsonData, err := json.Marshal(data)
@@ -204,42 +470,228 @@ func (d *Database) SetActiveSession(sessionID uuid.UUID, data interface{}) error
 		return fmt.Errorf("failed to marshal session data: %w", err)
 	}
 
-	return d.Redis.Set(d.ctx, key, jsonData, 24*time.Hour).Err()
+	return d.Redis.Set(d.ctx, key, jsonData, d.sessionTTL).Err()
 }
 
 // GetActiveSession gets an active connection session from Redis
 func (d *Database) GetActiveSession(sessionID uuid.UUID) (string, error) {
-	key := fmt.Sprintf("session:%s", sessionID.String())
+	key := d.key("session:%s", sessionID.String())
 	return d.Redis.Get(d.ctx, key).Result()
 }
 
 // DeleteActiveSession deletes an active session from Redis
 func (d *Database) DeleteActiveSession(sessionID uuid.UUID) error {
-	key := fmt.Sprintf("session:%s", sessionID.String())
+	key := d.key("session:%s", sessionID.String())
+	return d.Redis.Del(d.ctx, key).Err()
+}
+
+// SetReconnectToken stores a reconnect token in Redis
+func (d *Database) SetReconnectToken(reconnectToken string, data ReconnectToken, expiration time.Duration) error {
+	key := d.key("reconnect:%s", reconnectToken)
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reconnect token: %w", err)
+	}
+
+	return d.Redis.Set(d.ctx, key, jsonData, expiration).Err()
+}
+
+// GetReconnectToken gets a reconnect token from Redis
+func (d *Database) GetReconnectToken(reconnectToken string) (*ReconnectToken, error) {
+	key := d.key("reconnect:%s", reconnectToken)
+	jsonData, err := d.Redis.Get(d.ctx, key).Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var data ReconnectToken
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reconnect token: %w", err)
+	}
+	return &data, nil
+}
+
+// RefreshReconnectToken extends the expiry of a reconnect token in Redis
+func (d *Database) RefreshReconnectToken(reconnectToken string, expiration time.Duration) error {
+	key := d.key("reconnect:%s", reconnectToken)
+	return d.Redis.Expire(d.ctx, key, expiration).Err()
+}
+
+// DeleteReconnectToken deletes a reconnect token from Redis
+func (d *Database) DeleteReconnectToken(reconnectToken string) error {
+	key := d.key("reconnect:%s", reconnectToken)
 	return d.Redis.Del(d.ctx, key).Err()
 }
 
-// IncrementCounter increments a counter in Redis
-func (d *Database) IncrementCounter(key string) (int64, error) {
-	return d.Redis.Incr(d.ctx, key).Result()
+// CountInWindow counts an event under name in the current fixed window of the
+// given length, returning the count so far and how long until the window ends.
+// Each window's counter expires shortly after the window ends.
+func (d *Database) CountInWindow(name string, window time.Duration) (int64, time.Duration, error) {
+	now := time.Now().UnixNano()
+	index := now / int64(window)
+	count, err := d.IncrementCounter(fmt.Sprintf("%s:%d", name, index), 2*window)
+	return count, time.Duration((index+1)*int64(window) - now), err
 }
 
-// SetPortLock sets a port lock in Redis to prevent concurrent port assignments
+// SetPendingConn records which server instance holds a pending connection. It
+// returns ErrRedisUnavailable without calling Redis while Redis is failing.
+func (d *Database) SetPendingConn(connID, instanceID string, expiration time.Duration) error {
+	if !d.pendingConns.allow() {
+		return ErrRedisUnavailable
+	}
+	key := d.key("pending_conn:%s", connID)
+	err := d.Redis.Set(d.ctx, key, instanceID, expiration).Err()
+	d.pendingConns.record(err)
+	return err
+}
+
+// GetPendingConnOwner gets the server instance holding a pending connection. It
+// returns ErrRedisUnavailable without calling Redis while Redis is failing.
+func (d *Database) GetPendingConnOwner(connID string) (string, error) {
+	if !d.pendingConns.allow() {
+		return "", ErrRedisUnavailable
+	}
+	key := d.key("pending_conn:%s", connID)
+	owner, err := d.Redis.Get(d.ctx, key).Result()
+	if err != redis.Nil {
+		d.pendingConns.record(err)
+	}
+	return owner, err
+}
+
+// DeletePendingConn deletes a pending connection from Redis. It returns
+// ErrRedisUnavailable without calling Redis while Redis is failing; the entry
+// then lapses with its TTL.
+func (d *Database) DeletePendingConn(connID string) error {
+	if !d.pendingConns.allow() {
+		return ErrRedisUnavailable
+	}
+	key := d.key("pending_conn:%s", connID)
+	err := d.Redis.Del(d.ctx, key).Err()
+	d.pendingConns.record(err)
+	return err
+}
+
+// IncrementCounter increments a counter in Redis, resetting its expiry when
+// expiration is set
+func (d *Database) IncrementCounter(key string, expiration time.Duration) (int64, error) {
+	key = d.keyPrefix + key
+	pipe := d.Redis.TxPipeline()
+	incr := pipe.Incr(d.ctx, key)
+	if expiration > 0 {
+		pipe.Expire(d.ctx, key, expiration)
+	}
+	if _, err := pipe.Exec(d.ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// SetPortLock sets a port lock in Redis to prevent concurrent port assignments.
+// It returns ErrRedisUnavailable without calling Redis while Redis is failing.
 func (d *Database) SetPortLock(port int, tokenID uuid.UUID, expiration time.Duration) error {
-	key := fmt.Sprintf("port_lock:%d", port)
-	return d.Redis.SetNX(d.ctx, key, tokenID.String(), expiration).Err()
+	if !d.portLocks.allow() {
+		return ErrRedisUnavailable
+	}
+	key := d.key("port_lock:%d", port)
+	err := d.Redis.SetNX(d.ctx, key, tokenID.String(), expiration).Err()
+	d.portLocks.record(err)
+	return err
 }
 
-// ReleasePortLock releases a port lock in Redis
-func (d *Database) ReleasePortLock(port int) error {
-	key := fmt.Sprintf("port_lock:%d", port)
-	return d.DeleteCache(key)
+// releasePortLockScript deletes a port lock only while it still holds the given
+// token id, so a lock that expired and was taken by another token is left alone
+var releasePortLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// ReleasePortLock releases a port lock in Redis if tokenID still owns it. It
+// returns ErrRedisUnavailable without calling Redis while Redis is failing; the
+// lock then lapses with its TTL.
+func (d *Database) ReleasePortLock(port int, tokenID uuid.UUID) error {
+	if !d.portLocks.allow() {
+		return ErrRedisUnavailable
+	}
+	key := d.key("port_lock:%d", port)
+	err := releasePortLockScript.Run(d.ctx, d.Redis, []string{key}, tokenID.String()).Err()
+	d.portLocks.record(err)
+	return err
 }
 
-// IsPortLocked checks if a port is locked in Redis
+// ReleaseStalePortLocks deletes port locks that have no expiry. Locks are always
+// set with a TTL, so one without is left over and would block its port forever.
+func (d *Database) ReleaseStalePortLocks() (int, error) {
+	released := 0
+	iter := d.Redis.Scan(d.ctx, 0, d.key("port_lock:*"), 100).Iterator()
+	for iter.Next(d.ctx) {
+		key := iter.Val()
+		ttl, err := d.Redis.TTL(d.ctx, key).Result()
+		if err != nil {
+			return released, fmt.Errorf("failed to read TTL of %s: %w", key, err)
+		}
+		// -1 means the key exists without an expiry
+		if ttl != -1 {
+			continue
+		}
+		if err := d.Redis.Del(d.ctx, key).Err(); err != nil {
+			return released, fmt.Errorf("failed to release %s: %w", key, err)
+		}
+		released++
+	}
+	if err := iter.Err(); err != nil {
+		return released, fmt.Errorf("failed to scan port locks: %w", err)
+	}
+	return released, nil
+}
+
+// ListPortLocks returns the ports locked in Redis with the token id holding each,
+// lowest port first. It returns ErrRedisUnavailable without calling Redis while
+// Redis is failing.
+func (d *Database) ListPortLocks() ([]LockedPort, error) {
+	if !d.portLocks.allow() {
+		return nil, ErrRedisUnavailable
+	}
+	prefix := d.key("port_lock:")
+	var locks []LockedPort
+	iter := d.Redis.Scan(d.ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(d.ctx) {
+		key := iter.Val()
+		port, err := strconv.Atoi(strings.TrimPrefix(key, prefix))
+		if err != nil {
+			continue
+		}
+		tokenID, err := d.Redis.Get(d.ctx, key).Result()
+		if err == redis.Nil {
+			// Expired since the scan saw it
+			continue
+		}
+		if err != nil {
+			d.portLocks.record(err)
+			return nil, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		locks = append(locks, LockedPort{Port: port, TokenID: tokenID})
+	}
+	err := iter.Err()
+	d.portLocks.record(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan port locks: %w", err)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Port < locks[j].Port })
+	return locks, nil
+}
+
+// IsPortLocked checks if a port is locked in Redis. It returns ErrRedisUnavailable
+// without calling Redis while Redis is failing.
 func (d *Database) IsPortLocked(port int) (bool, error) {
-	key := fmt.Sprintf("port_lock:%d", port)
+	if !d.portLocks.allow() {
+		return false, ErrRedisUnavailable
+	}
+	key := d.key("port_lock:%d", port)
 	result, err := d.Redis.Exists(d.ctx, key).Result()
+	d.portLocks.record(err)
 	if err != nil {
 		return false, err
 	}
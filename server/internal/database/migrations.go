@@ -0,0 +1,177 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// migrationFilePattern matches migration files such as 0002_team_quotas.up.sql
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_([A-Za-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is a numbered schema change read from a migrations directory. DownPath
+// is empty when the migration cannot be rolled back.
+type Migration struct {
+	Version  int
+	Name     string
+	UpPath   string
+	DownPath string
+}
+
+// LoadMigrations reads the migrations in dir, ordered by version
+func LoadMigrations(dir string) ([]Migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		if version <= 0 {
+			return nil, fmt.Errorf("migration %s: version must be positive", entry.Name())
+		}
+
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, migration.Name, match[2])
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if match[3] == "up" {
+			migration.UpPath = path
+		} else {
+			migration.DownPath = path
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.UpPath == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	if len(migrations) == 0 {
+		return nil, fmt.Errorf("no migrations found in %s", dir)
+	}
+	return migrations, nil
+}
+
+// ensureMigrationsTable creates the table recording applied migrations
+func (d *Database) ensureMigrationsTable() error {
+	_, err := d.DB.ExecContext(d.ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// AppliedMigrations returns the versions recorded in schema_migrations, in order
+func (d *Database) AppliedMigrations() ([]int, error) {
+	if err := d.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := d.DB.QueryContext(d.ctx, `SELECT version FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("failed to scan migration version: %w", err)
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// MigrateTo applies every pending migration up to and including target, then rolls
+// back applied migrations above it, newest first. Each migration runs in its own
+// transaction together with its schema_migrations row.
+func (d *Database) MigrateTo(migrations []Migration, target int) error {
+	applied, err := d.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+	isApplied := make(map[int]bool, len(applied))
+	for _, version := range applied {
+		isApplied[version] = true
+	}
+
+	for _, migration := range migrations {
+		if migration.Version > target || isApplied[migration.Version] {
+			continue
+		}
+		if err := d.applyMigration(migration, migration.UpPath,
+			`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name); err != nil {
+			return err
+		}
+		slog.Info("applied migration", "version", migration.Version, "name", migration.Name)
+	}
+
+	known := make(map[int]Migration, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Version] = migration
+	}
+	for i := len(applied) - 1; i >= 0 && applied[i] > target; i-- {
+		migration, ok := known[applied[i]]
+		if !ok {
+			return fmt.Errorf("migration %04d is applied but its files are missing", applied[i])
+		}
+		if migration.DownPath == "" {
+			return fmt.Errorf("migration %04d_%s has no down file and cannot be rolled back", migration.Version, migration.Name)
+		}
+		if err := d.applyMigration(migration, migration.DownPath,
+			`DELETE FROM schema_migrations WHERE version = $1`, migration.Version); err != nil {
+			return err
+		}
+		slog.Info("rolled back migration", "version", migration.Version, "name", migration.Name)
+	}
+
+	return nil
+}
+
+// applyMigration runs one migration file and its bookkeeping statement in a transaction
+func (d *Database) applyMigration(migration Migration, path, record string, args ...interface{}) error {
+	migrationSQL, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read migration file: %w", err)
+	}
+
+	tx, err := d.BeginTx(d.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(d.ctx, string(migrationSQL)); err != nil {
+		return fmt.Errorf("migration %04d_%s failed: %w", migration.Version, migration.Name, err)
+	}
+	if _, err := tx.ExecContext(d.ctx, record, args...); err != nil {
+		return fmt.Errorf("failed to record migration %04d: %w", migration.Version, err)
+	}
+	return tx.Commit()
+}
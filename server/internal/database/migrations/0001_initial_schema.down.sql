@@ -0,0 +1,17 @@
+-- Rolls back 0001_initial_schema. The "Team" table is shared with the main
+-- application and is left in place; only the trigger this schema added is removed.
+
+DROP VIEW IF EXISTS connection_stats;
+
+DROP TRIGGER IF EXISTS calculate_connection_time_trigger ON connection_logs;
+DROP TRIGGER IF EXISTS update_port_assignments_updated_at ON port_assignments;
+DROP TRIGGER IF EXISTS update_teams_updated_at ON "Team";
+
+DROP FUNCTION IF EXISTS calculate_connection_time();
+DROP FUNCTION IF EXISTS update_updated_at_column();
+
+DROP TABLE IF EXISTS team_quotas;
+DROP TABLE IF EXISTS connection_logs;
+DROP TABLE IF EXISTS connection_sessions;
+DROP TABLE IF EXISTS port_assignments;
+DROP TABLE IF EXISTS team_tokens;
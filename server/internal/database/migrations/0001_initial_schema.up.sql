@@ -1,4 +1,4 @@
--- Migration for rabbit.go database schema
+-- Migration 0001: initial rabbit.go schema
 -- PostgreSQL Database Schema
 
 -- Enable UUID extension
@@ -41,6 +41,15 @@ CREATE TABLE IF NOT EXISTS port_assignments (
     CONSTRAINT valid_protocol CHECK (protocol IN ('tcp', 'udp', 'http', 'https'))
 );
 
+-- Subdomain for HTTP host-based routing (<subdomain>.<domain> on the shared HTTP(S) listener)
+ALTER TABLE port_assignments ADD COLUMN IF NOT EXISTS subdomain VARCHAR(63);
+
+-- Bandwidth limit in bytes per second applied to each direction of a tunnel (0 = unlimited)
+ALTER TABLE port_assignments ADD COLUMN IF NOT EXISTS rate_limit_bps BIGINT NOT NULL DEFAULT 0;
+
+-- Local ports a token may expose; NULL or empty allows any port
+ALTER TABLE team_tokens ADD COLUMN IF NOT EXISTS allowed_local_ports INTEGER[];
+
 -- Connection sessions table (for active connections tracking)
 CREATE TABLE IF NOT EXISTS connection_sessions (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -79,6 +88,18 @@ CREATE TABLE IF NOT EXISTS connection_logs (
     CONSTRAINT valid_log_status CHECK (status IN ('active', 'closed', 'error', 'timeout'))
 );
 
+-- Bytes actually carried on the data connection; lower than bytes_received/bytes_sent when compressed
+ALTER TABLE connection_logs ADD COLUMN IF NOT EXISTS wire_bytes_received BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE connection_logs ADD COLUMN IF NOT EXISTS wire_bytes_sent BIGINT NOT NULL DEFAULT 0;
+
+-- Per-team quotas; 0 means unlimited, and teams without a row have no limits
+CREATE TABLE IF NOT EXISTS team_quotas (
+    team_id VARCHAR(255) PRIMARY KEY, -- References Team(id) but no constraint
+    max_concurrent_tunnels INTEGER NOT NULL DEFAULT 0,
+    max_daily_connections INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 -- Indexes for better performance
 CREATE INDEX IF NOT EXISTS idx_team_tokens_team_id ON team_tokens(team_id);
 CREATE INDEX IF NOT EXISTS idx_team_tokens_token ON team_tokens(token) WHERE is_active = TRUE;
@@ -87,6 +108,7 @@ CREATE INDEX IF NOT EXISTS idx_team_tokens_active ON team_tokens(is_active, expi
 CREATE INDEX IF NOT EXISTS idx_port_assignments_team_id ON port_assignments(team_id);
 CREATE INDEX IF NOT EXISTS idx_port_assignments_token_id ON port_assignments(token_id);
 CREATE INDEX IF NOT EXISTS idx_port_assignments_port ON port_assignments(port, protocol);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_port_assignments_subdomain ON port_assignments(subdomain) WHERE subdomain IS NOT NULL;
 
 CREATE INDEX IF NOT EXISTS idx_connection_sessions_team_id ON connection_sessions(team_id);
 CREATE INDEX IF NOT EXISTS idx_connection_sessions_token_id ON connection_sessions(token_id);
@@ -0,0 +1,2 @@
+-- Nothing to undo: the backfilled durations are correct for the old rows too
+SELECT 1;
@@ -0,0 +1,4 @@
+-- Fill in connection_time_ms for connection logs that ended without it
+UPDATE connection_logs
+SET connection_time_ms = (EXTRACT(EPOCH FROM (ended_at - started_at)) * 1000)::BIGINT
+WHERE ended_at IS NOT NULL AND connection_time_ms IS NULL;
@@ -0,0 +1,2 @@
+-- Rolls back 0003_port_assignment_bind_address; every port binds to --bind again
+ALTER TABLE port_assignments DROP COLUMN IF EXISTS bind_address;
@@ -0,0 +1,3 @@
+-- Address a port's tunnel listener binds to instead of the server's --bind address
+-- (NULL = the server default), e.g. to expose some teams only on an internal interface
+ALTER TABLE port_assignments ADD COLUMN IF NOT EXISTS bind_address VARCHAR(45);
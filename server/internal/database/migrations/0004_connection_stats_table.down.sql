@@ -0,0 +1,15 @@
+-- Rolls back 0004_connection_stats_table: connection_stats is a view again
+DROP TABLE IF EXISTS connection_stats;
+DROP INDEX IF EXISTS idx_connection_logs_ended_at;
+
+CREATE OR REPLACE VIEW connection_stats AS
+SELECT
+    cl.team_id,
+    DATE(cl.started_at) as date,
+    COUNT(*) as total_connections,
+    COUNT(CASE WHEN cl.status = 'active' THEN 1 END) as active_connections,
+    COALESCE(SUM(cl.bytes_received), 0) as total_bytes_received,
+    COALESCE(SUM(cl.bytes_sent), 0) as total_bytes_sent,
+    COALESCE(AVG(cl.connection_time_ms), 0) as avg_connection_time_ms
+FROM connection_logs cl
+GROUP BY cl.team_id, DATE(cl.started_at);
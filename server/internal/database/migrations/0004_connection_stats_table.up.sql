@@ -0,0 +1,34 @@
+-- connection_stats becomes a table filled by the stats roll-up (the server's
+-- --stats-interval job and `database aggregate-stats`) instead of a view that
+-- scanned every connection log on each read
+DROP VIEW IF EXISTS connection_stats;
+
+CREATE TABLE IF NOT EXISTS connection_stats (
+    team_id VARCHAR(255) NOT NULL,
+    date DATE NOT NULL,
+    total_connections BIGINT NOT NULL DEFAULT 0,
+    active_connections BIGINT NOT NULL DEFAULT 0, -- Still active when the day was last rolled up
+    total_bytes_received BIGINT NOT NULL DEFAULT 0,
+    total_bytes_sent BIGINT NOT NULL DEFAULT 0,
+    avg_connection_time_ms DOUBLE PRECISION NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (team_id, date)
+);
+
+-- The roll-up finds the days to recompute by when their connections started or ended
+CREATE INDEX IF NOT EXISTS idx_connection_logs_ended_at ON connection_logs(ended_at);
+
+-- Roll up every day logged so far
+INSERT INTO connection_stats (team_id, date, total_connections, active_connections,
+                              total_bytes_received, total_bytes_sent, avg_connection_time_ms)
+SELECT
+    cl.team_id,
+    DATE(cl.started_at),
+    COUNT(*),
+    COUNT(CASE WHEN cl.status = 'active' THEN 1 END),
+    COALESCE(SUM(cl.bytes_received), 0),
+    COALESCE(SUM(cl.bytes_sent), 0),
+    COALESCE(AVG(cl.connection_time_ms), 0)
+FROM connection_logs cl
+GROUP BY cl.team_id, DATE(cl.started_at)
+ON CONFLICT (team_id, date) DO NOTHING;
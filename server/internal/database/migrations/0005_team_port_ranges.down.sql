@@ -0,0 +1,2 @@
+-- Rolls back 0005_team_port_ranges; ports in the ranges go back to the shared pool
+DROP TABLE IF EXISTS team_port_ranges;
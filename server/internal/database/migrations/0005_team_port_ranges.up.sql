@@ -0,0 +1,13 @@
+-- Blocks of ports reserved for a team, e.g. 15000-15010 for predictable firewall
+-- rules. The team's new port assignments are taken from its ranges first; other
+-- teams are never given a port inside them. Overlaps are rejected by the server.
+CREATE TABLE IF NOT EXISTS team_port_ranges (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    team_id VARCHAR(255) NOT NULL, -- References Team(id) but no constraint
+    start_port INTEGER NOT NULL,
+    end_port INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    CONSTRAINT valid_port_range CHECK (start_port <= end_port)
+);
+
+CREATE INDEX IF NOT EXISTS idx_team_port_ranges_team_id ON team_port_ranges(team_id);
@@ -0,0 +1,3 @@
+-- Rolls back 0006_token_last_used_location
+ALTER TABLE team_tokens DROP COLUMN IF EXISTS last_used_country;
+ALTER TABLE team_tokens DROP COLUMN IF EXISTS last_used_ip;
@@ -0,0 +1,4 @@
+-- Where a token was last authenticated from, for spotting a stolen token: the
+-- client IP and, when the server has a GeoIP database, its ISO country code
+ALTER TABLE team_tokens ADD COLUMN IF NOT EXISTS last_used_ip VARCHAR(45);
+ALTER TABLE team_tokens ADD COLUMN IF NOT EXISTS last_used_country VARCHAR(2);
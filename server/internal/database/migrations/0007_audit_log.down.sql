@@ -0,0 +1,2 @@
+-- Rolls back 0007_audit_log, discarding the recorded actions
+DROP TABLE IF EXISTS audit_log;
@@ -0,0 +1,17 @@
+-- Administrative actions taken through the API or the database commands, such as
+-- generating a token or deleting a team, for compliance reviews. Rows are only
+-- ever inserted; failed attempts are recorded too.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    actor VARCHAR(255) NOT NULL, -- "api", or "cli:<user>" for the database commands
+    actor_ip VARCHAR(45), -- API caller's IP; NULL for the database commands
+    action VARCHAR(50) NOT NULL, -- e.g. token.generate, team.delete
+    target VARCHAR(255), -- ID of the team, token or tunnel acted on
+    outcome VARCHAR(20) NOT NULL,
+    error_message TEXT,
+    metadata JSONB,
+    CONSTRAINT valid_audit_outcome CHECK (outcome IN ('success', 'failure'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);
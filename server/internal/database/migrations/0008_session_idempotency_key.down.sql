@@ -0,0 +1,3 @@
+-- Rolls back 0008_session_idempotency_key
+DROP INDEX IF EXISTS idx_connection_sessions_idempotency_key;
+ALTER TABLE connection_sessions DROP COLUMN IF EXISTS idempotency_key;
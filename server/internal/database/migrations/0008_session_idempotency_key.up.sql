@@ -0,0 +1,8 @@
+-- Key a client sends with a tunnel setup, so a retried setup gets back the session
+-- its earlier attempt created instead of a duplicate. Unique per token among
+-- active sessions; once a session ends its key can be used again.
+ALTER TABLE connection_sessions ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(255);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_connection_sessions_idempotency_key
+    ON connection_sessions(token_id, idempotency_key)
+    WHERE idempotency_key IS NOT NULL AND status = 'active';
@@ -0,0 +1,3 @@
+-- Rolls back 0009_public_bind
+ALTER TABLE connection_sessions DROP COLUMN IF EXISTS bind_address;
+ALTER TABLE team_tokens DROP COLUMN IF EXISTS allow_public_bind;
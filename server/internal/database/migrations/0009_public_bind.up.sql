@@ -0,0 +1,7 @@
+-- Whether clients using a token may have its tunnels listen publicly. Tokens that
+-- may not get loopback-only listeners. Existing tokens keep listening publicly.
+ALTER TABLE team_tokens ADD COLUMN IF NOT EXISTS allow_public_bind BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- Address a session's tunnel listens on, so a tunnel restored after a restart
+-- listens where the client asked for it to, e.g. on loopback only
+ALTER TABLE connection_sessions ADD COLUMN IF NOT EXISTS bind_address VARCHAR(45);
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,6 +15,10 @@ type Team struct {
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
 	IsActive    bool      `json:"is_active" db:"is_active"`
+
+	// Quotas from team_quotas; 0 means unlimited
+	MaxConcurrentTunnels int `json:"max_concurrent_tunnels" db:"max_concurrent_tunnels"`
+	MaxDailyConnections  int `json:"max_daily_connections" db:"max_daily_connections"`
 }
 
 // TeamToken represents an authentication token for a team
@@ -28,46 +33,154 @@ type TeamToken struct {
 	LastUsedAt  *time.Time `json:"last_used_at" db:"last_used_at"`
 	IsActive    bool       `json:"is_active" db:"is_active"`
 
+	// Where the token was last authenticated from; the country is only known
+	// when the server has a GeoIP database
+	LastUsedIP      *string `json:"last_used_ip,omitempty" db:"last_used_ip"`
+	LastUsedCountry *string `json:"last_used_country,omitempty" db:"last_used_country"`
+
+	// AllowedLocalPorts restricts which local ports the token may expose (empty allows any)
+	AllowedLocalPorts []int64 `json:"allowed_local_ports,omitempty" db:"allowed_local_ports"`
+
+	// AllowPublicBind lets the token's tunnels listen publicly; without it they
+	// listen on loopback only and clients asking to bind publicly are refused
+	AllowPublicBind bool `json:"allow_public_bind" db:"allow_public_bind"`
+
 	// Relations
 	Team *Team `json:"team,omitempty"`
 }
 
+// AllowsLocalPort reports whether the token may expose localPort
+func (t *TeamToken) AllowsLocalPort(localPort string) bool {
+	if len(t.AllowedLocalPorts) == 0 {
+		return true
+	}
+	port, err := strconv.Atoi(localPort)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range t.AllowedLocalPorts {
+		if int64(port) == allowed {
+			return true
+		}
+	}
+	return false
+}
+
 // PortAssignment represents a port assigned to a team token
 type PortAssignment struct {
-	ID         uuid.UUID `json:"id" db:"id"`
-	TeamID     string    `json:"team_id" db:"team_id"`
-	TokenID    uuid.UUID `json:"token_id" db:"token_id"`
-	Port       int       `json:"port" db:"port"`
-	Protocol   string    `json:"protocol" db:"protocol"` // tcp, udp, http, https
-	IsReserved bool      `json:"is_reserved" db:"is_reserved"`
-	CreatedAt  time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+	ID           uuid.UUID `json:"id" db:"id"`
+	TeamID       string    `json:"team_id" db:"team_id"`
+	TokenID      uuid.UUID `json:"token_id" db:"token_id"`
+	Port         int       `json:"port" db:"port"`
+	Protocol     string    `json:"protocol" db:"protocol"` // tcp, udp, http, https
+	IsReserved   bool      `json:"is_reserved" db:"is_reserved"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+	Subdomain    *string   `json:"subdomain,omitempty" db:"subdomain"`       // Routes <subdomain>.<domain> on the shared HTTP(S) listener
+	RateLimitBPS int64     `json:"rate_limit_bps" db:"rate_limit_bps"`       // Bandwidth cap per direction in bytes/sec (0 = unlimited)
+	BindAddress  *string   `json:"bind_address,omitempty" db:"bind_address"` // Listen address overriding the server's bind address
 
 	// Relations
 	Team  *Team      `json:"team,omitempty"`
 	Token *TeamToken `json:"token,omitempty"`
 }
 
+// PortConflict is a port that more than one active assignment would listen on, or
+// an active assignment outside the tunnel port range
+type PortConflict struct {
+	Port        int              `json:"port"`
+	Transport   string           `json:"transport"`   // tcp (for tcp, http and https assignments) or udp
+	Reason      string           `json:"reason"`      // duplicate or out_of_range
+	Assignments []PortAssignment `json:"assignments"` // Oldest first
+}
+
+// PortUsage reports how the tunnel port range is used: the active assignments,
+// the ranges reserved for teams and the ports locked in Redis
+type PortUsage struct {
+	RangeStart  int     `json:"range_start"`
+	RangeEnd    int     `json:"range_end"`
+	Total       int     `json:"total"`
+	Free        int     `json:"free"`                // Ports in the range neither assigned nor locked, for either transport
+	Utilization float64 `json:"utilization_percent"` // Share of the range that is not free
+
+	Assigned []AssignedPort `json:"assigned"` // Lowest port first, including any outside the range
+	Reserved []PortRange    `json:"reserved"`
+	Locked   []LockedPort   `json:"locked"`
+
+	// LocksUnavailable is set when Redis could not be read; Locked is then empty
+	// and Free counts assigned ports only
+	LocksUnavailable bool `json:"locks_unavailable,omitempty"`
+}
+
+// AssignedPort is an active port assignment with the names of its team and token
+type AssignedPort struct {
+	Port      int       `json:"port"`
+	Protocol  string    `json:"protocol"`
+	TeamID    string    `json:"team_id"`
+	TeamName  string    `json:"team_name"`
+	TokenID   uuid.UUID `json:"token_id"`
+	TokenName string    `json:"token_name"`
+}
+
+// LockedPort is a port locked in Redis while a token is being given it
+type LockedPort struct {
+	Port    int    `json:"port"`
+	TokenID string `json:"token_id"`
+}
+
+// PortMove is a port assignment moved to a new port to resolve a PortConflict
+type PortMove struct {
+	Assignment PortAssignment `json:"assignment"` // As moved, with its new port
+	OldPort    int            `json:"old_port"`
+}
+
+// PortRange is a block of ports reserved for a team
+type PortRange struct {
+	ID        uuid.UUID `json:"id" db:"id"`
+	TeamID    string    `json:"team_id" db:"team_id"`
+	StartPort int       `json:"start_port" db:"start_port"`
+	EndPort   int       `json:"end_port" db:"end_port"` // Inclusive
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// ConnectionResult is the final state of a connection, recorded in its log entry
+// when the connection ends
+type ConnectionResult struct {
+	SessionID         uuid.UUID
+	LogID             uuid.UUID
+	EndedAt           time.Time
+	BytesReceived     int64
+	BytesSent         int64
+	WireBytesReceived int64
+	WireBytesSent     int64
+	Status            string // closed or error
+	ErrorMessage      *string
+	UserAgent         *string // Set with RequestPath when the connection carried HTTP
+	RequestPath       *string
+}
+
 // ConnectionLog represents a log entry for tunnel connections
 type ConnectionLog struct {
-	ID             uuid.UUID  `json:"id" db:"id"`
-	TeamID         string     `json:"team_id" db:"team_id"`
-	TokenID        uuid.UUID  `json:"token_id" db:"token_id"`
-	PortAssignID   uuid.UUID  `json:"port_assign_id" db:"port_assign_id"`
-	SessionID      uuid.UUID  `json:"session_id" db:"session_id"`
-	ClientIP       string     `json:"client_ip" db:"client_ip"`
-	ClientPort     int        `json:"client_port" db:"client_port"`
-	ServerPort     int        `json:"server_port" db:"server_port"`
-	Protocol       string     `json:"protocol" db:"protocol"`
-	StartedAt      time.Time  `json:"started_at" db:"started_at"`
-	EndedAt        *time.Time `json:"ended_at" db:"ended_at"`
-	BytesReceived  int64      `json:"bytes_received" db:"bytes_received"`
-	BytesSent      int64      `json:"bytes_sent" db:"bytes_sent"`
-	ConnectionTime *int64     `json:"connection_time_ms" db:"connection_time_ms"` // Duration in milliseconds
-	Status         string     `json:"status" db:"status"`                         // active, closed, error, timeout
-	ErrorMessage   *string    `json:"error_message" db:"error_message"`
-	UserAgent      *string    `json:"user_agent" db:"user_agent"`
-	RequestPath    *string    `json:"request_path" db:"request_path"` // For HTTP connections
+	ID                uuid.UUID  `json:"id" db:"id"`
+	TeamID            string     `json:"team_id" db:"team_id"`
+	TokenID           uuid.UUID  `json:"token_id" db:"token_id"`
+	PortAssignID      uuid.UUID  `json:"port_assign_id" db:"port_assign_id"`
+	SessionID         uuid.UUID  `json:"session_id" db:"session_id"`
+	ClientIP          string     `json:"client_ip" db:"client_ip"`
+	ClientPort        int        `json:"client_port" db:"client_port"`
+	ServerPort        int        `json:"server_port" db:"server_port"`
+	Protocol          string     `json:"protocol" db:"protocol"`
+	StartedAt         time.Time  `json:"started_at" db:"started_at"`
+	EndedAt           *time.Time `json:"ended_at" db:"ended_at"`
+	BytesReceived     int64      `json:"bytes_received" db:"bytes_received"`
+	BytesSent         int64      `json:"bytes_sent" db:"bytes_sent"`
+	WireBytesReceived int64      `json:"wire_bytes_received" db:"wire_bytes_received"` // Compressed bytes read from the client
+	WireBytesSent     int64      `json:"wire_bytes_sent" db:"wire_bytes_sent"`         // Compressed bytes written to the client
+	ConnectionTime    *int64     `json:"connection_time_ms" db:"connection_time_ms"`   // Duration in milliseconds
+	Status            string     `json:"status" db:"status"`                           // active, closed, error, timeout
+	ErrorMessage      *string    `json:"error_message" db:"error_message"`
+	UserAgent         *string    `json:"user_agent" db:"user_agent"`
+	RequestPath       *string    `json:"request_path" db:"request_path"` // For HTTP connections
 
 	// Relations
 	Team           *Team           `json:"team,omitempty"`
@@ -87,6 +200,8 @@ type ConnectionSession struct {
 	StartedAt    time.Time `json:"started_at" db:"started_at"`
 	LastSeenAt   time.Time `json:"last_seen_at" db:"last_seen_at"`
 	Status       string    `json:"status" db:"status"` // active, inactive
+	// Address the session's tunnel listens on; nil for sessions started before migration 0009
+	BindAddress *string `json:"bind_address,omitempty" db:"bind_address"`
 }
 
 // ConnectionStats represents aggregated connection statistics
@@ -99,3 +214,52 @@ type ConnectionStats struct {
 	AvgConnectionTime  float64   `json:"avg_connection_time_ms"`
 	Date               time.Time `json:"date"`
 }
+
+// ConnectionLogFilter narrows a connection log query for a team
+type ConnectionLogFilter struct {
+	TeamID string
+	From   *time.Time // Only logs started at or after this time
+	To     *time.Time // Only logs started at or before this time
+	Status string     // active, closed, error, timeout (empty matches all)
+	Limit  int
+	Offset int
+}
+
+// ReconnectToken is the Redis record behind a reconnect token issued to a tunnel
+// client; it names the remote port the client is rebound to when it reconnects
+type ReconnectToken struct {
+	TokenID  uuid.UUID `json:"token_id"`
+	Port     int       `json:"port"`
+	Protocol string    `json:"protocol"`
+}
+
+// Audit actions recorded in the audit log
+const (
+	AuditTokenGenerate    = "token.generate"
+	AuditTokenRevoke      = "token.revoke"
+	AuditTokenDelete      = "token.delete"
+	AuditTeamCreate       = "team.create"
+	AuditTeamDelete       = "team.delete"
+	AuditTeamSetQuota     = "team.set_quota"
+	AuditTeamReserveRange = "team.reserve_range"
+	AuditTunnelClose      = "tunnel.close"
+)
+
+// Audit event outcomes
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// AuditEvent is an administrative action recorded in the audit log
+type AuditEvent struct {
+	ID           uuid.UUID              `json:"id" db:"id"`
+	CreatedAt    time.Time              `json:"created_at" db:"created_at"`
+	Actor        string                 `json:"actor" db:"actor"`       // "api", or "cli:<user>" for the database commands
+	ActorIP      *string                `json:"actor_ip" db:"actor_ip"` // API caller's IP
+	Action       string                 `json:"action" db:"action"`     // One of the Audit* actions
+	Target       string                 `json:"target" db:"target"`     // ID of the team, token or tunnel acted on
+	Outcome      string                 `json:"outcome" db:"outcome"`   // success or failure
+	ErrorMessage *string                `json:"error_message" db:"error_message"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty" db:"metadata"`
+}
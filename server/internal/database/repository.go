@@ -6,17 +6,62 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
+// Ports handed out to tunnels are taken from this range
+const (
+	portRangeStart = 10000
+	portRangeEnd   = 65535
+)
+
+// maxPortAssignAttempts bounds how many ports assignPortInTx tries when concurrent
+// assignments keep taking the port it picked
+const maxPortAssignAttempts = 10
+
 // Repository provides database operations
 type Repository struct {
 	db *Database
 }
 
+var (
+	// ErrTeamNotFound is returned when a team does not exist or has already been deleted
+	ErrTeamNotFound = errors.New("team not found or already deleted")
+
+	// ErrTeamNameTaken is returned when another team already uses the name
+	ErrTeamNameTaken = errors.New("team name already taken")
+
+	// ErrTokenNotFound is returned when a token does not exist or has already been revoked
+	ErrTokenNotFound = errors.New("token not found or already revoked")
+
+	// ErrInvalidToken is returned when a token presented for authentication does not
+	// exist, is inactive, has expired or belongs to a deleted team
+	ErrInvalidToken = errors.New("token not found or expired")
+
+	// ErrSubdomainTaken is returned when a subdomain is already registered to another port assignment
+	ErrSubdomainTaken = errors.New("subdomain already taken")
+
+	// ErrNoAvailablePorts is returned when every port in the tunnel port range is assigned or locked
+	ErrNoAvailablePorts = errors.New("no available ports")
+
+	// ErrPortRangeConflict is returned when a port range overlaps another team's range
+	// or ports already assigned to another team
+	ErrPortRangeConflict = errors.New("port range conflict")
+
+	// ErrTokenExpiryTooLong is returned when a token would expire later than
+	// TOKEN_MAX_EXPIRY_DAYS allows, or never while a maximum is set
+	ErrTokenExpiryTooLong = errors.New("token expiry exceeds the maximum")
+)
+
 // NewRepository creates a new repository instance
 func NewRepository(db *Database) *Repository {
 	return &Repository{db: db}
@@ -42,14 +87,12 @@ func (r *Repository) GetTeamByID(ctx context.Context, id string) (*Team, error)
 			&team.ID, &team.Name, &team.Description,
 		)
 		if err != nil {
-			fmt.Println("error", err)
 			return nil, fmt.Errorf("failed to scan team: %w", err)
 		}
 		team.IsActive = true
-		fmt.Println("team", team)
 	}
 
-	fmt.Println("team", team)
+	slog.Debug("team lookup", "team_id", id, "found", team.ID != "", "team_name", team.Name)
 
 	if team.ID == "" {
 		return nil, fmt.Errorf("team not found")
@@ -79,8 +122,77 @@ func (r *Repository) GetTeamByName(ctx context.Context, name string) (*Team, err
 	return team, nil
 }
 
-// CreateTokenForTeam creates a token for an existing team with port assignment
-func (r *Repository) CreateTokenForTeam(ctx context.Context, teamID string, tokenName, tokenDescription string, expiresAt *time.Time) (*TeamToken, *PortAssignment, error) {
+// CreateTeam inserts a team into the Team table shared with the main application
+func (r *Repository) CreateTeam(ctx context.Context, name, description string) (*Team, error) {
+	now := time.Now().UTC()
+	team := &Team{
+		ID:          uuid.New().String(),
+		Name:        name,
+		Description: description,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		IsActive:    true,
+	}
+
+	query := `
+		INSERT INTO public."Team" (id, name, description, "createdAt", "updatedAt", deleted)
+		VALUES ($1, $2, $3, $4, $5, false)`
+
+	_, err := r.db.DB.ExecContext(ctx, query, team.ID, team.Name, team.Description, team.CreatedAt, team.UpdatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+			return nil, ErrTeamNameTaken
+		}
+		return nil, fmt.Errorf("failed to create team: %w", err)
+	}
+
+	return team, nil
+}
+
+// SetTeamQuota sets a team's quotas, 0 meaning unlimited
+func (r *Repository) SetTeamQuota(ctx context.Context, teamID string, maxConcurrentTunnels, maxDailyConnections int) error {
+	var exists bool
+	err := r.db.DB.QueryRowContext(ctx,
+		`SELECT EXISTS(SELECT 1 FROM public."Team" WHERE id = $1 AND deleted = false)`, teamID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to look up team: %w", err)
+	}
+	if !exists {
+		return ErrTeamNotFound
+	}
+
+	query := `
+		INSERT INTO team_quotas (team_id, max_concurrent_tunnels, max_daily_connections, updated_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (team_id) DO UPDATE
+		SET max_concurrent_tunnels = EXCLUDED.max_concurrent_tunnels,
+		    max_daily_connections = EXCLUDED.max_daily_connections,
+		    updated_at = NOW()`
+
+	if _, err := r.db.DB.ExecContext(ctx, query, teamID, maxConcurrentTunnels, maxDailyConnections); err != nil {
+		return fmt.Errorf("failed to set team quota: %w", err)
+	}
+	return nil
+}
+
+// CountTeamConnectionsToday counts a team's connection logs started since midnight
+func (r *Repository) CountTeamConnectionsToday(ctx context.Context, teamID string) (int, error) {
+	var count int
+	err := r.db.DB.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM connection_logs WHERE team_id = $1 AND started_at >= CURRENT_DATE`, teamID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count connections: %w", err)
+	}
+	return count, nil
+}
+
+// CreateTokenForTeam creates a token for an existing team with a port assignment for the given protocol.
+// A non-empty subdomain is registered on the assignment for HTTP host-based routing,
+// and a non-empty bindAddress makes its tunnel listen on that address.
+// With validateOnly the checks run and the port that would be assigned is returned
+// as an unsaved assignment with a nil token; the transaction is rolled back.
+func (r *Repository) CreateTokenForTeam(ctx context.Context, teamID string, tokenName, tokenDescription string, expiresAt *time.Time, protocol, subdomain, bindAddress string, allowedLocalPorts []int64, allowPublicBind, validateOnly bool) (*TeamToken, *PortAssignment, error) {
 	// Start transaction
 	tx, err := r.db.BeginTx(ctx)
 	if err != nil {
@@ -98,6 +210,33 @@ func (r *Repository) CreateTokenForTeam(ctx context.Context, teamID string, toke
 		return nil, nil, fmt.Errorf("team not found")
 	}
 
+	// Verify the subdomain is free
+	if subdomain != "" {
+		var subdomainTaken bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM port_assignments WHERE subdomain = $1)", subdomain).Scan(&subdomainTaken)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to check subdomain availability: %w", err)
+		}
+		if subdomainTaken {
+			return nil, nil, ErrSubdomainTaken
+		}
+	}
+
+	if validateOnly {
+		port, err := r.findAvailablePortInTx(ctx, tx, teamID, protocol, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find available port: %w", err)
+		}
+		assignment := &PortAssignment{TeamID: teamID, Port: port, Protocol: protocol}
+		if subdomain != "" {
+			assignment.Subdomain = &subdomain
+		}
+		if bindAddress != "" {
+			assignment.BindAddress = &bindAddress
+		}
+		return nil, assignment, nil
+	}
+
 	// Generate secure token
 	tokenValue, err := generateSecureToken()
 	if err != nil {
@@ -114,16 +253,20 @@ func (r *Repository) CreateTokenForTeam(ctx context.Context, teamID string, toke
 		CreatedAt:   time.Now(),
 		ExpiresAt:   expiresAt,
 		IsActive:    true,
+
+		AllowedLocalPorts: allowedLocalPorts,
+		AllowPublicBind:   allowPublicBind,
 	}
 
 	tokenQuery := `
-		INSERT INTO team_tokens (id, team_id, token, name, description, created_at, expires_at, is_active)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		INSERT INTO team_tokens (id, team_id, token, name, description, created_at, expires_at, is_active, allowed_local_ports, allow_public_bind)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 		RETURNING id, team_id, token, name, description, created_at, expires_at, last_used_at, is_active`
 
 	err = tx.QueryRowContext(ctx, tokenQuery,
 		teamToken.ID, teamToken.TeamID, teamToken.Token, teamToken.Name,
 		teamToken.Description, teamToken.CreatedAt, teamToken.ExpiresAt, teamToken.IsActive,
+		pq.Array(teamToken.AllowedLocalPorts), teamToken.AllowPublicBind,
 	).Scan(&teamToken.ID, &teamToken.TeamID, &teamToken.Token, &teamToken.Name,
 		&teamToken.Description, &teamToken.CreatedAt, &teamToken.ExpiresAt,
 		&teamToken.LastUsedAt, &teamToken.IsActive)
@@ -132,64 +275,179 @@ func (r *Repository) CreateTokenForTeam(ctx context.Context, teamID string, toke
 		return nil, nil, fmt.Errorf("failed to create team token: %w", err)
 	}
 
-	// Find available port
-	availablePort, err := r.findAvailablePortInTx(ctx, tx, 10000, 65535, "tcp")
+	// Assign a port to the new token
+	assignment, err := r.assignPortInTx(ctx, tx, teamID, teamToken.ID, protocol, subdomain, bindAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		r.db.ReleasePortLock(assignment.Port, assignment.TokenID)
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return teamToken, assignment, nil
+}
+
+// CreatePortAssignment assigns an additional port to an existing token, listening on
+// bindAddress if it is not empty
+func (r *Repository) CreatePortAssignment(ctx context.Context, teamID string, tokenID uuid.UUID, protocol, bindAddress string) (*PortAssignment, error) {
+	tx, err := r.db.BeginTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	assignment, err := r.assignPortInTx(ctx, tx, teamID, tokenID, protocol, "", bindAddress)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to find available port: %w", err)
+		return nil, err
 	}
 
-	// Acquire port lock in Redis
-	if err := r.db.SetPortLock(availablePort, teamToken.ID, 10*time.Minute); err != nil {
-		return nil, nil, fmt.Errorf("failed to acquire port lock: %w", err)
+	if err := tx.Commit(); err != nil {
+		r.db.ReleasePortLock(assignment.Port, assignment.TokenID)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	// Create port assignment
-	assignment := &PortAssignment{
-		ID:         uuid.New(),
-		TeamID:     teamID,
-		TokenID:    teamToken.ID,
-		Port:       availablePort,
-		Protocol:   "tcp",
-		IsReserved: true,
-		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
+	return assignment, nil
+}
+
+// assignPortInTx finds a free port, locks it and records the assignment within a transaction.
+// The caller must release the port lock if the transaction fails to commit.
+//
+// The Redis port lock only keeps concurrent assignments from picking the same port;
+// the unique (port, protocol) constraint is what guarantees it. If another
+// transaction takes the port first, the insert does nothing and the next free port
+// is tried, so assignment keeps working while Redis is down.
+func (r *Repository) assignPortInTx(ctx context.Context, tx *sql.Tx, teamID string, tokenID uuid.UUID, protocol, subdomain, bindAddress string) (*PortAssignment, error) {
+	taken := make(map[int]bool)
+
+	for attempt := 0; attempt < maxPortAssignAttempts; attempt++ {
+		// Find available port
+		availablePort, err := r.findAvailablePortInTx(ctx, tx, teamID, protocol, taken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find available port: %w", err)
+		}
+
+		// Acquire port lock in Redis
+		if err := r.db.SetPortLock(availablePort, tokenID, 10*time.Minute); err != nil && !errors.Is(err, ErrRedisUnavailable) {
+			slog.Debug("failed to acquire port lock; relying on the database", "port", availablePort, "error", err)
+		}
+
+		// Create port assignment
+		assignment := &PortAssignment{
+			ID:         uuid.New(),
+			TeamID:     teamID,
+			TokenID:    tokenID,
+			Port:       availablePort,
+			Protocol:   protocol,
+			IsReserved: true,
+			CreatedAt:  time.Now(),
+			UpdatedAt:  time.Now(),
+		}
+		if subdomain != "" {
+			assignment.Subdomain = &subdomain
+		}
+		if bindAddress != "" {
+			assignment.BindAddress = &bindAddress
+		}
+
+		portQuery := `
+			INSERT INTO port_assignments (id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at, subdomain, bind_address)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT (port, protocol) DO NOTHING
+			RETURNING id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at, subdomain, rate_limit_bps, bind_address`
+
+		err = tx.QueryRowContext(ctx, portQuery,
+			assignment.ID, assignment.TeamID, assignment.TokenID, assignment.Port,
+			assignment.Protocol, assignment.IsReserved, assignment.CreatedAt, assignment.UpdatedAt, assignment.Subdomain, assignment.BindAddress,
+		).Scan(&assignment.ID, &assignment.TeamID, &assignment.TokenID, &assignment.Port,
+			&assignment.Protocol, &assignment.IsReserved, &assignment.CreatedAt, &assignment.UpdatedAt, &assignment.Subdomain, &assignment.RateLimitBPS, &assignment.BindAddress)
+
+		if err == sql.ErrNoRows {
+			// Another assignment holds the port; try the next one
+			r.db.ReleasePortLock(availablePort, tokenID)
+			taken[availablePort] = true
+			slog.Debug("port taken by a concurrent assignment", "port", availablePort, "protocol", protocol)
+			continue
+		}
+		if err != nil {
+			// Release the port lock if database insert fails
+			r.db.ReleasePortLock(availablePort, tokenID)
+			return nil, fmt.Errorf("failed to create port assignment: %w", err)
+		}
+
+		return assignment, nil
 	}
 
-	portQuery := `
-		INSERT INTO port_assignments (id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		RETURNING id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at`
+	return nil, fmt.Errorf("failed to create port assignment: ports kept being taken after %d attempts", maxPortAssignAttempts)
+}
 
-	err = tx.QueryRowContext(ctx, portQuery,
-		assignment.ID, assignment.TeamID, assignment.TokenID, assignment.Port,
-		assignment.Protocol, assignment.IsReserved, assignment.CreatedAt, assignment.UpdatedAt,
-	).Scan(&assignment.ID, &assignment.TeamID, &assignment.TokenID, &assignment.Port,
-		&assignment.Protocol, &assignment.IsReserved, &assignment.CreatedAt, &assignment.UpdatedAt)
+// ReassignPort moves an existing port assignment to another free port, for when its
+// port turns out to be held by some other process on the server. The old port is
+// released and the updated assignment returned.
+func (r *Repository) ReassignPort(ctx context.Context, assignmentID uuid.UUID) (*PortAssignment, error) {
+	tx, err := r.db.BeginTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
 
+	var oldPort int
+	var protocol, teamID string
+	var tokenID uuid.UUID
+	err = tx.QueryRowContext(ctx, `SELECT port, protocol, team_id, token_id FROM port_assignments WHERE id = $1 FOR UPDATE`, assignmentID).
+		Scan(&oldPort, &protocol, &teamID, &tokenID)
 	if err != nil {
-		// Release the port lock if database insert fails
-		r.db.ReleasePortLock(availablePort)
-		return nil, nil, fmt.Errorf("failed to create port assignment: %w", err)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("port assignment not found")
+		}
+		return nil, fmt.Errorf("failed to get port assignment: %w", err)
+	}
+
+	newPort, err := r.findAvailablePortInTx(ctx, tx, teamID, protocol, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find available port: %w", err)
+	}
+	if err := r.db.SetPortLock(newPort, tokenID, 10*time.Minute); err != nil && !errors.Is(err, ErrRedisUnavailable) {
+		slog.Debug("failed to acquire port lock; relying on the database", "port", newPort, "error", err)
+	}
+
+	query := `
+		UPDATE port_assignments SET port = $1, updated_at = NOW() WHERE id = $2
+		RETURNING id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at, subdomain, rate_limit_bps, bind_address`
+
+	pa := &PortAssignment{}
+	err = tx.QueryRowContext(ctx, query, newPort, assignmentID).Scan(&pa.ID, &pa.TeamID, &pa.TokenID, &pa.Port,
+		&pa.Protocol, &pa.IsReserved, &pa.CreatedAt, &pa.UpdatedAt, &pa.Subdomain, &pa.RateLimitBPS, &pa.BindAddress)
+	if err != nil {
+		r.db.ReleasePortLock(newPort, tokenID)
+		return nil, fmt.Errorf("failed to reassign port: %w", err)
 	}
 
-	// Commit transaction
 	if err := tx.Commit(); err != nil {
-		r.db.ReleasePortLock(availablePort)
-		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+		r.db.ReleasePortLock(newPort, tokenID)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return teamToken, assignment, nil
+	r.db.ReleasePortLock(oldPort, tokenID)
+	return pa, nil
 }
 
-// findAvailablePortInTx finds an available port within a transaction
-func (r *Repository) findAvailablePortInTx(ctx context.Context, tx *sql.Tx, startPort, endPort int, protocol string) (int, error) {
+// findAvailablePortInTx finds an available port for a team within a transaction,
+// skipping ports in exclude. The team's reserved port ranges are tried first, then
+// the rest of the tunnel port range outside every other team's ranges. Ports locked
+// in Redis are skipped too, unless Redis cannot be reached, in which case the
+// database alone decides.
+func (r *Repository) findAvailablePortInTx(ctx context.Context, tx *sql.Tx, teamID, protocol string, exclude map[int]bool) (int, error) {
+	// tcp, http and https tunnels all listen on a TCP port, so they share ports
 	query := `
 		SELECT port FROM port_assignments
-		WHERE port BETWEEN $1 AND $2 AND protocol = $3
+		WHERE port BETWEEN $1 AND $2 AND ` + portTransportSQL + ` = (CASE WHEN $3 = 'udp' THEN 'udp' ELSE 'tcp' END)
 		AND is_reserved = true
 		ORDER BY port`
 
-	rows, err := tx.QueryContext(ctx, query, startPort, endPort, protocol)
+	rows, err := tx.QueryContext(ctx, query, portRangeStart, portRangeEnd, protocol)
 	if err != nil {
 		return 0, fmt.Errorf("failed to query used ports: %w", err)
 	}
@@ -203,22 +461,359 @@ func (r *Repository) findAvailablePortInTx(ctx context.Context, tx *sql.Tx, star
 		}
 		usedPorts[port] = true
 	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to query used ports: %w", err)
+	}
 
-	// Find first available port
-	for port := startPort; port <= endPort; port++ {
-		if !usedPorts[port] {
-			// Check if port is locked in Redis
-			locked, err := r.db.IsPortLocked(port)
-			if err != nil {
-				continue // Skip this port if we can't check Redis
-			}
-			if !locked {
+	ranges, err := r.listPortRangesInTx(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	var own []PortRange
+	othersReserved := make(map[int]bool)
+	for _, pr := range ranges {
+		if pr.TeamID == teamID {
+			own = append(own, pr)
+			continue
+		}
+		for port := pr.StartPort; port <= pr.EndPort; port++ {
+			othersReserved[port] = true
+		}
+	}
+
+	free := func(port int) bool {
+		if usedPorts[port] || exclude[port] || othersReserved[port] {
+			return false
+		}
+		// Check if port is locked in Redis; the lock is only a hint, so a
+		// failed check does not rule the port out
+		locked, err := r.db.IsPortLocked(port)
+		return err != nil || !locked
+	}
+
+	for _, pr := range own {
+		for port := pr.StartPort; port <= pr.EndPort; port++ {
+			if free(port) {
 				return port, nil
 			}
 		}
 	}
+	for port := portRangeStart; port <= portRangeEnd; port++ {
+		if free(port) {
+			return port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w in range %d-%d", ErrNoAvailablePorts, portRangeStart, portRangeEnd)
+}
+
+// portTransportSQL maps an assignment's protocol to the listener it needs
+const portTransportSQL = `(CASE WHEN protocol = 'udp' THEN 'udp' ELSE 'tcp' END)`
+
+// FindDuplicatePortAssignments returns the ports that more than one active
+// assignment would listen on, e.g. a tcp and an http assignment left on the same
+// port by a race, and the ports of active assignments outside the tunnel port
+// range, lowest port first
+func (r *Repository) FindDuplicatePortAssignments(ctx context.Context) ([]PortConflict, error) {
+	query := `
+		SELECT id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at, subdomain, rate_limit_bps, bind_address, transport
+		FROM (
+			SELECT pa.*, ` + portTransportSQL + ` AS transport,
+			       COUNT(*) OVER (PARTITION BY port, ` + portTransportSQL + `) AS holders
+			FROM port_assignments pa
+			WHERE is_reserved = true
+		) a
+		WHERE holders > 1 OR port NOT BETWEEN $1 AND $2
+		ORDER BY port, transport, created_at, id`
+
+	rows, err := r.db.DB.QueryContext(ctx, query, portRangeStart, portRangeEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query port conflicts: %w", err)
+	}
+	defer rows.Close()
+
+	var conflicts []PortConflict
+	for rows.Next() {
+		var assignment PortAssignment
+		var transport string
+		err := rows.Scan(&assignment.ID, &assignment.TeamID, &assignment.TokenID, &assignment.Port,
+			&assignment.Protocol, &assignment.IsReserved, &assignment.CreatedAt, &assignment.UpdatedAt, &assignment.Subdomain, &assignment.RateLimitBPS, &assignment.BindAddress,
+			&transport)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan port assignment: %w", err)
+		}
+
+		// Out of range takes precedence, since none of the holders may keep the port
+		reason := "duplicate"
+		if assignment.Port < portRangeStart || assignment.Port > portRangeEnd {
+			reason = "out_of_range"
+		}
+		if n := len(conflicts); n > 0 && conflicts[n-1].Port == assignment.Port && conflicts[n-1].Transport == transport {
+			conflicts[n-1].Assignments = append(conflicts[n-1].Assignments, assignment)
+			continue
+		}
+		conflicts = append(conflicts, PortConflict{
+			Port:        assignment.Port,
+			Transport:   transport,
+			Reason:      reason,
+			Assignments: []PortAssignment{assignment},
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query port conflicts: %w", err)
+	}
+
+	return conflicts, nil
+}
+
+// ListPortUsage reports the active port assignments, the ports reserved for teams
+// and the ports locked in Redis, and how many ports of the tunnel port range are
+// left free. The database is read in one transaction, so assignments and ranges
+// agree; locks are read afterwards and, since they are only a hint, a Redis
+// failure is reported in LocksUnavailable rather than failing the call.
+func (r *Repository) ListPortUsage(ctx context.Context) (*PortUsage, error) {
+	usage := &PortUsage{
+		RangeStart: portRangeStart,
+		RangeEnd:   portRangeEnd,
+		Total:      portRangeEnd - portRangeStart + 1,
+		Assigned:   []AssignedPort{},
+		Reserved:   []PortRange{},
+		Locked:     []LockedPort{},
+	}
+
+	err := r.db.WithTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT pa.port, pa.protocol, pa.team_id, COALESCE(tm.name, ''), pa.token_id, COALESCE(tt.name, '')
+			FROM port_assignments pa
+			LEFT JOIN "Team" tm ON tm.id = pa.team_id
+			LEFT JOIN team_tokens tt ON tt.id = pa.token_id
+			WHERE pa.is_reserved = true
+			ORDER BY pa.port, pa.protocol`)
+		if err != nil {
+			return fmt.Errorf("failed to query port assignments: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var ap AssignedPort
+			if err := rows.Scan(&ap.Port, &ap.Protocol, &ap.TeamID, &ap.TeamName, &ap.TokenID, &ap.TokenName); err != nil {
+				return fmt.Errorf("failed to scan port assignment: %w", err)
+			}
+			usage.Assigned = append(usage.Assigned, ap)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to query port assignments: %w", err)
+		}
+
+		ranges, err := r.listPortRangesInTx(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if ranges != nil {
+			usage.Reserved = ranges
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	locks, err := r.db.ListPortLocks()
+	if err != nil {
+		usage.LocksUnavailable = true
+	} else if locks != nil {
+		usage.Locked = locks
+	}
+
+	used := make(map[int]bool)
+	for _, ap := range usage.Assigned {
+		used[ap.Port] = true
+	}
+	for _, lock := range usage.Locked {
+		used[lock.Port] = true
+	}
+	usage.Free = usage.Total
+	for port := range used {
+		if port >= portRangeStart && port <= portRangeEnd {
+			usage.Free--
+		}
+	}
+	usage.Utilization = float64(usage.Total-usage.Free) * 100 / float64(usage.Total)
+
+	return usage, nil
+}
+
+// ReassignPortAssignment moves an active port assignment to a free port in the
+// tunnel port range, preferring its team's reserved ranges, and returns it as moved
+func (r *Repository) ReassignPortAssignment(ctx context.Context, assignmentID uuid.UUID) (*PortAssignment, error) {
+	tx, err := r.db.BeginTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	assignment := &PortAssignment{}
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at, subdomain, rate_limit_bps, bind_address
+		FROM port_assignments WHERE id = $1 AND is_reserved = true
+		FOR UPDATE`, assignmentID).Scan(
+		&assignment.ID, &assignment.TeamID, &assignment.TokenID, &assignment.Port,
+		&assignment.Protocol, &assignment.IsReserved, &assignment.CreatedAt, &assignment.UpdatedAt, &assignment.Subdomain, &assignment.RateLimitBPS, &assignment.BindAddress)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("port assignment not found")
+		}
+		return nil, fmt.Errorf("failed to get port assignment: %w", err)
+	}
+	oldPort := assignment.Port
+
+	taken := map[int]bool{oldPort: true}
+	for attempt := 0; attempt < maxPortAssignAttempts; attempt++ {
+		port, err := r.findAvailablePortInTx(ctx, tx, assignment.TeamID, assignment.Protocol, taken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find available port: %w", err)
+		}
+
+		if err := r.db.SetPortLock(port, assignment.TokenID, 10*time.Minute); err != nil && !errors.Is(err, ErrRedisUnavailable) {
+			slog.Debug("failed to acquire port lock; relying on the database", "port", port, "error", err)
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			UPDATE port_assignments SET port = $2, updated_at = NOW()
+			WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM port_assignments WHERE port = $2 AND protocol = $3)
+			RETURNING port, updated_at`,
+			assignment.ID, port, assignment.Protocol).Scan(&assignment.Port, &assignment.UpdatedAt)
+		if err == sql.ErrNoRows {
+			// An unreserved assignment still holds the port; try the next one
+			r.db.ReleasePortLock(port, assignment.TokenID)
+			taken[port] = true
+			continue
+		}
+		if err != nil {
+			r.db.ReleasePortLock(port, assignment.TokenID)
+			return nil, fmt.Errorf("failed to reassign port: %w", err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			r.db.ReleasePortLock(port, assignment.TokenID)
+			return nil, fmt.Errorf("failed to commit port reassignment: %w", err)
+		}
+		r.db.ReleasePortLock(oldPort, assignment.TokenID)
+		return assignment, nil
+	}
+
+	return nil, fmt.Errorf("failed to reassign port after %d attempts", maxPortAssignAttempts)
+}
+
+// listPortRangesInTx returns every team's reserved port ranges, lowest first
+func (r *Repository) listPortRangesInTx(ctx context.Context, tx *sql.Tx) ([]PortRange, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, team_id, start_port, end_port, created_at FROM team_port_ranges ORDER BY start_port`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query port ranges: %w", err)
+	}
+	defer rows.Close()
+
+	var ranges []PortRange
+	for rows.Next() {
+		var pr PortRange
+		if err := rows.Scan(&pr.ID, &pr.TeamID, &pr.StartPort, &pr.EndPort, &pr.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan port range: %w", err)
+		}
+		ranges = append(ranges, pr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query port ranges: %w", err)
+	}
+	return ranges, nil
+}
+
+// ReservePortRange reserves the ports from start to end, inclusive, for a team. Its
+// new port assignments are taken from the range first, and other teams are never
+// given a port inside it. The range must lie within the tunnel port range and may
+// neither overlap another team's range nor contain ports assigned to another team;
+// ErrPortRangeConflict says which.
+func (r *Repository) ReservePortRange(ctx context.Context, teamID string, start, end int) (*PortRange, error) {
+	if start > end {
+		return nil, fmt.Errorf("invalid port range %d-%d: start is after end", start, end)
+	}
+	if start < portRangeStart || end > portRangeEnd {
+		return nil, fmt.Errorf("invalid port range %d-%d: ports must be within %d-%d", start, end, portRangeStart, portRangeEnd)
+	}
+
+	tx, err := r.db.BeginTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Keep concurrent reservations from both passing the overlap check
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE team_port_ranges IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return nil, fmt.Errorf("failed to lock port ranges: %w", err)
+	}
+
+	var teamExists bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM public."Team" WHERE id = $1 AND deleted = false)`, teamID).Scan(&teamExists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check team existence: %w", err)
+	}
+	if !teamExists {
+		return nil, ErrTeamNotFound
+	}
 
-	return 0, fmt.Errorf("no available ports in range %d-%d", startPort, endPort)
+	var other PortRange
+	err = tx.QueryRowContext(ctx, `
+		SELECT team_id, start_port, end_port FROM team_port_ranges
+		WHERE start_port <= $2 AND end_port >= $1
+		ORDER BY start_port LIMIT 1`, start, end).Scan(&other.TeamID, &other.StartPort, &other.EndPort)
+	if err == nil {
+		if other.TeamID == teamID {
+			return nil, fmt.Errorf("%w: overlaps the team's range %d-%d", ErrPortRangeConflict, other.StartPort, other.EndPort)
+		}
+		return nil, fmt.Errorf("%w: overlaps range %d-%d of team %s", ErrPortRangeConflict, other.StartPort, other.EndPort, other.TeamID)
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to check port range overlap: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT DISTINCT port FROM port_assignments
+		WHERE port BETWEEN $1 AND $2 AND team_id <> $3
+		ORDER BY port`, start, end, teamID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check assigned ports: %w", err)
+	}
+	var assigned []string
+	for rows.Next() {
+		var port int
+		if err := rows.Scan(&port); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan port: %w", err)
+		}
+		assigned = append(assigned, strconv.Itoa(port))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to check assigned ports: %w", err)
+	}
+	if len(assigned) > 0 {
+		return nil, fmt.Errorf("%w: port(s) %s already assigned to other teams", ErrPortRangeConflict, strings.Join(assigned, ", "))
+	}
+
+	pr := &PortRange{}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO team_port_ranges (team_id, start_port, end_port)
+		VALUES ($1, $2, $3)
+		RETURNING id, team_id, start_port, end_port, created_at`, teamID, start, end).
+		Scan(&pr.ID, &pr.TeamID, &pr.StartPort, &pr.EndPort, &pr.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve port range: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return pr, nil
 }
 
 // Team Token operations
@@ -228,10 +823,12 @@ func (r *Repository) GetTeamTokenByToken(ctx context.Context, token string) (*Te
 	teamToken := &TeamToken{}
 	query := `
 		SELECT t.id, t.team_id, t.token, t.name, t.description, t.created_at,
-		       t.expires_at, t.last_used_at, t.is_active,
-		       "Team".id, "Team".name, "Team".description, NOT "Team".deleted as is_active
+		       t.expires_at, t.last_used_at, t.is_active, t.allowed_local_ports, t.allow_public_bind,
+		       "Team".id, "Team".name, "Team".description, NOT "Team".deleted as is_active,
+		       COALESCE(q.max_concurrent_tunnels, 0), COALESCE(q.max_daily_connections, 0)
 		FROM team_tokens t
 		JOIN "Team" ON t.team_id = "Team".id AND "Team".deleted = false
+		LEFT JOIN team_quotas q ON q.team_id = t.team_id
 		WHERE t.token = $1 AND t.is_active = true
 		  AND (t.expires_at IS NULL OR t.expires_at > NOW())`
 
@@ -239,14 +836,15 @@ func (r *Repository) GetTeamTokenByToken(ctx context.Context, token string) (*Te
 	err := r.db.DB.QueryRowContext(ctx, query, token).Scan(
 		&teamToken.ID, &teamToken.TeamID, &teamToken.Token, &teamToken.Name,
 		&teamToken.Description, &teamToken.CreatedAt, &teamToken.ExpiresAt,
-		&teamToken.LastUsedAt, &teamToken.IsActive,
+		&teamToken.LastUsedAt, &teamToken.IsActive, pq.Array(&teamToken.AllowedLocalPorts), &teamToken.AllowPublicBind,
 		&team.ID, &team.Name, &team.Description, &team.IsActive,
+		&team.MaxConcurrentTunnels, &team.MaxDailyConnections,
 	)
 
 	if err != nil {
-		fmt.Println("error", err)
+		slog.Debug("team token lookup failed", "error", err)
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("token not found or expired")
+			return nil, ErrInvalidToken
 		}
 		return nil, fmt.Errorf("failed to get team token: %w", err)
 	}
@@ -258,6 +856,7 @@ func (r *Repository) GetTeamTokenByToken(ctx context.Context, token string) (*Te
 type TokenRow struct {
 	TeamID, TeamName, TeamDesc, TeamCreated                                         string
 	TokenID, TokenName, Token, TokenDesc, TokenCreated, TokenExpires, TokenLastUsed *string
+	TokenLastUsedIP, TokenLastUsedCountry                                           *string
 	Port                                                                            *int
 	Protocol                                                                        *string
 }
@@ -270,6 +869,7 @@ func (r *Repository) ListTeamsWithTokens(ctx context.Context) ([]TokenRow, error
 			t.id, t.name, COALESCE(t.description, '') as description, 
 			COALESCE(t."createdAt", NOW()) as created_at,
 			tt.id, tt.name, tt.token, tt.description, tt.created_at, tt.expires_at, tt.last_used_at,
+			tt.last_used_ip, tt.last_used_country,
 			pa.port, pa.protocol
 		FROM public."Team" t
 		LEFT JOIN team_tokens tt ON t.id = tt.team_id AND tt.is_active = true
@@ -290,12 +890,14 @@ func (r *Repository) ListTeamsWithTokens(ctx context.Context) ([]TokenRow, error
 		var (
 			teamID, teamName, teamDesc, teamCreated                                         string
 			tokenID, tokenName, token, tokenDesc, tokenCreated, tokenExpires, tokenLastUsed *string
+			tokenLastUsedIP, tokenLastUsedCountry                                           *string
 			port                                                                            *int
 			protocol                                                                        *string
 		)
 		err := rows.Scan(
 			&teamID, &teamName, &teamDesc, &teamCreated,
 			&tokenID, &tokenName, &token, &tokenDesc, &tokenCreated, &tokenExpires, &tokenLastUsed,
+			&tokenLastUsedIP, &tokenLastUsedCountry,
 			&port, &protocol,
 		)
 		if err != nil {
@@ -316,6 +918,9 @@ func (r *Repository) ListTeamsWithTokens(ctx context.Context) ([]TokenRow, error
 			TokenLastUsed: tokenLastUsed,
 			Port:          port,
 			Protocol:      protocol,
+
+			TokenLastUsedIP:      tokenLastUsedIP,
+			TokenLastUsedCountry: tokenLastUsedCountry,
 		})
 	}
 
@@ -324,7 +929,7 @@ func (r *Repository) ListTeamsWithTokens(ctx context.Context) ([]TokenRow, error
 
 // ListTokensByTeamID retrieves all tokens for a team
 func (r *Repository) ListTokensByTeamID(ctx context.Context, teamID string) ([]TeamToken, error) {
-	query := `SELECT id, team_id, token, name, description, created_at, expires_at, last_used_at, is_active FROM team_tokens WHERE team_id = $1`
+	query := `SELECT id, team_id, token, name, description, created_at, expires_at, last_used_at, is_active, last_used_ip, last_used_country FROM team_tokens WHERE team_id = $1`
 
 	rows, err := r.db.DB.QueryContext(ctx, query, teamID)
 	if err != nil {
@@ -335,7 +940,7 @@ func (r *Repository) ListTokensByTeamID(ctx context.Context, teamID string) ([]T
 	var tokens []TeamToken
 	for rows.Next() {
 		var token TeamToken
-		err := rows.Scan(&token.ID, &token.TeamID, &token.Token, &token.Name, &token.Description, &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt, &token.IsActive)
+		err := rows.Scan(&token.ID, &token.TeamID, &token.Token, &token.Name, &token.Description, &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt, &token.IsActive, &token.LastUsedIP, &token.LastUsedCountry)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan token: %w", err)
 		}
@@ -346,11 +951,15 @@ func (r *Repository) ListTokensByTeamID(ctx context.Context, teamID string) ([]T
 	return tokens, nil
 }
 
-// UpdateTokenLastUsed updates the last used timestamp for a token
-func (r *Repository) UpdateTokenLastUsed(ctx context.Context, tokenID uuid.UUID) error {
-	query := `UPDATE team_tokens SET last_used_at = NOW() WHERE id = $1`
+// UpdateTokenLastUsed records that a token was used now, from clientIP in country.
+// Either may be empty when unknown.
+func (r *Repository) UpdateTokenLastUsed(ctx context.Context, tokenID uuid.UUID, clientIP, country string) error {
+	query := `
+		UPDATE team_tokens
+		SET last_used_at = NOW(), last_used_ip = NULLIF($2, ''), last_used_country = NULLIF($3, '')
+		WHERE id = $1`
 
-	_, err := r.db.DB.ExecContext(ctx, query, tokenID)
+	_, err := r.db.DB.ExecContext(ctx, query, tokenID, clientIP, country)
 	if err != nil {
 		return fmt.Errorf("failed to update token last used: %w", err)
 	}
@@ -364,20 +973,22 @@ func (r *Repository) UpdateTokenLastUsed(ctx context.Context, tokenID uuid.UUID)
 func (r *Repository) GetPortAssignmentByToken(ctx context.Context, tokenID uuid.UUID) (*PortAssignment, error) {
 	assignment := &PortAssignment{}
 	query := `
-		SELECT pa.id, pa.team_id, pa.token_id, pa.port, pa.protocol, pa.is_reserved, pa.created_at, pa.updated_at,
+		SELECT pa.id, pa.team_id, pa.token_id, pa.port, pa.protocol, pa.is_reserved, pa.created_at, pa.updated_at, pa.subdomain, pa.rate_limit_bps, pa.bind_address,
 		       t.id, t.name, t.description, NOT t.deleted as is_active,
 		       tt.id, tt.team_id, tt.token, tt.name, tt.description, tt.created_at, tt.expires_at, tt.last_used_at, tt.is_active
 		FROM port_assignments pa
 		JOIN "Team" t ON pa.team_id = t.id AND t.deleted = false
 		JOIN team_tokens tt ON pa.token_id = tt.id
-		WHERE pa.token_id = $1 AND pa.is_reserved = true`
+		WHERE pa.token_id = $1 AND pa.is_reserved = true
+		ORDER BY pa.created_at
+		LIMIT 1`
 
 	team := &Team{}
 	token := &TeamToken{}
 
 	err := r.db.DB.QueryRowContext(ctx, query, tokenID).Scan(
 		&assignment.ID, &assignment.TeamID, &assignment.TokenID, &assignment.Port,
-		&assignment.Protocol, &assignment.IsReserved, &assignment.CreatedAt, &assignment.UpdatedAt,
+		&assignment.Protocol, &assignment.IsReserved, &assignment.CreatedAt, &assignment.UpdatedAt, &assignment.Subdomain, &assignment.RateLimitBPS, &assignment.BindAddress,
 		&team.ID, &team.Name, &team.Description, &team.IsActive,
 		&token.ID, &token.TeamID, &token.Token, &token.Name, &token.Description,
 		&token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt, &token.IsActive,
@@ -399,12 +1010,12 @@ func (r *Repository) GetPortAssignmentByToken(ctx context.Context, tokenID uuid.
 func (r *Repository) GetPortAssignmentByPort(ctx context.Context, port int, protocol string) (*PortAssignment, error) {
 	assignment := &PortAssignment{}
 	query := `
-		SELECT id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at
+		SELECT id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at, subdomain, rate_limit_bps, bind_address
 		FROM port_assignments WHERE port = $1 AND protocol = $2 AND is_reserved = true`
 
 	err := r.db.DB.QueryRowContext(ctx, query, port, protocol).Scan(
 		&assignment.ID, &assignment.TeamID, &assignment.TokenID, &assignment.Port,
-		&assignment.Protocol, &assignment.IsReserved, &assignment.CreatedAt, &assignment.UpdatedAt,
+		&assignment.Protocol, &assignment.IsReserved, &assignment.CreatedAt, &assignment.UpdatedAt, &assignment.Subdomain, &assignment.RateLimitBPS, &assignment.BindAddress,
 	)
 
 	if err != nil {
@@ -419,7 +1030,7 @@ func (r *Repository) GetPortAssignmentByPort(ctx context.Context, port int, prot
 
 // ListPortAssignmentsByTeamID retrieves all port assignments for a team
 func (r *Repository) ListPortAssignmentsByTeamID(ctx context.Context, teamID string) ([]PortAssignment, error) {
-	query := `SELECT id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at FROM port_assignments WHERE team_id = $1 AND is_reserved = true`
+	query := `SELECT id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at, subdomain, rate_limit_bps, bind_address FROM port_assignments WHERE team_id = $1 AND is_reserved = true`
 
 	rows, err := r.db.DB.QueryContext(ctx, query, teamID)
 	if err != nil {
@@ -431,7 +1042,7 @@ func (r *Repository) ListPortAssignmentsByTeamID(ctx context.Context, teamID str
 	for rows.Next() {
 		var assignment PortAssignment
 		err := rows.Scan(&assignment.ID, &assignment.TeamID, &assignment.TokenID, &assignment.Port,
-			&assignment.Protocol, &assignment.IsReserved, &assignment.CreatedAt, &assignment.UpdatedAt)
+			&assignment.Protocol, &assignment.IsReserved, &assignment.CreatedAt, &assignment.UpdatedAt, &assignment.Subdomain, &assignment.RateLimitBPS, &assignment.BindAddress)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan port assignment: %w", err)
 		}
@@ -441,47 +1052,147 @@ func (r *Repository) ListPortAssignmentsByTeamID(ctx context.Context, teamID str
 	return assignments, nil
 }
 
-// Connection Session operations
-
-// CreateConnectionSession creates a new connection session
-func (r *Repository) CreateConnectionSession(ctx context.Context, teamID string, tokenID, portAssignID uuid.UUID, clientIP string, serverPort int, protocol string) (*ConnectionSession, error) {
-	session := &ConnectionSession{
-		ID:           uuid.New(),
-		TeamID:       teamID,
-		TokenID:      tokenID,
-		PortAssignID: portAssignID,
-		ClientIP:     clientIP,
-		ServerPort:   serverPort,
-		Protocol:     protocol,
-		StartedAt:    time.Now(),
-		LastSeenAt:   time.Now(),
-		Status:       "active",
-	}
-
+// ListPortAssignmentsByToken retrieves all reserved port assignments for a token, oldest first
+func (r *Repository) ListPortAssignmentsByToken(ctx context.Context, tokenID uuid.UUID) ([]PortAssignment, error) {
 	query := `
-		INSERT INTO connection_sessions (id, team_id, token_id, port_assign_id, client_ip, server_port, protocol, started_at, last_seen_at, status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		RETURNING id, team_id, token_id, port_assign_id, client_ip, server_port, protocol, started_at, last_seen_at, status`
-
-	err := r.db.DB.QueryRowContext(ctx, query,
-		session.ID, session.TeamID, session.TokenID, session.PortAssignID,
-		session.ClientIP, session.ServerPort, session.Protocol,
-		session.StartedAt, session.LastSeenAt, session.Status,
-	).Scan(&session.ID, &session.TeamID, &session.TokenID, &session.PortAssignID,
-		&session.ClientIP, &session.ServerPort, &session.Protocol,
-		&session.StartedAt, &session.LastSeenAt, &session.Status)
+		SELECT id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at, subdomain, rate_limit_bps, bind_address
+		FROM port_assignments WHERE token_id = $1 AND is_reserved = true
+		ORDER BY created_at`
 
+	rows, err := r.db.DB.QueryContext(ctx, query, tokenID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create connection session: %w", err)
+		return nil, fmt.Errorf("failed to query port assignments: %w", err)
 	}
+	defer rows.Close()
 
-	// Also store in Redis for fast access
-	if err := r.db.SetActiveSession(session.ID, session); err != nil {
-		// Log error but don't fail the operation
-		fmt.Printf("Warning: failed to store session in Redis: %v\n", err)
+	var assignments []PortAssignment
+	for rows.Next() {
+		var assignment PortAssignment
+		err := rows.Scan(&assignment.ID, &assignment.TeamID, &assignment.TokenID, &assignment.Port,
+			&assignment.Protocol, &assignment.IsReserved, &assignment.CreatedAt, &assignment.UpdatedAt, &assignment.Subdomain, &assignment.RateLimitBPS, &assignment.BindAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan port assignment: %w", err)
+		}
+		assignments = append(assignments, assignment)
+	}
+
+	return assignments, nil
+}
+
+// Connection Session operations
+
+// StartConnection creates a connection session and its log entry in one
+// transaction, so there is never a session without its log. With an idempotency
+// key, an active session of the token already created with the same key is
+// returned with its log instead, so a retried setup does not open a second one.
+func (r *Repository) StartConnection(ctx context.Context, teamID string, tokenID, portAssignID uuid.UUID, clientIP string, serverPort int, protocol, bindAddress, idempotencyKey string) (*ConnectionSession, *ConnectionLog, error) {
+	var session *ConnectionSession
+	var log *ConnectionLog
+	created := false
+
+	err := r.db.WithTx(ctx, func(tx *sql.Tx) error {
+		session = &ConnectionSession{
+			ID:           uuid.New(),
+			TeamID:       teamID,
+			TokenID:      tokenID,
+			PortAssignID: portAssignID,
+			ClientIP:     clientIP,
+			ServerPort:   serverPort,
+			Protocol:     protocol,
+			StartedAt:    time.Now(),
+			LastSeenAt:   time.Now(),
+			Status:       "active",
+		}
+		if bindAddress != "" {
+			session.BindAddress = &bindAddress
+		}
+		var err error
+		created, err = insertConnectionSession(ctx, tx, session, idempotencyKey)
+		if err != nil {
+			return err
+		}
+
+		if !created {
+			if session, err = getSessionByIdempotencyKey(ctx, tx, tokenID, idempotencyKey); err != nil {
+				return err
+			}
+			if log, err = getFirstConnectionLog(ctx, tx, session.ID); err != nil || log != nil {
+				return err
+			}
+			// A session left without a log before logs were created with it
+		}
+
+		log = &ConnectionLog{
+			ID:           uuid.New(),
+			TeamID:       session.TeamID,
+			TokenID:      session.TokenID,
+			PortAssignID: session.PortAssignID,
+			SessionID:    session.ID,
+			ClientIP:     session.ClientIP,
+			ServerPort:   session.ServerPort,
+			Protocol:     session.Protocol,
+			StartedAt:    time.Now(),
+			Status:       "active",
+		}
+		return insertConnectionLog(ctx, tx, log)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if created {
+		// Also store in Redis for fast access
+		if err := r.db.SetActiveSession(session.ID, session); err != nil {
+			// Log error but don't fail the operation
+			slog.Warn("failed to store session in Redis", "session_id", session.ID, "error", err)
+		}
 	}
 
-	return session, nil
+	return session, log, nil
+}
+
+// insertConnectionSession inserts session, reporting false without inserting
+// anything when an active session of the token already has idempotencyKey
+func insertConnectionSession(ctx context.Context, tx *sql.Tx, session *ConnectionSession, idempotencyKey string) (bool, error) {
+	query := `
+		INSERT INTO connection_sessions (id, team_id, token_id, port_assign_id, client_ip, server_port, protocol, started_at, last_seen_at, status, bind_address, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''))
+		ON CONFLICT (token_id, idempotency_key) WHERE idempotency_key IS NOT NULL AND status = 'active' DO NOTHING
+		RETURNING id, team_id, token_id, port_assign_id, client_ip, server_port, protocol, started_at, last_seen_at, status, bind_address`
+
+	err := tx.QueryRowContext(ctx, query,
+		session.ID, session.TeamID, session.TokenID, session.PortAssignID,
+		session.ClientIP, session.ServerPort, session.Protocol,
+		session.StartedAt, session.LastSeenAt, session.Status, session.BindAddress, idempotencyKey,
+	).Scan(&session.ID, &session.TeamID, &session.TokenID, &session.PortAssignID,
+		&session.ClientIP, &session.ServerPort, &session.Protocol,
+		&session.StartedAt, &session.LastSeenAt, &session.Status, &session.BindAddress)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to create connection session: %w", err)
+	}
+	return true, nil
+}
+
+// getSessionByIdempotencyKey returns the active session of a token created with idempotencyKey
+func getSessionByIdempotencyKey(ctx context.Context, tx *sql.Tx, tokenID uuid.UUID, idempotencyKey string) (*ConnectionSession, error) {
+	query := `
+		SELECT id, team_id, token_id, port_assign_id, client_ip, server_port, protocol, started_at, last_seen_at, status, bind_address
+		FROM connection_sessions
+		WHERE token_id = $1 AND idempotency_key = $2 AND status = 'active'`
+
+	var session ConnectionSession
+	err := tx.QueryRowContext(ctx, query, tokenID, idempotencyKey).Scan(
+		&session.ID, &session.TeamID, &session.TokenID, &session.PortAssignID,
+		&session.ClientIP, &session.ServerPort, &session.Protocol,
+		&session.StartedAt, &session.LastSeenAt, &session.Status, &session.BindAddress)
+	if err != nil {
+		// Ended between the conflicting insert and this read; the caller may retry
+		return nil, fmt.Errorf("failed to get connection session by idempotency key: %w", err)
+	}
+	return &session, nil
 }
 
 // UpdateSessionLastSeen updates the last seen timestamp for a session
@@ -508,7 +1219,7 @@ func (r *Repository) EndConnectionSession(ctx context.Context, sessionID uuid.UU
 	// Remove from Redis
 	if err := r.db.DeleteActiveSession(sessionID); err != nil {
 		// Log error but don't fail the operation
-		fmt.Printf("Warning: failed to remove session from Redis: %v\n", err)
+		slog.Warn("failed to remove session from Redis", "session_id", sessionID, "error", err)
 	}
 
 	return nil
@@ -516,30 +1227,14 @@ func (r *Repository) EndConnectionSession(ctx context.Context, sessionID uuid.UU
 
 // Connection Log operations
 
-// CreateConnectionLog creates a new connection log entry
-func (r *Repository) CreateConnectionLog(ctx context.Context, teamID string, tokenID, portAssignID, sessionID uuid.UUID, clientIP string, clientPort, serverPort int, protocol string) (*ConnectionLog, error) {
-	log := &ConnectionLog{
-		ID:            uuid.New(),
-		TeamID:        teamID,
-		TokenID:       tokenID,
-		PortAssignID:  portAssignID,
-		SessionID:     sessionID,
-		ClientIP:      clientIP,
-		ClientPort:    clientPort,
-		ServerPort:    serverPort,
-		Protocol:      protocol,
-		StartedAt:     time.Now(),
-		BytesReceived: 0,
-		BytesSent:     0,
-		Status:        "active",
-	}
-
+// insertConnectionLog inserts a connection log entry
+func insertConnectionLog(ctx context.Context, tx *sql.Tx, log *ConnectionLog) error {
 	query := `
 		INSERT INTO connection_logs (id, team_id, token_id, port_assign_id, session_id, client_ip, client_port, server_port, protocol, started_at, bytes_received, bytes_sent, status)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 		RETURNING id, team_id, token_id, port_assign_id, session_id, client_ip, client_port, server_port, protocol, started_at, ended_at, bytes_received, bytes_sent, connection_time_ms, status, error_message, user_agent, request_path`
 
-	err := r.db.DB.QueryRowContext(ctx, query,
+	err := tx.QueryRowContext(ctx, query,
 		log.ID, log.TeamID, log.TokenID, log.PortAssignID, log.SessionID,
 		log.ClientIP, log.ClientPort, log.ServerPort, log.Protocol,
 		log.StartedAt, log.BytesReceived, log.BytesSent, log.Status,
@@ -547,22 +1242,50 @@ func (r *Repository) CreateConnectionLog(ctx context.Context, teamID string, tok
 		&log.ClientIP, &log.ClientPort, &log.ServerPort, &log.Protocol,
 		&log.StartedAt, &log.EndedAt, &log.BytesReceived, &log.BytesSent,
 		&log.ConnectionTime, &log.Status, &log.ErrorMessage, &log.UserAgent, &log.RequestPath)
+	if err != nil {
+		return fmt.Errorf("failed to create connection log: %w", err)
+	}
+	return nil
+}
 
+// getFirstConnectionLog returns the first log entry of a session, or nil if it has none
+func getFirstConnectionLog(ctx context.Context, tx *sql.Tx, sessionID uuid.UUID) (*ConnectionLog, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM connection_logs
+		WHERE session_id = $1
+		ORDER BY started_at, id
+		LIMIT 1`, connectionLogColumns)
+
+	rows, err := tx.QueryContext(ctx, query, sessionID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create connection log: %w", err)
+		return nil, fmt.Errorf("failed to get connection log: %w", err)
 	}
+	defer rows.Close()
 
-	return log, nil
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to get connection log: %w", err)
+		}
+		return nil, nil
+	}
+	log, err := scanConnectionLog(rows)
+	if err != nil {
+		return nil, err
+	}
+	return &log, nil
 }
 
-// UpdateConnectionLogStats updates the bytes sent/received for a connection log
-func (r *Repository) UpdateConnectionLogStats(ctx context.Context, logID uuid.UUID, bytesReceived, bytesSent int64) error {
+// UpdateConnectionLogStats updates the bytes sent/received for a connection log, both
+// as seen by the external peer and as carried on the (possibly compressed) data connection
+func (r *Repository) UpdateConnectionLogStats(ctx context.Context, logID uuid.UUID, bytesReceived, bytesSent, wireReceived, wireSent int64) error {
 	query := `
 		UPDATE connection_logs 
-		SET bytes_received = bytes_received + $2, bytes_sent = bytes_sent + $3
+		SET bytes_received = bytes_received + $2, bytes_sent = bytes_sent + $3,
+		    wire_bytes_received = wire_bytes_received + $4, wire_bytes_sent = wire_bytes_sent + $5
 		WHERE id = $1`
 
-	_, err := r.db.DB.ExecContext(ctx, query, logID, bytesReceived, bytesSent)
+	_, err := r.db.DB.ExecContext(ctx, query, logID, bytesReceived, bytesSent, wireReceived, wireSent)
 	if err != nil {
 		return fmt.Errorf("failed to update connection log stats: %w", err)
 	}
@@ -570,11 +1293,12 @@ func (r *Repository) UpdateConnectionLogStats(ctx context.Context, logID uuid.UU
 	return nil
 }
 
-// EndConnectionLog closes a connection log entry
+// EndConnectionLog closes a connection log entry, recording how long it was open
 func (r *Repository) EndConnectionLog(ctx context.Context, logID uuid.UUID, status string, errorMessage *string) error {
 	query := `
 		UPDATE connection_logs 
-		SET ended_at = NOW(), status = $2, error_message = $3
+		SET ended_at = NOW(), status = $2, error_message = $3,
+		    connection_time_ms = (EXTRACT(EPOCH FROM (NOW() - started_at)) * 1000)::BIGINT
 		WHERE id = $1`
 
 	_, err := r.db.DB.ExecContext(ctx, query, logID, status, errorMessage)
@@ -585,6 +1309,68 @@ func (r *Repository) EndConnectionLog(ctx context.Context, logID uuid.UUID, stat
 	return nil
 }
 
+// EndConnectionLogs records the final state of several connections in one
+// transaction, ending each connection's log entry and session
+func (r *Repository) EndConnectionLogs(ctx context.Context, results []ConnectionResult) error {
+	tx, err := r.db.BeginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	endLog, err := tx.PrepareContext(ctx, `
+		UPDATE connection_logs
+		SET bytes_received = bytes_received + $2, bytes_sent = bytes_sent + $3,
+		    wire_bytes_received = wire_bytes_received + $4, wire_bytes_sent = wire_bytes_sent + $5,
+		    ended_at = $6::TIMESTAMPTZ, status = $7, error_message = $8,
+		    connection_time_ms = (EXTRACT(EPOCH FROM ($6::TIMESTAMPTZ - started_at)) * 1000)::BIGINT,
+		    protocol = CASE WHEN $10::TEXT IS NULL THEN protocol ELSE 'http' END,
+		    user_agent = COALESCE($9, user_agent), request_path = COALESCE($10, request_path)
+		WHERE id = $1`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare connection log update: %w", err)
+	}
+	defer endLog.Close()
+
+	sessionIDs := make([]uuid.UUID, 0, len(results))
+	seen := make(map[uuid.UUID]bool, len(results))
+	for _, result := range results {
+		if result.LogID != uuid.Nil {
+			if _, err := endLog.ExecContext(ctx, result.LogID,
+				result.BytesReceived, result.BytesSent, result.WireBytesReceived, result.WireBytesSent,
+				result.EndedAt, result.Status, result.ErrorMessage, result.UserAgent, result.RequestPath); err != nil {
+				return fmt.Errorf("failed to end connection log %s: %w", result.LogID, err)
+			}
+		}
+		if !seen[result.SessionID] {
+			seen[result.SessionID] = true
+			sessionIDs = append(sessionIDs, result.SessionID)
+		}
+	}
+
+	ids := make([]string, len(sessionIDs))
+	for i, id := range sessionIDs {
+		ids[i] = id.String()
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE connection_sessions SET status = 'inactive', last_seen_at = NOW() WHERE id = ANY($1::uuid[])`,
+		pq.Array(ids)); err != nil {
+		return fmt.Errorf("failed to end connection sessions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit connection results: %w", err)
+	}
+
+	for _, id := range sessionIDs {
+		if err := r.db.DeleteActiveSession(id); err != nil {
+			slog.Warn("failed to remove session from Redis", "session_id", id, "error", err)
+		}
+	}
+
+	return nil
+}
+
 // GetConnectionStats retrieves connection statistics for a team
 func (r *Repository) GetConnectionStats(ctx context.Context, teamID string, from, to time.Time) ([]ConnectionStats, error) {
 	query := `
@@ -615,6 +1401,227 @@ func (r *Repository) GetConnectionStats(ctx context.Context, teamID string, from
 	return stats, nil
 }
 
+// AggregateConnectionStats rolls connection logs up into connection_stats, one row
+// per team per day. Every day with a connection that started or ended at or after
+// since is recomputed in full, so running it again, or over overlapping periods,
+// gives the same result. It returns the number of days written.
+func (r *Repository) AggregateConnectionStats(ctx context.Context, since time.Time) (int64, error) {
+	query := `
+		INSERT INTO connection_stats (team_id, date, total_connections, active_connections,
+		                              total_bytes_received, total_bytes_sent, avg_connection_time_ms, updated_at)
+		SELECT cl.team_id, DATE(cl.started_at), COUNT(*),
+		       COUNT(CASE WHEN cl.status = 'active' THEN 1 END),
+		       COALESCE(SUM(cl.bytes_received), 0), COALESCE(SUM(cl.bytes_sent), 0),
+		       COALESCE(AVG(cl.connection_time_ms), 0), NOW()
+		FROM connection_logs cl
+		WHERE (cl.team_id, DATE(cl.started_at)) IN (
+			SELECT DISTINCT team_id, DATE(started_at) FROM connection_logs
+			WHERE started_at >= $1 OR ended_at >= $1)
+		GROUP BY cl.team_id, DATE(cl.started_at)
+		ON CONFLICT (team_id, date) DO UPDATE
+		SET total_connections = EXCLUDED.total_connections,
+		    active_connections = EXCLUDED.active_connections,
+		    total_bytes_received = EXCLUDED.total_bytes_received,
+		    total_bytes_sent = EXCLUDED.total_bytes_sent,
+		    avg_connection_time_ms = EXCLUDED.avg_connection_time_ms,
+		    updated_at = NOW()`
+
+	result, err := r.db.DB.ExecContext(ctx, query, since)
+	if err != nil {
+		return 0, fmt.Errorf("failed to aggregate connection stats: %w", err)
+	}
+	days, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to aggregate connection stats: %w", err)
+	}
+	return days, nil
+}
+
+// connectionLogColumns are the connection_logs columns read by scanConnectionLog
+const connectionLogColumns = `id, team_id, token_id, port_assign_id, session_id, client_ip,
+		       client_port, server_port, protocol, started_at, ended_at,
+		       COALESCE(bytes_received, 0), COALESCE(bytes_sent, 0),
+		       wire_bytes_received, wire_bytes_sent, connection_time_ms,
+		       COALESCE(status, 'active'), error_message, user_agent, request_path`
+
+// connectionLogWhere builds the WHERE clause and arguments selecting the logs
+// matching filter; Limit and Offset are left to the caller
+func connectionLogWhere(filter ConnectionLogFilter) (string, []interface{}) {
+	conditions := []string{"team_id = $1"}
+	args := []interface{}{filter.TeamID}
+
+	if filter.From != nil {
+		args = append(args, *filter.From)
+		conditions = append(conditions, fmt.Sprintf("started_at >= $%d", len(args)))
+	}
+	if filter.To != nil {
+		args = append(args, *filter.To)
+		conditions = append(conditions, fmt.Sprintf("started_at <= $%d", len(args)))
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// scanConnectionLog reads one row selected with connectionLogColumns
+func scanConnectionLog(rows *sql.Rows) (ConnectionLog, error) {
+	var entry ConnectionLog
+	var clientPort sql.NullInt64
+	err := rows.Scan(
+		&entry.ID, &entry.TeamID, &entry.TokenID, &entry.PortAssignID, &entry.SessionID,
+		&entry.ClientIP, &clientPort, &entry.ServerPort, &entry.Protocol,
+		&entry.StartedAt, &entry.EndedAt, &entry.BytesReceived, &entry.BytesSent,
+		&entry.WireBytesReceived, &entry.WireBytesSent, &entry.ConnectionTime, &entry.Status, &entry.ErrorMessage, &entry.UserAgent,
+		&entry.RequestPath,
+	)
+	if err != nil {
+		return entry, fmt.Errorf("failed to scan connection log: %w", err)
+	}
+	entry.ClientPort = int(clientPort.Int64)
+	return entry, nil
+}
+
+// ListConnectionLogs returns one page of a team's connection logs, newest first,
+// along with the total number of logs matching the filter
+func (r *Repository) ListConnectionLogs(ctx context.Context, filter ConnectionLogFilter) ([]ConnectionLog, int, error) {
+	where, args := connectionLogWhere(filter)
+
+	var total int
+	countQuery := `SELECT COUNT(*) FROM connection_logs WHERE ` + where
+	if err := r.db.DB.QueryRowContext(ctx, countQuery, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count connection logs: %w", err)
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM connection_logs
+		WHERE %s
+		ORDER BY started_at DESC
+		LIMIT $%d OFFSET $%d`, connectionLogColumns, where, len(args)-1, len(args))
+
+	rows, err := r.db.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list connection logs: %w", err)
+	}
+	defer rows.Close()
+
+	logs := []ConnectionLog{}
+	for rows.Next() {
+		entry, err := scanConnectionLog(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		logs = append(logs, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to iterate connection logs: %w", err)
+	}
+
+	return logs, total, nil
+}
+
+// StreamConnectionLogs calls fn for each of a team's connection logs matching
+// filter, oldest first, without holding them all in memory. Limit and Offset
+// are ignored. Iteration stops at the first error fn returns.
+func (r *Repository) StreamConnectionLogs(ctx context.Context, filter ConnectionLogFilter, fn func(ConnectionLog) error) error {
+	where, args := connectionLogWhere(filter)
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM connection_logs
+		WHERE %s
+		ORDER BY started_at, id`, connectionLogColumns, where)
+
+	rows, err := r.db.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to stream connection logs: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanConnectionLog(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate connection logs: %w", err)
+	}
+	return nil
+}
+
+// RecordAuditEvent appends event to the audit log. ID and CreatedAt are set by
+// the database; an empty Target or nil ActorIP is stored as NULL.
+func (r *Repository) RecordAuditEvent(ctx context.Context, event AuditEvent) error {
+	// Sent as text: lib/pq would send []byte as bytea, which is not valid JSONB
+	var metadata sql.NullString
+	if len(event.Metadata) > 0 {
+		encoded, err := json.Marshal(event.Metadata)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit metadata: %w", err)
+		}
+		metadata = sql.NullString{String: string(encoded), Valid: true}
+	}
+
+	query := `
+		INSERT INTO audit_log (actor, actor_ip, action, target, outcome, error_message, metadata)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7)`
+	if _, err := r.db.DB.ExecContext(ctx, query, event.Actor, event.ActorIP, event.Action, event.Target,
+		event.Outcome, event.ErrorMessage, metadata); err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
+
+// ListAuditEvents returns one page of the audit log, newest first, along with the
+// total number of events
+func (r *Repository) ListAuditEvents(ctx context.Context, limit, offset int) ([]AuditEvent, int, error) {
+	var total int
+	if err := r.db.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM audit_log`).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count audit events: %w", err)
+	}
+
+	query := `
+		SELECT id, created_at, actor, actor_ip, action, COALESCE(target, ''), outcome, error_message, metadata
+		FROM audit_log
+		ORDER BY created_at DESC, id
+		LIMIT $1 OFFSET $2`
+	rows, err := r.db.DB.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list audit events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		var metadata []byte
+		if err := rows.Scan(&event.ID, &event.CreatedAt, &event.Actor, &event.ActorIP, &event.Action,
+			&event.Target, &event.Outcome, &event.ErrorMessage, &metadata); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		if len(metadata) > 0 {
+			if err := json.Unmarshal(metadata, &event.Metadata); err != nil {
+				return nil, 0, fmt.Errorf("failed to decode audit metadata: %w", err)
+			}
+		}
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to iterate audit events: %w", err)
+	}
+
+	return events, total, nil
+}
+
 // generateSecureToken generates a cryptographically secure token
 func generateSecureToken() (string, error) {
 	// Generate 32 random bytes
@@ -667,11 +1674,11 @@ func (r *Repository) GetSessionWithDetails(ctx context.Context, sessionID uuid.U
 	query := `
 		SELECT 
 			cs.id, cs.team_id, cs.token_id, cs.port_assign_id, cs.client_ip, 
-			cs.server_port, cs.protocol, cs.started_at, cs.last_seen_at, cs.status,
+			cs.server_port, cs.protocol, cs.started_at, cs.last_seen_at, cs.status, cs.bind_address,
 			tt.id, tt.team_id, tt.token, tt.name, tt.description, tt.created_at, 
-			tt.expires_at, tt.last_used_at, tt.is_active,
+			tt.expires_at, tt.last_used_at, tt.is_active, tt.allow_public_bind,
 			pa.id, pa.team_id, pa.token_id, pa.port, pa.protocol, pa.is_reserved,
-			pa.created_at, pa.updated_at
+			pa.created_at, pa.updated_at, pa.subdomain, pa.rate_limit_bps, pa.bind_address
 		FROM connection_sessions cs
 		JOIN team_tokens tt ON cs.token_id = tt.id
 		JOIN port_assignments pa ON cs.port_assign_id = pa.id
@@ -684,12 +1691,12 @@ func (r *Repository) GetSessionWithDetails(ctx context.Context, sessionID uuid.U
 	err := r.db.DB.QueryRowContext(ctx, query, sessionID).Scan(
 		&session.ID, &session.TeamID, &session.TokenID, &session.PortAssignID,
 		&session.ClientIP, &session.ServerPort, &session.Protocol,
-		&session.StartedAt, &session.LastSeenAt, &session.Status,
+		&session.StartedAt, &session.LastSeenAt, &session.Status, &session.BindAddress,
 		&token.ID, &token.TeamID, &token.Token, &token.Name, &token.Description,
-		&token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt, &token.IsActive,
+		&token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt, &token.IsActive, &token.AllowPublicBind,
 		&portAssignment.ID, &portAssignment.TeamID, &portAssignment.TokenID,
 		&portAssignment.Port, &portAssignment.Protocol, &portAssignment.IsReserved,
-		&portAssignment.CreatedAt, &portAssignment.UpdatedAt,
+		&portAssignment.CreatedAt, &portAssignment.UpdatedAt, &portAssignment.Subdomain, &portAssignment.RateLimitBPS, &portAssignment.BindAddress,
 	)
 
 	if err != nil {
@@ -724,6 +1731,225 @@ func (r *Repository) MarkStaleSessionsInactive(ctx context.Context, staleThresho
 	return int(rowsAffected), nil
 }
 
+// RevokeToken deactivates a token and releases its port assignments, returning the released assignments
+func (r *Repository) RevokeToken(ctx context.Context, tokenID uuid.UUID) ([]PortAssignment, error) {
+	tx, err := r.db.BeginTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE team_tokens SET is_active = false WHERE id = $1 AND is_active = true`, tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke token: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if rowsAffected == 0 {
+		return nil, ErrTokenNotFound
+	}
+
+	query := `
+		DELETE FROM port_assignments WHERE token_id = $1
+		RETURNING id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at, subdomain, rate_limit_bps, bind_address`
+
+	rows, err := tx.QueryContext(ctx, query, tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to release port assignments: %w", err)
+	}
+	defer rows.Close()
+
+	var assignments []PortAssignment
+	for rows.Next() {
+		var pa PortAssignment
+		err := rows.Scan(&pa.ID, &pa.TeamID, &pa.TokenID, &pa.Port,
+			&pa.Protocol, &pa.IsReserved, &pa.CreatedAt, &pa.UpdatedAt, &pa.Subdomain, &pa.RateLimitBPS, &pa.BindAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan port assignment: %w", err)
+		}
+		assignments = append(assignments, pa)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to release port assignments: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	for _, pa := range assignments {
+		r.db.ReleasePortLock(pa.Port, pa.TokenID)
+	}
+
+	return assignments, nil
+}
+
+// DeactivateTeam soft-deletes a team, deactivates all of its tokens and releases all
+// of its port assignments in one transaction. It returns the released assignments,
+// so live tunnels on those ports can be closed, and the number of tokens deactivated.
+func (r *Repository) DeactivateTeam(ctx context.Context, teamID string) ([]PortAssignment, int, error) {
+	tx, err := r.db.BeginTx(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		`UPDATE public."Team" SET deleted = true, "updatedAt" = NOW() WHERE id = $1 AND deleted = false`, teamID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to delete team: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if rowsAffected == 0 {
+		return nil, 0, ErrTeamNotFound
+	}
+
+	result, err = tx.ExecContext(ctx, `UPDATE team_tokens SET is_active = false WHERE team_id = $1 AND is_active = true`, teamID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to deactivate tokens: %w", err)
+	}
+	tokens, err := result.RowsAffected()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+
+	// Ports reserved for the team go back to the shared pool
+	if _, err := tx.ExecContext(ctx, `DELETE FROM team_port_ranges WHERE team_id = $1`, teamID); err != nil {
+		return nil, 0, fmt.Errorf("failed to release port ranges: %w", err)
+	}
+
+	query := `
+		DELETE FROM port_assignments WHERE team_id = $1
+		RETURNING id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at, subdomain, rate_limit_bps, bind_address`
+
+	rows, err := tx.QueryContext(ctx, query, teamID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to release port assignments: %w", err)
+	}
+	defer rows.Close()
+
+	var assignments []PortAssignment
+	for rows.Next() {
+		var pa PortAssignment
+		err := rows.Scan(&pa.ID, &pa.TeamID, &pa.TokenID, &pa.Port,
+			&pa.Protocol, &pa.IsReserved, &pa.CreatedAt, &pa.UpdatedAt, &pa.Subdomain, &pa.RateLimitBPS, &pa.BindAddress)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan port assignment: %w", err)
+		}
+		assignments = append(assignments, pa)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to release port assignments: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	for _, pa := range assignments {
+		r.db.ReleasePortLock(pa.Port, pa.TokenID)
+	}
+
+	return assignments, int(tokens), nil
+}
+
+// ExpireTokens deactivates every active token past its expires_at and deletes its
+// port assignments, including reserved ones, so the ports can be reassigned. It
+// returns the tokens that expired; ports of tokens that have not expired are untouched.
+func (r *Repository) ExpireTokens(ctx context.Context) ([]TeamToken, error) {
+	query := `
+		WITH expired AS (
+			UPDATE team_tokens SET is_active = false
+			WHERE is_active = true AND expires_at IS NOT NULL AND expires_at < NOW()
+			RETURNING id, team_id, name, expires_at
+		), released AS (
+			DELETE FROM port_assignments pa USING expired e
+			WHERE pa.token_id = e.id
+			RETURNING pa.token_id, pa.port
+		)
+		SELECT e.id, e.team_id, e.name, e.expires_at, r.port
+		FROM expired e
+		LEFT JOIN released r ON r.token_id = e.id`
+
+	rows, err := r.db.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []TeamToken
+	var releasedPorts []PortAssignment
+	seen := make(map[uuid.UUID]bool)
+	for rows.Next() {
+		var token TeamToken
+		var port sql.NullInt64
+		if err := rows.Scan(&token.ID, &token.TeamID, &token.Name, &token.ExpiresAt, &port); err != nil {
+			return nil, fmt.Errorf("failed to scan expired token: %w", err)
+		}
+		if port.Valid {
+			releasedPorts = append(releasedPorts, PortAssignment{TokenID: token.ID, Port: int(port.Int64)})
+		}
+		if !seen[token.ID] {
+			seen[token.ID] = true
+			tokens = append(tokens, token)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to expire tokens: %w", err)
+	}
+
+	for _, pa := range releasedPorts {
+		r.db.ReleasePortLock(pa.Port, pa.TokenID)
+	}
+
+	return tokens, nil
+}
+
+// ReclaimOrphanedPorts deletes port assignments whose token is inactive or missing or
+// whose team is soft-deleted, and releases their port locks. Reserved assignments are
+// kept unless includeReserved is set. It returns the deleted assignments.
+func (r *Repository) ReclaimOrphanedPorts(ctx context.Context, includeReserved bool) ([]PortAssignment, error) {
+	query := `
+		DELETE FROM port_assignments pa
+		WHERE ($1 OR pa.is_reserved = false)
+		AND (
+			NOT EXISTS (SELECT 1 FROM team_tokens t WHERE t.id = pa.token_id AND t.is_active = true)
+			OR EXISTS (SELECT 1 FROM "Team" tm WHERE tm.id = pa.team_id AND tm.deleted = true)
+		)
+		RETURNING id, team_id, token_id, port, protocol, is_reserved, created_at, updated_at, subdomain, rate_limit_bps, bind_address`
+
+	rows, err := r.db.DB.QueryContext(ctx, query, includeReserved)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reclaim orphaned ports: %w", err)
+	}
+	defer rows.Close()
+
+	var assignments []PortAssignment
+	for rows.Next() {
+		var pa PortAssignment
+		err := rows.Scan(&pa.ID, &pa.TeamID, &pa.TokenID, &pa.Port,
+			&pa.Protocol, &pa.IsReserved, &pa.CreatedAt, &pa.UpdatedAt, &pa.Subdomain, &pa.RateLimitBPS, &pa.BindAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan port assignment: %w", err)
+		}
+		assignments = append(assignments, pa)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to reclaim orphaned ports: %w", err)
+	}
+
+	for _, pa := range assignments {
+		r.db.ReleasePortLock(pa.Port, pa.TokenID)
+	}
+
+	return assignments, nil
+}
+
 // delete a token for a team
 func (r *Repository) DeleteTokenForTeam(ctx context.Context, teamID string, tokenID uuid.UUID) (*PortAssignment, error) {
 	query := `UPDATE team_tokens SET is_active = false WHERE team_id = $1 AND id = $2`
@@ -744,7 +1970,7 @@ func (r *Repository) DeletePortAssignmentForToken(ctx context.Context, teamID st
 	portAssignment := &PortAssignment{}
 	err := r.db.DB.QueryRowContext(ctx, query, teamID, tokenID).Scan(
 		&portAssignment.ID, &portAssignment.TeamID, &portAssignment.TokenID, &portAssignment.Port,
-		&portAssignment.Protocol, &portAssignment.IsReserved, &portAssignment.CreatedAt, &portAssignment.UpdatedAt,
+		&portAssignment.Protocol, &portAssignment.IsReserved, &portAssignment.CreatedAt, &portAssignment.UpdatedAt, &portAssignment.Subdomain, &portAssignment.RateLimitBPS, &portAssignment.BindAddress,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to release port: %w", err)
@@ -0,0 +1,320 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// testTeamTableSQL creates the Team table as the main application defines it,
+// which the migrations expect to find
+const testTeamTableSQL = `
+	CREATE TABLE IF NOT EXISTS public."Team" (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		description TEXT,
+		"createdAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+		"updatedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+		deleted BOOLEAN NOT NULL DEFAULT false,
+		is_active BOOLEAN NOT NULL DEFAULT true,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+	)`
+
+// newTestRepository connects to the scratch PostgreSQL database named by
+// RABBIT_TEST_DATABASE_URL and migrates it. Redis points at a closed port, so
+// every test runs as if Redis were down. Tests are skipped without the variable.
+func newTestRepository(t *testing.T) (*Repository, *Database) {
+	t.Helper()
+
+	url := os.Getenv("RABBIT_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("RABBIT_TEST_DATABASE_URL is not set")
+	}
+
+	sqlDB, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := sqlDB.Ping(); err != nil {
+		t.Fatalf("failed to ping database: %v", err)
+	}
+	if _, err := sqlDB.Exec(testTeamTableSQL); err != nil {
+		t.Fatalf("failed to create Team table: %v", err)
+	}
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr:        "127.0.0.1:1",
+		DialTimeout: 100 * time.Millisecond,
+		MaxRetries:  -1,
+	})
+	t.Cleanup(func() { rdb.Close() })
+
+	db := &Database{
+		DB:         sqlDB,
+		Redis:      rdb,
+		ctx:        context.Background(),
+		keyPrefix:  "rabbit-test:",
+		sessionTTL: time.Minute,
+
+		portLocks:    redisBreaker{what: "port locks"},
+		pendingConns: redisBreaker{what: "shared pending connections"},
+	}
+	if err := db.RunMigrations("migrations"); err != nil {
+		t.Fatalf("failed to run migrations: %v", err)
+	}
+
+	return NewRepository(db), db
+}
+
+// createTestTeam creates a team that is deleted, with everything of its tokens,
+// when the test ends
+func createTestTeam(t *testing.T, r *Repository) string {
+	t.Helper()
+
+	team, err := r.CreateTeam(context.Background(), "test-"+t.Name()+"-"+time.Now().Format("150405.000000000"), "")
+	if err != nil {
+		t.Fatalf("failed to create team: %v", err)
+	}
+	t.Cleanup(func() {
+		r.db.DB.Exec(`DELETE FROM team_tokens WHERE team_id = $1`, team.ID)
+		r.db.DB.Exec(`DELETE FROM public."Team" WHERE id = $1`, team.ID)
+	})
+	return team.ID
+}
+
+func TestCreateTokenForTeamWithoutRedis(t *testing.T) {
+	// With Redis unreachable the port locks are skipped, and concurrent
+	// assignments are kept apart only by the unique (port, protocol) constraint
+	r, db := newTestRepository(t)
+	teamID := createTestTeam(t, r)
+
+	const n = 8
+	ports := make([]int, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, assignment, err := r.CreateTokenForTeam(context.Background(), teamID, "token", "", nil, "tcp", "", "", nil, false, false)
+			errs[i] = err
+			if err == nil {
+				ports[i] = assignment.Port
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool)
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("token %d: %v", i, err)
+			continue
+		}
+		if seen[ports[i]] {
+			t.Errorf("port %d was assigned twice", ports[i])
+		}
+		seen[ports[i]] = true
+	}
+	if db.portLocks.allow() {
+		t.Errorf("port lock breaker is closed after Redis failed")
+	}
+}
+
+// startTestConnection starts a connection on a new token of a new team
+func startTestConnection(t *testing.T, r *Repository) (*ConnectionSession, *ConnectionLog) {
+	t.Helper()
+	ctx := context.Background()
+
+	teamID := createTestTeam(t, r)
+	token, assignment, err := r.CreateTokenForTeam(ctx, teamID, "token", "", nil, "tcp", "", "", nil, false, false)
+	if err != nil {
+		t.Fatalf("failed to create token: %v", err)
+	}
+	session, log, err := r.StartConnection(ctx, teamID, token.ID, assignment.ID, "192.0.2.1", assignment.Port, "tcp", "", "")
+	if err != nil {
+		t.Fatalf("failed to start connection: %v", err)
+	}
+	return session, log
+}
+
+func connectionTimeMS(t *testing.T, r *Repository, logID uuid.UUID) int64 {
+	t.Helper()
+	var ms sql.NullInt64
+	if err := r.db.DB.QueryRow(`SELECT connection_time_ms FROM connection_logs WHERE id = $1`, logID).Scan(&ms); err != nil {
+		t.Fatalf("failed to read connection time: %v", err)
+	}
+	if !ms.Valid {
+		t.Fatalf("connection log %s has no connection time", logID)
+	}
+	return ms.Int64
+}
+
+func TestEndConnectionLogRecordsConnectionTime(t *testing.T) {
+	r, _ := newTestRepository(t)
+	_, log := startTestConnection(t, r)
+
+	time.Sleep(2 * time.Second)
+	if err := r.EndConnectionLog(context.Background(), log.ID, "closed", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if ms := connectionTimeMS(t, r, log.ID); ms < 1900 || ms > 2500 {
+		t.Errorf("a connection of about 2s recorded %dms", ms)
+	}
+}
+
+func TestEndConnectionLogsRecordsConnectionTime(t *testing.T) {
+	r, _ := newTestRepository(t)
+	session, log := startTestConnection(t, r)
+
+	err := r.EndConnectionLogs(context.Background(), []ConnectionResult{{
+		SessionID: session.ID,
+		LogID:     log.ID,
+		EndedAt:   log.StartedAt.Add(2 * time.Second),
+		Status:    "closed",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ms := connectionTimeMS(t, r, log.ID); ms != 2000 {
+		t.Errorf("a connection ended 2s after it started recorded %dms", ms)
+	}
+}
+
+// findConflict returns the conflict reported on port, if any
+func findConflict(t *testing.T, r *Repository, port int) *PortConflict {
+	t.Helper()
+	conflicts, err := r.FindDuplicatePortAssignments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range conflicts {
+		if conflicts[i].Port == port {
+			return &conflicts[i]
+		}
+	}
+	return nil
+}
+
+func TestFindDuplicatePortAssignments(t *testing.T) {
+	r, _ := newTestRepository(t)
+	ctx := context.Background()
+	teamID := createTestTeam(t, r)
+
+	_, older, err := r.CreateTokenForTeam(ctx, teamID, "older", "", nil, "tcp", "", "", nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, newer, err := r.CreateTokenForTeam(ctx, teamID, "newer", "", nil, "tcp", "", "", nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, outside, err := r.CreateTokenForTeam(ctx, teamID, "outside", "", nil, "tcp", "", "", nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An http assignment on a tcp assignment's port passes the unique (port,
+	// protocol) constraint but cannot listen next to it
+	if _, err := r.db.DB.Exec(`UPDATE port_assignments SET port = $1, protocol = 'http' WHERE id = $2`, older.Port, newer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.db.DB.Exec(`UPDATE port_assignments SET port = 80 WHERE id = $1`, outside.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	conflict := findConflict(t, r, older.Port)
+	if conflict == nil {
+		t.Fatalf("duplicate port %d was not reported", older.Port)
+	}
+	if conflict.Reason != "duplicate" || conflict.Transport != "tcp" || len(conflict.Assignments) != 2 ||
+		conflict.Assignments[0].ID != older.ID || conflict.Assignments[1].ID != newer.ID {
+		t.Errorf("duplicate port %d reported as %+v, want the older then the newer assignment", older.Port, conflict)
+	}
+	if conflict := findConflict(t, r, 80); conflict == nil || conflict.Reason != "out_of_range" {
+		t.Errorf("port 80 reported as %+v, want out_of_range", conflict)
+	}
+
+	// Repairing moves the newer assignment off the port
+	if _, err := r.ReassignPortAssignment(ctx, newer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if conflict := findConflict(t, r, older.Port); conflict != nil {
+		t.Errorf("port %d still reported after the repair: %+v", older.Port, conflict)
+	}
+}
+
+func TestStartConnectionRollsBackSessionWhenLogFails(t *testing.T) {
+	r, _ := newTestRepository(t)
+	ctx := context.Background()
+	teamID := createTestTeam(t, r)
+	token, assignment, err := r.CreateTokenForTeam(ctx, teamID, "token", "", nil, "tcp", "", "", nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the log insert of connections from one address only, so other tests
+	// sharing the database are unaffected
+	const failingIP = "198.51.100.101"
+	_, err = r.db.DB.Exec(`
+		CREATE OR REPLACE FUNCTION fail_test_connection_log() RETURNS TRIGGER AS $$
+		BEGIN
+			IF NEW.client_ip = '` + failingIP + `' THEN
+				RAISE EXCEPTION 'connection log insert failed for the test';
+			END IF;
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS fail_test_connection_log ON connection_logs;
+		CREATE TRIGGER fail_test_connection_log BEFORE INSERT ON connection_logs
+			FOR EACH ROW EXECUTE FUNCTION fail_test_connection_log();`)
+	if err != nil {
+		t.Fatalf("failed to install trigger: %v", err)
+	}
+	t.Cleanup(func() {
+		r.db.DB.Exec(`DROP TRIGGER IF EXISTS fail_test_connection_log ON connection_logs; DROP FUNCTION IF EXISTS fail_test_connection_log();`)
+	})
+
+	countSessions := func() int {
+		t.Helper()
+		var n int
+		if err := r.db.DB.QueryRow(`SELECT COUNT(*) FROM connection_sessions WHERE token_id = $1`, token.ID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	session, log, err := r.StartConnection(ctx, teamID, token.ID, assignment.ID, failingIP, assignment.Port, "tcp", "", "setup-1")
+	if err == nil {
+		t.Fatalf("StartConnection succeeded with session %v and log %v despite the failing log insert", session, log)
+	}
+	if n := countSessions(); n != 0 {
+		t.Errorf("%d sessions left after the log insert failed, want the session rolled back", n)
+	}
+
+	// Retrying with the same key once the log can be written creates the session
+	// once, however often it is retried
+	first, firstLog, err := r.StartConnection(ctx, teamID, token.ID, assignment.ID, "192.0.2.1", assignment.Port, "tcp", "", "setup-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, againLog, err := r.StartConnection(ctx, teamID, token.ID, assignment.ID, "192.0.2.1", assignment.Port, "tcp", "", "setup-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID || againLog.ID != firstLog.ID {
+		t.Errorf("retry created session %s with log %s, want session %s with log %s", again.ID, againLog.ID, first.ID, firstLog.ID)
+	}
+	if n := countSessions(); n != 1 {
+		t.Errorf("%d sessions after a retried setup, want 1", n)
+	}
+}
@@ -2,8 +2,10 @@ package database
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/google/uuid"
@@ -35,25 +37,71 @@ func (s *Service) GetTeamByName(ctx context.Context, name string) (*Team, error)
 	return s.repo.GetTeamByName(ctx, name)
 }
 
-// GenerateTokenForTeam creates a new token for an existing team with automatic port assignment
-func (s *Service) GenerateTokenForTeam(ctx context.Context, teamID string, tokenName, tokenDescription string, expiresAt *time.Time) (*TeamToken, *PortAssignment, error) {
-	return s.repo.CreateTokenForTeam(ctx, teamID, tokenName, tokenDescription, expiresAt)
+// CreateTeam creates a new team
+func (s *Service) CreateTeam(ctx context.Context, name, description string) (*Team, error) {
+	return s.repo.CreateTeam(ctx, name, description)
+}
+
+// SetTeamQuota sets a team's concurrent tunnel and daily connection quotas (0 = unlimited)
+func (s *Service) SetTeamQuota(ctx context.Context, teamID string, maxConcurrentTunnels, maxDailyConnections int) error {
+	return s.repo.SetTeamQuota(ctx, teamID, maxConcurrentTunnels, maxDailyConnections)
+}
+
+// CountTeamConnectionsToday returns how many connections a team has made today
+func (s *Service) CountTeamConnectionsToday(ctx context.Context, teamID string) (int, error) {
+	return s.repo.CountTeamConnectionsToday(ctx, teamID)
+}
+
+// GenerateTokenForTeam creates a new token for an existing team with automatic port assignment.
+// A non-empty bindAddress makes the token's tunnels listen on that address, and
+// without allowPublicBind they listen on loopback only.
+// With validateOnly nothing is created; the returned token is nil and the assignment
+// shows the port that would have been assigned.
+func (s *Service) GenerateTokenForTeam(ctx context.Context, teamID string, tokenName, tokenDescription string, expiresAt *time.Time, protocol, subdomain, bindAddress string, allowedLocalPorts []int64, allowPublicBind, validateOnly bool) (*TeamToken, *PortAssignment, error) {
+	expiresAt, err := s.ResolveTokenExpiry(expiresAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.repo.CreateTokenForTeam(ctx, teamID, tokenName, tokenDescription, expiresAt, protocol, subdomain, bindAddress, allowedLocalPorts, allowPublicBind, validateOnly)
+}
+
+// ResolveTokenExpiry applies the token expiry policy to a requested expiry: nil
+// gets the default expiry, if any, and an expiry past the maximum is rejected
+// with ErrTokenExpiryTooLong. GenerateTokenForTeam applies it itself; callers use
+// it to report the effective expiry up front.
+func (s *Service) ResolveTokenExpiry(expiresAt *time.Time) (*time.Time, error) {
+	defaultDays, maxDays := s.db.tokenDefaultExpiryDays, s.db.tokenMaxExpiryDays
+	if expiresAt == nil {
+		if defaultDays == 0 {
+			defaultDays = maxDays
+		}
+		if defaultDays == 0 {
+			return nil, nil
+		}
+		expires := time.Now().AddDate(0, 0, defaultDays)
+		return &expires, nil
+	}
+	if maxDays > 0 && expiresAt.After(time.Now().AddDate(0, 0, maxDays)) {
+		return nil, fmt.Errorf("%w of %d days", ErrTokenExpiryTooLong, maxDays)
+	}
+	return expiresAt, nil
 }
 
 // Authentication and Token operations
 
-// AuthenticateToken validates a token and returns team and port information
-func (s *Service) AuthenticateToken(ctx context.Context, token string) (*TeamToken, *PortAssignment, error) {
+// AuthenticateToken validates a token and returns team and port information. The
+// token is recorded as last used from clientIP in country; either may be empty.
+func (s *Service) AuthenticateToken(ctx context.Context, token, clientIP, country string) (*TeamToken, *PortAssignment, error) {
 	// Get team token
 	teamToken, err := s.repo.GetTeamTokenByToken(ctx, token)
 	if err != nil {
 		return nil, nil, fmt.Errorf("authentication failed: %w", err)
 	}
 
-	// Update last used timestamp
-	if err := s.repo.UpdateTokenLastUsed(ctx, teamToken.ID); err != nil {
+	// Update last used timestamp and location
+	if err := s.repo.UpdateTokenLastUsed(ctx, teamToken.ID, clientIP, country); err != nil {
 		// Log error but don't fail authentication
-		fmt.Printf("Warning: failed to update token last used: %v\n", err)
+		slog.Warn("failed to update token last used", "token_id", teamToken.ID, "error", err)
 	}
 
 	// Get port assignment
@@ -65,38 +113,211 @@ func (s *Service) AuthenticateToken(ctx context.Context, token string) (*TeamTok
 	return teamToken, portAssignment, nil
 }
 
-// Connection management
+// InspectToken returns a valid token and its reserved port assignments, primary
+// first. Unlike AuthenticateToken it changes nothing, not even the last used time.
+func (s *Service) InspectToken(ctx context.Context, token string) (*TeamToken, []PortAssignment, error) {
+	teamToken, err := s.repo.GetTeamTokenByToken(ctx, token)
+	if err != nil {
+		return nil, nil, fmt.Errorf("authentication failed: %w", err)
+	}
 
-// StartConnection creates a new connection session and log entry
-func (s *Service) StartConnection(ctx context.Context, teamID string, tokenID, portAssignID uuid.UUID, clientIP string, serverPort int, protocol string) (*ConnectionSession, *ConnectionLog, error) {
-	// Create connection session
-	session, err := s.repo.CreateConnectionSession(ctx, teamID, tokenID, portAssignID, clientIP, serverPort, protocol)
+	assignments, err := s.repo.ListPortAssignmentsByToken(ctx, teamToken.ID)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create connection session: %w", err)
+		return nil, nil, fmt.Errorf("failed to list port assignments: %w", err)
 	}
 
-	// Create connection log
-	log, err := s.repo.CreateConnectionLog(ctx, teamID, tokenID, portAssignID, session.ID, clientIP, 0, serverPort, protocol)
+	return teamToken, assignments, nil
+}
+
+// ResolvePortAssignments returns one port assignment per requested remote port for a token.
+// A requested port of 0 takes the primary assignment first, then the token's other unused
+// assignments, allocating a new port once the token has none left. A non-zero port must
+// already be assigned to the token.
+func (s *Service) ResolvePortAssignments(ctx context.Context, teamToken *TeamToken, primary *PortAssignment, requested []int) ([]*PortAssignment, error) {
+	existing, err := s.repo.ListPortAssignmentsByToken(ctx, teamToken.ID)
 	if err != nil {
-		// Session created but log failed - not critical
-		fmt.Printf("Warning: failed to create connection log: %v\n", err)
-		return session, nil, nil
+		return nil, fmt.Errorf("failed to list port assignments: %w", err)
+	}
+
+	// The primary assignment carries its team and token relations, so prefer it
+	available := []*PortAssignment{primary}
+	for i := range existing {
+		if existing[i].ID != primary.ID {
+			available = append(available, &existing[i])
+		}
+	}
+
+	resolved := make([]*PortAssignment, len(requested))
+	used := make(map[uuid.UUID]bool)
+
+	// Pinned ports first so they are not handed out to unpinned mappings
+	for i, port := range requested {
+		if port == 0 {
+			continue
+		}
+		for _, assignment := range available {
+			if assignment.Port == port && !used[assignment.ID] {
+				resolved[i] = assignment
+				used[assignment.ID] = true
+				break
+			}
+		}
+		if resolved[i] == nil {
+			return nil, fmt.Errorf("remote port %d is not assigned to this token", port)
+		}
+	}
+
+	for i, port := range requested {
+		if port != 0 {
+			continue
+		}
+		for _, assignment := range available {
+			if !used[assignment.ID] {
+				resolved[i] = assignment
+				used[assignment.ID] = true
+				break
+			}
+		}
+		if resolved[i] == nil {
+			// Additional ports listen where the token's primary port does
+			var bindAddress string
+			if primary.BindAddress != nil {
+				bindAddress = *primary.BindAddress
+			}
+			assignment, err := s.repo.CreatePortAssignment(ctx, teamToken.TeamID, teamToken.ID, primary.Protocol, bindAddress)
+			if err != nil {
+				return nil, fmt.Errorf("failed to assign additional port: %w", err)
+			}
+			slog.Info("assigned additional port", "port", assignment.Port, "token_id", teamToken.ID, "team_id", teamToken.TeamID)
+			resolved[i] = assignment
+			used[assignment.ID] = true
+		}
+	}
+
+	return resolved, nil
+}
+
+// ReconnectTokenTTL is how long a reconnect token stays valid after its client's
+// last heartbeat. It outlives the 5-minute stale session cleanup so a client can
+// still reclaim its port when the server was down for a while.
+const ReconnectTokenTTL = 10 * time.Minute
+
+// IssueReconnectToken creates a reconnect token that rebinds the client to port on
+// its next handshake
+func (s *Service) IssueReconnectToken(ctx context.Context, tokenID uuid.UUID, port int, protocol string) (string, error) {
+	reconnectToken, err := generateSecureToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate reconnect token: %w", err)
+	}
+
+	data := ReconnectToken{TokenID: tokenID, Port: port, Protocol: protocol}
+	if err := s.db.SetReconnectToken(reconnectToken, data, ReconnectTokenTTL); err != nil {
+		return "", fmt.Errorf("failed to store reconnect token: %w", err)
+	}
+	return reconnectToken, nil
+}
+
+// ResolveReconnectToken returns the remote port a reconnect token rebinds to, or 0
+// if the token is unknown or expired, was issued to another token or protocol, or
+// its port is no longer assigned to the token
+func (s *Service) ResolveReconnectToken(ctx context.Context, teamToken *TeamToken, reconnectToken, protocol string) int {
+	data, err := s.db.GetReconnectToken(reconnectToken)
+	if err != nil {
+		return 0
+	}
+	if data.TokenID != teamToken.ID || data.Protocol != protocol {
+		return 0
+	}
+
+	assignments, err := s.repo.ListPortAssignmentsByToken(ctx, teamToken.ID)
+	if err != nil {
+		slog.Warn("failed to check reconnect token port", "token_id", teamToken.ID, "error", err)
+		return 0
+	}
+	for _, assignment := range assignments {
+		if assignment.Port == data.Port {
+			return data.Port
+		}
+	}
+	return 0
+}
+
+// RefreshReconnectToken keeps a reconnect token alive while its client is connected
+func (s *Service) RefreshReconnectToken(reconnectToken string) error {
+	return s.db.RefreshReconnectToken(reconnectToken, ReconnectTokenTTL)
+}
+
+// RevokeReconnectToken invalidates a reconnect token, e.g. after a clean disconnect
+func (s *Service) RevokeReconnectToken(reconnectToken string) error {
+	return s.db.DeleteReconnectToken(reconnectToken)
+}
+
+// CountAuthentication counts an authentication attempt with token in the current
+// minute and returns the count so far. Tokens are counted under a hash, so the
+// token itself is never stored in Redis.
+func (s *Service) CountAuthentication(token string) (int64, error) {
+	sum := sha256.Sum256([]byte(token))
+	count, _, err := s.db.CountInWindow("auth_count:"+hex.EncodeToString(sum[:16]), time.Minute)
+	return count, err
+}
+
+// CountTokenGeneration counts a token generation request from clientIP in the
+// current minute, returning the count so far and how long until the minute ends
+func (s *Service) CountTokenGeneration(clientIP string) (int64, time.Duration, error) {
+	return s.db.CountInWindow("token_generate:"+clientIP, time.Minute)
+}
+
+// Connection management
+
+// Retries of StartConnection calls with an idempotency key
+const (
+	startConnectionAttempts = 3
+	startConnectionBackoff  = 100 * time.Millisecond // Doubled after each failed attempt
+)
+
+// StartConnection creates a new connection session and its log entry, both or
+// neither. A non-empty idempotencyKey makes the call safe to repeat: an active
+// session of the token created with the same key is returned, with its log,
+// instead of a new one. Such calls are also retried on failure, since a retry
+// cannot create a duplicate even if an earlier attempt committed unseen.
+func (s *Service) StartConnection(ctx context.Context, teamID string, tokenID, portAssignID uuid.UUID, clientIP string, serverPort int, protocol, bindAddress, idempotencyKey string) (*ConnectionSession, *ConnectionLog, error) {
+	attempts := 1
+	if idempotencyKey != "" {
+		attempts = startConnectionAttempts
 	}
 
-	return session, log, nil
+	backoff := startConnectionBackoff
+	for attempt := 1; ; attempt++ {
+		session, log, err := s.repo.StartConnection(ctx, teamID, tokenID, portAssignID, clientIP, serverPort, protocol, bindAddress, idempotencyKey)
+		if err == nil {
+			return session, log, nil
+		}
+		if attempt == attempts || ctx.Err() != nil {
+			return nil, nil, err
+		}
+
+		slog.Warn("failed to start connection, retrying", "token_id", tokenID, "attempt", attempt, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, nil, err
+		}
+		backoff *= 2
+	}
 }
 
-// UpdateConnectionActivity updates session and connection statistics
-func (s *Service) UpdateConnectionActivity(ctx context.Context, sessionID, logID uuid.UUID, bytesReceived, bytesSent int64) error {
+// UpdateConnectionActivity updates session and connection statistics. The wire
+// counts are the bytes carried on the data connection after compression.
+func (s *Service) UpdateConnectionActivity(ctx context.Context, sessionID, logID uuid.UUID, bytesReceived, bytesSent, wireReceived, wireSent int64) error {
 	// Update session last seen
 	if err := s.repo.UpdateSessionLastSeen(ctx, sessionID); err != nil {
 		// Log error but continue
-		fmt.Printf("Warning: failed to update session last seen: %v\n", err)
+		slog.Warn("failed to update session last seen", "session_id", sessionID, "error", err)
 	}
 
 	// Update connection log stats
 	if logID != uuid.Nil {
-		if err := s.repo.UpdateConnectionLogStats(ctx, logID, bytesReceived, bytesSent); err != nil {
+		if err := s.repo.UpdateConnectionLogStats(ctx, logID, bytesReceived, bytesSent, wireReceived, wireSent); err != nil {
 			return fmt.Errorf("failed to update connection stats: %w", err)
 		}
 	}
@@ -109,7 +330,7 @@ func (s *Service) EndConnection(ctx context.Context, sessionID, logID uuid.UUID,
 	// End session
 	if err := s.repo.EndConnectionSession(ctx, sessionID); err != nil {
 		// Log error but continue
-		fmt.Printf("Warning: failed to end session: %v\n", err)
+		slog.Warn("failed to end session", "session_id", sessionID, "error", err)
 	}
 
 	// End connection log
@@ -122,37 +343,75 @@ func (s *Service) EndConnection(ctx context.Context, sessionID, logID uuid.UUID,
 	return nil
 }
 
+// EndConnections records the final state of a batch of connections
+func (s *Service) EndConnections(ctx context.Context, results []ConnectionResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	return s.repo.EndConnectionLogs(ctx, results)
+}
+
 // Statistics and health
 
-// GetConnectionStats retrieves connection statistics for a team
+// GetConnectionStats retrieves a team's daily connection statistics as of the last
+// AggregateConnectionStats run
 func (s *Service) GetConnectionStats(ctx context.Context, teamID string, from, to time.Time) ([]ConnectionStats, error) {
 	return s.repo.GetConnectionStats(ctx, teamID, from, to)
 }
 
-// GetPortAssignmentByPort retrieves port assignment information
-func (s *Service) GetPortAssignmentByPort(ctx context.Context, port int, protocol string) (*PortAssignment, error) {
-	return s.repo.GetPortAssignmentByPort(ctx, port, protocol)
+// AggregateConnectionStats recomputes the daily statistics of every day with
+// connection activity since the given time, returning the number of days written
+func (s *Service) AggregateConnectionStats(ctx context.Context, since time.Time) (int64, error) {
+	return s.repo.AggregateConnectionStats(ctx, since)
 }
 
-// HealthCheck verifies database connectivity and basic operations
-func (s *Service) HealthCheck(ctx context.Context) error {
-	// Test database connectivity
-	if err := s.db.DB.PingContext(ctx); err != nil {
-		return fmt.Errorf("database connection failed: %w", err)
-	}
+// ListConnectionLogs retrieves a page of connection logs for a team
+func (s *Service) ListConnectionLogs(ctx context.Context, filter ConnectionLogFilter) ([]ConnectionLog, int, error) {
+	return s.repo.ListConnectionLogs(ctx, filter)
+}
 
-	// Test Redis connectivity
-	if err := s.db.Redis.Ping(ctx).Err(); err != nil {
-		return fmt.Errorf("redis connection failed: %w", err)
-	}
+// StreamConnectionLogs calls fn for each connection log of a team matching filter, oldest first
+func (s *Service) StreamConnectionLogs(ctx context.Context, filter ConnectionLogFilter, fn func(ConnectionLog) error) error {
+	return s.repo.StreamConnectionLogs(ctx, filter, fn)
+}
 
-	// Test basic query
-	var count int
-	if err := s.db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM public.\"Team\"").Scan(&count); err != nil {
-		return fmt.Errorf("database query failed: %w", err)
+// NewAuditEvent describes action on target by actor, as failed with actionErr's
+// message when actionErr is set
+func NewAuditEvent(actor, action, target string, actionErr error, metadata map[string]interface{}) AuditEvent {
+	event := AuditEvent{Actor: actor, Action: action, Target: target, Outcome: AuditOutcomeSuccess, Metadata: metadata}
+	if actionErr != nil {
+		message := actionErr.Error()
+		event.Outcome = AuditOutcomeFailure
+		event.ErrorMessage = &message
 	}
+	return event
+}
 
-	return nil
+// RecordAuditEvent appends an administrative action to the audit log
+func (s *Service) RecordAuditEvent(ctx context.Context, event AuditEvent) error {
+	return s.repo.RecordAuditEvent(ctx, event)
+}
+
+// ListAuditEvents retrieves a page of the audit log, newest first
+func (s *Service) ListAuditEvents(ctx context.Context, limit, offset int) ([]AuditEvent, int, error) {
+	return s.repo.ListAuditEvents(ctx, limit, offset)
+}
+
+// ListPortUsage reports which ports of the tunnel port range are assigned,
+// reserved, locked and free
+func (s *Service) ListPortUsage(ctx context.Context) (*PortUsage, error) {
+	return s.repo.ListPortUsage(ctx)
+}
+
+// GetPortAssignmentByPort retrieves port assignment information
+func (s *Service) GetPortAssignmentByPort(ctx context.Context, port int, protocol string) (*PortAssignment, error) {
+	return s.repo.GetPortAssignmentByPort(ctx, port, protocol)
+}
+
+// HealthCheck checks PostgreSQL connectivity, Redis connectivity and a basic query
+// independently, timing each
+func (s *Service) HealthCheck(ctx context.Context) *HealthReport {
+	return checkHealth(ctx, s.db.DB, nil, s.db.Redis, nil)
 }
 
 func (s *Service) ListTeamsWithTokens(ctx context.Context) ([]TokenRow, error) {
@@ -248,7 +507,7 @@ func (s *Service) ReactivateRestoredTunnel(ctx context.Context, sessionID uuid.U
 
 	if err := s.db.SetActiveSession(sessionID, reactivationData); err != nil {
 		// Log error but don't fail the reactivation
-		log.Printf("⚠️ Failed to store reactivation data in Redis: %v", err)
+		slog.Warn("failed to store reactivation data in Redis", "session_id", sessionID, "error", err)
 	}
 
 	return nil
@@ -269,6 +528,92 @@ func (s *Service) ListPortAssignmentsByTeamID(ctx context.Context, teamID string
 	return s.repo.ListPortAssignmentsByTeamID(ctx, teamID)
 }
 
+// RevokeToken deactivates a token so it can no longer authenticate and releases its ports
+func (s *Service) RevokeToken(ctx context.Context, tokenID uuid.UUID) ([]PortAssignment, error) {
+	return s.repo.RevokeToken(ctx, tokenID)
+}
+
+// DeactivateTeam soft-deletes a team, deactivates its tokens and releases its ports.
+// It returns the released assignments and the number of tokens deactivated.
+func (s *Service) DeactivateTeam(ctx context.Context, teamID string) ([]PortAssignment, int, error) {
+	return s.repo.DeactivateTeam(ctx, teamID)
+}
+
+// ReservePortRange reserves a block of ports for a team's new port assignments
+func (s *Service) ReservePortRange(ctx context.Context, teamID string, start, end int) (*PortRange, error) {
+	return s.repo.ReservePortRange(ctx, teamID, start, end)
+}
+
+// ReassignPort moves a port assignment whose port is unusable to a free port
+func (s *Service) ReassignPort(ctx context.Context, assignmentID uuid.UUID) (*PortAssignment, error) {
+	return s.repo.ReassignPort(ctx, assignmentID)
+}
+
+// ReleasePortLock drops the Redis lock tokenID held on a port while it was being assigned
+func (s *Service) ReleasePortLock(port int, tokenID uuid.UUID) error {
+	return s.db.ReleasePortLock(port, tokenID)
+}
+
+// RegisterPendingConn shares which server instance is waiting for a data connection
+func (s *Service) RegisterPendingConn(connID, instanceID string, ttl time.Duration) error {
+	return s.db.SetPendingConn(connID, instanceID, ttl)
+}
+
+// PendingConnOwner returns the server instance waiting for a data connection
+func (s *Service) PendingConnOwner(connID string) (string, error) {
+	return s.db.GetPendingConnOwner(connID)
+}
+
+// UnregisterPendingConn removes a shared pending connection
+func (s *Service) UnregisterPendingConn(connID string) error {
+	return s.db.DeletePendingConn(connID)
+}
+
+// ExpireTokens deactivates expired tokens and releases their ports
+func (s *Service) ExpireTokens(ctx context.Context) ([]TeamToken, error) {
+	return s.repo.ExpireTokens(ctx)
+}
+
+// ReclaimOrphanedPorts deletes port assignments left behind by inactive tokens or
+// deleted teams, then releases Redis port locks that never expire. It returns the
+// deleted assignments and the number of stale locks released.
+func (s *Service) ReclaimOrphanedPorts(ctx context.Context, includeReserved bool) ([]PortAssignment, int, error) {
+	assignments, err := s.repo.ReclaimOrphanedPorts(ctx, includeReserved)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	locks, err := s.db.ReleaseStalePortLocks()
+	return assignments, locks, err
+}
+
+// CheckPorts finds ports that more than one active assignment would listen on, and
+// active assignments outside the tunnel port range. With repair, every assignment
+// in a conflict but the oldest, and every assignment out of range, is moved to a
+// free port; the moves made before a failure are returned with its error.
+func (s *Service) CheckPorts(ctx context.Context, repair bool) ([]PortConflict, []PortMove, error) {
+	conflicts, err := s.repo.FindDuplicatePortAssignments(ctx)
+	if err != nil || !repair {
+		return conflicts, nil, err
+	}
+
+	var moves []PortMove
+	for _, conflict := range conflicts {
+		toMove := conflict.Assignments
+		if conflict.Reason == "duplicate" {
+			toMove = toMove[1:]
+		}
+		for _, assignment := range toMove {
+			moved, err := s.repo.ReassignPortAssignment(ctx, assignment.ID)
+			if err != nil {
+				return conflicts, moves, fmt.Errorf("failed to move port %d/%s of token %s: %w", assignment.Port, assignment.Protocol, assignment.TokenID, err)
+			}
+			moves = append(moves, PortMove{Assignment: *moved, OldPort: assignment.Port})
+		}
+	}
+	return conflicts, moves, nil
+}
+
 // Delete a tcp tunnel for a team
 func (s *Service) DeleteTunnelForTeam(ctx context.Context, teamID string, tokenID uuid.UUID) (*PortAssignment, error) {
 	portAssignment, err := s.repo.DeleteTokenForTeam(ctx, teamID, tokenID)
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoRecord holds the fields read from a GeoLite2 Country or City database
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// asnRecord holds the fields read from a GeoLite2 ASN database
+type asnRecord struct {
+	AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+}
+
+// geoFilter blocks connections by the country or autonomous system of their IP
+type geoFilter struct {
+	countries *maxminddb.Reader // nil without a country database
+	asns      *maxminddb.Reader // nil without an ASN database
+
+	blockedCountries map[string]bool
+	allowedCountries map[string]bool // When set, every other country is blocked
+	blockedASNs      map[uint]bool
+}
+
+// newGeoFilter opens the databases named in config. It returns nil when none is
+// configured, which disables geo blocking.
+func newGeoFilter(config SecurityConfig) (*geoFilter, error) {
+	if config.GeoIPDatabase == "" && config.ASNDatabase == "" {
+		return nil, nil
+	}
+
+	f := &geoFilter{
+		blockedCountries: countrySet(config.BlockedCountries),
+		allowedCountries: countrySet(config.AllowedCountries),
+		blockedASNs:      make(map[uint]bool, len(config.BlockedASNs)),
+	}
+	for _, asn := range config.BlockedASNs {
+		f.blockedASNs[asn] = true
+	}
+
+	var err error
+	if config.GeoIPDatabase != "" {
+		if f.countries, err = maxminddb.Open(config.GeoIPDatabase); err != nil {
+			return nil, fmt.Errorf("failed to open GeoIP database %s: %w", config.GeoIPDatabase, err)
+		}
+	}
+	if config.ASNDatabase != "" {
+		if f.asns, err = maxminddb.Open(config.ASNDatabase); err != nil {
+			f.close()
+			return nil, fmt.Errorf("failed to open ASN database %s: %w", config.ASNDatabase, err)
+		}
+	}
+
+	if f.countries == nil && (len(f.blockedCountries) > 0 || len(f.allowedCountries) > 0) {
+		log.Printf("⚠️ Country rules are set but no GeoIP database is configured; they are ignored")
+	}
+	if f.asns == nil && len(f.blockedASNs) > 0 {
+		log.Printf("⚠️ Blocked ASNs are set but no ASN database is configured; they are ignored")
+	}
+	return f, nil
+}
+
+// countrySet returns the ISO country codes in codes, upper-cased
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			set[code] = true
+		}
+	}
+	return set
+}
+
+// lookup returns the ISO country code and autonomous system number of ip. Either
+// is empty or zero when its database is missing or has no entry for the IP.
+func (f *geoFilter) lookup(ip net.IP) (country string, asn uint) {
+	if f.countries != nil {
+		var record geoRecord
+		if err := f.countries.Lookup(ip, &record); err != nil {
+			log.Printf("⚠️ GeoIP lookup failed for %s: %v", ip, err)
+		}
+		country = record.Country.ISOCode
+	}
+	if f.asns != nil {
+		var record asnRecord
+		if err := f.asns.Lookup(ip, &record); err != nil {
+			log.Printf("⚠️ ASN lookup failed for %s: %v", ip, err)
+		}
+		asn = record.AutonomousSystemNumber
+	}
+	return country, asn
+}
+
+// blockReason returns why a connection from country and asn is blocked, or ""
+// if it is allowed, along with the country code or "AS<n>" it is counted under.
+// An IP whose country is unknown is only blocked by an allow list.
+func (f *geoFilter) blockReason(country string, asn uint) (key, reason string) {
+	if f.countries != nil {
+		if f.blockedCountries[country] {
+			return country, fmt.Sprintf("country %s is blocked", country)
+		}
+		if len(f.allowedCountries) > 0 && !f.allowedCountries[country] {
+			if country == "" {
+				return "unknown", "country is unknown and not in the allowed list"
+			}
+			return country, fmt.Sprintf("country %s is not allowed", country)
+		}
+	}
+	if f.asns != nil && f.blockedASNs[asn] {
+		return fmt.Sprintf("AS%d", asn), fmt.Sprintf("AS%d is blocked", asn)
+	}
+	return "", ""
+}
+
+// close closes the databases
+func (f *geoFilter) close() {
+	if f == nil {
+		return
+	}
+	if f.countries != nil {
+		f.countries.Close()
+	}
+	if f.asns != nil {
+		f.asns.Close()
+	}
+}
@@ -1,11 +1,29 @@
 package middleware
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// blacklistKeyPrefix prefixes the Redis keys that persist blacklisted IPs
+	blacklistKeyPrefix = "blacklist:"
+
+	// redisTimeout bounds every blacklist lookup or write against Redis
+	redisTimeout = 2 * time.Second
+
+	// blacklistCheckTTL is how long an IP found not to be blacklisted in Redis is
+	// trusted before Redis is asked again, so a slow Redis costs one lookup per IP
+	// per interval rather than one per connection. Entries written by other
+	// instances are picked up within this interval.
+	blacklistCheckTTL = 30 * time.Second
 )
 
 // SecurityConfig holds configuration for security middleware
@@ -22,7 +40,12 @@ type SecurityConfig struct {
 
 	// Timeouts
 	HandshakeTimeout time.Duration // Timeout for initial handshake
-	IdleTimeout      time.Duration // Timeout for idle connections
+	IdleTimeout      time.Duration // Timeout for idle connections, unless KeepAlive is set
+
+	// KeepAlive is the TCP keepalive probe interval. When set, TCP connections are
+	// not closed for being idle: a quiet connection stays open for as long as its
+	// peer answers the probes, and one whose peer has gone fails its next read.
+	KeepAlive time.Duration
 
 	// Blacklist
 	BlacklistDuration    time.Duration // How long to blacklist IPs
@@ -30,6 +53,13 @@ type SecurityConfig struct {
 
 	// Whitelist
 	TrustedNetworks []string // List of trusted IP networks/ranges (CIDR notation)
+
+	// Geo blocking, skipped for trusted networks and disabled unless a database is set
+	GeoIPDatabase    string   // MaxMind GeoLite2 Country or City .mmdb file
+	ASNDatabase      string   // MaxMind GeoLite2 ASN .mmdb file
+	BlockedCountries []string // ISO country codes to reject, e.g. "KP"
+	AllowedCountries []string // When set, reject every country not listed
+	BlockedASNs      []uint   // Autonomous system numbers to reject
 }
 
 // DefaultSecurityConfig returns a default security configuration
@@ -43,6 +73,7 @@ func DefaultSecurityConfig() SecurityConfig {
 		BurstWindow:           time.Minute,
 		HandshakeTimeout:      30 * time.Second,
 		IdleTimeout:           5 * time.Minute,
+		KeepAlive:             30 * time.Second,
 		BlacklistDuration:     time.Hour,
 		MaxViolationsPerHour:  5,
 		TrustedNetworks:       []string{"172.16.0.0/12", "10.0.0.0/8", "192.168.0.0/16"},
@@ -57,6 +88,12 @@ type IPStats struct {
 	LastActivity       time.Time
 	IsBlacklisted      bool
 	BlacklistUntil     time.Time
+	BlacklistChecked   time.Time // When Redis last had no blacklist entry for the IP
+
+	// Geo lookup results, cached for as long as the IP is tracked
+	GeoLookedUp bool
+	Country     string
+	ASN         uint
 }
 
 // SecurityMiddleware provides security controls for TCP connections
@@ -67,22 +104,49 @@ type SecurityMiddleware struct {
 	mu                sync.RWMutex
 	trustedNets       []*net.IPNet
 
+	// Optional country and ASN blocking; nil when no database is configured
+	geo              *geoFilter
+	geoBlocked       int
+	geoBlockedByCode map[string]int // Rejections per country code, or per "AS<n>"
+
+	// Optional Redis store that persists the blacklist across restarts, and the
+	// prefix of its keys
+	redis          *redis.Client
+	redisKeyPrefix string
+
+	// Optional callback invoked for every security violation
+	onViolation func(clientIP, reason string, blacklisted bool)
+
 	// Cleanup ticker
 	cleanupTicker *time.Ticker
 	stopCleanup   chan struct{}
 }
 
-// NewSecurityMiddleware creates a new security middleware
-func NewSecurityMiddleware(config SecurityConfig) *SecurityMiddleware {
+// NewSecurityMiddleware creates a new security middleware. Blacklisted IPs are
+// persisted to rdb under keys starting with keyPrefix so they survive restarts; a
+// nil client keeps them in memory only.
+func NewSecurityMiddleware(config SecurityConfig, rdb *redis.Client, keyPrefix string) *SecurityMiddleware {
 	sm := &SecurityMiddleware{
-		config:      config,
-		ipStats:     make(map[string]*IPStats),
-		stopCleanup: make(chan struct{}),
+		config:         config,
+		ipStats:        make(map[string]*IPStats),
+		redis:          rdb,
+		redisKeyPrefix: keyPrefix,
+		stopCleanup:    make(chan struct{}),
 	}
 
 	// Parse trusted networks
 	sm.parseTrustedNetworks()
 
+	geo, err := newGeoFilter(config)
+	if err != nil {
+		log.Printf("⚠️ Geo blocking disabled: %v", err)
+	} else if geo != nil {
+		sm.geo = geo
+		sm.geoBlockedByCode = make(map[string]int)
+		log.Printf("🌍 Geo blocking enabled (%d blocked countries, %d allowed countries, %d blocked ASNs)",
+			len(geo.blockedCountries), len(geo.allowedCountries), len(geo.blockedASNs))
+	}
+
 	// Start cleanup goroutine
 	sm.cleanupTicker = time.NewTicker(5 * time.Minute)
 	go sm.cleanupRoutine()
@@ -116,7 +180,8 @@ func (sm *SecurityMiddleware) isTrustedIP(ip net.IP) bool {
 	return false
 }
 
-// ValidateConnection checks if a connection should be allowed
+// ValidateConnection checks if a connection should be allowed. It may wait on
+// Redis for up to redisTimeout, so callers run it off their accept loops.
 func (sm *SecurityMiddleware) ValidateConnection(conn net.Conn) error {
 	clientAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
 	if !ok {
@@ -138,6 +203,21 @@ func (sm *SecurityMiddleware) ValidateConnection(conn net.Conn) error {
 		return nil
 	}
 
+	// Look up a persisted blacklist entry unless the in-memory cache already has
+	// one, or Redis had none a moment ago
+	lookupStart := time.Now()
+	sm.mu.RLock()
+	cached := sm.ipStats[clientIP]
+	cachedBlacklist := cached != nil && cached.IsBlacklisted && lookupStart.Before(cached.BlacklistUntil)
+	recentlyChecked := cached != nil && lookupStart.Sub(cached.BlacklistChecked) < blacklistCheckTTL
+	sm.mu.RUnlock()
+
+	var persistedUntil time.Time
+	lookedUp := !cachedBlacklist && !recentlyChecked && sm.redis != nil
+	if lookedUp {
+		persistedUntil = sm.lookupBlacklist(clientIP)
+	}
+
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
@@ -152,6 +232,15 @@ func (sm *SecurityMiddleware) ValidateConnection(conn net.Conn) error {
 	stats := sm.ipStats[clientIP]
 	now := time.Now()
 
+	// Cache a blacklist entry restored from Redis, or that there was none. A failed
+	// lookup counts as none, so an unreachable Redis is not asked on every connection.
+	if persistedUntil.After(now) {
+		stats.IsBlacklisted = true
+		stats.BlacklistUntil = persistedUntil
+	} else if lookedUp {
+		stats.BlacklistChecked = lookupStart
+	}
+
 	// Check if IP is blacklisted
 	if stats.IsBlacklisted && now.Before(stats.BlacklistUntil) {
 		return fmt.Errorf("IP %s is blacklisted until %v", clientIP, stats.BlacklistUntil)
@@ -163,6 +252,20 @@ func (sm *SecurityMiddleware) ValidateConnection(conn net.Conn) error {
 		log.Printf("🔓 IP %s removed from blacklist", clientIP)
 	}
 
+	// Check the IP's country and autonomous system
+	if sm.geo != nil {
+		if !stats.GeoLookedUp {
+			stats.Country, stats.ASN = sm.geo.lookup(clientAddr.IP)
+			stats.GeoLookedUp = true
+		}
+		if key, reason := sm.geo.blockReason(stats.Country, stats.ASN); reason != "" {
+			sm.geoBlocked++
+			sm.geoBlockedByCode[key]++
+			log.Printf("🌍 Connection from %s blocked: %s", clientIP, reason)
+			return fmt.Errorf("connections from IP %s are blocked: %s", clientIP, reason)
+		}
+	}
+
 	// Check global connection limit
 	if sm.globalConnections >= sm.config.MaxGlobalConnections {
 		sm.recordViolation(clientIP, stats, "global connection limit exceeded")
@@ -267,7 +370,80 @@ func (sm *SecurityMiddleware) recordViolation(clientIP string, stats *IPStats, r
 		stats.BlacklistUntil = now.Add(sm.config.BlacklistDuration)
 		log.Printf("🚫 IP %s blacklisted until %v (violations: %d)",
 			clientIP, stats.BlacklistUntil, len(stats.Violations))
+
+		if sm.redis != nil {
+			go sm.persistBlacklist(clientIP, sm.config.BlacklistDuration)
+		}
+	}
+
+	if sm.onViolation != nil {
+		sm.onViolation(clientIP, reason, stats.IsBlacklisted)
+	}
+}
+
+// Country returns the ISO country code of clientIP, or "" when geo lookups are
+// disabled or the IP has no entry. Lookups of tracked IPs are cached.
+func (sm *SecurityMiddleware) Country(clientIP string) string {
+	if sm.geo == nil {
+		return ""
+	}
+
+	sm.mu.RLock()
+	stats, tracked := sm.ipStats[clientIP]
+	if tracked && stats.GeoLookedUp {
+		country := stats.Country
+		sm.mu.RUnlock()
+		return country
+	}
+	sm.mu.RUnlock()
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return ""
 	}
+	country, _ := sm.geo.lookup(ip)
+	return country
+}
+
+// SetViolationHandler registers a callback invoked for every security violation.
+// It runs while the middleware's lock is held, so it must not block.
+func (sm *SecurityMiddleware) SetViolationHandler(fn func(clientIP, reason string, blacklisted bool)) {
+	sm.mu.Lock()
+	sm.onViolation = fn
+	sm.mu.Unlock()
+}
+
+// persistBlacklist stores a blacklist entry in Redis with the blacklist duration as TTL
+func (sm *SecurityMiddleware) persistBlacklist(clientIP string, duration time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	if err := sm.redis.Set(ctx, sm.redisKeyPrefix+blacklistKeyPrefix+clientIP, time.Now().Add(duration).Unix(), duration).Err(); err != nil {
+		log.Printf("⚠️ Failed to persist blacklist entry for %s: %v", clientIP, err)
+	}
+}
+
+// lookupBlacklist returns when a persisted blacklist entry for the IP expires, or the
+// zero time if there is none. Redis errors are logged and treated as not blacklisted.
+func (sm *SecurityMiddleware) lookupBlacklist(clientIP string) time.Time {
+	if sm.redis == nil {
+		return time.Time{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	ttl, err := sm.redis.PTTL(ctx, sm.redisKeyPrefix+blacklistKeyPrefix+clientIP).Result()
+	if err != nil {
+		log.Printf("⚠️ Failed to look up blacklist entry for %s: %v", clientIP, err)
+		return time.Time{}
+	}
+
+	// Negative TTLs mean the key is missing (-2) or has no expiry (-1)
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
 }
 
 // detectBurst detects burst attacks based on connection patterns
@@ -378,7 +554,32 @@ func (sm *SecurityMiddleware) GetStats() map[string]interface{} {
 		"max_global_conns":   sm.config.MaxGlobalConnections,
 		"max_ip_conns":       sm.config.MaxConnectionsPerIP,
 		"trusted_networks":   len(sm.trustedNets),
+		"geo_enabled":        sm.geo != nil,
+		"geo_blocked":        sm.geoBlocked,
+		"geo_blocked_by":     copyCounts(sm.geoBlockedByCode),
+	}
+}
+
+// copyCounts returns a copy of counts that is safe to use after the lock is released
+func copyCounts(counts map[string]int) map[string]int {
+	copied := make(map[string]int, len(counts))
+	for key, n := range counts {
+		copied[key] = n
 	}
+	return copied
+}
+
+// SetLimits changes the connection limits at runtime. Connections already allowed
+// are kept even when they are now over a limit; the limits apply to new ones.
+func (sm *SecurityMiddleware) SetLimits(maxPerIP, maxPerHour, maxGlobal int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.config.MaxConnectionsPerIP = maxPerIP
+	sm.config.MaxConnectionsPerHour = maxPerHour
+	sm.config.MaxGlobalConnections = maxGlobal
+
+	log.Printf("🔒 Connection limits set: %d per IP, %d per IP per hour, %d global", maxPerIP, maxPerHour, maxGlobal)
 }
 
 // AddTrustedNetwork adds a new trusted network at runtime
@@ -441,40 +642,104 @@ func (sm *SecurityMiddleware) Stop() {
 		sm.cleanupTicker.Stop()
 	}
 	close(sm.stopCleanup)
+	sm.geo.close()
 }
 
-// WrapConnection wraps a connection with security checks and timeouts
+// WrapConnection wraps a connection with security checks and timeouts. TCP
+// connections are probed with keepalives instead of timing out when idle if
+// KeepAlive is set.
 func (sm *SecurityMiddleware) WrapConnection(conn net.Conn) net.Conn {
-	return &secureConnection{
+	sc := &secureConnection{
 		Conn:    conn,
 		sm:      sm,
 		created: time.Now(),
 	}
+	if tcpConn := TCPConn(conn); tcpConn != nil && sm.config.KeepAlive > 0 {
+		err := tcpConn.SetKeepAlive(true)
+		if err == nil {
+			err = tcpConn.SetKeepAlivePeriod(sm.config.KeepAlive)
+		}
+		// Fall back to the idle timeout if the probes cannot be enabled
+		sc.keepAlive = err == nil
+	}
+	return sc
+}
+
+// TCPConn returns the TCP connection under conn, looking through wrappers such as
+// *tls.Conn and the connections returned by WrapConnection, or nil if there is none
+func TCPConn(conn net.Conn) *net.TCPConn {
+	for conn != nil {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			return tcpConn
+		}
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapped.NetConn()
+	}
+	return nil
 }
 
 // secureConnection wraps a net.Conn with security features
 type secureConnection struct {
 	net.Conn
-	sm      *SecurityMiddleware
-	created time.Time
+	sm            *SecurityMiddleware
+	created       time.Time
+	keepAlive     bool // Liveness is left to TCP keepalive probes rather than the idle timeout
+	closeOnce     sync.Once
+	handshakeDone atomic.Bool
 }
 
-// Read implements net.Conn with idle timeout
+// Read implements net.Conn with idle timeout, or with no deadline once the
+// handshake is complete on a connection probed by keepalives. Until the handshake
+// is complete, reads also stop at HandshakeTimeout after the connection was
+// accepted, so a client that sends nothing, or trickles its first frame, is dropped.
 func (sc *secureConnection) Read(b []byte) (n int, err error) {
-	// Set read deadline for idle timeout
-	sc.SetReadDeadline(time.Now().Add(sc.sm.config.IdleTimeout))
+	var deadline time.Time
+	if !sc.keepAlive {
+		deadline = time.Now().Add(sc.sm.config.IdleTimeout)
+	}
+	if timeout := sc.sm.config.HandshakeTimeout; timeout > 0 && !sc.handshakeDone.Load() {
+		if handshake := sc.created.Add(timeout); deadline.IsZero() || handshake.Before(deadline) {
+			deadline = handshake
+		}
+	}
+	sc.SetReadDeadline(deadline)
 	return sc.Conn.Read(b)
 }
 
-// Write implements net.Conn with idle timeout
+// CompleteHandshake lifts the handshake deadline, leaving only the idle timeout
+func (sc *secureConnection) CompleteHandshake() {
+	sc.handshakeDone.Store(true)
+}
+
+// CompleteHandshake marks the handshake on a connection returned by
+// WrapConnection as complete. Other connections are left alone.
+func CompleteHandshake(conn net.Conn) {
+	if sc, ok := conn.(*secureConnection); ok {
+		sc.CompleteHandshake()
+	}
+}
+
+// Write implements net.Conn with idle timeout. A write blocked this long means the
+// peer has stopped reading, so it applies even with keepalives.
 func (sc *secureConnection) Write(b []byte) (n int, err error) {
 	// Set write deadline for idle timeout
 	sc.SetWriteDeadline(time.Now().Add(sc.sm.config.IdleTimeout))
 	return sc.Conn.Write(b)
 }
 
+// NetConn returns the wrapped connection
+func (sc *secureConnection) NetConn() net.Conn {
+	return sc.Conn
+}
+
 // Close implements net.Conn and records the connection closure
 func (sc *secureConnection) Close() error {
-	sc.sm.RecordConnectionClosed(sc.Conn)
+	// Only release the connection slot once, even if Close is called repeatedly
+	sc.closeOnce.Do(func() {
+		sc.sm.RecordConnectionClosed(sc.Conn)
+	})
 	return sc.Conn.Close()
 }
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clfTimeFormat is the timestamp layout of the Common and Combined Log Formats
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// maxObservedRequests bounds how many pipelined requests may wait for their
+// responses while an HTTP connection is observed
+const maxObservedRequests = 32
+
+// accessLog appends Combined Log Format lines to a file. A nil accessLog
+// discards everything.
+type accessLog struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openAccessLog opens the access log at path for appending, creating it if needed
+func openAccessLog(path string) (*accessLog, error) {
+	l := &accessLog{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen closes and reopens the file, so it can be rotated by renaming it and
+// signalling the server
+func (l *accessLog) reopen() error {
+	if l == nil {
+		return nil
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log %s: %w", l.path, err)
+	}
+
+	l.mu.Lock()
+	old := l.file
+	l.file = file
+	l.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Close closes the file
+func (l *accessLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// accessLogEntry is one request and its response
+type accessLogEntry struct {
+	clientIP  string
+	received  time.Time
+	method    string
+	uri       string
+	proto     string
+	status    int
+	bytes     int64
+	referer   string
+	userAgent string
+}
+
+// write appends entry as a Combined Log Format line
+func (l *accessLog) write(entry accessLogEntry) {
+	if l == nil {
+		return
+	}
+	size := "-"
+	if entry.bytes > 0 {
+		size = fmt.Sprint(entry.bytes)
+	}
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		entry.clientIP, entry.received.Format(clfTimeFormat),
+		clfEscape(entry.method), clfEscape(entry.uri), clfEscape(entry.proto),
+		entry.status, size, clfField(entry.referer), clfField(entry.userAgent))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.WriteString(line)
+	}
+}
+
+// clfField escapes a quoted log field, using "-" for an empty one
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return clfEscape(s)
+}
+
+// clfEscape keeps a client-supplied value from breaking out of its quoted field
+func clfEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+// sniffHTTPRequest reports whether head, the first bytes read from an external
+// connection, starts an HTTP request, and if so returns its request target and
+// User-Agent. head may stop before the end of the headers; the user agent is then
+// left empty.
+func sniffHTTPRequest(head []byte) (path, userAgent string, ok bool) {
+	line, _, _ := bytes.Cut(head, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/1.") || !isHTTPMethod(fields[0]) {
+		return "", "", false
+	}
+
+	if req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head))); err == nil {
+		return req.RequestURI, req.UserAgent(), true
+	}
+	return fields[1], "", true
+}
+
+// isHTTPMethod reports whether method is one of the standard HTTP methods
+func isHTTPMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// httpObserver parses copies of both directions of a bridged HTTP/1.x connection
+// and writes an access log entry for each request and its response. Parsing
+// never holds up the bridge for longer than it takes to read the copied bytes:
+// once either side stops looking like HTTP (a protocol upgrade, a CONNECT
+// tunnel, malformed data), the rest of the stream is discarded unparsed.
+type httpObserver struct {
+	requests  *io.PipeWriter
+	responses *io.PipeWriter
+	wg        sync.WaitGroup
+}
+
+// observedRequest is a parsed request waiting for its response
+type observedRequest struct {
+	req      *http.Request
+	received time.Time
+}
+
+// newHTTPObserver starts observing a connection from clientIP, logging to log
+func newHTTPObserver(log *accessLog, clientIP string) *httpObserver {
+	reqReader, reqWriter := io.Pipe()
+	respReader, respWriter := io.Pipe()
+	o := &httpObserver{requests: reqWriter, responses: respWriter}
+	pending := make(chan observedRequest, maxObservedRequests)
+
+	o.wg.Add(2)
+	go func() {
+		defer o.wg.Done()
+		defer io.Copy(io.Discard, reqReader)
+		defer close(pending)
+
+		reader := bufio.NewReader(reqReader)
+		for {
+			req, err := http.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			pending <- observedRequest{req: req, received: time.Now()}
+			if _, err := io.Copy(io.Discard, req.Body); err != nil {
+				return
+			}
+			if req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer o.wg.Done()
+		defer io.Copy(io.Discard, respReader)
+		// Keep the request side from blocking if responses stop being parsed
+		defer func() {
+			go func() {
+				for range pending {
+				}
+			}()
+		}()
+
+		reader := bufio.NewReader(respReader)
+		for observed := range pending {
+			resp, err := http.ReadResponse(reader, observed.req)
+			// Informational responses such as 100 Continue precede the final one
+			for err == nil && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+				resp, err = http.ReadResponse(reader, observed.req)
+			}
+			if err != nil {
+				return
+			}
+			n, err := io.Copy(io.Discard, resp.Body)
+
+			log.write(accessLogEntry{
+				clientIP:  clientIP,
+				received:  observed.received,
+				method:    observed.req.Method,
+				uri:       observed.req.RequestURI,
+				proto:     observed.req.Proto,
+				status:    resp.StatusCode,
+				bytes:     n,
+				referer:   observed.req.Referer(),
+				userAgent: observed.req.UserAgent(),
+			})
+			if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+				return
+			}
+		}
+	}()
+
+	return o
+}
+
+// requestReader returns r with every byte read from it copied to the observer
+func (o *httpObserver) requestReader(r io.Reader) io.Reader {
+	return io.TeeReader(r, o.requests)
+}
+
+// observeResponses returns r with every byte read from it copied to the observer
+// in observer, once one has been stored. The responses can start flowing before
+// the request that decides whether the connection is observed; for HTTP they
+// never do, and other protocols are not held up waiting for it.
+func observeResponses(r io.Reader, observer *atomic.Pointer[httpObserver]) io.Reader {
+	return &responseTee{reader: r, observer: observer}
+}
+
+// responseTee is the reader returned by observeResponses
+type responseTee struct {
+	reader   io.Reader
+	observer *atomic.Pointer[httpObserver]
+}
+
+// Read implements io.Reader
+func (r *responseTee) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if o := r.observer.Load(); o != nil && n > 0 {
+		o.responses.Write(p[:n])
+	}
+	return n, err
+}
+
+// close ends both streams and waits for the last entries to be written
+func (o *httpObserver) close() {
+	o.requests.Close()
+	o.responses.Close()
+	o.wg.Wait()
+}
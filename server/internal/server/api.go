@@ -2,60 +2,162 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"rabbit.go/internal/database"
+	"rabbit.go/internal/middleware"
+	"rabbit.go/protocol"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 // APIServer represents the HTTP API server
 type APIServer struct {
-	server    *http.Server
-	dbService *database.Service
+	server       *http.Server
+	tunnelServer *Server
+	dbService    *database.Service
+	security     *middleware.SecurityMiddleware
+	adminKey     string // Bearer key for management endpoints; empty leaves them open
+	maxBodyBytes int64  // Largest request body accepted
+
+	// Token generation requests allowed per client IP per minute; 0 is unlimited
+	generateLimit int
 }
 
+// DefaultMaxRequestBodyBytes limits API request bodies when Config.MaxRequestBodyBytes is unset
+const DefaultMaxRequestBodyBytes = 1 << 20
+
+// DefaultGenerateRateLimit is the default for Config.GenerateRateLimit
+const DefaultGenerateRateLimit = 10
+
 // TokenGenerationRequest represents the request body for token generation
 type TokenGenerationRequest struct {
 	TeamID        string `json:"team_id"`
 	Name          string `json:"name"`
 	Description   string `json:"description,omitempty"`
 	ExpiresInDays int    `json:"expires_in_days,omitempty"`
+	Protocol      string `json:"protocol,omitempty"`  // tcp (default) or udp
+	Subdomain     string `json:"subdomain,omitempty"` // Optional: route <subdomain>.<domain> on the shared HTTP(S) port
+
+	// BindAddress optionally makes the token's tunnels listen on this IP address
+	// instead of the server's bind address, e.g. an internal interface
+	BindAddress string `json:"bind_address,omitempty"`
+
+	// AllowedLocalPorts optionally restricts which local ports the token may expose
+	AllowedLocalPorts []int64 `json:"allowed_local_ports,omitempty"`
+
+	// AllowPublicBind controls whether clients may ask for a public listener.
+	// Defaults to true; when false the token's tunnels only listen on loopback.
+	AllowPublicBind *bool `json:"allow_public_bind,omitempty"`
+
+	// ValidateOnly checks the request and reports the port that would be assigned
+	// without creating a token or reserving the port
+	ValidateOnly bool `json:"validate_only,omitempty"`
+}
+
+// TeamCreationRequest represents the request body for team creation
+type TeamCreationRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
 }
 
+// TeamQuotaRequest represents the request body for setting a team's quotas
+type TeamQuotaRequest struct {
+	MaxConcurrentTunnels int `json:"max_concurrent_tunnels"`
+	MaxDailyConnections  int `json:"max_daily_connections"`
+}
+
+// ErrorResponse is the body of every failed API response
+type ErrorResponse struct {
+	Success bool      `json:"success"`
+	Error   *APIError `json:"error"`
+}
+
+// APIError describes why a request failed. Code is stable and meant for clients
+// to switch on; Message is for people and may change.
+type APIError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// API error codes
+const (
+	APIErrValidation         = "VALIDATION_ERROR"
+	APIErrUnauthorized       = "UNAUTHORIZED"
+	APIErrTeamNotFound       = "TEAM_NOT_FOUND"
+	APIErrTeamNameTaken      = "TEAM_NAME_TAKEN"
+	APIErrTokenNotFound      = "TOKEN_NOT_FOUND"
+	APIErrTunnelNotFound     = "TUNNEL_NOT_FOUND"
+	APIErrSubdomainTaken     = "SUBDOMAIN_TAKEN"
+	APIErrPortExhausted      = "PORT_EXHAUSTED"
+	APIErrServiceUnavailable = "SERVICE_UNAVAILABLE"
+	APIErrInternal           = "INTERNAL_ERROR"
+	APIErrRequestTooLarge    = "REQUEST_TOO_LARGE"
+	APIErrRateLimited        = "RATE_LIMITED"
+)
+
 // TokenGenerationResponse represents the response for token generation
 type TokenGenerationResponse struct {
-	Success bool       `json:"success"`
-	Message string     `json:"message,omitempty"`
-	Error   string     `json:"error,omitempty"`
-	Data    *TokenData `json:"data,omitempty"`
+	Success    bool                 `json:"success"`
+	Message    string               `json:"message,omitempty"`
+	Error      *APIError            `json:"error,omitempty"`
+	Data       *TokenData           `json:"data,omitempty"`
+	Validation *TokenValidationData `json:"validation,omitempty"` // Set instead of Data for validate_only requests
 }
 
 // TokenData represents the token information
 type TokenData struct {
-	TokenID      string     `json:"token_id"`
-	TeamID       string     `json:"team_id"`
-	TeamName     string     `json:"team_name"`
-	TokenName    string     `json:"token_name"`
-	Token        string     `json:"token"`
-	Description  string     `json:"description"`
-	AssignedPort int        `json:"assigned_port"`
-	Protocol     string     `json:"protocol"`
-	CreatedAt    time.Time  `json:"created_at"`
-	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	TokenID           string     `json:"token_id"`
+	TeamID            string     `json:"team_id"`
+	TeamName          string     `json:"team_name"`
+	TokenName         string     `json:"token_name"`
+	Token             string     `json:"token"`
+	Description       string     `json:"description"`
+	AssignedPort      int        `json:"assigned_port"`
+	Protocol          string     `json:"protocol"`
+	Subdomain         string     `json:"subdomain,omitempty"`
+	BindAddress       string     `json:"bind_address,omitempty"`
+	AllowedLocalPorts []int64    `json:"allowed_local_ports,omitempty"`
+	AllowPublicBind   bool       `json:"allow_public_bind"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+}
+
+// TokenValidationData describes the token a validate_only request would create
+type TokenValidationData struct {
+	TeamID            string     `json:"team_id"`
+	TeamName          string     `json:"team_name"`
+	TokenName         string     `json:"token_name"`
+	AssignedPort      int        `json:"assigned_port"` // Free now; not reserved, so a later request may get another port
+	Protocol          string     `json:"protocol"`
+	Subdomain         string     `json:"subdomain,omitempty"`
+	BindAddress       string     `json:"bind_address,omitempty"`
+	AllowedLocalPorts []int64    `json:"allowed_local_ports,omitempty"`
+	AllowPublicBind   bool       `json:"allow_public_bind"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
 }
 
 // TeamListResponse represents the response for listing teams
 type TeamListResponse struct {
 	Success bool       `json:"success"`
 	Message string     `json:"message,omitempty"`
-	Error   string     `json:"error,omitempty"`
+	Error   *APIError  `json:"error,omitempty"`
 	Data    []TeamInfo `json:"data,omitempty"`
 }
 
@@ -63,7 +165,7 @@ type TeamListResponse struct {
 type TeamTokenResponse struct {
 	Success bool        `json:"success"`
 	Message string      `json:"message,omitempty"`
-	Error   string      `json:"error,omitempty"`
+	Error   *APIError   `json:"error,omitempty"`
 	Data    []TokenInfo `json:"data,omitempty"`
 }
 
@@ -87,108 +189,222 @@ type TokenInfo struct {
 	CreatedAt   time.Time  `json:"created_at"`
 	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
 	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+
+	// Where the token was last authenticated from; the country needs --geoip-db
+	LastUsedIP      string `json:"last_used_ip,omitempty"`
+	LastUsedCountry string `json:"last_used_country,omitempty"`
 }
 
 // StatsResponse represents database statistics
 type StatsResponse struct {
 	Success bool                   `json:"success"`
 	Message string                 `json:"message,omitempty"`
-	Error   string                 `json:"error,omitempty"`
+	Error   *APIError              `json:"error,omitempty"`
 	Data    map[string]interface{} `json:"data,omitempty"`
 }
 
+// PortUsageResponse represents the use of the tunnel port range
+type PortUsageResponse struct {
+	Success bool                `json:"success"`
+	Message string              `json:"message,omitempty"`
+	Error   *APIError           `json:"error,omitempty"`
+	Data    *database.PortUsage `json:"data,omitempty"`
+}
+
+// ConnectionLogsResponse represents one page of a team's connection logs
+type ConnectionLogsResponse struct {
+	Success bool                     `json:"success"`
+	Message string                   `json:"message,omitempty"`
+	Error   *APIError                `json:"error,omitempty"`
+	Data    []database.ConnectionLog `json:"data,omitempty"`
+	Total   int                      `json:"total"`
+	Limit   int                      `json:"limit"`
+	Offset  int                      `json:"offset"`
+}
+
+// AuditLogResponse represents one page of the audit log
+type AuditLogResponse struct {
+	Success bool                  `json:"success"`
+	Message string                `json:"message,omitempty"`
+	Error   *APIError             `json:"error,omitempty"`
+	Data    []database.AuditEvent `json:"data,omitempty"`
+	Total   int                   `json:"total"`
+	Limit   int                   `json:"limit"`
+	Offset  int                   `json:"offset"`
+}
+
+// Connection log and audit log pagination defaults
+const (
+	defaultConnectionLogLimit = 50
+	maxConnectionLogLimit     = 500
+)
+
+// connectionLogStatuses are the statuses a connection log can be filtered by
+var connectionLogStatuses = map[string]bool{
+	"active":  true,
+	"closed":  true,
+	"error":   true,
+	"timeout": true,
+}
+
+// Event stream keepalive settings
+const (
+	eventPingInterval = 30 * time.Second
+	eventWriteTimeout = 10 * time.Second
+)
+
+// eventUpgrader upgrades event stream requests. Any origin is accepted because
+// access is already gated by the admin API key, as for the rest of the API.
+var eventUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// subdomainPattern matches a single lowercase DNS label
+var subdomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
 // NewAPIServer creates a new API server instance
-func NewAPIServer(dbService *database.Service, bindAddress string, apiPort string, controlPort string) *APIServer {
+func NewAPIServer(tunnelServer *Server, dbService *database.Service, security *middleware.SecurityMiddleware, bindAddress string, apiPort string, adminKey string, maxBodyBytes int64, generateLimit int) *APIServer {
 	router := mux.NewRouter()
 
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = DefaultMaxRequestBodyBytes
+	}
 	apiServer := &APIServer{
-		dbService: dbService,
+		tunnelServer: tunnelServer,
+		dbService:    dbService,
+		security:     security,
+		adminKey:     adminKey,
+		maxBodyBytes: maxBodyBytes,
+
+		generateLimit: generateLimit,
 	}
 
 	// Setup routes
-	apiServer.setupRoutes(router, controlPort)
+	apiServer.setupRoutes(router)
 
 	// Create HTTP server
 	apiServer.server = &http.Server{
-		Addr:         fmt.Sprintf("%s:%s", bindAddress, apiPort),
-		Handler:      router,
-		WriteTimeout: 30 * time.Second,
-		ReadTimeout:  30 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:              fmt.Sprintf("%s:%s", bindAddress, apiPort),
+		Handler:           router,
+		WriteTimeout:      30 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       60 * time.Second,
 	}
 
 	return apiServer
 }
 
 // setupRoutes configures all HTTP API routes
-func (api *APIServer) setupRoutes(router *mux.Router, controlPort string) {
+func (api *APIServer) setupRoutes(router *mux.Router) {
 	// Add CORS middleware
 	router.Use(corsMiddleware)
 	router.Use(loggingMiddleware)
+	router.Use(api.limitRequestBody)
 
 	// API routes
 	v1 := router.PathPrefix("/api/v1").Subrouter()
 
-	// Token management
-	v1.HandleFunc("/tokens/generate", api.generateToken).Methods("POST")
-	v1.HandleFunc("/teams", api.listTeams).Methods("GET")
-	v1.HandleFunc("/teams/{teamId}/tokens", api.getTeamTokens).Methods("GET")
-	v1.HandleFunc("/stats", api.getStats).Methods("GET")
+	// Public endpoints
 	v1.HandleFunc("/health", api.healthCheck).Methods("GET")
-	v1.HandleFunc("/teams/{teamId}/tokens/{tokenId}", func(w http.ResponseWriter, r *http.Request) {
-		api.deleteToken(w, r, controlPort)
-	}).Methods("DELETE")
+
+	// Authenticated by a tunnel token instead of the admin key
+	v1.HandleFunc("/usage", api.getUsage).Methods("GET")
+
+	// Everything else requires the admin API key
+	admin := v1.NewRoute().Subrouter()
+	admin.Use(api.requireAdminKey)
+
+	// Token management
+	admin.Handle("/tokens/generate", api.limitTokenGeneration(http.HandlerFunc(api.generateToken))).Methods("POST")
+	admin.HandleFunc("/tokens/{tokenId}", api.revokeToken).Methods("DELETE")
+	admin.HandleFunc("/teams", api.listTeams).Methods("GET")
+	admin.HandleFunc("/teams", api.createTeam).Methods("POST")
+	admin.HandleFunc("/teams/{teamId}", api.deleteTeam).Methods("DELETE")
+	admin.HandleFunc("/teams/{teamId}/quota", api.setTeamQuota).Methods("PUT")
+	admin.HandleFunc("/teams/{teamId}/tokens", api.getTeamTokens).Methods("GET")
+	admin.HandleFunc("/teams/{teamId}/connections", api.listConnectionLogs).Methods("GET")
+	admin.HandleFunc("/teams/{teamId}/connections.csv", api.exportConnectionLogs).Methods("GET")
+	admin.HandleFunc("/tunnels", api.listTunnels).Methods("GET")
+	admin.HandleFunc("/tunnels/{tunnelId}", api.closeTunnel).Methods("DELETE")
+	admin.HandleFunc("/stats", api.getStats).Methods("GET")
+	admin.HandleFunc("/audit", api.listAuditEvents).Methods("GET")
+	admin.HandleFunc("/ports", api.getPortUsage).Methods("GET")
+	admin.HandleFunc("/security", api.getSecurityStats).Methods("GET")
+	admin.HandleFunc("/events", api.streamEvents).Methods("GET")
+	admin.HandleFunc("/teams/{teamId}/tokens/{tokenId}", api.deleteToken).Methods("DELETE")
 	// Root endpoint
 	router.HandleFunc("/", api.homeEndpoint).Methods("GET")
 }
 
 // Start starts the API server
 func (api *APIServer) Start() error {
-	log.Printf("🌐 API server starting on %s", api.server.Addr)
-	log.Printf("📋 Available endpoints:")
-	log.Printf("   GET  / - API information")
-	log.Printf("   GET  /api/v1/health - Health check")
-	log.Printf("   GET  /api/v1/teams - List teams with tokens")
-	log.Printf("   GET  /api/v1/stats - Database statistics")
-	log.Printf("   POST /api/v1/tokens/generate - Generate new token")
-	log.Printf("   GET  /api/v1/teams/:teamId/tokens - Get team's tokens")
-	log.Printf("   DELETE /api/v1/teams/:teamId/tokens/:tokenId - Delete a token")
+	slog.Info("API server starting", "addr", api.server.Addr, "auth_required", api.adminKey != "")
+	if api.adminKey == "" {
+		slog.Warn("API_ADMIN_KEY is not set; management endpoints are open to anyone who can reach the API")
+	}
+	for _, endpoint := range []string{
+		"GET / - API information (public)",
+		"GET /api/v1/health - Health check (public)",
+		"GET /api/v1/teams - List teams with tokens",
+		"POST /api/v1/teams - Create a team",
+		"GET /api/v1/tunnels - Live tunnels on this server",
+		"DELETE /api/v1/tunnels/:tunnelId - Force-close a tunnel",
+		"GET /api/v1/stats - Database statistics",
+		"GET /api/v1/security - Security middleware statistics",
+		"GET /api/v1/events - Live event stream (WebSocket)",
+		"POST /api/v1/tokens/generate - Generate new token",
+		"DELETE /api/v1/tokens/:tokenId - Revoke a token",
+		"DELETE /api/v1/teams/:teamId - Delete a team",
+		"PUT /api/v1/teams/:teamId/quota - Set a team's quotas",
+		"GET /api/v1/teams/:teamId/tokens - Get team's tokens",
+		"GET /api/v1/teams/:teamId/connections - List team's connection logs",
+		"DELETE /api/v1/teams/:teamId/tokens/:tokenId - Delete a token",
+	} {
+		slog.Debug("API endpoint available", "endpoint", endpoint)
+	}
 
 	return api.server.ListenAndServe()
 }
 
-// Stop stops the API server
-func (api *APIServer) Stop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	return api.server.Shutdown(ctx)
+// Shutdown stops the API server, waiting for in-flight requests until ctx is
+// done and then closing the connections still open
+func (api *APIServer) Shutdown(ctx context.Context) error {
+	if err := api.server.Shutdown(ctx); err != nil {
+		api.server.Close()
+		return err
+	}
+	return nil
 }
 
 // deleteToken handles DELETE /api/v1/teams/:teamId/tokens/:tokenId
-func (api *APIServer) deleteToken(w http.ResponseWriter, r *http.Request, controlPort string) {
+func (api *APIServer) deleteToken(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	teamId := vars["teamId"]
-	tokenId := vars["tokenId"]
-	ctx := context.Background()
-	portAssignment, err := api.dbService.DeleteTunnelForTeam(ctx, teamId, uuid.MustParse(tokenId))
+	tokenId, err := uuid.Parse(vars["tokenId"])
 	if err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, TokenGenerationResponse{
-			Success: false,
-			Error:   "failed to delete token",
-		})
+		respondWithValidationError(w, "tokenId", "invalid token id")
 		return
 	}
-
-	// notify server - dial tcp:
-	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%s", controlPort))
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
+	portAssignment, err := api.dbService.DeleteTunnelForTeam(ctx, teamId, tokenId)
 	if err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, TokenGenerationResponse{
-			Success: false,
-			Error:   "failed to notify server",
-		})
+		api.audit(r, database.AuditTokenDelete, tokenId.String(), err, map[string]interface{}{"team_id": teamId})
+		slog.Error("failed to delete token", "team_id", teamId, "token_id", tokenId, "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to delete token")
+		return
 	}
-	defer conn.Close()
-	conn.Write([]byte(fmt.Sprintf("delete_port_%s", portAssignment.Port)))
+
+	// Close any tunnel still using the released port
+	if api.tunnelServer != nil {
+		api.tunnelServer.stopTunnelsOnPort(portAssignment.Port)
+	}
+
+	api.audit(r, database.AuditTokenDelete, tokenId.String(), nil, map[string]interface{}{
+		"team_id":       teamId,
+		"released_port": portAssignment.Port,
+	})
 
 	respondWithJSON(w, http.StatusOK, TokenGenerationResponse{
 		Success: true,
@@ -196,59 +412,273 @@ func (api *APIServer) deleteToken(w http.ResponseWriter, r *http.Request, contro
 	})
 }
 
+// revokeToken handles DELETE /api/v1/tokens/:tokenId
+func (api *APIServer) revokeToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := uuid.Parse(mux.Vars(r)["tokenId"])
+	if err != nil {
+		respondWithValidationError(w, "tokenId", "invalid token id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
+	assignments, err := api.dbService.RevokeToken(ctx, tokenID)
+	if err != nil {
+		api.audit(r, database.AuditTokenRevoke, tokenID.String(), err, nil)
+		if errors.Is(err, database.ErrTokenNotFound) {
+			respondWithError(w, http.StatusNotFound, APIErrTokenNotFound, err.Error())
+			return
+		}
+		slog.Error("failed to revoke token", "token_id", tokenID, "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to revoke token")
+		return
+	}
+
+	closedTunnels := 0
+	if api.tunnelServer != nil {
+		closedTunnels = api.tunnelServer.closeTunnelsForToken(tokenID.String(),
+			&protocol.Error{Error: "token revoked", Code: protocol.ErrCodeTokenRevoked})
+	}
+
+	releasedPorts := make([]int, 0, len(assignments))
+	for _, pa := range assignments {
+		releasedPorts = append(releasedPorts, pa.Port)
+	}
+
+	slog.Info("token revoked", "token_id", tokenID, "released_ports", releasedPorts, "closed_tunnels", closedTunnels)
+	api.audit(r, database.AuditTokenRevoke, tokenID.String(), nil, map[string]interface{}{
+		"released_ports": releasedPorts,
+		"closed_tunnels": closedTunnels,
+	})
+
+	respondWithJSON(w, http.StatusOK, StatsResponse{
+		Success: true,
+		Message: "Token revoked successfully",
+		Data: map[string]interface{}{
+			"token_id":       tokenID.String(),
+			"released_ports": releasedPorts,
+			"closed_tunnels": closedTunnels,
+		},
+	})
+}
+
+// createTeam handles POST /api/v1/teams
+func (api *APIServer) createTeam(w http.ResponseWriter, r *http.Request) {
+	var req TeamCreationRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		respondWithValidationError(w, "name", "name is required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
+	team, err := api.dbService.CreateTeam(ctx, req.Name, req.Description)
+	if err != nil {
+		api.audit(r, database.AuditTeamCreate, "", err, map[string]interface{}{"name": req.Name})
+		if errors.Is(err, database.ErrTeamNameTaken) {
+			respondWithError(w, http.StatusConflict, APIErrTeamNameTaken, fmt.Sprintf("a team named %q already exists", req.Name))
+			return
+		}
+		slog.Error("failed to create team", "team_name", req.Name, "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to create team")
+		return
+	}
+
+	slog.Info("team created", "team_id", team.ID, "team_name", team.Name)
+	api.audit(r, database.AuditTeamCreate, team.ID, nil, map[string]interface{}{"name": team.Name})
+
+	respondWithJSON(w, http.StatusCreated, StatsResponse{
+		Success: true,
+		Message: "Team created successfully",
+		Data: map[string]interface{}{
+			"team_id":     team.ID,
+			"name":        team.Name,
+			"description": team.Description,
+			"created_at":  team.CreatedAt,
+		},
+	})
+}
+
+// deleteTeam handles DELETE /api/v1/teams/{teamId}. The team is soft-deleted, its
+// tokens deactivated and its ports released, and tunnels on those ports are closed.
+func (api *APIServer) deleteTeam(w http.ResponseWriter, r *http.Request) {
+	teamID := mux.Vars(r)["teamId"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
+	assignments, tokens, err := api.dbService.DeactivateTeam(ctx, teamID)
+	if err != nil {
+		api.audit(r, database.AuditTeamDelete, teamID, err, nil)
+		if errors.Is(err, database.ErrTeamNotFound) {
+			respondWithError(w, http.StatusNotFound, APIErrTeamNotFound, err.Error())
+			return
+		}
+		slog.Error("failed to delete team", "team_id", teamID, "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to delete team")
+		return
+	}
+
+	closedTunnels := 0
+	if api.tunnelServer != nil {
+		closedTunnels = api.tunnelServer.closeTunnelsForPorts(assignments)
+	}
+
+	releasedPorts := make([]int, 0, len(assignments))
+	for _, pa := range assignments {
+		releasedPorts = append(releasedPorts, pa.Port)
+	}
+
+	slog.Info("team deleted", "team_id", teamID, "deactivated_tokens", tokens,
+		"released_ports", releasedPorts, "closed_tunnels", closedTunnels)
+	api.audit(r, database.AuditTeamDelete, teamID, nil, map[string]interface{}{
+		"deactivated_tokens": tokens,
+		"released_ports":     releasedPorts,
+		"closed_tunnels":     closedTunnels,
+	})
+
+	respondWithJSON(w, http.StatusOK, StatsResponse{
+		Success: true,
+		Message: "Team deleted successfully",
+		Data: map[string]interface{}{
+			"team_id":            teamID,
+			"deactivated_tokens": tokens,
+			"released_ports":     releasedPorts,
+			"closed_tunnels":     closedTunnels,
+		},
+	})
+}
+
 // generateToken handles POST /api/v1/tokens/generate
 func (api *APIServer) generateToken(w http.ResponseWriter, r *http.Request) {
 	var req TokenGenerationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithJSON(w, http.StatusBadRequest, TokenGenerationResponse{
-			Success: false,
-			Error:   "Invalid JSON request body",
-		})
+	if !decodeJSONBody(w, r, &req) {
 		return
 	}
 
 	// Validate required fields
 	if req.TeamID == "" {
-		respondWithJSON(w, http.StatusBadRequest, TokenGenerationResponse{
-			Success: false,
-			Error:   "team_id is required",
-		})
+		respondWithValidationError(w, "team_id", "team_id is required")
 		return
 	}
 
 	if req.Name == "" {
-		respondWithJSON(w, http.StatusBadRequest, TokenGenerationResponse{
-			Success: false,
-			Error:   "name is required",
-		})
+		respondWithValidationError(w, "name", "name is required")
+		return
+	}
+
+	if req.Protocol == "" {
+		req.Protocol = "tcp"
+	}
+	if req.Protocol != "tcp" && req.Protocol != "udp" {
+		respondWithValidationError(w, "protocol", "protocol must be tcp or udp")
+		return
+	}
+
+	req.Subdomain = strings.ToLower(req.Subdomain)
+	if req.Subdomain != "" {
+		if !subdomainPattern.MatchString(req.Subdomain) {
+			respondWithValidationError(w, "subdomain", "subdomain must be a single DNS label of letters, digits and hyphens")
+			return
+		}
+		if req.Protocol != "tcp" {
+			respondWithValidationError(w, "subdomain", "subdomain routing requires protocol tcp")
+			return
+		}
+	}
+
+	if req.BindAddress != "" {
+		ip := net.ParseIP(req.BindAddress)
+		if ip == nil {
+			respondWithValidationError(w, "bind_address", "bind_address must be an IP address")
+			return
+		}
+		req.BindAddress = ip.String()
+	}
+
+	if req.ExpiresInDays < 0 {
+		respondWithValidationError(w, "expires_in_days", "expires_in_days must not be negative")
 		return
 	}
 
-	ctx := context.Background()
+	for _, port := range req.AllowedLocalPorts {
+		if port < 1 || port > 65535 {
+			respondWithValidationError(w, "allowed_local_ports", fmt.Sprintf("allowed_local_ports: invalid port %d", port))
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
 
 	// Verify team exists
 	team, err := api.dbService.GetTeamByID(ctx, req.TeamID)
 	if err != nil {
-		respondWithJSON(w, http.StatusNotFound, TokenGenerationResponse{
-			Success: false,
-			Error:   "team not found",
-		})
+		if !req.ValidateOnly {
+			api.audit(r, database.AuditTokenGenerate, "", err, map[string]interface{}{"team_id": req.TeamID, "name": req.Name})
+		}
+		respondWithError(w, http.StatusNotFound, APIErrTeamNotFound, "team not found")
 		return
 	}
 
-	// Calculate expiration
+	// Calculate expiration, applying the server's default and maximum
 	var expiresAt *time.Time
 	if req.ExpiresInDays > 0 {
 		expires := time.Now().AddDate(0, 0, req.ExpiresInDays)
 		expiresAt = &expires
 	}
+	expiresAt, err = api.dbService.ResolveTokenExpiry(expiresAt)
+	if err != nil {
+		respondWithValidationError(w, "expires_in_days", err.Error())
+		return
+	}
+
+	allowPublicBind := req.AllowPublicBind == nil || *req.AllowPublicBind
 
 	// Generate token
-	token, assignment, err := api.dbService.GenerateTokenForTeam(ctx, req.TeamID, req.Name, req.Description, expiresAt)
+	token, assignment, err := api.dbService.GenerateTokenForTeam(ctx, req.TeamID, req.Name, req.Description, expiresAt, req.Protocol, req.Subdomain, req.BindAddress, req.AllowedLocalPorts, allowPublicBind, req.ValidateOnly)
+	if err != nil && !req.ValidateOnly {
+		api.audit(r, database.AuditTokenGenerate, "", err, map[string]interface{}{"team_id": req.TeamID, "name": req.Name})
+	}
+	if errors.Is(err, database.ErrSubdomainTaken) {
+		respondWithError(w, http.StatusConflict, APIErrSubdomainTaken, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrTokenExpiryTooLong) {
+		respondWithValidationError(w, "expires_in_days", err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrNoAvailablePorts) {
+		slog.Warn("token generation failed: port range exhausted", "team_id", team.ID)
+		respondWithError(w, http.StatusInternalServerError, APIErrPortExhausted, "no tunnel ports are available")
+		return
+	}
 	if err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, TokenGenerationResponse{
-			Success: false,
-			Error:   fmt.Sprintf("failed to generate token: %v", err),
+		slog.Error("failed to generate token", "team_id", team.ID, "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to generate token")
+		return
+	}
+
+	if req.ValidateOnly {
+		respondWithJSON(w, http.StatusOK, TokenGenerationResponse{
+			Success: true,
+			Message: "Token request is valid; nothing was created",
+			Validation: &TokenValidationData{
+				TeamID:            team.ID,
+				TeamName:          team.Name,
+				TokenName:         req.Name,
+				AssignedPort:      assignment.Port,
+				Protocol:          assignment.Protocol,
+				Subdomain:         req.Subdomain,
+				BindAddress:       req.BindAddress,
+				AllowedLocalPorts: req.AllowedLocalPorts,
+				AllowPublicBind:   allowPublicBind,
+				ExpiresAt:         expiresAt,
+			},
 		})
 		return
 	}
@@ -258,54 +688,109 @@ func (api *APIServer) generateToken(w http.ResponseWriter, r *http.Request) {
 		Success: true,
 		Message: "Token generated successfully",
 		Data: &TokenData{
-			TokenID:      token.ID.String(),
-			TeamID:       team.ID,
-			TeamName:     team.Name,
-			TokenName:    token.Name,
-			Token:        token.Token,
-			Description:  token.Description,
-			AssignedPort: assignment.Port,
-			Protocol:     assignment.Protocol,
-			CreatedAt:    token.CreatedAt,
-			ExpiresAt:    token.ExpiresAt,
+			TokenID:           token.ID.String(),
+			TeamID:            team.ID,
+			TeamName:          team.Name,
+			TokenName:         token.Name,
+			Token:             token.Token,
+			Description:       token.Description,
+			AssignedPort:      assignment.Port,
+			Protocol:          assignment.Protocol,
+			Subdomain:         req.Subdomain,
+			BindAddress:       req.BindAddress,
+			AllowedLocalPorts: token.AllowedLocalPorts,
+			AllowPublicBind:   token.AllowPublicBind,
+			CreatedAt:         token.CreatedAt,
+			ExpiresAt:         token.ExpiresAt,
 		},
 	}
 
-	log.Printf("✅ Token generated via API for team %s: %s (port: %d)", team.Name, token.Name, assignment.Port)
+	slog.Info("token generated via API", "team_id", team.ID, "team_name", team.Name, "token_id", token.ID,
+		"token_name", token.Name, "assigned_port", assignment.Port)
+	api.audit(r, database.AuditTokenGenerate, token.ID.String(), nil, map[string]interface{}{
+		"team_id":           team.ID,
+		"name":              token.Name,
+		"assigned_port":     assignment.Port,
+		"protocol":          assignment.Protocol,
+		"allow_public_bind": token.AllowPublicBind,
+		"expires_at":        token.ExpiresAt,
+	})
 
 	respondWithJSON(w, http.StatusCreated, response)
 }
 
+// setTeamQuota handles PUT /api/v1/teams/{teamId}/quota. Limits apply to new
+// tunnel requests; existing tunnels are left open.
+func (api *APIServer) setTeamQuota(w http.ResponseWriter, r *http.Request) {
+	teamID := mux.Vars(r)["teamId"]
+
+	var req TeamQuotaRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.MaxConcurrentTunnels < 0 {
+		respondWithValidationError(w, "max_concurrent_tunnels", "quotas must be zero (unlimited) or positive")
+		return
+	}
+	if req.MaxDailyConnections < 0 {
+		respondWithValidationError(w, "max_daily_connections", "quotas must be zero (unlimited) or positive")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
+	quota := map[string]interface{}{
+		"max_concurrent_tunnels": req.MaxConcurrentTunnels,
+		"max_daily_connections":  req.MaxDailyConnections,
+	}
+	if err := api.dbService.SetTeamQuota(ctx, teamID, req.MaxConcurrentTunnels, req.MaxDailyConnections); err != nil {
+		api.audit(r, database.AuditTeamSetQuota, teamID, err, quota)
+		if errors.Is(err, database.ErrTeamNotFound) {
+			respondWithError(w, http.StatusNotFound, APIErrTeamNotFound, err.Error())
+			return
+		}
+		slog.Error("failed to set team quota", "team_id", teamID, "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to set team quota")
+		return
+	}
+
+	slog.Info("team quota set", "team_id", teamID,
+		"max_concurrent_tunnels", req.MaxConcurrentTunnels, "max_daily_connections", req.MaxDailyConnections)
+	api.audit(r, database.AuditTeamSetQuota, teamID, nil, quota)
+
+	respondWithJSON(w, http.StatusOK, StatsResponse{
+		Success: true,
+		Message: "Team quota updated successfully",
+		Data: map[string]interface{}{
+			"team_id":                teamID,
+			"max_concurrent_tunnels": req.MaxConcurrentTunnels,
+			"max_daily_connections":  req.MaxDailyConnections,
+		},
+	})
+}
+
 // getTeamTokens handles GET /api/v1/teams/:teamId/tokens
 func (api *APIServer) getTeamTokens(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	teamId := vars["teamId"]
 
-	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
 	_, err := api.dbService.GetTeamByID(ctx, teamId)
 	if err != nil {
-		respondWithJSON(w, http.StatusNotFound, TeamTokenResponse{
-			Success: false,
-			Error:   "team not found",
-		})
+		respondWithError(w, http.StatusNotFound, APIErrTeamNotFound, "team not found")
 		return
 	}
 
 	teamTokens, err := api.dbService.ListTokensByTeamID(ctx, teamId)
 	if err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, TeamTokenResponse{
-			Success: false,
-			Error:   "failed to get team tokens",
-		})
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to get team tokens")
 		return
 	}
 
 	portAssignments, err := api.dbService.ListPortAssignmentsByTeamID(ctx, teamId)
 	if err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, TeamTokenResponse{
-			Success: false,
-			Error:   "failed to get team port assignments",
-		})
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to get team port assignments")
 		return
 	}
 
@@ -330,6 +815,9 @@ func (api *APIServer) getTeamTokens(w http.ResponseWriter, r *http.Request) {
 			CreatedAt:   token.CreatedAt,
 			LastUsedAt:  token.LastUsedAt,
 			ExpiresAt:   token.ExpiresAt,
+
+			LastUsedIP:      derefString(token.LastUsedIP),
+			LastUsedCountry: derefString(token.LastUsedCountry),
 		})
 	}
 
@@ -342,35 +830,469 @@ func (api *APIServer) getTeamTokens(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, response)
 }
 
+// listConnectionLogs handles GET /api/v1/teams/:teamId/connections
+func (api *APIServer) listConnectionLogs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	teamId := vars["teamId"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
+	if _, err := api.dbService.GetTeamByID(ctx, teamId); err != nil {
+		respondWithError(w, http.StatusNotFound, APIErrTeamNotFound, "team not found")
+		return
+	}
+
+	filter, err := parseConnectionLogFilter(r)
+	if err != nil {
+		var fieldErr *fieldError
+		if errors.As(err, &fieldErr) {
+			respondWithValidationError(w, fieldErr.field, fieldErr.message)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, APIErrValidation, err.Error())
+		return
+	}
+	filter.TeamID = teamId
+
+	logs, total, err := api.dbService.ListConnectionLogs(ctx, filter)
+	if err != nil {
+		slog.Error("failed to list connection logs", "team_id", teamId, "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to get connection logs")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, ConnectionLogsResponse{
+		Success: true,
+		Message: "Connection logs retrieved successfully",
+		Data:    logs,
+		Total:   total,
+		Limit:   filter.Limit,
+		Offset:  filter.Offset,
+	})
+}
+
+// connectionLogCSVHeader names the columns written by exportConnectionLogs
+var connectionLogCSVHeader = []string{
+	"id", "team_id", "token_id", "port_assign_id", "session_id", "client_ip", "client_port",
+	"server_port", "protocol", "started_at", "ended_at", "bytes_received", "bytes_sent",
+	"wire_bytes_received", "wire_bytes_sent", "connection_time_ms", "status",
+	"error_message", "user_agent", "request_path",
+}
+
+// Connection log export settings
+const (
+	connectionLogExportTimeout    = 10 * time.Minute // Longest an export may run
+	connectionLogExportFlushEvery = 500              // Rows buffered before each flush
+)
+
+// exportConnectionLogs handles GET /api/v1/teams/{teamId}/connections.csv. Logs
+// are written as they are read from the database, oldest first, so exports of
+// any size use constant memory. limit and offset are ignored.
+func (api *APIServer) exportConnectionLogs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	teamId := vars["teamId"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	_, err := api.dbService.GetTeamByID(ctx, teamId)
+	cancel()
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, APIErrTeamNotFound, "team not found")
+		return
+	}
+
+	filter, err := parseConnectionLogFilter(r)
+	if err != nil {
+		var fieldErr *fieldError
+		if errors.As(err, &fieldErr) {
+			respondWithValidationError(w, fieldErr.field, fieldErr.message)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, APIErrValidation, err.Error())
+		return
+	}
+	filter.TeamID = teamId
+
+	// The server's write timeout is sized for JSON responses; lift it to the
+	// export timeout so large exports are not cut off part way
+	deadline := time.Now().Add(connectionLogExportTimeout)
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		slog.Warn("failed to extend write deadline for connection log export", "team_id", teamId, "error", err)
+	}
+	ctx, cancel = context.WithDeadline(r.Context(), deadline)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": fmt.Sprintf("connections-%s.csv", teamId)}))
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	cw.Write(connectionLogCSVHeader)
+
+	rows := 0
+	err = api.dbService.StreamConnectionLogs(ctx, filter, func(entry database.ConnectionLog) error {
+		if err := cw.Write(connectionLogCSVRecord(entry)); err != nil {
+			return err
+		}
+		rows++
+		if rows%connectionLogExportFlushEvery == 0 {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			rc.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		cw.Flush()
+		err = cw.Error()
+	}
+	if err != nil {
+		// The status line has already been sent, so abort the connection rather
+		// than end the body cleanly and pass off a partial export as complete
+		slog.Error("failed to export connection logs", "team_id", teamId, "rows", rows, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	slog.Info("exported connection logs", "team_id", teamId, "rows", rows)
+}
+
+// connectionLogCSVRecord formats entry in the order of connectionLogCSVHeader,
+// leaving columns without a value empty
+func connectionLogCSVRecord(entry database.ConnectionLog) []string {
+	optionalTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	optionalInt := func(v *int64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatInt(*v, 10)
+	}
+	optionalString := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+
+	clientPort := ""
+	if entry.ClientPort != 0 {
+		clientPort = strconv.Itoa(entry.ClientPort)
+	}
+
+	return []string{
+		entry.ID.String(),
+		entry.TeamID,
+		entry.TokenID.String(),
+		entry.PortAssignID.String(),
+		entry.SessionID.String(),
+		entry.ClientIP,
+		clientPort,
+		strconv.Itoa(entry.ServerPort),
+		entry.Protocol,
+		entry.StartedAt.UTC().Format(time.RFC3339Nano),
+		optionalTime(entry.EndedAt),
+		strconv.FormatInt(entry.BytesReceived, 10),
+		strconv.FormatInt(entry.BytesSent, 10),
+		strconv.FormatInt(entry.WireBytesReceived, 10),
+		strconv.FormatInt(entry.WireBytesSent, 10),
+		optionalInt(entry.ConnectionTime),
+		entry.Status,
+		optionalString(entry.ErrorMessage),
+		optionalString(entry.UserAgent),
+		optionalString(entry.RequestPath),
+	}
+}
+
+// parseConnectionLogFilter reads the from, to, status, limit and offset query parameters
+func parseConnectionLogFilter(r *http.Request) (database.ConnectionLogFilter, error) {
+	query := r.URL.Query()
+	var filter database.ConnectionLogFilter
+
+	if v := query.Get("from"); v != "" {
+		from, err := parseTimeParam(v)
+		if err != nil {
+			return filter, &fieldError{field: "from", message: fmt.Sprintf("invalid from: %v", err)}
+		}
+		filter.From = &from
+	}
+	if v := query.Get("to"); v != "" {
+		to, err := parseTimeParam(v)
+		if err != nil {
+			return filter, &fieldError{field: "to", message: fmt.Sprintf("invalid to: %v", err)}
+		}
+		filter.To = &to
+	}
+	if filter.From != nil && filter.To != nil && filter.To.Before(*filter.From) {
+		return filter, &fieldError{field: "to", message: "to must not be before from"}
+	}
+
+	if v := query.Get("status"); v != "" {
+		status := strings.ToLower(v)
+		if !connectionLogStatuses[status] {
+			return filter, &fieldError{field: "status", message: "status must be one of active, closed, error, timeout"}
+		}
+		filter.Status = status
+	}
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		return filter, err
+	}
+	filter.Limit, filter.Offset = limit, offset
+
+	return filter, nil
+}
+
+// parsePagination reads the limit and offset query parameters, defaulting to
+// the first defaultConnectionLogLimit entries
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	query := r.URL.Query()
+	limit = defaultConnectionLogLimit
+
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxConnectionLogLimit {
+			return 0, 0, &fieldError{field: "limit", message: fmt.Sprintf("limit must be between 1 and %d", maxConnectionLogLimit)}
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, &fieldError{field: "offset", message: "offset must be a non-negative integer"}
+		}
+	}
+
+	return limit, offset, nil
+}
+
+// fieldError is a validation failure attributed to one request field
+type fieldError struct {
+	field   string
+	message string
+}
+
+func (e *fieldError) Error() string { return e.message }
+
+// parseTimeParam accepts an RFC 3339 timestamp or a YYYY-MM-DD date (midnight UTC)
+func parseTimeParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 timestamp or YYYY-MM-DD date")
+	}
+	return t, nil
+}
+
 // listTeams handles GET /api/v1/teams
 func (api *APIServer) listTeams(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
 	teamInfo, err := api.dbService.ListTeamsWithTokens(ctx)
 	if err != nil {
-		log.Printf("❌ Failed to list teams: %v", err)
-		respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
-			"success": false,
-			"error":   "Failed to retrieve teams",
-		})
+		slog.Error("failed to list teams", "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "Failed to retrieve teams")
 		return
 	}
 	respondWithJSON(w, http.StatusOK, map[string]interface{}{
 		"success": true,
 		"message": "Teams retrieved successfully",
-		"data":    teamInfo,
+		"data":    groupTeamRows(teamInfo),
+	})
+}
+
+// groupTeamRows collapses the flat team/token rows into one TeamInfo per team, in
+// row order. Teams without tokens come back as a single row with NULL token columns
+// and get an empty Tokens slice.
+func groupTeamRows(rows []database.TokenRow) []TeamInfo {
+	teams := []TeamInfo{}
+	index := make(map[string]int)
+
+	for _, row := range rows {
+		i, ok := index[row.TeamID]
+		if !ok {
+			createdAt, _ := time.Parse(time.RFC3339, row.TeamCreated)
+			teams = append(teams, TeamInfo{
+				TeamID:      row.TeamID,
+				TeamName:    row.TeamName,
+				Description: row.TeamDesc,
+				CreatedAt:   createdAt,
+				Tokens:      []TokenInfo{},
+			})
+			i = len(teams) - 1
+			index[row.TeamID] = i
+		}
+
+		if row.TokenID == nil {
+			continue
+		}
+
+		token := TokenInfo{
+			TokenID:     *row.TokenID,
+			Name:        derefString(row.TokenName),
+			Token:       derefString(row.Token),
+			Description: derefString(row.TokenDesc),
+			Protocol:    derefString(row.Protocol),
+			LastUsedAt:  parseOptionalTime(row.TokenLastUsed),
+			ExpiresAt:   parseOptionalTime(row.TokenExpires),
+
+			LastUsedIP:      derefString(row.TokenLastUsedIP),
+			LastUsedCountry: derefString(row.TokenLastUsedCountry),
+		}
+		if row.Port != nil {
+			token.Port = *row.Port
+		}
+		if createdAt := parseOptionalTime(row.TokenCreated); createdAt != nil {
+			token.CreatedAt = *createdAt
+		}
+		teams[i].Tokens = append(teams[i].Tokens, token)
+	}
+
+	return teams
+}
+
+// derefString returns the value of a nullable column, or "" for NULL
+func derefString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// parseOptionalTime parses a nullable RFC 3339 timestamp column, returning nil for
+// NULL or unparseable values
+func parseOptionalTime(value *string) *time.Time {
+	if value == nil {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, *value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// listTunnels handles GET /api/v1/tunnels
+func (api *APIServer) listTunnels(w http.ResponseWriter, r *http.Request) {
+	if api.tunnelServer == nil {
+		respondWithError(w, http.StatusServiceUnavailable, APIErrServiceUnavailable, "tunnel server is not available")
+		return
+	}
+
+	tunnels := api.tunnelServer.ListTunnels()
+
+	respondWithJSON(w, http.StatusOK, StatsResponse{
+		Success: true,
+		Message: "Tunnels retrieved successfully",
+		Data: map[string]interface{}{
+			"count":   len(tunnels),
+			"tunnels": tunnels,
+		},
+	})
+}
+
+// closeTunnel handles DELETE /api/v1/tunnels/{tunnelId}
+func (api *APIServer) closeTunnel(w http.ResponseWriter, r *http.Request) {
+	if api.tunnelServer == nil {
+		respondWithError(w, http.StatusServiceUnavailable, APIErrServiceUnavailable, "tunnel server is not available")
+		return
+	}
+
+	tunnelID := mux.Vars(r)["tunnelId"]
+	tunnel := api.tunnelServer.CloseTunnel(tunnelID, adminTerminatedReason)
+	if tunnel == nil {
+		api.audit(r, database.AuditTunnelClose, tunnelID, errors.New("tunnel not found"), nil)
+		respondWithError(w, http.StatusNotFound, APIErrTunnelNotFound, "tunnel not found")
+		return
+	}
+	api.audit(r, database.AuditTunnelClose, tunnelID, nil, map[string]interface{}{
+		"team_id":     tunnel.TeamID,
+		"token_id":    tunnel.TokenID,
+		"remote_port": tunnel.RemotePort,
+	})
+
+	respondWithJSON(w, http.StatusOK, StatsResponse{
+		Success: true,
+		Message: "Tunnel closed successfully",
+		Data: map[string]interface{}{
+			"tunnel_id":   tunnel.ID,
+			"team_id":     tunnel.TeamID,
+			"token_id":    tunnel.TokenID,
+			"remote_port": tunnel.RemotePort,
+			"protocol":    tunnel.Protocol,
+		},
+	})
+}
+
+// auditActor identifies the management API in the audit log. Its callers share
+// the admin key, so they are told apart by IP.
+const auditActor = "api"
+
+// audit records an administrative action taken through the API, as failed when
+// actionErr is set. Recording is best effort: a failure is logged and the
+// action's response is unaffected. The write is not bound to the request, so
+// an action is recorded even when its caller has gone away.
+func (api *APIServer) audit(r *http.Request, action, target string, actionErr error, metadata map[string]interface{}) {
+	event := database.NewAuditEvent(auditActor, action, target, actionErr, metadata)
+	ip := requestIP(r)
+	event.ActorIP = &ip
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbOperationTimeout)
+	defer cancel()
+	if err := api.dbService.RecordAuditEvent(ctx, event); err != nil {
+		slog.Error("failed to record audit event", "action", action, "target", target, "error", err)
+	}
+}
+
+// listAuditEvents handles GET /api/v1/audit
+func (api *APIServer) listAuditEvents(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		var fieldErr *fieldError
+		if errors.As(err, &fieldErr) {
+			respondWithValidationError(w, fieldErr.field, fieldErr.message)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, APIErrValidation, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
+	events, total, err := api.dbService.ListAuditEvents(ctx, limit, offset)
+	if err != nil {
+		slog.Error("failed to list audit events", "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to get audit events")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, AuditLogResponse{
+		Success: true,
+		Message: "Audit events retrieved successfully",
+		Data:    events,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
 	})
 }
 
 // getStats handles GET /api/v1/stats
 func (api *APIServer) getStats(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
 
 	stats, err := api.dbService.GetDatabaseStats(ctx)
 	if err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, StatsResponse{
-			Success: false,
-			Error:   fmt.Sprintf("failed to get stats: %v", err),
-		})
+		slog.Error("failed to get stats", "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to get stats")
 		return
 	}
 
@@ -380,29 +1302,240 @@ func (api *APIServer) getStats(w http.ResponseWriter, r *http.Request) {
 		Data:    stats,
 	}
 
-	log.Printf("📊 Database stats requested via API")
+	slog.Debug("database stats requested via API")
 
 	respondWithJSON(w, http.StatusOK, response)
 }
 
+// getPortUsage handles GET /api/v1/ports, reporting which ports of the tunnel
+// port range are assigned, reserved for a team, locked in Redis and free
+func (api *APIServer) getPortUsage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
+
+	usage, err := api.dbService.ListPortUsage(ctx)
+	if err != nil {
+		slog.Error("failed to get port usage", "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to get port usage")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, PortUsageResponse{
+		Success: true,
+		Message: "Port usage retrieved successfully",
+		Data:    usage,
+	})
+}
+
+// defaultUsagePeriod is how far back GET /api/v1/usage reports without a from parameter
+const defaultUsagePeriod = 30 * 24 * time.Hour
+
+// getUsage handles GET /api/v1/usage. It authenticates with a tunnel token
+// instead of the admin key and reports only the token's own team: its daily
+// connection stats and its live tunnels. Nothing is changed, not even the
+// token's last used time.
+func (api *APIServer) getUsage(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rabbit.go"`)
+		respondWithError(w, http.StatusUnauthorized, APIErrUnauthorized, "a tunnel token is required")
+		return
+	}
+
+	to := time.Now().UTC()
+	from := to.Add(-defaultUsagePeriod)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			respondWithValidationError(w, "from", fmt.Sprintf("invalid from: %v", err))
+			return
+		}
+		from = t
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			respondWithValidationError(w, "to", fmt.Sprintf("invalid to: %v", err))
+			return
+		}
+		to = t
+	}
+	if to.Before(from) {
+		respondWithValidationError(w, "to", "to must not be before from")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
+
+	teamToken, _, err := api.dbService.InspectToken(ctx, token)
+	if errors.Is(err, database.ErrInvalidToken) {
+		slog.Warn("usage request with invalid token", "client_ip", requestIP(r))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rabbit.go"`)
+		respondWithError(w, http.StatusUnauthorized, APIErrUnauthorized, "unauthorized")
+		return
+	}
+	if err != nil {
+		slog.Error("failed to check usage token", "client_ip", requestIP(r), "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to get usage")
+		return
+	}
+	teamID := teamToken.TeamID
+
+	stats, err := api.dbService.GetConnectionStats(ctx, teamID, from, to)
+	if err != nil {
+		slog.Error("failed to get usage stats", "team_id", teamID, "error", err)
+		respondWithError(w, http.StatusInternalServerError, APIErrInternal, "failed to get usage")
+		return
+	}
+	if stats == nil {
+		stats = []database.ConnectionStats{}
+	}
+
+	tunnels := []TunnelStatus{}
+	if api.tunnelServer != nil {
+		for _, tunnel := range api.tunnelServer.ListTunnels() {
+			if tunnel.TeamID == teamID {
+				tunnels = append(tunnels, tunnel)
+			}
+		}
+	}
+
+	var teamName string
+	if teamToken.Team != nil {
+		teamName = teamToken.Team.Name
+	}
+
+	respondWithJSON(w, http.StatusOK, StatsResponse{
+		Success: true,
+		Message: "Usage retrieved successfully",
+		Data: map[string]interface{}{
+			"team_id":    teamID,
+			"team_name":  teamName,
+			"token_name": teamToken.Name,
+			"from":       from,
+			"to":         to,
+			"stats":      stats,
+			"tunnels":    tunnels,
+		},
+	})
+}
+
+// getSecurityStats handles GET /api/v1/security
+func (api *APIServer) getSecurityStats(w http.ResponseWriter, r *http.Request) {
+	if api.security == nil {
+		respondWithError(w, http.StatusServiceUnavailable, APIErrServiceUnavailable, "security middleware is not enabled")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, StatsResponse{
+		Success: true,
+		Message: "Security statistics retrieved successfully",
+		Data:    api.security.GetStats(),
+	})
+}
+
+// streamEvents handles GET /api/v1/events by upgrading to a WebSocket and pushing
+// tunnel, connection and security events as JSON messages. The optional team_id
+// query parameter limits the stream to one team's tunnels and connections.
+func (api *APIServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+	if api.tunnelServer == nil || api.tunnelServer.events == nil {
+		respondWithError(w, http.StatusServiceUnavailable, APIErrServiceUnavailable, "event stream is not available")
+		return
+	}
+	bus := api.tunnelServer.events
+	teamID := r.URL.Query().Get("team_id")
+
+	conn, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an HTTP error
+		slog.Warn("event stream upgrade failed", "client_ip", requestIP(r), "error", err)
+		return
+	}
+	defer conn.Close()
+
+	sub := bus.subscribe(teamID)
+	defer bus.unsubscribe(sub)
+
+	slog.Info("event stream opened", "client_ip", requestIP(r), "team_id", teamID)
+	defer slog.Info("event stream closed", "client_ip", requestIP(r), "team_id", teamID)
+
+	// The API server's read timeout also applies to the hijacked connection, so
+	// replace it with one that pongs keep extending
+	conn.SetReadDeadline(time.Now().Add(2 * eventPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * eventPingInterval))
+	})
+
+	// Read until the subscriber goes away; incoming messages are ignored
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-clientGone:
+			return
+		case <-api.tunnelServer.stopChan:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(eventWriteTimeout))
+			return
+		case event := <-sub.events:
+			conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
 // healthCheck handles GET /api/v1/health
 func (api *APIServer) healthCheck(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	// A draining server is still up but should be taken out of rotation
+	if api.tunnelServer != nil && api.tunnelServer.Draining() {
+		respondWithJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"success":   false,
+			"status":    "draining",
+			"message":   "Server is shutting down",
+			"timestamp": time.Now().UTC(),
+		})
+		return
+	}
 
-	err := api.dbService.HealthCheck(ctx)
-	if err != nil {
+	ctx, cancel := context.WithTimeout(r.Context(), dbOperationTimeout)
+	defer cancel()
+
+	report := api.dbService.HealthCheck(ctx)
+	if err := report.Err(); err != nil {
 		respondWithJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
-			"success": false,
-			"status":  "unhealthy",
-			"error":   err.Error(),
+			"success":   false,
+			"status":    report.Status,
+			"checks":    report.Checks,
+			"error":     &APIError{Code: APIErrServiceUnavailable, Message: err.Error()},
+			"timestamp": time.Now().UTC(),
 		})
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, map[string]interface{}{
 		"success":   true,
-		"status":    "healthy",
+		"status":    report.Status,
 		"message":   "All systems operational",
+		"checks":    report.Checks,
 		"timestamp": time.Now().UTC(),
 	})
 }
@@ -415,12 +1548,32 @@ func (api *APIServer) homeEndpoint(w http.ResponseWriter, r *http.Request) {
 		"description": "Database-backed token management API for Syne Tunneler",
 		"endpoints": map[string]string{
 			"health":          "GET /api/v1/health",
+			"usage":           "GET /api/v1/usage (tunnel token)",
 			"teams":           "GET /api/v1/teams",
+			"create_team":     "POST /api/v1/teams",
+			"tunnels":         "GET /api/v1/tunnels",
+			"close_tunnel":    "DELETE /api/v1/tunnels/:tunnelId",
 			"stats":           "GET /api/v1/stats",
+			"audit":           "GET /api/v1/audit",
+			"ports":           "GET /api/v1/ports",
+			"security":        "GET /api/v1/security",
+			"events":          "GET /api/v1/events (WebSocket, optional ?team_id=)",
 			"generate_token":  "POST /api/v1/tokens/generate",
+			"revoke_token":    "DELETE /api/v1/tokens/:tokenId",
+			"delete_team":     "DELETE /api/v1/teams/:teamId",
+			"set_team_quota":  "PUT /api/v1/teams/:teamId/quota",
 			"get_team_tokens": "GET /api/v1/teams/:teamId/tokens",
+			"connection_logs": "GET /api/v1/teams/:teamId/connections",
+			"export_logs":     "GET /api/v1/teams/:teamId/connections.csv",
 			"delete_token":    "DELETE /api/v1/teams/:teamId/tokens/:tokenId",
 		},
+		"authentication": map[string]interface{}{
+			"scheme":    "Authorization: Bearer <API_ADMIN_KEY>",
+			"enabled":   api.adminKey != "",
+			"public":    []string{"GET /", "GET /api/v1/health"},
+			"token":     []string{"GET /api/v1/usage"},
+			"protected": "all other /api/v1 endpoints",
+		},
 		"timestamp": time.Now().UTC(),
 	}
 
@@ -435,8 +1588,134 @@ func respondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
 	w.WriteHeader(status)
 
 	if err := json.NewEncoder(w).Encode(payload); err != nil {
-		log.Printf("Error encoding JSON response: %v", err)
+		slog.Error("error encoding JSON response", "error", err)
+	}
+}
+
+// respondWithError writes an error envelope with a stable error code
+func respondWithError(w http.ResponseWriter, status int, code, message string) {
+	respondWithJSON(w, status, ErrorResponse{
+		Success: false,
+		Error:   &APIError{Code: code, Message: message},
+	})
+}
+
+// respondWithValidationError writes a 400 VALIDATION_ERROR naming the offending field
+func respondWithValidationError(w http.ResponseWriter, field, message string) {
+	respondWithJSON(w, http.StatusBadRequest, ErrorResponse{
+		Success: false,
+		Error: &APIError{
+			Code:    APIErrValidation,
+			Message: message,
+			Details: map[string]interface{}{"field": field},
+		},
+	})
+}
+
+// requireAdminKey rejects requests without the admin API key. With no key
+// configured the management endpoints stay open, as before keys existed.
+func (api *APIServer) requireAdminKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.adminKey == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(key), []byte(api.adminKey)) != 1 {
+			slog.Warn("unauthorized API request", "method", r.Method, "path", r.URL.Path, "client_ip", requestIP(r))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rabbit.go"`)
+			respondWithError(w, http.StatusUnauthorized, APIErrUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitTokenGeneration rejects token generation requests from a client IP that
+// is over generateLimit for the current minute with a 429 and Retry-After. Requests
+// are let through when Redis cannot count them.
+func (api *APIServer) limitTokenGeneration(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.generateLimit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		clientIP := requestIP(r)
+		count, reset, err := api.dbService.CountTokenGeneration(clientIP)
+		if err != nil {
+			slog.Warn("could not count token generation; allowing it", "client_ip", clientIP, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if count > int64(api.generateLimit) {
+			retryAfter := int(math.Ceil(reset.Seconds()))
+			slog.Warn("token generation rate limited", "client_ip", clientIP, "count", count, "limit", api.generateLimit)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			respondWithJSON(w, http.StatusTooManyRequests, ErrorResponse{
+				Success: false,
+				Error: &APIError{
+					Code:    APIErrRateLimited,
+					Message: fmt.Sprintf("too many token generation requests; retry in %ds", retryAfter),
+					Details: map[string]interface{}{"limit": api.generateLimit, "retry_after": retryAfter},
+				},
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitRequestBody rejects requests whose declared body is over the size limit and
+// caps the bytes handlers can read from the rest
+func (api *APIServer) limitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > api.maxBodyBytes {
+			respondWithRequestTooLarge(w, api.maxBodyBytes)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, api.maxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeJSONBody decodes the request body into v. On failure it writes a 413 for
+// bodies over the size limit, or a 400 otherwise, and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondWithRequestTooLarge(w, tooLarge.Limit)
+		return false
+	}
+	respondWithError(w, http.StatusBadRequest, APIErrValidation, "Invalid JSON request body")
+	return false
+}
+
+// respondWithRequestTooLarge writes a 413 REQUEST_TOO_LARGE naming the limit
+func respondWithRequestTooLarge(w http.ResponseWriter, limit int64) {
+	respondWithJSON(w, http.StatusRequestEntityTooLarge, ErrorResponse{
+		Success: false,
+		Error: &APIError{
+			Code:    APIErrRequestTooLarge,
+			Message: fmt.Sprintf("request body is larger than %d bytes", limit),
+			Details: map[string]interface{}{"max_bytes": limit},
+		},
+	})
+}
+
+// requestIP returns the IP address of an API request's peer for log fields
+func requestIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
 	}
+	return r.RemoteAddr
 }
 
 // corsMiddleware adds CORS headers
@@ -462,6 +1741,7 @@ func loggingMiddleware(next http.Handler) http.Handler {
 
 		next.ServeHTTP(w, r)
 
-		log.Printf("🌐 %s %s %v", r.Method, r.URL.Path, time.Since(start))
+		slog.Info("API request", "method", r.Method, "path", r.URL.Path, "client_ip", requestIP(r),
+			"duration_ms", time.Since(start).Milliseconds())
 	})
 }
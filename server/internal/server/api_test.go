@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"rabbit.go/internal/database"
+)
+
+// newTestService connects to the scratch PostgreSQL database and Redis named by
+// RABBIT_TEST_DATABASE_URL and RABBIT_TEST_REDIS_URL and migrates the database.
+// Tests are skipped unless both are set.
+func newTestService(t *testing.T) (*database.Service, *database.Database) {
+	t.Helper()
+
+	postgresURL, redisURL := os.Getenv("RABBIT_TEST_DATABASE_URL"), os.Getenv("RABBIT_TEST_REDIS_URL")
+	if postgresURL == "" || redisURL == "" {
+		t.Skip("RABBIT_TEST_DATABASE_URL and RABBIT_TEST_REDIS_URL are not set")
+	}
+
+	db, err := database.NewDatabase(database.Config{PostgresURL: postgresURL, RedisURL: redisURL, KeyPrefix: "rabbit-test:"})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// The Team table belongs to the main application; create it as it defines it
+	_, err = db.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS public."Team" (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			description TEXT,
+			"createdAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			"updatedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			deleted BOOLEAN NOT NULL DEFAULT false,
+			is_active BOOLEAN NOT NULL DEFAULT true,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`)
+	if err != nil {
+		t.Fatalf("failed to create Team table: %v", err)
+	}
+	if err := db.RunMigrations("../database/migrations"); err != nil {
+		t.Fatalf("failed to run migrations: %v", err)
+	}
+
+	return database.NewService(db), db
+}
+
+// createUsageTeam creates a team with a token and a day of connection stats
+// reporting connections, all removed when the test ends. It returns the team id
+// and the token.
+func createUsageTeam(t *testing.T, svc *database.Service, db *database.Database, connections int) (string, string) {
+	t.Helper()
+	ctx := context.Background()
+
+	team, err := svc.CreateTeam(ctx, "usage-"+time.Now().Format("150405.000000000"), "")
+	if err != nil {
+		t.Fatalf("failed to create team: %v", err)
+	}
+	t.Cleanup(func() {
+		db.DB.Exec(`DELETE FROM connection_stats WHERE team_id = $1`, team.ID)
+		db.DB.Exec(`DELETE FROM team_tokens WHERE team_id = $1`, team.ID)
+		db.DB.Exec(`DELETE FROM public."Team" WHERE id = $1`, team.ID)
+	})
+
+	token, _, err := svc.GenerateTokenForTeam(ctx, team.ID, "usage", "", nil, "tcp", "", "", nil, false, false)
+	if err != nil {
+		t.Fatalf("failed to create token: %v", err)
+	}
+	_, err = db.DB.Exec(`INSERT INTO connection_stats (team_id, date, total_connections) VALUES ($1, CURRENT_DATE, $2)`, team.ID, connections)
+	if err != nil {
+		t.Fatalf("failed to insert connection stats: %v", err)
+	}
+	return team.ID, token.Token
+}
+
+type usageResponse struct {
+	Data struct {
+		TeamID  string                     `json:"team_id"`
+		Stats   []database.ConnectionStats `json:"stats"`
+		Tunnels []TunnelStatus             `json:"tunnels"`
+	} `json:"data"`
+}
+
+func getUsage(t *testing.T, api *APIServer, token string) (int, usageResponse) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/usage", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	api.server.Handler.ServeHTTP(rec, req)
+
+	var resp usageResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to decode usage: %v", err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestUsageIsLimitedToTheTokensTeam(t *testing.T) {
+	svc, db := newTestService(t)
+	teamA, tokenA := createUsageTeam(t, svc, db, 3)
+	teamB, tokenB := createUsageTeam(t, svc, db, 5)
+
+	s := &Server{tunnels: map[string]*Tunnel{
+		"a": {ID: "a", TeamID: teamA, CreatedAt: time.Now()},
+		"b": {ID: "b", TeamID: teamB, CreatedAt: time.Now()},
+	}}
+	api := NewAPIServer(s, svc, nil, "127.0.0.1", "0", "admin", 0, 0)
+
+	for _, tc := range []struct {
+		token, teamID, tunnelID string
+		connections             int64
+	}{
+		{tokenA, teamA, "a", 3},
+		{tokenB, teamB, "b", 5},
+	} {
+		code, resp := getUsage(t, api, tc.token)
+		if code != http.StatusOK {
+			t.Fatalf("usage for team %s: status %d", tc.teamID, code)
+		}
+		if resp.Data.TeamID != tc.teamID {
+			t.Errorf("usage for team %s reported team %s", tc.teamID, resp.Data.TeamID)
+		}
+		if len(resp.Data.Stats) != 1 || resp.Data.Stats[0].TeamID != tc.teamID || resp.Data.Stats[0].TotalConnections != tc.connections {
+			t.Errorf("usage for team %s: stats %+v, want only its own day of %d connections", tc.teamID, resp.Data.Stats, tc.connections)
+		}
+		if len(resp.Data.Tunnels) != 1 || resp.Data.Tunnels[0].TunnelID != tc.tunnelID {
+			t.Errorf("usage for team %s: tunnels %+v, want only tunnel %s", tc.teamID, resp.Data.Tunnels, tc.tunnelID)
+		}
+	}
+
+	if code, _ := getUsage(t, api, "not-a-token"); code != http.StatusUnauthorized {
+		t.Errorf("usage with an unknown token: status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestUsageReportsDatabaseFailure(t *testing.T) {
+	// A token that cannot be checked is not an invalid token
+	sqlDB, err := sql.Open("postgres", "postgres://127.0.0.1:1/rabbit?sslmode=disable&connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	api := NewAPIServer(nil, database.NewService(&database.Database{DB: sqlDB}), nil, "127.0.0.1", "0", "admin", 0, 0)
+
+	if code, _ := getUsage(t, api, "some-token"); code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", code, http.StatusInternalServerError)
+	}
+}
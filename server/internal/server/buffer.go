@@ -0,0 +1,40 @@
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+// DefaultBridgeBufferSize matches the buffer io.Copy allocates on its own
+const DefaultBridgeBufferSize = 32 * 1024
+
+// bufferPool hands out copy buffers of one size, so busy servers reuse them instead
+// of allocating two per bridged connection
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{New: func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}}}
+}
+
+// copy copies src to dst through a pooled buffer. A nil pool falls back to io.Copy.
+func (p *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if p == nil {
+		return io.Copy(dst, src)
+	}
+	buf := p.pool.Get().(*[]byte)
+	defer p.pool.Put(buf)
+
+	// Hide io.ReaderFrom: *net.TCPConn implements it by copying through its own
+	// 32KB buffer, which would ignore ours
+	return io.CopyBuffer(writerOnly{dst}, src, *buf)
+}
+
+// writerOnly exposes only the Write method of a writer
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// latencyConn is a connection over a slow link: every write waits a round trip
+// for the far end to take it, as a write over a link with a small window does
+type latencyConn struct {
+	net.Conn
+	latency time.Duration
+}
+
+func (c latencyConn) Write(p []byte) (int, error) {
+	time.Sleep(c.latency)
+	return c.Conn.Write(p)
+}
+
+func BenchmarkBridge(b *testing.B) {
+	const payload = 4 << 20
+
+	for _, bc := range []struct {
+		name string
+		size int
+	}{
+		{"32KB", DefaultBridgeBufferSize},
+		{"256KB", 256 * 1024},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			s, tunnel, _ := newTestTunnel(b, time.Second)
+			s.buffers = newBufferPool(bc.size)
+			body := make([]byte, payload)
+
+			b.SetBytes(payload)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				external, externalPeer := net.Pipe()
+				data, dataPeer := net.Pipe()
+
+				// The external peer sends the payload in one write, so every
+				// read of the bridge fills its buffer
+				go func() {
+					externalPeer.Write(body)
+					externalPeer.Close()
+				}()
+				delivered := make(chan int64, 1)
+				go func() {
+					n, _ := io.Copy(io.Discard, dataPeer)
+					delivered <- n
+				}()
+
+				tunnel.bridgeConnectionsWithLogging(external, latencyConn{data, time.Millisecond}, "", uuid.New())
+				if n := <-delivered; n != payload {
+					b.Fatalf("client got %d of %d bytes", n, payload)
+				}
+			}
+		})
+	}
+}
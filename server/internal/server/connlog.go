@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rabbit.go/internal/database"
+)
+
+// Bounds on the connection log writer
+const (
+	connLogQueueSize     = 4096        // Results waiting to be written; more are dropped
+	connLogBatchSize     = 256         // Results written in one transaction
+	connLogFlushInterval = time.Second // Longest a result waits for a batch to fill
+)
+
+// connLogWriter records the final state of bridged connections in the background,
+// so a bridge never waits on the database. Results are queued and written in
+// batches; when the queue is full they are dropped and logged instead.
+type connLogWriter struct {
+	service *database.Service
+	ctx     context.Context // Bounds every write; see Server.ctx
+	queue   chan database.ConnectionResult
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	dropped atomic.Int64 // Results dropped since the last warning
+}
+
+// newConnLogWriter starts a writer that records results through service
+func newConnLogWriter(ctx context.Context, service *database.Service) *connLogWriter {
+	w := &connLogWriter{
+		service: service,
+		ctx:     ctx,
+		queue:   make(chan database.ConnectionResult, connLogQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// enqueue queues result to be written, dropping it if the queue is full
+func (w *connLogWriter) enqueue(result database.ConnectionResult) {
+	select {
+	case w.queue <- result:
+	default:
+		if w.dropped.Add(1) == 1 {
+			slog.Warn("connection log queue full; dropping connection results",
+				"queue_size", connLogQueueSize, "connection_log_id", result.LogID, "status", result.Status)
+		}
+	}
+}
+
+// Close writes the results still queued and stops the writer. Results queued
+// after Close are not written.
+func (w *connLogWriter) Close() {
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+// run collects results into batches and writes each once it is full, once
+// connLogFlushInterval has passed, or when the writer is closed
+func (w *connLogWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(connLogFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]database.ConnectionResult, 0, connLogBatchSize)
+	for {
+		select {
+		case result := <-w.queue:
+			batch = append(batch, result)
+			if len(batch) >= connLogBatchSize {
+				batch = w.flush(batch)
+			}
+		case <-ticker.C:
+			batch = w.flush(batch)
+		case <-w.stop:
+			for {
+				select {
+				case result := <-w.queue:
+					batch = append(batch, result)
+					if len(batch) >= connLogBatchSize {
+						batch = w.flush(batch)
+					}
+				default:
+					w.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush writes batch and returns it emptied for reuse
+func (w *connLogWriter) flush(batch []database.ConnectionResult) []database.ConnectionResult {
+	if dropped := w.dropped.Swap(0); dropped > 0 {
+		slog.Warn("dropped connection results while the queue was full", "dropped", dropped)
+	}
+	if len(batch) == 0 {
+		return batch
+	}
+
+	ctx, cancel := context.WithTimeout(w.ctx, dbOperationTimeout)
+	defer cancel()
+	if err := w.service.EndConnections(ctx, batch); err != nil {
+		slog.Warn("failed to record connection results", "connections", len(batch), "error", err)
+	}
+	return batch[:0]
+}
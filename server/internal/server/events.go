@@ -0,0 +1,121 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published on the event bus
+const (
+	EventTunnelCreated     = "tunnel.created"
+	EventTunnelClosed      = "tunnel.closed"
+	EventConnectionOpened  = "connection.opened"
+	EventConnectionClosed  = "connection.closed"
+	EventSecurityViolation = "security.violation"
+)
+
+// eventSubscriberBuffer is how many events a subscriber may fall behind before
+// further events are dropped for it
+const eventSubscriberBuffer = 64
+
+// Event is a tunnel, connection or security event streamed to API subscribers
+type Event struct {
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	TeamID        string    `json:"team_id,omitempty"`
+	TunnelID      string    `json:"tunnel_id,omitempty"`
+	RemotePort    string    `json:"remote_port,omitempty"`
+	Protocol      string    `json:"protocol,omitempty"`
+	ClientIP      string    `json:"client_ip,omitempty"`
+	ClientPort    int       `json:"client_port,omitempty"`
+	BytesSent     int64     `json:"bytes_sent,omitempty"`
+	BytesReceived int64     `json:"bytes_received,omitempty"`
+	DurationMs    int64     `json:"duration_ms,omitempty"`
+	Status        string    `json:"status,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	Blacklisted   bool      `json:"blacklisted,omitempty"`
+}
+
+// eventSubscriber receives events, optionally only those for one team
+type eventSubscriber struct {
+	teamID string
+	events chan Event
+}
+
+// eventBus fans events out to subscribers without ever blocking publishers
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers map[*eventSubscriber]struct{}
+}
+
+// newEventBus creates an empty event bus
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[*eventSubscriber]struct{})}
+}
+
+// subscribe registers a subscriber. An empty teamID receives events for every
+// team; security events carry no team and are only sent to unfiltered subscribers.
+func (b *eventBus) subscribe(teamID string) *eventSubscriber {
+	sub := &eventSubscriber{
+		teamID: teamID,
+		events: make(chan Event, eventSubscriberBuffer),
+	}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub
+}
+
+// unsubscribe removes a subscriber and closes its channel
+func (b *eventBus) unsubscribe(sub *eventSubscriber) {
+	b.mu.Lock()
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+	b.mu.Unlock()
+}
+
+// publish sends an event to every matching subscriber. Subscribers that are too
+// far behind miss the event rather than slowing down the tunnel.
+func (b *eventBus) publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subscribers {
+		if sub.teamID != "" && sub.teamID != event.TeamID {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+		}
+	}
+}
+
+// tunnelEvent creates an event carrying the tunnel's identifying fields
+func (t *Tunnel) tunnelEvent(eventType string) Event {
+	return Event{
+		Type:       eventType,
+		TeamID:     t.TeamID,
+		TunnelID:   t.ID,
+		RemotePort: t.RemotePort,
+		Protocol:   t.Protocol,
+	}
+}
+
+// publishEvent publishes a tunnel event on the server's event bus
+func (t *Tunnel) publishEvent(event Event) {
+	if s := getServerFromTunnel(t); s != nil {
+		s.events.publish(event)
+	}
+}
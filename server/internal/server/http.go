@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpRouteTimeout bounds how long a client may take to send its request line and
+// headers (or TLS ClientHello) before the connection is routed
+const httpRouteTimeout = 10 * time.Second
+
+// tlsRecordTypeHandshake is the first byte of a TLS connection
+const tlsRecordTypeHandshake = 0x16
+
+// errClientHelloRead aborts the sniffing handshake once the ClientHello has been parsed
+var errClientHelloRead = errors.New("client hello read")
+
+// handleHTTPConnections accepts connections on the shared HTTP(S) port and routes
+// each one to the tunnel registered for the requested subdomain
+func (s *Server) handleHTTPConnections() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.httpListener.Accept()
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				slog.Error("error accepting http connection", "error", err)
+				continue
+			}
+			return
+		}
+
+		go s.handleHTTPConnection(conn)
+	}
+}
+
+// handleHTTPConnection reads the Host header or TLS SNI from a connection, then hands
+// it to the owning tunnel with the bytes read so far replayed ahead of the stream.
+// TLS is passed through untouched; the local service terminates it.
+func (s *Server) handleHTTPConnection(conn net.Conn) {
+	// Validated here rather than in the accept loop, as validation may wait on Redis
+	if s.securityMiddleware != nil {
+		if err := s.securityMiddleware.ValidateConnection(conn); err != nil {
+			slog.Warn("http connection rejected", "client_ip", remoteIP(conn), "error", err)
+			conn.Close()
+			return
+		}
+	}
+	s.setNoDelay(conn)
+
+	// Sniff on the raw connection so the routing deadline is not reset by the
+	// security wrapper's idle timeout
+	conn.SetReadDeadline(time.Now().Add(httpRouteTimeout))
+	host, isTLS, peeked, err := sniffHost(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	if s.securityMiddleware != nil {
+		conn = s.securityMiddleware.WrapConnection(conn)
+	}
+
+	if err != nil {
+		slog.Warn("could not route http connection", "client_ip", remoteIP(conn), "error", err)
+		if !isTLS {
+			writeHTTPError(conn, http.StatusBadRequest, "malformed request")
+		}
+		conn.Close()
+		return
+	}
+
+	subdomain, ok := s.subdomainForHost(host)
+	if !ok {
+		slog.Warn("host is not under the routing domain", "host", host, "domain", s.config.Domain, "client_ip", remoteIP(conn))
+		if !isTLS {
+			writeHTTPError(conn, http.StatusNotFound, "unknown host "+host)
+		}
+		conn.Close()
+		return
+	}
+
+	tunnel := s.findTunnelBySubdomain(subdomain)
+	if tunnel == nil || tunnel.Client() == nil {
+		slog.Warn("no connected tunnel for host", "host", host, "client_ip", remoteIP(conn))
+		if !isTLS {
+			writeHTTPError(conn, http.StatusBadGateway, "no tunnel connected for "+host)
+		}
+		conn.Close()
+		return
+	}
+
+	tunnel.logger().Debug("routing http connection", "host", host, "client_ip", remoteIP(conn))
+
+	tunnel.wg.Add(1)
+	go tunnel.handleConnection(&peekedConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(peeked), conn),
+		isTLS:  isTLS,
+	})
+}
+
+// subdomainForHost extracts the subdomain label from a host under the configured domain
+func (s *Server) subdomainForHost(host string) (string, bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	suffix := "." + strings.ToLower(s.config.Domain)
+	if !strings.HasSuffix(host, suffix) {
+		return "", false
+	}
+
+	subdomain := strings.TrimSuffix(host, suffix)
+	if subdomain == "" || strings.Contains(subdomain, ".") {
+		return "", false
+	}
+	return subdomain, true
+}
+
+// findTunnelBySubdomain returns the tunnel serving a subdomain, preferring one with a connected client.
+// Loopback-only tunnels are never served on the shared port.
+func (s *Server) findTunnelBySubdomain(subdomain string) *Tunnel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var match *Tunnel
+	for _, tunnel := range s.tunnels {
+		if tunnel.Subdomain != subdomain || tunnel.Protocol == "udp" || tunnel.BindAddress == loopbackAddress {
+			continue
+		}
+		if tunnel.Client() != nil {
+			return tunnel
+		}
+		match = tunnel
+	}
+	return match
+}
+
+// sniffHost reads just enough of a connection to learn the requested host: the TLS
+// SNI for TLS connections, or the Host header for plain HTTP. It returns every byte
+// consumed so the stream can be replayed to the tunnel.
+func sniffHost(conn net.Conn) (host string, isTLS bool, peeked []byte, err error) {
+	var buf bytes.Buffer
+	tee := io.TeeReader(conn, &buf)
+
+	var first [1]byte
+	if _, err := io.ReadFull(tee, first[:]); err != nil {
+		return "", false, buf.Bytes(), err
+	}
+	reader := io.MultiReader(bytes.NewReader(first[:]), tee)
+
+	if first[0] == tlsRecordTypeHandshake {
+		host, err = readClientHelloServerName(reader)
+		return host, true, buf.Bytes(), err
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(reader))
+	if err != nil {
+		return "", false, buf.Bytes(), err
+	}
+	if req.Host == "" {
+		return "", false, buf.Bytes(), fmt.Errorf("request has no Host header")
+	}
+	return req.Host, false, buf.Bytes(), nil
+}
+
+// readClientHelloServerName parses a TLS ClientHello and returns its SNI server name.
+// The handshake runs against a read-only connection and is aborted as soon as the
+// ClientHello has been parsed, so nothing is ever written back to the client.
+func readClientHelloServerName(r io.Reader) (string, error) {
+	var serverName string
+	err := tls.Server(sniffConn{reader: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+
+	if serverName == "" {
+		if err == nil || errors.Is(err, errClientHelloRead) {
+			return "", fmt.Errorf("TLS client hello has no server name")
+		}
+		return "", fmt.Errorf("failed to read TLS client hello: %w", err)
+	}
+	return serverName, nil
+}
+
+// writeHTTPError writes a minimal plain-text HTTP error response
+func writeHTTPError(w io.Writer, status int, message string) {
+	body := message + "\n"
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
+}
+
+// peekedConn replays bytes consumed while routing before reading from the connection
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+	isTLS  bool // Plaintext HTTP connections can be answered with an HTTP error
+}
+
+// Read implements net.Conn
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// sniffConn is a read-only net.Conn used to parse a TLS ClientHello
+type sniffConn struct {
+	reader io.Reader
+}
+
+func (c sniffConn) Read(b []byte) (int, error)         { return c.reader.Read(b) }
+func (c sniffConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c sniffConn) Close() error                       { return nil }
+func (c sniffConn) LocalAddr() net.Addr                { return nil }
+func (c sniffConn) RemoteAddr() net.Addr               { return nil }
+func (c sniffConn) SetDeadline(t time.Time) error      { return nil }
+func (c sniffConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c sniffConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// parseLogLevel converts a log level name to its slog level
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", level)
+	}
+}
+
+// newLogger creates the server logger, logging at level. Output is JSON when w is
+// not a terminal, so log collectors get structured records, and text otherwise.
+func newLogger(level slog.Leveler, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if isTerminal(w) {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// isTerminal reports whether w is a character device such as an interactive terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// logger returns a logger carrying the tunnel's identifying fields, including the
+// session of the client currently connected
+func (t *Tunnel) logger() *slog.Logger {
+	logger := slog.With("tunnel_id", t.ID, "team_id", t.TeamID, "remote_port", t.RemotePort)
+	if client := t.Client(); client != nil {
+		logger = logger.With("session_id", client.sessionID)
+	}
+	return logger
+}
+
+// logger returns a logger carrying the control connection's session id
+func (c *controlConn) logger() *slog.Logger {
+	return slog.With("session_id", c.sessionID)
+}
+
+// remoteIP returns the IP address of a connection's peer, or "" if it has none
+func remoteIP(conn net.Conn) string {
+	ip, _ := remoteEndpoint(conn)
+	return ip
+}
+
+// remoteEndpoint returns the IP address and port of a connection's peer. Wrapped
+// connections (TLS, the security middleware) are unwrapped until one reports an
+// address, and non-TCP addresses are parsed from their string form.
+func remoteEndpoint(conn net.Conn) (string, int) {
+	for conn != nil {
+		switch addr := conn.RemoteAddr().(type) {
+		case *net.TCPAddr:
+			if addr != nil {
+				return addr.IP.String(), addr.Port
+			}
+		case *net.UDPAddr:
+			if addr != nil {
+				return addr.IP.String(), addr.Port
+			}
+		case nil:
+		default:
+			host, port, err := net.SplitHostPort(addr.String())
+			if err != nil {
+				return addr.String(), 0
+			}
+			portNum, _ := strconv.Atoi(port)
+			return host, portNum
+		}
+
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return "", 0
+		}
+		conn = wrapped.NetConn()
+	}
+	return "", 0
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"rabbit.go/protocol"
+)
+
+// maxNoticeLength bounds the operator notice, which clients print as is
+const maxNoticeLength = 1024
+
+// loadNotice returns the notice configured by config: the contents of
+// NoticeFile when it is set, otherwise Notice. Surrounding whitespace is trimmed.
+func loadNotice(config Config) (string, error) {
+	notice := config.Notice
+	if config.NoticeFile != "" {
+		data, err := os.ReadFile(config.NoticeFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading notice file: %v", err)
+		}
+		notice = string(data)
+	}
+
+	notice = strings.TrimSpace(notice)
+	if len(notice) > maxNoticeLength {
+		return "", fmt.Errorf("notice is %d bytes long, more than the %d allowed", len(notice), maxNoticeLength)
+	}
+	return notice, nil
+}
+
+// sendNotice sends the operator notice, if any, to a client
+func (s *Server) sendNotice(client *controlConn) {
+	notice := s.settings().Notice
+	if notice == "" {
+		return
+	}
+	if err := client.writeMessage(protocol.MsgNotice, protocol.Notice{Message: notice}); err != nil {
+		client.logger().Warn("error sending notice", "client_ip", remoteIP(client), "error", err)
+	}
+}
+
+// broadcastNotice sends the operator notice to every connected client, e.g.
+// after a reload changed it. Clients are written to concurrently so one that
+// stopped reading does not hold up the rest.
+func (s *Server) broadcastNotice() {
+	s.mu.RLock()
+	clients := make(map[*controlConn]bool)
+	for _, tunnel := range s.tunnels {
+		if client := tunnel.Client(); client != nil {
+			clients[client] = true
+		}
+	}
+	s.mu.RUnlock()
+
+	for client := range clients {
+		go s.sendNotice(client)
+	}
+	slog.Info("notice sent to connected clients", "clients", len(clients))
+}
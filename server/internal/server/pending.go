@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rabbit.go/internal/database"
+)
+
+// Pending connection registries
+const (
+	PendingRegistryMemory = "memory"
+	PendingRegistryRedis  = "redis"
+)
+
+// pendingConnGrace is how much longer than the data connection timeout a shared
+// pending connection entry outlives its waiter
+const pendingConnGrace = 5 * time.Second
+
+// pendingRegistry tracks external connections waiting for their client's data
+// connection, keyed by the connection ID sent in NewConn. Data connections are
+// only ever paired on the instance holding the pending connection; a shared
+// registry lets other instances recognize one that reached them by mistake, but
+// does not route it to its owner.
+type pendingRegistry interface {
+	// add registers a pending connection; its data connection is sent on connChan
+	add(connID string, connChan chan net.Conn)
+
+	// claim removes a pending connection and returns its channel. It reports false
+	// if the connection is not pending on this instance.
+	claim(connID string) (chan net.Conn, bool)
+
+	// remove withdraws a pending connection, reporting whether it was still pending
+	remove(connID string) bool
+
+	// owner returns the instance waiting for a connection ID, or "" if unknown
+	owner(connID string) string
+
+	// setDataConnTimeout updates how long pending connections wait, after a reload
+	setDataConnTimeout(timeout time.Duration)
+}
+
+// newPendingRegistry creates the pending connection registry named by kind
+func newPendingRegistry(kind, instanceID string, dataConnTimeout time.Duration, dbService *database.Service) pendingRegistry {
+	local := newMemoryPendingRegistry()
+	if kind != PendingRegistryRedis {
+		return local
+	}
+	registry := &redisPendingRegistry{
+		local:      local,
+		dbService:  dbService,
+		instanceID: instanceID,
+	}
+	registry.setDataConnTimeout(dataConnTimeout)
+	return registry
+}
+
+// memoryPendingRegistry keeps pending connections in process, so data connections
+// must reach the instance that holds the control connection
+type memoryPendingRegistry struct {
+	mu    sync.Mutex
+	conns map[string]chan net.Conn
+}
+
+func newMemoryPendingRegistry() *memoryPendingRegistry {
+	return &memoryPendingRegistry{conns: make(map[string]chan net.Conn)}
+}
+
+func (r *memoryPendingRegistry) add(connID string, connChan chan net.Conn) {
+	r.mu.Lock()
+	r.conns[connID] = connChan
+	r.mu.Unlock()
+}
+
+func (r *memoryPendingRegistry) claim(connID string) (chan net.Conn, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	connChan, exists := r.conns[connID]
+	delete(r.conns, connID)
+	return connChan, exists
+}
+
+func (r *memoryPendingRegistry) remove(connID string) bool {
+	_, pending := r.claim(connID)
+	return pending
+}
+
+func (r *memoryPendingRegistry) owner(connID string) string {
+	return ""
+}
+
+func (r *memoryPendingRegistry) setDataConnTimeout(timeout time.Duration) {}
+
+// redisPendingRegistry also records each pending connection in Redis with a short
+// TTL, so any instance can look up which one is waiting for a data connection.
+// This is only a first step towards running instances behind one load balancer:
+// handoff still happens in process, and a data connection reaching another
+// instance is closed there (see Server.handleDataConnection), so clients must
+// still reach the instance holding their control connection.
+//
+// Redis is written in the background, off the data path, and skipped while it is
+// failing; Redis failures are logged and never affect the handoff. An entry may
+// be written after the connection it names was already claimed, and then
+// lingers until its TTL; owner only ever reports it as this instance's.
+type redisPendingRegistry struct {
+	local      *memoryPendingRegistry
+	dbService  *database.Service
+	instanceID string
+	ttl        atomic.Int64 // Lifetime of a shared entry, as a time.Duration
+}
+
+func (r *redisPendingRegistry) add(connID string, connChan chan net.Conn) {
+	r.local.add(connID, connChan)
+	ttl := time.Duration(r.ttl.Load())
+	go func() {
+		err := r.dbService.RegisterPendingConn(connID, r.instanceID, ttl)
+		if err != nil && !errors.Is(err, database.ErrRedisUnavailable) {
+			slog.Warn("failed to share pending connection", "conn_id", connID, "error", err)
+		}
+	}()
+}
+
+func (r *redisPendingRegistry) claim(connID string) (chan net.Conn, bool) {
+	connChan, exists := r.local.claim(connID)
+	if exists {
+		go r.unregister(connID)
+	}
+	return connChan, exists
+}
+
+func (r *redisPendingRegistry) remove(connID string) bool {
+	pending := r.local.remove(connID)
+	if pending {
+		go r.unregister(connID)
+	}
+	return pending
+}
+
+func (r *redisPendingRegistry) setDataConnTimeout(timeout time.Duration) {
+	r.ttl.Store(int64(timeout + pendingConnGrace))
+}
+
+func (r *redisPendingRegistry) owner(connID string) string {
+	instanceID, err := r.dbService.PendingConnOwner(connID)
+	if err != nil {
+		return ""
+	}
+	return instanceID
+}
+
+func (r *redisPendingRegistry) unregister(connID string) {
+	if err := r.dbService.UnregisterPendingConn(connID); err != nil && !errors.Is(err, database.ErrRedisUnavailable) {
+		slog.Warn("failed to remove shared pending connection", "conn_id", connID, "error", err)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"rabbit.go/protocol"
+)
+
+// serveNewConns plays the tunnel client: for every NewConn it waits delay(), opens
+// a data connection and writes the connection ID down it. delivered records
+// whether each write reached the external side, i.e. the server kept the data
+// connection rather than closing it.
+func serveNewConns(t *testing.T, s *Server, control net.Conn, delay func() time.Duration) (delivered *sync.Map, wait func()) {
+	t.Helper()
+
+	delivered = &sync.Map{}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			msgType, payload, err := protocol.ReadFrame(control)
+			if err != nil {
+				return
+			}
+			var newConn protocol.NewConn
+			if msgType != protocol.MsgNewConn || protocol.Decode(msgType, payload, &newConn) != nil {
+				t.Errorf("unexpected %s frame", msgType)
+				return
+			}
+
+			wg.Add(1)
+			go func(connID string) {
+				defer wg.Done()
+				time.Sleep(delay())
+
+				serverSide, clientSide := net.Pipe()
+				defer clientSide.Close()
+				go s.handleDataConnection(serverSide, connID)
+
+				_, err := clientSide.Write([]byte(connID))
+				delivered.Store(connID, err == nil)
+			}(newConn.ConnID)
+		}
+	}()
+
+	return delivered, func() {
+		control.Close()
+		<-done
+		wg.Wait()
+	}
+}
+
+// requestConcurrently opens n external connections to the tunnel at once and
+// reports, by connection ID, whether each was paired with a data connection. A
+// paired connection must have received the data connection carrying its own ID.
+func requestConcurrently(t *testing.T, tunnel *Tunnel, n int) map[string]bool {
+	t.Helper()
+
+	var mu sync.Mutex
+	results := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+			dataConn, connID, ok := tunnel.requestDataConnection("192.0.2.1", port, addr)
+			if !ok {
+				mu.Lock()
+				results[connID] = false
+				mu.Unlock()
+				return
+			}
+			defer dataConn.Close()
+
+			got := make([]byte, len(connID))
+			_, err := io.ReadFull(dataConn, got)
+			if err != nil || string(got) != connID {
+				t.Errorf("connection %s was paired with data connection %q (%v)", connID, got, err)
+			}
+			mu.Lock()
+			results[connID] = true
+			mu.Unlock()
+		}(20000 + i)
+	}
+	wg.Wait()
+	return results
+}
+
+func assertNothingPending(t *testing.T, s *Server, tunnel *Tunnel) {
+	t.Helper()
+	registry := s.pendingConns.(*memoryPendingRegistry)
+	registry.mu.Lock()
+	pending := len(registry.conns)
+	registry.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d connections still pending", pending)
+	}
+	tunnel.mu.RLock()
+	awaiting := len(tunnel.awaiting)
+	tunnel.mu.RUnlock()
+	if awaiting != 0 {
+		t.Errorf("%d connection requests still awaiting a data connection", awaiting)
+	}
+}
+
+func TestConcurrentConnectionsAreAllPaired(t *testing.T) {
+	const n = 200
+	s, tunnel, control := newTestTunnel(t, 5*time.Second)
+	delivered, wait := serveNewConns(t, s, control, func() time.Duration {
+		return time.Duration(rand.Intn(5)) * time.Millisecond
+	})
+
+	results := requestConcurrently(t, tunnel, n)
+	wait()
+
+	if len(results) != n {
+		t.Fatalf("got %d distinct connection ids for %d connections", len(results), n)
+	}
+	for connID, paired := range results {
+		if !paired {
+			t.Errorf("connection %s was dropped", connID)
+		}
+		if ok, _ := delivered.Load(connID); ok != true {
+			t.Errorf("data connection for %s was not delivered", connID)
+		}
+	}
+	assertNothingPending(t, s, tunnel)
+}
+
+func TestDataConnectionsAroundTimeout(t *testing.T) {
+	// Data connections land anywhere from well before to well after the waiter
+	// gives up. Each must either reach its waiter or be closed by the server; none
+	// may be handed to a waiter that has already given up.
+	const n = 200
+	const timeout = 50 * time.Millisecond
+	s, tunnel, control := newTestTunnel(t, timeout)
+	delivered, wait := serveNewConns(t, s, control, func() time.Duration {
+		return time.Duration(rand.Int63n(int64(2 * timeout)))
+	})
+
+	results := requestConcurrently(t, tunnel, n)
+	wait()
+
+	if len(results) != n {
+		t.Fatalf("got %d distinct connection ids for %d connections", len(results), n)
+	}
+	pairedCount := 0
+	for _, paired := range results {
+		if paired {
+			pairedCount++
+		}
+	}
+	t.Logf("%d of %d connections paired before the timeout", pairedCount, n)
+
+	for connID, paired := range results {
+		ok, seen := delivered.Load(connID)
+		if !seen {
+			t.Errorf("no data connection was opened for %s", connID)
+			continue
+		}
+		if ok.(bool) != paired {
+			t.Errorf("connection %s: waiter paired=%v but data connection delivered=%v", connID, paired, ok)
+		}
+	}
+	assertNothingPending(t, s, tunnel)
+}
+
+func TestGenerateConnIDIsNotGuessable(t *testing.T) {
+	a, err := generateConnID("tunnel", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := generateConnID("tunnel", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(a, "tunnel-1-") || len(a) <= len("tunnel-1-") {
+		t.Errorf("generateConnID = %q, want the tunnel id and sequence followed by a random suffix", a)
+	}
+	if a == b {
+		t.Errorf("two ids with the same sequence number are both %q", a)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// bandwidthLimiter is a token bucket shared by every connection bridged through a
+// tunnel in one direction, so the tunnel as a whole stays under its byte/sec limit
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes added to the bucket per second
+	burst  float64 // Bucket capacity in bytes
+	tokens float64 // Available bytes; negative while paying off a read larger than the balance
+	last   time.Time
+}
+
+// newBandwidthLimiter creates a limiter for the given bytes per second, or nil for unlimited
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	rate := float64(bytesPerSecond)
+	return &bandwidthLimiter{
+		rate:   rate,
+		burst:  rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// maxChunk returns the largest read that should be attempted in one go
+func (l *bandwidthLimiter) maxChunk() int {
+	return int(l.burst)
+}
+
+// wait consumes n bytes from the bucket, sleeping until the balance is no longer negative
+func (l *bandwidthLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// limitedReader throttles reads from an underlying reader through a bandwidthLimiter
+type limitedReader struct {
+	reader  io.Reader
+	limiter *bandwidthLimiter
+}
+
+// limitReader wraps r so reads are throttled by l; a nil limiter returns r unchanged
+func limitReader(r io.Reader, l *bandwidthLimiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{reader: r, limiter: l}
+}
+
+// Read implements io.Reader
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if chunk := r.limiter.maxChunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
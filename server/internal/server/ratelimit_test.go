@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"rabbit.go/internal/database"
+)
+
+func TestLimitReaderThrottlesToRate(t *testing.T) {
+	// A scaled-down 1MB through 100KB/s: the bucket starts full with one second
+	// of rate, so 30KB at 10KB/s sends the first 10KB at once and the other
+	// 20KB over about two seconds
+	const rate = 10 * 1024
+	const size = 3 * rate
+
+	limiter := newBandwidthLimiter(rate)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, limitReader(bytes.NewReader(make([]byte, size)), limiter))
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if n != size {
+		t.Fatalf("copied %d bytes, want %d", n, size)
+	}
+	if elapsed < 1800*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("copying %d bytes at %d bytes/s with a %d byte burst took %v, want about 2s", size, rate, rate, elapsed)
+	}
+}
+
+func TestLimitReaderCapsReadsAtBurst(t *testing.T) {
+	limiter := newBandwidthLimiter(1024)
+	n, err := limitReader(bytes.NewReader(make([]byte, 4096)), limiter).Read(make([]byte, 4096))
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if n != 1024 {
+		t.Errorf("read %d bytes, want the 1024 byte burst", n)
+	}
+}
+
+func TestNewBandwidthLimiterUnlimited(t *testing.T) {
+	if l := newBandwidthLimiter(0); l != nil {
+		t.Errorf("newBandwidthLimiter(0) = %+v, want nil", l)
+	}
+	r := bytes.NewReader(nil)
+	if got := limitReader(r, nil); got != io.Reader(r) {
+		t.Errorf("limitReader with a nil limiter wrapped the reader")
+	}
+}
+
+// received is what a peer read from a bridge and when it had all of it
+type received struct {
+	data []byte
+	at   time.Time
+}
+
+// peer writes send to conn while reading want's worth of bytes back, and closes
+// conn once both are done, so neither direction of a bridge is cut short
+func peer(t *testing.T, name string, conn net.Conn, send []byte, want int) <-chan received {
+	done := make(chan received, 1)
+	go func() {
+		defer conn.Close()
+		wrote := make(chan struct{})
+		go func() {
+			defer close(wrote)
+			if _, err := conn.Write(send); err != nil {
+				t.Errorf("%s write: %v", name, err)
+			}
+		}()
+		got := received{data: make([]byte, want)}
+		if _, err := io.ReadFull(conn, got.data); err != nil {
+			t.Errorf("%s read: %v", name, err)
+		}
+		got.at = time.Now()
+		<-wrote
+		done <- got
+	}()
+	return done
+}
+
+func TestBridgeIsRateLimitedInBothDirections(t *testing.T) {
+	// 1MB each way through a tunnel whose port assignment allows 100KB/s: after
+	// the one second burst, the other 924KB take about 9.2s in each direction at
+	// once. -short scales it down to 30KB at 10KB/s, about 2s.
+	rate, size := int64(100*1024), 1<<20
+	if testing.Short() {
+		rate, size = 10*1024, 30*1024
+	}
+	want := time.Duration(float64(int64(size)-rate) / float64(rate) * float64(time.Second))
+
+	s, tunnel, _ := newTestTunnel(t, time.Second)
+	tunnel.SessionID = uuid.NewString()
+	s.connLogs = &connLogWriter{queue: make(chan database.ConnectionResult, 1)}
+	tunnel.applyPortAssignment(&database.PortAssignment{RateLimitBPS: rate})
+
+	toClient := bytes.Repeat([]byte{'c'}, size)
+	toExternal := bytes.Repeat([]byte{'e'}, size)
+	external, externalPeer := net.Pipe()
+	data, dataPeer := net.Pipe()
+	externalGot := peer(t, "external", externalPeer, toClient, size)
+	clientGot := peer(t, "client", dataPeer, toExternal, size)
+
+	start := time.Now()
+	tunnel.bridgeConnectionsWithLogging(external, data, "", uuid.New())
+
+	// Each direction is capped on its own, so both finish after about want
+	for _, dir := range []struct {
+		name string
+		got  received
+		sent []byte
+	}{
+		{"to the client", <-clientGot, toClient},
+		{"to the external peer", <-externalGot, toExternal},
+	} {
+		if !bytes.Equal(dir.got.data, dir.sent) {
+			t.Errorf("%d bytes %s differ from the %d sent", len(dir.got.data), dir.name, len(dir.sent))
+		}
+		if took := dir.got.at.Sub(start); took < want*9/10 || took > want+2*time.Second {
+			t.Errorf("%d bytes %s at %d bytes/s took %v, want about %v", size, dir.name, rate, took, want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"log/slog"
+)
+
+// settings returns the server's configuration, including changes made by Reload
+func (s *Server) settings() Config {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	return s.config
+}
+
+// Reload applies the settings in config that can change while the server runs:
+// the log level, the security middleware's connection limits, the tunnel idle
+// timeout and maximum lifetime, the data connection timeout, the per-tunnel
+// connection limit and the notice, which is sent to every connected client when
+// it changes. It also reopens the access log, so the file can be rotated.
+// Other fields, such as listen addresses, ports and TLS files, only take effect on
+// restart and are ignored. Open tunnels are kept; the new limits apply to the
+// connections and checks that follow.
+func (s *Server) Reload(config Config) error {
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	if config.DataConnTimeout <= 0 {
+		config.DataConnTimeout = DefaultDataConnTimeout
+	}
+	notice, err := loadNotice(config)
+	if err != nil {
+		return err
+	}
+
+	s.settingsMu.Lock()
+	noticeChanged := notice != s.config.Notice
+	s.config.Notice = notice
+	s.config.NoticeFile = config.NoticeFile
+	s.config.LogLevel = config.LogLevel
+	s.config.TunnelIdleTimeout = config.TunnelIdleTimeout
+	s.config.MaxTunnelLifetime = config.MaxTunnelLifetime
+	s.config.DataConnTimeout = config.DataConnTimeout
+	s.config.MaxConnsPerTunnel = config.MaxConnsPerTunnel
+	if config.Security != nil {
+		security := *config.Security
+		s.config.Security = &security
+	}
+	s.settingsMu.Unlock()
+
+	s.logLevel.Set(level)
+	s.pendingConns.setDataConnTimeout(config.DataConnTimeout)
+	if config.Security != nil {
+		s.securityMiddleware.SetLimits(config.Security.MaxConnectionsPerIP,
+			config.Security.MaxConnectionsPerHour, config.Security.MaxGlobalConnections)
+	}
+	s.startReaper()
+	if noticeChanged && notice != "" {
+		s.broadcastNotice()
+	}
+	if err := s.accessLog.reopen(); err != nil {
+		slog.Warn("failed to reopen access log", "error", err)
+	}
+
+	args := []any{
+		"log_level", level.String(),
+		"tunnel_idle_timeout", config.TunnelIdleTimeout.String(),
+		"max_tunnel_lifetime", config.MaxTunnelLifetime.String(),
+		"data_conn_timeout", config.DataConnTimeout.String(),
+		"max_conns_per_tunnel", config.MaxConnsPerTunnel,
+		"notice", notice,
+	}
+	if config.Security != nil {
+		args = append(args,
+			"max_conns_per_ip", config.Security.MaxConnectionsPerIP,
+			"max_conns_per_hour", config.Security.MaxConnectionsPerHour,
+			"max_global_conns", config.Security.MaxGlobalConnections)
+	}
+	slog.Info("configuration reloaded", args...)
+	return nil
+}
+
+// startReaper starts reapTunnels once an idle timeout or maximum lifetime is set,
+// unless it is already running
+func (s *Server) startReaper() {
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+
+	if s.reaping || (s.config.TunnelIdleTimeout <= 0 && s.config.MaxTunnelLifetime <= 0) {
+		return
+	}
+	s.reaping = true
+	s.wg.Add(1)
+	go s.reapTunnels()
+}
@@ -4,19 +4,26 @@ import (
 	"bufio"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"rabbit.go/internal/database"
 	"rabbit.go/internal/middleware"
+	"rabbit.go/protocol"
 
 	"github.com/google/uuid"
 )
@@ -27,24 +34,165 @@ type Config struct {
 	ControlPort string
 	LogLevel    string
 	APIPort     string // Port for HTTP API server
+	APIAdminKey string // Bearer key required by the management API (defaults to API_ADMIN_KEY)
+	HTTPPort    string // Shared port for subdomain-routed HTTP(S) tunnels (empty disables)
+	Domain      string // Base domain for subdomain routing, e.g. "tunnels.example.com"
+
+	// TLS for control and data connections; both files must be set to enable it
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// MaxRequestBodyBytes caps the size of API request bodies; larger ones get a
+	// 413 (defaults to DefaultMaxRequestBodyBytes)
+	MaxRequestBodyBytes int64
+
+	// GenerateRateLimit caps POST /api/v1/tokens/generate requests per client IP
+	// per minute, counted in Redis across instances (0 = unlimited)
+	GenerateRateLimit int
+
+	// TunnelIdleTimeout tears down a tunnel, releasing its listener and ending its
+	// session, once it has had no active connections for this long (0 disables)
+	TunnelIdleTimeout time.Duration
+
+	// MaxTunnelLifetime closes tunnels this long after they were created, whatever
+	// their activity, so clients re-establish a fresh session (0 disables)
+	MaxTunnelLifetime time.Duration
+
+	// TokenCleanupInterval is how often expired tokens are deactivated, their ports
+	// released and their tunnels closed (0 disables)
+	TokenCleanupInterval time.Duration
+
+	// StatsInterval is how often connection logs are rolled up into the daily
+	// connection_stats (0 disables; run `database aggregate-stats` instead)
+	StatsInterval time.Duration
+
+	// Compression lets clients negotiate compressed data connections for tcp tunnels
+	Compression bool
+
+	// DBConnectAttempts bounds how many times startup tries to reach PostgreSQL and
+	// Redis, waiting DBConnectBackoff after the first failure and doubling the wait
+	// after each further one (defaults to DefaultDBConnectAttempts and DefaultDBConnectBackoff)
+	DBConnectAttempts int
+	DBConnectBackoff  time.Duration
+
+	// ReassignBusyPorts moves a tunnel to another free port when its assigned port is
+	// already bound by some other process; otherwise the tunnel request fails
+	ReassignBusyPorts bool
+
+	// AllowTakeover lets a client take over a tunnel another client is connected to
+	// with the same token and port. When false the second client is rejected with
+	// ErrCodeTunnelActive, unless it presents the reconnect token issued to the
+	// current client, which shows it is that client reconnecting.
+	AllowTakeover bool
+
+	// ReconnectsPerMinute caps how often one token may authenticate per minute,
+	// counted in Redis across instances, so a client stuck in a reconnect loop
+	// cannot churn the database. Handshakes over the cap are rejected with
+	// ErrCodeReconnectLimited (0 = unlimited).
+	ReconnectsPerMinute int
+
+	// TCPNoDelay sends small writes on control, data and external connections at
+	// once. Turning it off lets the kernel coalesce them (Nagle's algorithm), trading
+	// latency for fewer packets. Keepalives are set by Security.KeepAlive.
+	TCPNoDelay bool
+
+	// DataConnTimeout is how long an external connection waits for the client to
+	// open its data connection (defaults to DefaultDataConnTimeout)
+	DataConnTimeout time.Duration
+
+	// ControlWriteTimeout bounds each write to a client's control connection, so
+	// a client that stops reading cannot block its tunnels. A control connection
+	// whose write fails or times out is closed (defaults to DefaultControlWriteTimeout).
+	ControlWriteTimeout time.Duration
+
+	// MaxControlMessage bounds the payload of each frame a client sends on a
+	// control connection, in bytes. A larger frame is rejected before it is read
+	// and the connection closed (defaults to, and may not exceed,
+	// DefaultMaxControlMessage).
+	MaxControlMessage int
+
+	// DetectHTTP peeks at the first bytes of each tcp tunnel connection and, when
+	// they start an HTTP request, logs the connection with protocol http and the
+	// request's path and user agent
+	DetectHTTP bool
+
+	// AccessLog names a file that gets a Combined Log Format line for every HTTP
+	// request made through a tunnel (empty disables)
+	AccessLog string
+
+	// Notice is an operator message, e.g. about a maintenance window, sent to
+	// clients after they authenticate and to every connected client when a reload
+	// changes it. NoticeFile, when set, is read for the message instead, on start
+	// and on every reload (empty sends nothing).
+	Notice     string
+	NoticeFile string
+
+	// MaxConnsPerTunnel caps the external connections a single tcp tunnel handles at
+	// once; further connections are closed until one finishes (0 = unlimited)
+	MaxConnsPerTunnel int
+
+	// BridgeBufferSize is the size of the buffers bridged connections are copied
+	// through; larger buffers help high-bandwidth, high-latency links (defaults to
+	// DefaultBridgeBufferSize)
+	BridgeBufferSize int
+
+	// PendingRegistry selects where connections waiting for a data connection are
+	// registered: PendingRegistryMemory (default) or PendingRegistryRedis, which
+	// also tells other instances which one holds each. Data connections are not
+	// routed between instances either way; see redisPendingRegistry.
+	PendingRegistry string
+
+	// InstanceID identifies this server in shared state (defaults to the hostname)
+	InstanceID string
+
+	// Security configures the connection security middleware.
+	// A nil value uses middleware.DefaultSecurityConfig().
+	Security *middleware.SecurityConfig
 }
 
 // Server represents the tunnel server
 type Server struct {
 	config          Config
+	settingsMu      sync.RWMutex   // Guards the Config fields Reload can change
+	logLevel        *slog.LevelVar // Level of the default logger, changed by Reload
+	reaping         bool           // Whether reapTunnels is running; guarded by settingsMu
 	controlListener net.Listener
+	httpListener    net.Listener
 	tunnels         map[string]*Tunnel
-	pendingConns    map[string]chan net.Conn
+	opening         map[tunnelKey]bool // Tunnels being created by a handshake; guarded by mu
+	reserved        map[string]int     // Quota slots held by tunnels being created, per team; guarded by mu
+	pendingConns    pendingRegistry
+	connSeq         uint64 // Makes pending connection IDs unique under concurrent accepts; see generateConnID
 	mu              sync.RWMutex
 	stopChan        chan struct{}
 	wg              sync.WaitGroup
 
+	// draining is set when Shutdown begins; no tunnel is added after it is set
+	draining atomic.Bool
+
+	// Root context for database operations; cancelled once Shutdown finishes, or
+	// shortly after its deadline so a stalled query cannot hold up shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	// Database integration
 	dbService *database.Service
 
+	// Writes the results of bridged connections to the database in batches
+	connLogs *connLogWriter
+
 	// API server
 	apiServer *APIServer
 
+	// Event bus for streaming tunnel, connection and security events
+	events *eventBus
+
+	// Copy buffers shared by all bridged connections
+	buffers *bufferPool
+
+	// Access log for HTTP requests made through tunnels; nil when disabled
+	accessLog *accessLog
+
 	// Security middleware
 	securityMiddleware *middleware.SecurityMiddleware
 }
@@ -59,16 +207,57 @@ type Tunnel struct {
 	LocalPort    string
 	RemotePort   string
 	BindAddress  string
-	Client       net.Conn
-	Listener     net.Listener
+	Protocol     string         // tcp or udp
+	Subdomain    string         // Routes <subdomain>.<domain> on the shared HTTP(S) port when set
+	Listener     net.Listener   // Set for tcp tunnels
+	PacketConn   net.PacketConn // Set for udp tunnels
 	CreatedAt    time.Time
 	stopChan     chan struct{}
 	stopOnce     sync.Once // Ensure stopChan is only closed once
+	endReason    string    // Why the server stopped the tunnel; set only before stopChan is closed
 	wg           sync.WaitGroup
 
+	// The client's control connection, replaced when the client reconnects. nil for a
+	// restored tunnel until its client comes back. mu also guards LocalPort.
+	client *controlConn
+	mu     sync.RWMutex
+
+	// awaiting holds the requests for data connections the client has not opened
+	// yet, keyed by connection id, so they can be re-sent to a client that takes
+	// over the tunnel. Guarded by mu.
+	awaiting map[string]protocol.NewConn
+
+	// reconnectToken was issued to the current client for this tunnel; a client
+	// presenting it is the same client reconnecting. Guarded by mu.
+	reconnectToken string
+
 	// Database tracking
 	SessionID     string
 	ConnectionLog string
+
+	// clientDisconnected is set when the client ended the tunnel with a Disconnect
+	// message rather than dropping its control connection
+	clientDisconnected atomic.Bool
+
+	// External connections being handled, closed when a shutdown runs out of
+	// time to drain them. Guarded by mu.
+	externalConns map[net.Conn]struct{}
+
+	// Activity tracking for the idle timeout
+	activeConns  atomic.Int32 // Connections currently being handled
+	lastActivity atomic.Int64 // Unix nanoseconds when a connection last started or finished
+
+	// Bytes relayed so far across all of the tunnel's connections
+	bytesSent     atomic.Int64 // External peers → client
+	bytesReceived atomic.Int64 // Client → external peers
+
+	// Bandwidth limits shared by all bridged connections (nil = unlimited)
+	inboundLimiter  *bandwidthLimiter // External peer → client
+	outboundLimiter *bandwidthLimiter // Client → external peer
+
+	// UDP sessions keyed by remote source address
+	udpSessions map[string]*udpSession
+	udpMu       sync.Mutex
 }
 
 // TunnelRequest represents a tunnel creation request
@@ -87,48 +276,233 @@ type TunnelResponse struct {
 
 // NewServer creates a new tunnel server
 func NewServer(config Config) (*Server, error) {
-	log.Println("Loading .env file")
-	// Initialize database connection
-	dbConfig := database.GetConfigFromEnv()
-	db, err := database.NewDatabase(dbConfig)
+	level, err := parseLogLevel(config.LogLevel)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to database: %w", err)
+		return nil, err
 	}
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(level)
+	slog.SetDefault(newLogger(logLevel, os.Stdout))
 
-	dbService := database.NewService(db)
+	if config.Notice, err = loadNotice(config); err != nil {
+		return nil, err
+	}
+
+	if config.DBConnectAttempts <= 0 {
+		config.DBConnectAttempts = DefaultDBConnectAttempts
+	}
+	if config.DBConnectBackoff <= 0 {
+		config.DBConnectBackoff = DefaultDBConnectBackoff
+	}
+	if config.DataConnTimeout <= 0 {
+		config.DataConnTimeout = DefaultDataConnTimeout
+	}
+	if config.ControlWriteTimeout <= 0 {
+		config.ControlWriteTimeout = DefaultControlWriteTimeout
+	}
+	if config.MaxControlMessage <= 0 {
+		config.MaxControlMessage = DefaultMaxControlMessage
+	}
+	if config.MaxControlMessage > DefaultMaxControlMessage {
+		return nil, fmt.Errorf("max control message must be at most %d bytes, got %d", DefaultMaxControlMessage, config.MaxControlMessage)
+	}
+	if config.BridgeBufferSize <= 0 {
+		config.BridgeBufferSize = DefaultBridgeBufferSize
+	}
+	switch config.PendingRegistry {
+	case "":
+		config.PendingRegistry = PendingRegistryMemory
+	case PendingRegistryMemory, PendingRegistryRedis:
+	default:
+		return nil, fmt.Errorf("unknown pending connection registry %q (use %s or %s)",
+			config.PendingRegistry, PendingRegistryMemory, PendingRegistryRedis)
+	}
+	if config.InstanceID == "" {
+		if hostname, err := os.Hostname(); err == nil {
+			config.InstanceID = hostname
+		} else {
+			config.InstanceID = uuid.New().String()
+		}
+	}
+
+	// The .env file has been loaded by now, so it can supply the API key too
+	if config.APIAdminKey == "" {
+		config.APIAdminKey = os.Getenv("API_ADMIN_KEY")
+	}
+
+	var access *accessLog
+	if config.AccessLog != "" {
+		access, err = openAccessLog(config.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// Test database connection
-	ctx := context.Background()
-	if err := dbService.HealthCheck(ctx); err != nil {
-		return nil, fmt.Errorf("database health check failed: %w", err)
+	// Initialize database connection
+	ctx, cancel := context.WithCancel(context.Background())
+	db, err := connectDatabase(ctx, database.GetConfigFromEnv(), config.DBConnectAttempts, config.DBConnectBackoff)
+	if err != nil {
+		cancel()
+		access.Close()
+		return nil, err
 	}
 
-	log.Printf("✅ Database connection established")
+	dbService := database.NewService(db)
+	slog.Info("database connection established")
 
 	// Initialize security middleware
 	securityConfig := middleware.DefaultSecurityConfig()
-	securityMiddleware := middleware.NewSecurityMiddleware(securityConfig)
+	if config.Security != nil {
+		securityConfig = *config.Security
+	}
+	securityMiddleware := middleware.NewSecurityMiddleware(securityConfig, db.Redis, db.KeyPrefix())
 
 	server := &Server{
 		config:             config,
+		logLevel:           logLevel,
 		tunnels:            make(map[string]*Tunnel),
-		pendingConns:       make(map[string]chan net.Conn),
+		opening:            make(map[tunnelKey]bool),
+		reserved:           make(map[string]int),
+		pendingConns:       newPendingRegistry(config.PendingRegistry, config.InstanceID, config.DataConnTimeout, dbService),
 		stopChan:           make(chan struct{}),
+		ctx:                ctx,
+		cancel:             cancel,
 		dbService:          dbService,
+		connLogs:           newConnLogWriter(ctx, dbService),
 		securityMiddleware: securityMiddleware,
+		events:             newEventBus(),
+		accessLog:          access,
+		buffers:            newBufferPool(config.BridgeBufferSize),
 	}
 
+	securityMiddleware.SetViolationHandler(func(clientIP, reason string, blacklisted bool) {
+		server.events.publish(Event{
+			Type:        EventSecurityViolation,
+			ClientIP:    clientIP,
+			Reason:      reason,
+			Blacklisted: blacklisted,
+		})
+	})
+
 	// Create API server if port is specified
 	if config.APIPort != "" {
-		server.apiServer = NewAPIServer(dbService, config.BindAddress, config.APIPort, config.ControlPort)
+		server.apiServer = NewAPIServer(server, dbService, securityMiddleware, config.BindAddress, config.APIPort, config.APIAdminKey, config.MaxRequestBodyBytes, config.GenerateRateLimit)
 	}
 
 	return server, nil
 }
 
-// authenticateToken validates a token using the database and returns port assignment
-func (s *Server) authenticateToken(ctx context.Context, token string) (*database.TeamToken, *database.PortAssignment, error) {
-	return s.dbService.AuthenticateToken(ctx, token)
+// Defaults for unset Config fields
+const (
+	DefaultDataConnTimeout     = 10 * time.Second
+	DefaultControlWriteTimeout = 10 * time.Second
+	DefaultMaxControlMessage   = protocol.MaxPayloadSize
+	DefaultDBConnectAttempts   = 5
+	DefaultDBConnectBackoff    = time.Second
+)
+
+// maxDBConnectBackoff caps the wait between database connection attempts
+const maxDBConnectBackoff = 30 * time.Second
+
+// connectDatabase connects to PostgreSQL and Redis and checks their health. Failed
+// attempts are retried with exponential backoff so the server can start alongside a
+// database that is still coming up; the last error is returned once attempts run out.
+func connectDatabase(ctx context.Context, dbConfig database.Config, attempts int, backoff time.Duration) (*database.Database, error) {
+	// A bad pool setting will not fix itself, so do not retry it
+	if err := dbConfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		slog.Info("connecting to database", "attempt", attempt, "max_attempts", attempts)
+
+		db, err := database.NewDatabase(dbConfig)
+		if err != nil {
+			err = fmt.Errorf("failed to connect to database: %w", err)
+		} else {
+			healthCtx, healthCancel := context.WithTimeout(ctx, dbOperationTimeout)
+			err = database.NewService(db).HealthCheck(healthCtx).Err()
+			healthCancel()
+			if err == nil {
+				slog.Info("connected to database",
+					"max_open_conns", dbConfig.MaxOpenConns,
+					"max_idle_conns", dbConfig.MaxIdleConns,
+					"conn_max_lifetime", dbConfig.ConnMaxLifetime.String(),
+					"conn_max_idle_time", dbConfig.ConnMaxIdleTime.String(),
+					"token_default_expiry_days", dbConfig.TokenDefaultExpiryDays,
+					"token_max_expiry_days", dbConfig.TokenMaxExpiryDays)
+				return db, nil
+			}
+			db.Close()
+			err = fmt.Errorf("database health check failed: %w", err)
+		}
+
+		if attempt >= attempts {
+			return nil, err
+		}
+
+		slog.Warn("database not ready, retrying", "attempt", attempt, "max_attempts", attempts,
+			"retry_in", backoff.String(), "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+
+		backoff *= 2
+		if backoff > maxDBConnectBackoff {
+			backoff = maxDBConnectBackoff
+		}
+	}
+}
+
+// Bounds on database work
+const (
+	dbOperationTimeout  = 10 * time.Second // A single database operation
+	shutdownGracePeriod = 5 * time.Second  // Database writes still allowed after the shutdown deadline
+	restoreTimeout      = time.Minute      // Restoring all active sessions at startup
+)
+
+// clientHandoffGrace is how long a replaced client connection stays open so data
+// connections it was asked for can still arrive
+const clientHandoffGrace = 5 * time.Second
+
+// statsLookback is how far back the first stats roll-up after startup looks for
+// connection activity
+const statsLookback = 48 * time.Hour
+
+// noticeTimeout bounds how long sending a client the reason its session ends may take
+const noticeTimeout = 5 * time.Second
+
+// dbContext returns a context for one database operation. It expires after
+// dbOperationTimeout and is cancelled along with the server's root context.
+func (s *Server) dbContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(s.ctx, dbOperationTimeout)
+}
+
+// authenticateToken validates a token using the database and returns port
+// assignment, recording clientIP and its country as where the token was last used
+func (s *Server) authenticateToken(ctx context.Context, token, clientIP string) (*database.TeamToken, *database.PortAssignment, error) {
+	country := ""
+	if s.securityMiddleware != nil {
+		country = s.securityMiddleware.Country(clientIP)
+	}
+	return s.dbService.AuthenticateToken(ctx, token, clientIP, country)
+}
+
+// reconnectLimited counts a handshake with token and reports whether the token is
+// over ReconnectsPerMinute. Handshakes are let through while Redis is failing.
+func (s *Server) reconnectLimited(token string) bool {
+	limit := s.config.ReconnectsPerMinute
+	if limit <= 0 {
+		return false
+	}
+	count, err := s.dbService.CountAuthentication(token)
+	if err != nil {
+		slog.Debug("failed to count token authentication; not limiting", "error", err)
+		return false
+	}
+	return count > int64(limit)
 }
 
 // Start starts the tunnel server
@@ -137,18 +511,47 @@ func (s *Server) Start() error {
 	globalServer = s
 
 	var err error
-	s.controlListener, err = net.Listen("tcp", net.JoinHostPort(s.config.BindAddress, s.config.ControlPort))
-	if err != nil {
-		return fmt.Errorf("error starting control listener: %v", err)
+	controlAddr := net.JoinHostPort(s.config.BindAddress, s.config.ControlPort)
+	if s.config.TLSCertFile != "" || s.config.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("error loading TLS certificate: %v", err)
+		}
+		s.controlListener, err = tls.Listen("tcp", controlAddr, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			return fmt.Errorf("error starting control listener: %v", err)
+		}
+		slog.Info("TLS enabled for control and data connections")
+	} else {
+		s.controlListener, err = net.Listen("tcp", controlAddr)
+		if err != nil {
+			return fmt.Errorf("error starting control listener: %v", err)
+		}
 	}
 
-	log.Printf("🚀 Tunnel server started on %s:%s", s.config.BindAddress, s.config.ControlPort)
-	log.Printf("🔐 Security middleware enabled")
-	log.Printf("📡 Using database-based authentication")
+	slog.Info("tunnel server started", "bind_address", s.config.BindAddress, "control_port", s.config.ControlPort, "tls", s.config.TLSCertFile != "")
+
+	// Start the shared HTTP(S) listener for subdomain routing
+	if s.config.HTTPPort != "" {
+		if s.config.Domain == "" {
+			return fmt.Errorf("a domain is required for subdomain routing on port %s", s.config.HTTPPort)
+		}
+		s.httpListener, err = net.Listen("tcp", net.JoinHostPort(s.config.BindAddress, s.config.HTTPPort))
+		if err != nil {
+			return fmt.Errorf("error starting http listener: %v", err)
+		}
+		slog.Info("subdomain routing started", "domain", s.config.Domain, "bind_address", s.config.BindAddress, "http_port", s.config.HTTPPort)
+
+		s.wg.Add(1)
+		go s.handleHTTPConnections()
+	}
 
 	// Restore active connections from database
 	if err := s.restoreActiveConnections(); err != nil {
-		log.Printf("⚠️ Failed to restore active connections: %v", err)
+		slog.Warn("failed to restore active connections", "error", err)
 	}
 
 	// Start API server if configured
@@ -157,7 +560,7 @@ func (s *Server) Start() error {
 		go func() {
 			defer s.wg.Done()
 			if err := s.apiServer.Start(); err != nil && err != http.ErrServerClosed {
-				log.Printf("❌ API server error: %v", err)
+				slog.Error("API server error", "error", err)
 			}
 		}()
 	}
@@ -165,38 +568,268 @@ func (s *Server) Start() error {
 	s.wg.Add(1)
 	go s.handleControlConnections()
 
+	if s.config.TokenCleanupInterval > 0 {
+		s.wg.Add(1)
+		go s.expireTokens()
+	}
+	if s.config.StatsInterval > 0 {
+		s.wg.Add(1)
+		go s.aggregateStats()
+	}
+
+	if s.config.PendingRegistry == PendingRegistryRedis {
+		slog.Info("sharing pending connections through redis", "instance", s.config.InstanceID)
+	}
+	if s.config.TunnelIdleTimeout > 0 {
+		slog.Info("idle tunnel timeout enabled", "timeout", s.config.TunnelIdleTimeout.String())
+	}
+	if s.config.MaxTunnelLifetime > 0 {
+		slog.Info("maximum tunnel lifetime enabled", "max_lifetime", s.config.MaxTunnelLifetime.String())
+	}
+	s.startReaper()
+
 	return nil
 }
 
-// Stop stops the tunnel server
-func (s *Server) Stop() error {
+// expireTokens periodically deactivates expired tokens, releases their ports and
+// closes any tunnel still using them
+func (s *Server) expireTokens() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.TokenCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		s.expireTokensOnce()
+
+		select {
+		case <-s.stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// aggregateStats periodically rolls connection logs up into connection_stats. Each
+// pass recomputes the days touched since the previous one began; the first covers
+// the last statsLookback.
+func (s *Server) aggregateStats() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.StatsInterval)
+	defer ticker.Stop()
+
+	since := time.Now().Add(-statsLookback)
+	for {
+		started := time.Now()
+		ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+		days, err := s.dbService.AggregateConnectionStats(ctx, since)
+		cancel()
+		if err != nil {
+			// Retry the same period next time
+			slog.Warn("failed to aggregate connection stats", "since", since, "error", err)
+		} else {
+			slog.Debug("aggregated connection stats", "since", since, "days", days, "duration_ms", time.Since(started).Milliseconds())
+			// Overlap passes slightly so logs committed while one ran are not missed
+			since = started.Add(-time.Minute)
+		}
+
+		select {
+		case <-s.stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireTokensOnce runs a single token expiry pass, then reclaims unreserved ports
+// left behind by inactive tokens or deleted teams
+func (s *Server) expireTokensOnce() {
+	ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+	defer cancel()
+
+	tokens, err := s.dbService.ExpireTokens(ctx)
+	if err != nil {
+		slog.Warn("failed to expire tokens", "error", err)
+		return
+	}
+
+	for _, token := range tokens {
+		closed := s.closeTunnelsForToken(token.ID.String(), nil)
+		slog.Info("token expired", "token_id", token.ID, "token_name", token.Name, "team_id", token.TeamID,
+			"expired_at", token.ExpiresAt, "closed_tunnels", closed)
+	}
+	if len(tokens) > 0 {
+		slog.Info("expired tokens", "count", len(tokens))
+	}
+
+	assignments, locks, err := s.dbService.ReclaimOrphanedPorts(ctx, false)
+	if err != nil {
+		slog.Warn("failed to reclaim orphaned ports", "error", err)
+	}
+	if len(assignments) > 0 || locks > 0 {
+		slog.Info("reclaimed orphaned ports", "ports", len(assignments), "stale_locks", locks)
+	}
+}
+
+// reapTunnels periodically tears down tunnels that have had no active connections
+// for longer than the idle timeout, or that have outlived the maximum lifetime.
+// The limits are re-read on every pass so Reload can change them.
+func (s *Server) reapTunnels() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(reapInterval(s.settings()))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case now := <-ticker.C:
+			config := s.settings()
+			s.mu.RLock()
+			var expired, idle []*Tunnel
+			for _, tunnel := range s.tunnels {
+				switch {
+				case config.MaxTunnelLifetime > 0 && now.Sub(tunnel.CreatedAt) >= config.MaxTunnelLifetime:
+					expired = append(expired, tunnel)
+				case config.TunnelIdleTimeout > 0 && tunnel.idleFor(now) >= config.TunnelIdleTimeout:
+					idle = append(idle, tunnel)
+				}
+			}
+			s.mu.RUnlock()
+
+			for _, tunnel := range expired {
+				tunnel.logger().Info("rotating tunnel past its maximum lifetime",
+					"max_lifetime", config.MaxTunnelLifetime.String(), "age", now.Sub(tunnel.CreatedAt).Round(time.Second).String())
+				s.retireTunnel(tunnel, "closed", "lifetime exceeded")
+			}
+			for _, tunnel := range idle {
+				tunnel.logger().Info("closing idle tunnel", "idle_timeout", config.TunnelIdleTimeout.String())
+				s.retireTunnel(tunnel, "timeout", "tunnel idle timeout")
+			}
+
+			ticker.Reset(reapInterval(config))
+		}
+	}
+}
+
+// reapInterval is how often reapTunnels checks tunnels against the limits in config
+func reapInterval(config Config) time.Duration {
+	interval := time.Minute
+	for _, limit := range []time.Duration{config.TunnelIdleTimeout, config.MaxTunnelLifetime} {
+		if limit > 0 && limit/2 < interval {
+			interval = limit / 2
+		}
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// retireTunnel stops a tunnel and ends its database session with status and reason.
+// Tunnels with a client end their session in handleTunnel; restored tunnels are
+// ended here.
+func (s *Server) retireTunnel(tunnel *Tunnel, status, reason string) {
+	restored := tunnel.Client() == nil
+	s.stopTunnelWithReason(tunnel, reason)
+
+	if restored && tunnel.SessionID != "" {
+		sessionID, _ := uuid.Parse(tunnel.SessionID)
+		ctx, cancel := s.dbContext()
+		defer cancel()
+		if err := s.dbService.EndConnection(ctx, sessionID, uuid.Nil, status, &reason); err != nil {
+			tunnel.logger().Warn("failed to end database session", "session_id", tunnel.SessionID, "error", err)
+		}
+	}
+}
+
+// Shutdown stops the server in stages. It stops accepting control connections
+// and tunnel traffic, then drains the tunnels, waiting for their connections to
+// finish, and shuts the API down last so the health endpoint reports "draining"
+// throughout. Connections still open when ctx is done are closed, in which case
+// ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
 	close(s.stopChan)
+	defer s.cancel()
 
 	if s.controlListener != nil {
 		s.controlListener.Close()
 	}
+	if s.httpListener != nil {
+		s.httpListener.Close()
+	}
 
-	// Stop security middleware
-	if s.securityMiddleware != nil {
-		s.securityMiddleware.Stop()
+	s.mu.RLock()
+	tunnels := make([]*Tunnel, 0, len(s.tunnels))
+	for _, tunnel := range s.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	s.mu.RUnlock()
+	slog.Info("draining tunnels", "tunnels", len(tunnels))
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		var wg sync.WaitGroup
+		for _, tunnel := range tunnels {
+			wg.Add(1)
+			go func(tunnel *Tunnel) {
+				defer wg.Done()
+				s.stopTunnel(tunnel)
+			}(tunnel)
+		}
+		wg.Wait()
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		slog.Warn("shutdown deadline reached; closing remaining tunnel connections")
+		for _, tunnel := range tunnels {
+			tunnel.closeConnections()
+		}
+		// Let tunnels record their final state, but cancel database work that is
+		// still running after the grace period so a stalled query cannot block
+		// shutdown any further
+		grace := time.AfterFunc(shutdownGracePeriod, s.cancel)
+		defer grace.Stop()
+		<-drained
 	}
 
-	// Stop API server
+	// Every bridge has finished, so write the connection results still queued
+	s.connLogs.Close()
+
+	// Shut the API down last, so the health endpoint reports draining until the end
 	if s.apiServer != nil {
-		if err := s.apiServer.Stop(); err != nil {
-			log.Printf("⚠️ Error stopping API server: %v", err)
+		if err := s.apiServer.Shutdown(ctx); err != nil {
+			slog.Warn("error stopping API server", "error", err)
 		}
 	}
 
-	// Stop all tunnels
-	s.mu.Lock()
-	for _, tunnel := range s.tunnels {
-		s.stopTunnel(tunnel)
+	if s.securityMiddleware != nil {
+		s.securityMiddleware.Stop()
 	}
-	s.mu.Unlock()
 
 	s.wg.Wait()
-	return nil
+	s.accessLog.Close()
+	return err
+}
+
+// setNoDelay applies TCPNoDelay to conn, or to the TCP connection under it
+func (s *Server) setNoDelay(conn net.Conn) {
+	if tcpConn := middleware.TCPConn(conn); tcpConn != nil {
+		tcpConn.SetNoDelay(s.config.TCPNoDelay)
+	}
+}
+
+// Draining reports whether the server is shutting down
+func (s *Server) Draining() bool {
+	return s.draining.Load()
 }
 
 // handleControlConnections handles incoming control connections
@@ -211,176 +844,662 @@ func (s *Server) handleControlConnections() {
 			conn, err := s.controlListener.Accept()
 			if err != nil {
 				if !strings.Contains(err.Error(), "use of closed network connection") {
-					log.Printf("Error accepting control connection: %v", err)
+					slog.Error("error accepting control connection", "error", err)
 				}
 				continue
 			}
 
-			// Apply security validation
-			if err := s.securityMiddleware.ValidateConnection(conn); err != nil {
-				log.Printf("🚫 Connection rejected from %s: %v", conn.RemoteAddr(), err)
-				conn.Close()
-				continue
-			}
-
-			// Wrap connection with security features
-			secureConn := s.securityMiddleware.WrapConnection(conn)
-
 			s.wg.Add(1)
-			go s.handleControlConnection(secureConn)
+			go s.admitControlConnection(conn)
 		}
 	}
 }
 
+// admitControlConnection applies security validation to a new connection and
+// hands it to handleControlConnection. It runs off the accept loop because
+// validation may wait on Redis.
+func (s *Server) admitControlConnection(conn net.Conn) {
+	if err := s.securityMiddleware.ValidateConnection(conn); err != nil {
+		defer s.wg.Done()
+		slog.Warn("control connection rejected", "client_ip", remoteIP(conn), "error", err)
+		conn.SetWriteDeadline(time.Now().Add(s.config.ControlWriteTimeout))
+		protocol.WriteMessage(conn, protocol.MsgAuthResult, protocol.AuthResult{Error: "rate limited", Code: protocol.ErrCodeRateLimited})
+		conn.Close()
+		return
+	}
+
+	// Wrap connection with security features
+	s.setNoDelay(conn)
+	s.handleControlConnection(s.securityMiddleware.WrapConnection(conn))
+}
+
 // handleControlConnection handles a single control connection
 func (s *Server) handleControlConnection(conn net.Conn) {
 	defer s.wg.Done()
+	// Closing the secure connection releases its slot in the security middleware.
+	// Data connections are handed off to a bridge, which owns their lifetime.
+	isDataConn := false
+	defer func() {
+		if !isDataConn {
+			conn.Close()
+		}
+	}()
 
-	log.Printf("🔗 New control connection from %s", conn.RemoteAddr())
-
-	// Simple protocol: read token and local port on separate lines
-	reader := bufio.NewReader(conn)
+	slog.Debug("new control connection", "client_ip", remoteIP(conn))
 
-	// Read first line to determine connection type
-	firstLine, err := reader.ReadString('\n')
+	// The first frame tells data connections apart from control connections. It
+	// must arrive within the handshake timeout.
+	msgType, payload, err := protocol.ReadFrameLimit(conn, s.config.MaxControlMessage)
 	if err != nil {
-		log.Printf("Error reading first line: %v", err)
-		conn.Close()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			slog.Warn("handshake timeout", "client_ip", remoteIP(conn))
+			writeFrameWithTimeout(conn, s.config.ControlWriteTimeout, protocol.MsgAuthResult, protocol.AuthResult{Error: "handshake timeout", Code: protocol.ErrCodeHandshakeTimeout})
+			return
+		}
+		if errors.Is(err, protocol.ErrFrameTooLarge) {
+			slog.Warn("first frame too large", "client_ip", remoteIP(conn), "error", err)
+			writeFrameWithTimeout(conn, s.config.ControlWriteTimeout, protocol.MsgAuthResult, protocol.AuthResult{Error: err.Error(), Code: protocol.ErrCodeBadRequest})
+			return
+		}
+		slog.Warn("error reading first frame", "client_ip", remoteIP(conn), "error", err)
 		return
 	}
-	firstLine = strings.TrimSpace(firstLine)
+	middleware.CompleteHandshake(conn)
 
 	// Handle data connections
-	if strings.HasPrefix(firstLine, "DATA:") {
-		s.handleDataConnection(conn, firstLine)
+	if msgType == protocol.MsgDataConn {
+		var dataConn protocol.DataConn
+		if err := protocol.Decode(msgType, payload, &dataConn); err != nil {
+			slog.Warn("invalid data connection", "client_ip", remoteIP(conn), "error", err)
+			return
+		}
+		isDataConn = true
+		s.handleDataConnection(conn, dataConn.ConnID)
 		return
 	}
 
-	// Handle delete port commands from API
-	if strings.HasPrefix(firstLine, "delete_port_") {
-		s.handleDeletePortCommand(conn, firstLine)
+	// A multiplexed data connection outlives this handler, like a bridged one
+	if msgType == protocol.MsgMuxConn {
+		isDataConn = true
+		go s.serveMux(conn)
 		return
 	}
 
 	// This is a control connection - continue with tunnel setup
-	token := firstLine
+	client := newControlConn(conn, s.config.ControlWriteTimeout)
+	logger := client.logger()
 
-	// Read local port
-	localPort, err := reader.ReadString('\n')
-	if err != nil {
-		log.Printf("Error reading local port: %v", err)
-		conn.Close()
+	// Token inspection is answered without creating anything
+	if msgType == protocol.MsgInspect {
+		s.handleInspect(client, payload)
 		return
 	}
-	localPort = strings.TrimSpace(localPort)
 
-	ctx := context.Background()
+	if msgType != protocol.MsgAuth {
+		client.writeAuthError(protocol.ErrCodeBadRequest, fmt.Sprintf("expected %s, got %s", protocol.MsgAuth, msgType))
+		logger.Warn("unexpected frame on control connection", "client_ip", remoteIP(conn), "frame", msgType.String())
+		return
+	}
 
-	// Authenticate token and get port assignment
-	teamToken, portAssignment, err := s.authenticateToken(ctx, token)
-	if err != nil {
-		fmt.Fprintf(conn, "ERROR:Invalid token or authentication failed\n")
-		log.Printf("❌ Authentication failed for token from %s: %v", conn.RemoteAddr(), err)
-		conn.Close()
+	var auth protocol.Auth
+	if err := protocol.Decode(msgType, payload, &auth); err != nil {
+		client.writeAuthError(protocol.ErrCodeBadRequest, err.Error())
+		logger.Warn("invalid auth message", "client_ip", remoteIP(conn), "error", err)
 		return
 	}
 
-	log.Printf("✅ Token authenticated for team: %s", teamToken.Team.Name)
-	log.Printf("📍 Assigned port: %d", portAssignment.Port)
+	mappings := auth.Mappings
+	if err := validatePortMappings(mappings); err != nil {
+		client.writeAuthError(protocol.ErrCodeBadRequest, err.Error())
+		logger.Warn("invalid port mappings", "client_ip", remoteIP(conn), "error", err)
+		return
+	}
 
-	// Check if there's already a tunnel for this port/token (restored or active)
-	s.mu.Lock()
-	existingTunnel := s.findTunnelByTokenAndPort(token, portAssignment.Port)
-	if existingTunnel != nil {
-		if existingTunnel.Client == nil {
-			log.Printf("🔄 Found existing restored tunnel %s, reconnecting client", existingTunnel.ID)
-		} else {
-			log.Printf("🔄 Found existing active tunnel %s, replacing client connection", existingTunnel.ID)
-		}
-		s.mu.Unlock()
+	token := auth.Token
+	ctx, cancel := s.dbContext()
+	defer cancel()
 
-		// Reconnect the client to the existing tunnel (restored or active)
-		s.reconnectClientToTunnel(existingTunnel, conn, teamToken, portAssignment, localPort)
+	if s.reconnectLimited(token) {
+		client.writeAuthError(protocol.ErrCodeReconnectLimited, "reconnecting too fast, backoff")
+		logger.Warn("handshake rejected: token reconnecting too fast", "client_ip", remoteIP(conn),
+			"limit_per_minute", s.config.ReconnectsPerMinute)
 		return
 	}
-	s.mu.Unlock()
 
-	// Create new tunnel using the pre-assigned port
-	tunnel, err := s.createTunnel(teamToken, portAssignment, localPort, conn)
+	// Authenticate token and get port assignment
+	teamToken, portAssignment, err := s.authenticateToken(ctx, token, remoteIP(conn))
 	if err != nil {
-		fmt.Fprintf(conn, "ERROR:%s\n", err.Error())
-		log.Printf("Error creating tunnel: %v", err)
-		conn.Close()
+		client.writeAuthError(protocol.ErrCodeAuthFailed, "Invalid token or authentication failed")
+		logger.Warn("authentication failed", "client_ip", remoteIP(conn), "error", err)
 		return
 	}
 
-	// Send success response
-	fmt.Fprintf(conn, "SUCCESS:%s:%s\n", tunnel.ID, tunnel.RemotePort)
-	log.Printf("🎯 Tunnel created: %s (team:%s, local:%s -> remote:%s)",
-		tunnel.ID, teamToken.Team.Name, localPort, tunnel.RemotePort)
+	logger.Info("token authenticated", "team_id", teamToken.TeamID, "team_name", teamToken.Team.Name,
+		"token_id", teamToken.ID, "client_ip", remoteIP(conn), "assigned_port", portAssignment.Port)
 
-	// Keep connection alive and handle tunnel traffic
-	// Listen for DISCONNECT message from client
-	go tunnel.handleTunnel()
+	// Compress data connections when both sides support it. UDP tunnels frame their
+	// datagrams on the data connection and are left uncompressed.
+	if s.config.Compression && portAssignment.Protocol == "tcp" {
+		client.compression = protocol.NegotiateCompression(auth.Compression)
+	}
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			log.Printf("Control connection closed for tunnel %s: %v", tunnel.ID, err)
-			break
+	// The token may be restricted to exposing specific local ports
+	for _, mapping := range mappings {
+		if !teamToken.AllowsLocalPort(mapping.LocalPort) {
+			client.writeAuthError(protocol.ErrCodeLocalPortDenied, "local port not permitted")
+			logger.Warn("local port not permitted", "team_id", teamToken.TeamID, "token_id", teamToken.ID,
+				"local_port", mapping.LocalPort, "client_ip", remoteIP(conn))
+			return
 		}
-		line = strings.TrimSpace(line)
-		if line == "DISCONNECT" {
-			log.Printf("🚪 Client requested disconnect for tunnel %s", tunnel.ID)
-			s.stopTunnel(tunnel)
-			break
+		if mapping.Bind == protocol.BindPublic && !teamToken.AllowPublicBind {
+			client.writeAuthError(protocol.ErrCodePublicBindDenied, "public bind not permitted")
+			logger.Warn("public bind not permitted", "team_id", teamToken.TeamID, "token_id", teamToken.ID,
+				"local_port", mapping.LocalPort, "client_ip", remoteIP(conn))
+			return
 		}
 	}
-}
-
-// handleDeletePortCommand handles delete port commands from the API
-func (s *Server) handleDeletePortCommand(conn net.Conn, commandLine string) {
-	defer conn.Close()
 
-	// Parse the command: delete_port_PORT
-	parts := strings.Split(commandLine, "_")
-	if len(parts) < 3 {
-		log.Printf("Invalid delete port command format: %s", commandLine)
+	// The team may be capped on connections per day
+	if err := s.checkDailyConnectionQuota(ctx, teamToken); err != nil {
+		client.writeAuthError(protocol.ErrCodeQuotaExceeded, err.Error())
+		logger.Warn("daily connection quota exceeded", "team_id", teamToken.TeamID,
+			"limit", teamToken.Team.MaxDailyConnections, "client_ip", remoteIP(conn))
 		return
 	}
 
-	portStr := parts[2]
-	port, err := strconv.Atoi(portStr)
+	// Resolve one port assignment per mapping, allocating extra ports if needed
+	requestedPorts := make([]int, len(mappings))
+	for i, mapping := range mappings {
+		if mapping.Protocol != portAssignment.Protocol {
+			client.writeAuthError(protocol.ErrCodePortAssignment, fmt.Sprintf("token is assigned %s ports, not %s", portAssignment.Protocol, mapping.Protocol))
+			logger.Warn("protocol mismatch", "team_id", teamToken.TeamID, "requested", mapping.Protocol, "assigned", portAssignment.Protocol)
+			return
+		}
+		requestedPorts[i] = mapping.RemotePort
+
+		// A reconnect token from the previous session rebinds the mapping to its old port
+		if mapping.RemotePort == 0 && mapping.ReconnectToken != "" {
+			requestedPorts[i] = s.dbService.ResolveReconnectToken(ctx, teamToken, mapping.ReconnectToken, mapping.Protocol)
+		}
+	}
+	assignments, err := s.dbService.ResolvePortAssignments(ctx, teamToken, portAssignment, requestedPorts)
 	if err != nil {
-		log.Printf("Invalid port in delete command: %s", portStr)
+		client.writeAuthError(protocol.ErrCodePortAssignment, err.Error())
+		logger.Warn("failed to resolve port assignments", "team_id", teamToken.TeamID, "error", err)
 		return
 	}
 
-	log.Printf("🗑️ Received delete port command for port %d", port)
-
-	// Find and stop any tunnels using this port
-	s.mu.Lock()
-	var tunnelsToStop []*Tunnel
-	for _, tunnel := range s.tunnels {
-		if tunnel.RemotePort == portStr {
-			tunnelsToStop = append(tunnelsToStop, tunnel)
+	tunnels := make([]*Tunnel, 0, len(mappings))
+	result := protocol.AuthResult{Success: true, Compression: client.compression, Multiplex: auth.Multiplex, SessionID: client.sessionID}
+	var created []*Tunnel
+	var takeovers []func()
+	for i, mapping := range mappings {
+		assignment := assignments[i]
+		result.Tunnels = append(result.Tunnels, protocol.TunnelInfo{
+			LocalPort:  mapping.LocalPort,
+			RemotePort: assignment.Port,
+		})
+
+		// Take over the tunnel for this port/token if there is one, or open it
+		key := tunnelKey{token: token, port: assignment.Port}
+		existingTunnel, ok := s.claimTunnel(key, mapping.ReconnectToken)
+		if !ok {
+			client.writeAuthError(protocol.ErrCodeTunnelActive, "tunnel already active")
+			logger.Warn("tunnel already active for another client", "team_id", teamToken.TeamID,
+				"token_id", teamToken.ID, "remote_port", assignment.Port, "client_ip", remoteIP(conn))
+			for _, t := range created {
+				s.discardTunnel(t)
+			}
+			return
+		}
+
+		if existingTunnel != nil {
+			if existingTunnel.Client() == nil {
+				existingTunnel.logger().Info("reconnecting client to restored tunnel")
+			} else {
+				existingTunnel.logger().Info("replacing client connection of active tunnel")
+			}
+
+			// Reconnect the client to the existing tunnel (restored or active) once
+			// it has its auth result, so nothing is sent to it before that
+			existingTunnel, localPort := existingTunnel, mapping.LocalPort
+			takeovers = append(takeovers, func() {
+				s.reconnectClientToTunnel(existingTunnel, client, teamToken, assignment, localPort)
+			})
+			tunnels = append(tunnels, existingTunnel)
+			result.Tunnels[i].TunnelID = existingTunnel.ID
+			continue
+		}
+
+		// Create new tunnel using the pre-assigned port. The assignment is updated
+		// in place if its port was busy and had to be reassigned.
+		tunnel, err := s.createTunnel(teamToken, assignment, mapping.LocalPort, mapping.Bind, mapping.IdempotencyKey, client)
+		s.mu.Lock()
+		delete(s.opening, key)
+		s.mu.Unlock()
+		if err != nil {
+			code := protocol.ErrCodePortAssignment
+			if errors.Is(err, errQuotaExceeded) {
+				code = protocol.ErrCodeQuotaExceeded
+			}
+			client.writeAuthError(code, err.Error())
+			logger.Error("error creating tunnel", "team_id", teamToken.TeamID, "error", err)
+			for _, t := range created {
+				s.discardTunnel(t)
+			}
+			return
+		}
+
+		tunnel.logger().Info("tunnel created", "team_name", teamToken.Team.Name, "local_port", mapping.LocalPort, "client_ip", remoteIP(conn))
+		tunnels = append(tunnels, tunnel)
+		created = append(created, tunnel)
+		result.Tunnels[i].TunnelID = tunnel.ID
+		result.Tunnels[i].RemotePort = assignment.Port
+	}
+
+	// Issue a reconnect token per tunnel so the client gets the same ports back
+	var reconnectTokens []string
+	for i, assignment := range assignments {
+		reconnectToken, err := s.dbService.IssueReconnectToken(ctx, teamToken.ID, assignment.Port, assignment.Protocol)
+		if err != nil {
+			tunnels[i].logger().Warn("failed to issue reconnect token", "error", err)
+			continue
+		}
+		result.Tunnels[i].ReconnectToken = reconnectToken
+		reconnectTokens = append(reconnectTokens, reconnectToken)
+	}
+
+	// Report every tunnel, in the order the mappings were requested
+	if err := client.writeMessage(protocol.MsgAuthResult, result); err != nil {
+		// Existing tunnels stay with their current client
+		logger.Warn("error sending auth result", "client_ip", remoteIP(conn), "error", err)
+	} else {
+		for _, takeover := range takeovers {
+			takeover()
+		}
+		for i, tunnel := range tunnels {
+			tunnel.setReconnectToken(result.Tunnels[i].ReconnectToken)
+		}
+		s.sendNotice(client)
+	}
+
+	// Keep connection alive and handle tunnel traffic
+	for _, tunnel := range tunnels {
+		go tunnel.handleTunnel()
+	}
+
+	s.readControlMessages(tunnels, reconnectTokens, client)
+	client.closed.Store(true)
+}
+
+// readControlMessages reads messages sent by the client on its control connection
+// until the connection closes or the client asks to disconnect. Heartbeats keep
+// the client's reconnect tokens alive; a clean disconnect revokes them.
+func (s *Server) readControlMessages(tunnels []*Tunnel, reconnectTokens []string, client *controlConn) {
+	logger := client.logger()
+	for {
+		msgType, _, err := protocol.ReadFrameLimit(client, s.config.MaxControlMessage)
+		if err != nil {
+			// An idle control connection is expected; only give up on real errors.
+			// A timeout partway through a frame is one: resuming would read from
+			// the middle of it.
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !errors.Is(err, protocol.ErrPartialFrame) {
+				continue
+			}
+			// The rest of the frame was not read, so the stream cannot be resumed
+			if errors.Is(err, protocol.ErrFrameTooLarge) {
+				logger.Warn("control message too large, closing connection", "client_ip", remoteIP(client), "error", err)
+				return
+			}
+			if tunnelsStopped(tunnels) {
+				logger.Info("control connection closed", "client_ip", remoteIP(client))
+				return
+			}
+			// Tunnels stay up so the client can reconnect; their sessions are left
+			// active for stale cleanup rather than closed
+			logger.Warn("control connection lost without disconnect", "client_ip", remoteIP(client), "error", err)
+			return
+		}
+
+		switch msgType {
+		case protocol.MsgPing:
+			if err := client.writeMessage(protocol.MsgPong, nil); err != nil {
+				logger.Warn("error sending pong", "client_ip", remoteIP(client), "error", err)
+				return
+			}
+			for _, reconnectToken := range reconnectTokens {
+				if err := s.dbService.RefreshReconnectToken(reconnectToken); err != nil {
+					logger.Warn("failed to refresh reconnect token", "client_ip", remoteIP(client), "error", err)
+				}
+			}
+		case protocol.MsgDisconnect:
+			logger.Info("client disconnected cleanly", "client_ip", remoteIP(client), "tunnels", len(tunnels))
+			for _, reconnectToken := range reconnectTokens {
+				s.dbService.RevokeReconnectToken(reconnectToken)
+			}
+			for _, tunnel := range tunnels {
+				// A tunnel handed off to a newer client connection is no longer ours
+				if tunnel.Client() != client {
+					continue
+				}
+				tunnel.clientDisconnected.Store(true)
+				s.stopTunnel(tunnel)
+			}
+			return
+		default:
+			logger.Warn("ignoring unexpected frame", "client_ip", remoteIP(client), "frame", msgType.String())
+		}
+	}
+}
+
+// tunnelsStopped reports whether every tunnel has been stopped by the server
+func tunnelsStopped(tunnels []*Tunnel) bool {
+	for _, tunnel := range tunnels {
+		select {
+		case <-tunnel.stopChan:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// controlConn is a client control connection that may be shared by several tunnels
+type controlConn struct {
+	net.Conn
+	writeMu     sync.Mutex // Serializes protocol writes from concurrent tunnels
+	compression string     // Algorithm negotiated for this client's data connections ("" = none)
+	sessionID   string     // Sent to the client and logged on both sides to correlate their logs
+
+	writeTimeout time.Duration // Longest a single frame write may take
+	writeErr     error         // Set by the first failed write; guarded by writeMu
+
+	// closed is set once the server stops reading the connection, so its tunnels
+	// can be taken over even when takeovers are not allowed
+	closed atomic.Bool
+}
+
+// newControlConn wraps a connection for use as a control connection whose
+// writes give up after writeTimeout
+func newControlConn(conn net.Conn, writeTimeout time.Duration) *controlConn {
+	return &controlConn{Conn: conn, sessionID: uuid.NewString(), writeTimeout: writeTimeout}
+}
+
+// writeMessage writes a single protocol frame so it cannot be interleaved with
+// frames written by other tunnels sharing the connection. A write that fails or
+// times out may have sent part of a frame, leaving the client unable to find the
+// next one, so the connection is closed and every later write fails at once.
+func (c *controlConn) writeMessage(msgType protocol.MessageType, msg interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if err := writeFrameWithTimeout(c.Conn, c.writeTimeout, msgType, msg); err != nil {
+		c.writeErr = fmt.Errorf("control connection closed after failed write: %w", err)
+		c.logger().Warn("closing control connection after failed write", "client_ip", remoteIP(c),
+			"frame", msgType.String(), "error", err)
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// writeFrameWithTimeout writes a protocol frame to conn, abandoning the write
+// after timeout. The deadline is set from a timer rather than up front because
+// connections wrapped by the security middleware set their own deadline on
+// every Write.
+func writeFrameWithTimeout(conn net.Conn, timeout time.Duration, msgType protocol.MessageType, msg interface{}) error {
+	timer := time.AfterFunc(timeout, func() { conn.SetWriteDeadline(time.Now()) })
+	defer timer.Stop()
+
+	return protocol.WriteMessage(conn, msgType, msg)
+}
+
+// sendError tells the client why its session is ending. It gives up after
+// noticeTimeout so a client that stopped reading cannot hold up the caller;
+// closing the connection then abandons the write.
+func (c *controlConn) sendError(notice protocol.Error) {
+	done := make(chan error, 1)
+	go func() { done <- c.writeMessage(protocol.MsgError, notice) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			c.logger().Warn("error sending session error", "client_ip", remoteIP(c), "code", notice.Code, "error", err)
+		}
+	case <-time.After(noticeTimeout):
+		c.logger().Warn("timed out sending session error", "client_ip", remoteIP(c), "code", notice.Code)
+	}
+}
+
+// handleInspect replies to an Inspect request with what the token grants. It is
+// read-only: no tunnel, session or last used time is recorded.
+func (s *Server) handleInspect(client *controlConn, payload []byte) {
+	logger := client.logger()
+	var inspect protocol.Inspect
+	if err := protocol.Decode(protocol.MsgInspect, payload, &inspect); err != nil {
+		client.writeMessage(protocol.MsgInspectResult, protocol.InspectResult{Code: protocol.ErrCodeBadRequest, Error: err.Error()})
+		logger.Warn("invalid inspect message", "client_ip", remoteIP(client), "error", err)
+		return
+	}
+
+	ctx, cancel := s.dbContext()
+	defer cancel()
+
+	teamToken, assignments, err := s.dbService.InspectToken(ctx, inspect.Token)
+	if err != nil {
+		client.writeMessage(protocol.MsgInspectResult, protocol.InspectResult{Code: protocol.ErrCodeAuthFailed, Error: "Invalid token or authentication failed"})
+		logger.Warn("token inspection failed", "client_ip", remoteIP(client), "error", err)
+		return
+	}
+
+	result := protocol.InspectResult{
+		Success:           true,
+		TeamName:          teamToken.Team.Name,
+		TokenName:         teamToken.Name,
+		ExpiresAt:         teamToken.ExpiresAt,
+		AllowedLocalPorts: teamToken.AllowedLocalPorts,
+	}
+	for _, assignment := range assignments {
+		port := protocol.InspectedPort{Port: assignment.Port, Protocol: assignment.Protocol}
+		if assignment.Subdomain != nil {
+			port.Subdomain = *assignment.Subdomain
+		}
+		result.Ports = append(result.Ports, port)
+	}
+
+	if err := client.writeMessage(protocol.MsgInspectResult, result); err != nil {
+		logger.Warn("error sending inspect result", "client_ip", remoteIP(client), "error", err)
+		return
+	}
+	logger.Debug("token inspected", "team_id", teamToken.TeamID, "token_id", teamToken.ID, "client_ip", remoteIP(client))
+}
+
+// writeAuthError reports a failed handshake to the client
+func (c *controlConn) writeAuthError(code, message string) error {
+	return c.writeMessage(protocol.MsgAuthResult, protocol.AuthResult{Error: message, Code: code, SessionID: c.sessionID})
+}
+
+// maxPortMappings limits how many ports a single control connection can expose
+const maxPortMappings = 16
+
+// maxIdempotencyKeyLength is the longest tunnel setup idempotency key accepted,
+// the size of the connection_sessions column
+const maxIdempotencyKeyLength = 255
+
+// validatePortMappings checks the mappings requested by a client and fills in
+// the default protocol
+func validatePortMappings(mappings []protocol.PortMapping) error {
+	if len(mappings) == 0 {
+		return fmt.Errorf("no local port specified")
+	}
+	if len(mappings) > maxPortMappings {
+		return fmt.Errorf("too many port mappings (max %d)", maxPortMappings)
+	}
+
+	for i := range mappings {
+		mapping := &mappings[i]
+		if mapping.Protocol == "" {
+			mapping.Protocol = "tcp"
+		}
+		if mapping.Protocol != "tcp" && mapping.Protocol != "udp" {
+			return fmt.Errorf("unsupported protocol %q for local port %s", mapping.Protocol, mapping.LocalPort)
+		}
+		if mapping.LocalPort == "" {
+			return fmt.Errorf("missing local port in mapping %d", i+1)
+		}
+		if mapping.RemotePort < 0 || mapping.RemotePort > 65535 {
+			return fmt.Errorf("invalid remote port %d for local port %s", mapping.RemotePort, mapping.LocalPort)
+		}
+		if len(mapping.IdempotencyKey) > maxIdempotencyKeyLength {
+			return fmt.Errorf("idempotency key for local port %s is longer than %d bytes", mapping.LocalPort, maxIdempotencyKeyLength)
+		}
+		if mapping.Bind != "" && mapping.Bind != protocol.BindPublic && mapping.Bind != protocol.BindLoopback {
+			return fmt.Errorf("unsupported bind %q for local port %s (expected %s or %s)", mapping.Bind, mapping.LocalPort, protocol.BindPublic, protocol.BindLoopback)
+		}
+	}
+
+	return nil
+}
+
+// stopTunnelsOnPort stops every tunnel bound to a remote port after its token was deleted
+func (s *Server) stopTunnelsOnPort(port int) {
+	portStr := strconv.Itoa(port)
+
+	// Find and stop any tunnels using this port
+	s.mu.Lock()
+	var tunnelsToStop []*Tunnel
+	for _, tunnel := range s.tunnels {
+		if tunnel.RemotePort == portStr {
+			tunnelsToStop = append(tunnelsToStop, tunnel)
 		}
 	}
 	s.mu.Unlock()
 
 	// Stop the tunnels
 	for _, tunnel := range tunnelsToStop {
-		log.Printf("🛑 Stopping tunnel %s on port %d due to token deletion", tunnel.ID, port)
+		tunnel.logger().Info("stopping tunnel after token deletion")
 		s.stopTunnel(tunnel)
 	}
 
 	if len(tunnelsToStop) > 0 {
-		log.Printf("✅ Stopped %d tunnel(s) on port %d", len(tunnelsToStop), port)
+		slog.Info("stopped tunnels on port", "port", port, "count", len(tunnelsToStop))
 	} else {
-		log.Printf("ℹ️ No active tunnels found on port %d", port)
+		slog.Debug("no active tunnels found on port", "port", port)
 	}
 }
 
+// closeTunnelsForToken force-closes every tunnel opened with the given token and
+// returns the number of tunnels stopped. A non-nil notice is sent to each client
+// first, telling it why its session ended so it does not reconnect.
+func (s *Server) closeTunnelsForToken(tokenID string, notice *protocol.Error) int {
+	s.mu.Lock()
+	var tunnelsToStop []*Tunnel
+	for _, tunnel := range s.tunnels {
+		if tunnel.TokenID == tokenID {
+			tunnelsToStop = append(tunnelsToStop, tunnel)
+		}
+	}
+	s.mu.Unlock()
+
+	if notice != nil {
+		// Tunnels of one client share its control connection
+		notified := make(map[*controlConn]bool)
+		for _, tunnel := range tunnelsToStop {
+			if client := tunnel.Client(); client != nil && !notified[client] {
+				notified[client] = true
+				client.sendError(*notice)
+			}
+		}
+	}
+
+	for _, tunnel := range tunnelsToStop {
+		tunnel.logger().Info("stopping tunnel after token revocation")
+		if notice != nil {
+			s.stopTunnelWithReason(tunnel, notice.Error)
+		} else {
+			s.stopTunnel(tunnel)
+		}
+	}
+
+	return len(tunnelsToStop)
+}
+
+// adminTerminatedReason ends the session of a tunnel closed through the API
+const adminTerminatedReason = "admin terminated"
+
+// CloseTunnel stops the tunnel with the given id and ends its session with
+// reason, returning the stopped tunnel or nil if there is none. The client is
+// not told why; it reconnects with its usual backoff unless its token is revoked.
+func (s *Server) CloseTunnel(tunnelID, reason string) *Tunnel {
+	s.mu.RLock()
+	tunnel := s.tunnels[tunnelID]
+	s.mu.RUnlock()
+	if tunnel == nil {
+		return nil
+	}
+
+	tunnel.logger().Info("closing tunnel", "reason", reason)
+	s.retireTunnel(tunnel, "closed", reason)
+	return tunnel
+}
+
+// closeTunnelsForPorts stops every tunnel listening on one of the released port
+// assignments and returns how many were stopped
+func (s *Server) closeTunnelsForPorts(assignments []database.PortAssignment) int {
+	released := make(map[string]bool, len(assignments))
+	for _, pa := range assignments {
+		released[strconv.Itoa(pa.Port)+"/"+pa.Protocol] = true
+	}
+
+	s.mu.Lock()
+	var tunnelsToStop []*Tunnel
+	for _, tunnel := range s.tunnels {
+		if released[tunnel.RemotePort+"/"+tunnel.Protocol] {
+			tunnelsToStop = append(tunnelsToStop, tunnel)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, tunnel := range tunnelsToStop {
+		tunnel.logger().Info("stopping tunnel after its port was released")
+		s.stopTunnel(tunnel)
+	}
+
+	return len(tunnelsToStop)
+}
+
+// tunnelKey identifies the tunnel of a token on one remote port
+type tunnelKey struct {
+	token string
+	port  int
+}
+
+// claimTunnel decides what a handshake presenting reconnectToken gets for key. If
+// a tunnel exists (restored or active) it is returned for the client to be
+// reconnected to, unless another client holds it and AllowTakeover is off. If
+// none exists the key is marked as opening, so a concurrent handshake cannot open
+// a second tunnel, and nil is returned; the caller clears the mark once it has
+// created the tunnel or given up. ok is false if the handshake must be rejected.
+func (s *Server) claimTunnel(key tunnelKey, reconnectToken string) (existing *Tunnel, ok bool) {
+	s.mu.Lock()
+	existing = s.findTunnelByTokenAndPort(key.token, key.port)
+	opening := existing == nil && s.opening[key]
+	if existing == nil && !opening {
+		s.opening[key] = true
+	}
+	s.mu.Unlock()
+
+	if opening || (existing != nil && !s.config.AllowTakeover && existing.heldByOtherClient(reconnectToken)) {
+		return nil, false
+	}
+	return existing, true
+}
+
 // findTunnelByTokenAndPort finds any tunnel (restored or active) by token and port
 func (s *Server) findTunnelByTokenAndPort(token string, port int) *Tunnel {
 	for _, tunnel := range s.tunnels {
@@ -391,173 +1510,488 @@ func (s *Server) findTunnelByTokenAndPort(token string, port int) *Tunnel {
 	return nil
 }
 
-// reconnectClientToTunnel reconnects a client to an existing restored tunnel
-func (s *Server) reconnectClientToTunnel(tunnel *Tunnel, conn net.Conn, teamToken *database.TeamToken, _ *database.PortAssignment, localPort string) {
-	// If there's an existing client, close it gracefully
-	s.mu.Lock()
-	oldClient := tunnel.Client
+// reconnectClientToTunnel reconnects a client to an existing restored tunnel, or
+// hands an active tunnel over from its current client. Data connections requested
+// from the old client and not yet opened are requested again from the new one;
+// the old control connection stays open for clientHandoffGrace, so whichever
+// client opens a data connection first serves the external connection.
+func (s *Server) reconnectClientToTunnel(tunnel *Tunnel, conn *controlConn, teamToken *database.TeamToken, _ *database.PortAssignment, localPort string) {
+	// Swap in the new client connection, then close the old one gracefully.
+	// Do NOT close or reset tunnel.stopChan here; keep the tunnel running.
+	oldClient, awaiting := tunnel.setClient(conn, localPort)
 	if oldClient != nil {
-		log.Printf("🔄 Closing existing client connection for tunnel %s", tunnel.ID)
-		oldClient.Close()
-		// Do NOT close tunnel.stopChan here! This keeps the tunnel alive.
+		tunnel.logger().Info("client connection replaced, handing off tunnel", "team_name", teamToken.Team.Name,
+			"local_port", localPort, "client_ip", remoteIP(conn), "previous_client_ip", remoteIP(oldClient),
+			"pending_connections", len(awaiting), "grace", clientHandoffGrace.String())
+		time.AfterFunc(clientHandoffGrace, func() {
+			tunnel.logger().Info("closing previous client connection after handoff", "client_ip", remoteIP(oldClient))
+			oldClient.Close()
+		})
+	} else {
+		tunnel.logger().Info("client reconnected to restored tunnel", "team_name", teamToken.Team.Name, "local_port", localPort, "client_ip", remoteIP(conn))
+	}
+
+	for _, newConn := range awaiting {
+		if err := conn.writeMessage(protocol.MsgNewConn, newConn); err != nil {
+			tunnel.logger().Warn("error re-sending connection request to new client", "conn_id", newConn.ConnID, "error", err)
+			break
+		}
+		tunnel.logger().Info("re-sent pending connection request to new client", "conn_id", newConn.ConnID, "external_addr", newConn.ClientAddr)
+	}
+
+	// Reactivate the tunnel in database
+	if tunnel.SessionID != "" {
+		ctx, cancel := s.dbContext()
+		defer cancel()
+		sessionID, _ := uuid.Parse(tunnel.SessionID)
+		clientIP := remoteIP(conn)
+		if err := s.dbService.ReactivateRestoredTunnel(ctx, sessionID, clientIP); err != nil {
+			tunnel.logger().Warn("failed to reactivate tunnel in database", "error", err)
+		}
+	}
+}
+
+// handleDataConnection hands a data connection to the external connection waiting for it
+func (s *Server) handleDataConnection(conn net.Conn, connID string) {
+	slog.Debug("received data connection", "conn_id", connID)
+
+	// Claim the pending connection. Removing it atomically means exactly one
+	// data connection is ever sent on its channel, so the buffered send below can
+	// never block, and a waiter that times out can tell a handoff is in flight.
+	connChan, exists := s.pendingConns.claim(connID)
+	if !exists {
+		// Data connections are not routed between instances, so one meant for
+		// another instance can only be reported
+		if owner := s.pendingConns.owner(connID); owner != "" && owner != s.config.InstanceID {
+			slog.Warn("data connection reached the wrong server instance", "conn_id", connID,
+				"client_ip", remoteIP(conn), "instance", s.config.InstanceID, "owner", owner)
+			conn.Close()
+			return
+		}
+		slog.Warn("no pending connection for data connection", "conn_id", connID, "client_ip", remoteIP(conn))
+		conn.Close()
+		return
+	}
+
+	connChan <- conn
+	slog.Debug("data connection paired", "conn_id", connID)
+}
+
+// serveMux pairs every stream of a multiplexed data connection with its pending
+// connection, as handleDataConnection does for a connection of its own. The
+// connection closes when the client closes it or it fails.
+func (s *Server) serveMux(conn net.Conn) {
+	session := protocol.NewMuxSession(conn, false)
+	defer session.Close()
+
+	slog.Debug("multiplexed data connection opened", "client_ip", remoteIP(conn))
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			slog.Debug("multiplexed data connection closed", "client_ip", remoteIP(conn))
+			return
+		}
+		s.handleDataConnection(stream, stream.Name())
+	}
+}
+
+// cancelPendingConn withdraws a pending connection. If a data connection already
+// claimed it, the handoff is completed and that connection is returned instead.
+func (s *Server) cancelPendingConn(connID string, connChan chan net.Conn) net.Conn {
+	if s.pendingConns.remove(connID) {
+		return nil
+	}
+	return <-connChan
+}
+
+// createTunnel creates a new tunnel using database-assigned port, listening where
+// bind and the token allow (see tunnelBindAddress). The tunnel's session is
+// reused rather than duplicated when the client retries a setup with the same
+// idempotencyKey.
+func (s *Server) createTunnel(teamToken *database.TeamToken, portAssignment *database.PortAssignment, localPort, bind, idempotencyKey string, client *controlConn) (*Tunnel, error) {
+	slotHeld, err := s.reserveTunnelSlot(teamToken)
+	if err != nil {
+		return nil, err
+	}
+	// The slot is handed over to the tunnel once it is in s.tunnels; until then
+	// any failure gives it back
+	defer func() {
+		if slotHeld {
+			s.mu.Lock()
+			s.releaseTunnelSlot(teamToken.TeamID)
+			s.mu.Unlock()
+		}
+	}()
+
+	ctx, cancel := s.dbContext()
+	defer cancel()
+
+	// Generate random tunnel ID
+	tunnelID, err := generateTunnelID()
+	if err != nil {
+		return nil, fmt.Errorf("error generating tunnel ID: %v", err)
+	}
+
+	// Use the pre-assigned port from database
+	remotePort := strconv.Itoa(portAssignment.Port)
+
+	tunnel := &Tunnel{
+		ID:           tunnelID,
+		Token:        teamToken.Token,
+		TeamID:       teamToken.TeamID,
+		TokenID:      teamToken.ID.String(),
+		PortAssignID: portAssignment.ID.String(),
+		LocalPort:    localPort,
+		RemotePort:   remotePort,
+		BindAddress:  s.tunnelBindAddress(teamToken, portAssignment, bind),
+		Protocol:     portAssignment.Protocol,
+		client:       client,
+		CreatedAt:    time.Now(),
+		stopChan:     make(chan struct{}),
+	}
+	tunnel.applyPortAssignment(portAssignment)
+
+	// Create listener for the tunnel on the assigned port
+	if err := tunnel.listen(); err != nil {
+		if !isAddrInUse(err) {
+			return nil, err
+		}
+		tunnel.logger().Warn("assigned port is already bound by another process",
+			"port", portAssignment.Port, "reassign", s.config.ReassignBusyPorts)
+		if !s.config.ReassignBusyPorts {
+			return nil, fmt.Errorf("port %d is already in use on the server", portAssignment.Port)
+		}
+		if err := s.reassignBusyPort(ctx, tunnel, portAssignment); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create connection session in database
+	clientIP := remoteIP(client)
+	session, connLog, err := s.dbService.StartConnection(ctx,
+		teamToken.TeamID, teamToken.ID, portAssignment.ID,
+		clientIP, portAssignment.Port, tunnel.Protocol, tunnel.BindAddress, idempotencyKey)
+
+	if err != nil {
+		// Log error but don't fail tunnel creation
+		tunnel.logger().Warn("failed to create database session", "error", err)
+	} else {
+		tunnel.SessionID = session.ID.String()
+		if connLog != nil {
+			tunnel.ConnectionLog = connLog.ID.String()
+		}
+		tunnel.logger().Debug("database session created", "session_id", session.ID)
+	}
+
+	// Add to tunnels map, unless a shutdown began while the tunnel was set up
+	s.mu.Lock()
+	if slotHeld {
+		s.releaseTunnelSlot(teamToken.TeamID)
+		slotHeld = false
+	}
+	if s.draining.Load() {
+		s.mu.Unlock()
+		s.discardTunnel(tunnel)
+		return nil, errShuttingDown
+	}
+	s.tunnels[tunnelID] = tunnel
+	s.mu.Unlock()
+
+	s.events.publish(tunnel.tunnelEvent(EventTunnelCreated))
+
+	return tunnel, nil
+}
+
+// errQuotaExceeded is wrapped by errors for requests over a team quota
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// errShuttingDown is returned for tunnels requested while the server shuts down
+var errShuttingDown = errors.New("server is shutting down")
+
+// reserveTunnelSlot fails if the token's team already has as many tunnels on
+// this server as its concurrent tunnel quota allows, counting the tunnels other
+// handshakes are still creating. Otherwise it holds a slot for the tunnel about
+// to be created, so concurrent handshakes cannot all pass the check, and reports
+// true; the caller gives the slot back with releaseTunnelSlot once the tunnel is
+// in s.tunnels or its creation failed. Teams without a quota need no slot.
+func (s *Server) reserveTunnelSlot(teamToken *database.TeamToken) (bool, error) {
+	limit := teamToken.Team.MaxConcurrentTunnels
+	if limit <= 0 {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active := s.reserved[teamToken.TeamID]
+	for _, tunnel := range s.tunnels {
+		if tunnel.TeamID == teamToken.TeamID {
+			active++
+		}
+	}
+
+	if active >= limit {
+		return false, fmt.Errorf("%w: team has reached its limit of %d concurrent tunnels", errQuotaExceeded, limit)
+	}
+	s.reserved[teamToken.TeamID]++
+	return true, nil
+}
+
+// releaseTunnelSlot gives back a slot held by reserveTunnelSlot. s.mu must be held.
+func (s *Server) releaseTunnelSlot(teamID string) {
+	if s.reserved[teamID]--; s.reserved[teamID] <= 0 {
+		delete(s.reserved, teamID)
+	}
+}
+
+// checkDailyConnectionQuota fails if the token's team has already made as many
+// connections today as its daily connection quota allows
+func (s *Server) checkDailyConnectionQuota(ctx context.Context, teamToken *database.TeamToken) error {
+	limit := teamToken.Team.MaxDailyConnections
+	if limit <= 0 {
+		return nil
+	}
+
+	count, err := s.dbService.CountTeamConnectionsToday(ctx, teamToken.TeamID)
+	if err != nil {
+		// Don't lock teams out because the count is unavailable
+		slog.Warn("failed to check daily connection quota", "team_id", teamToken.TeamID, "error", err)
+		return nil
+	}
+	if count >= limit {
+		return fmt.Errorf("%w: team has used its %d connections for today", errQuotaExceeded, limit)
+	}
+	return nil
+}
+
+// maxPortReassignAttempts bounds how many replacement ports are tried for a tunnel
+// whose assigned port is already bound
+const maxPortReassignAttempts = 5
+
+// reassignBusyPort moves the tunnel's port assignment to free ports until one can be
+// listened on, updating portAssignment and the tunnel in place
+func (s *Server) reassignBusyPort(ctx context.Context, tunnel *Tunnel, portAssignment *database.PortAssignment) error {
+	oldPort := portAssignment.Port
+	for attempt := 1; attempt <= maxPortReassignAttempts; attempt++ {
+		reassigned, err := s.dbService.ReassignPort(ctx, portAssignment.ID)
+		if err != nil {
+			return fmt.Errorf("port %d is in use and could not be reassigned: %w", oldPort, err)
+		}
+		*portAssignment = *reassigned
+		tunnel.RemotePort = strconv.Itoa(reassigned.Port)
+
+		err = tunnel.listen()
+		if err == nil {
+			tunnel.logger().Info("reassigned busy port", "old_port", oldPort, "new_port", reassigned.Port)
+			return nil
+		}
+		if !isAddrInUse(err) {
+			return err
+		}
+		tunnel.logger().Warn("reassigned port is also in use", "port", reassigned.Port, "attempt", attempt)
 	}
+	return fmt.Errorf("port %d is in use and no free replacement was found after %d attempts", oldPort, maxPortReassignAttempts)
+}
 
-	// Update tunnel with new client connection
-	tunnel.Client = conn
-	tunnel.LocalPort = localPort
-	// Do NOT reset stopChan here; keep the tunnel running
-	s.mu.Unlock()
+// isAddrInUse reports whether a listen failed because the address is already bound
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
 
-	// Send success response to client
-	fmt.Fprintf(conn, "SUCCESS:%s:%s\n", tunnel.ID, tunnel.RemotePort)
-	if oldClient != nil {
-		log.Printf("🎯 Client connection replaced for tunnel: %s (team:%s, local:%s -> remote:%s)",
-			tunnel.ID, teamToken.Team.Name, localPort, tunnel.RemotePort)
-	} else {
-		log.Printf("🎯 Client reconnected to restored tunnel: %s (team:%s, local:%s -> remote:%s)",
-			tunnel.ID, teamToken.Team.Name, localPort, tunnel.RemotePort)
-	}
+// isAddrNotAvail reports whether a listen failed because no interface on this host
+// has the address
+func isAddrNotAvail(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL)
+}
 
-	// Reactivate the tunnel in database
-	ctx := context.Background()
-	if tunnel.SessionID != "" {
-		sessionID, _ := uuid.Parse(tunnel.SessionID)
-		clientIP := conn.RemoteAddr().(*net.TCPAddr).IP.String()
-		if err := s.dbService.ReactivateRestoredTunnel(ctx, sessionID, clientIP); err != nil {
-			log.Printf("⚠️ Failed to reactivate tunnel in database: %v", err)
-		}
+// bindAddressFor returns the address a port assignment's tunnel listens on: its
+// own bind address if it has one, otherwise the server's
+func (s *Server) bindAddressFor(portAssignment *database.PortAssignment) string {
+	if portAssignment.BindAddress != nil && *portAssignment.BindAddress != "" {
+		return *portAssignment.BindAddress
 	}
-
-	// Start normal tunnel operations
-	tunnel.handleTunnel()
+	return s.config.BindAddress
 }
 
-// handleDataConnection handles a data connection from a client
-func (s *Server) handleDataConnection(conn net.Conn, dataLine string) {
-	// Parse the data line: DATA:connectionID
-	parts := strings.Split(dataLine, ":")
-	if len(parts) < 2 {
-		log.Printf("Invalid data connection format: %s", dataLine)
-		conn.Close()
-		return
+// loopbackAddress is where tunnels meant for same-host consumers only listen
+const loopbackAddress = "127.0.0.1"
+
+// tunnelBindAddress returns the address a tunnel listens on given the bind its
+// client asked for: loopback for protocol.BindLoopback and for every tunnel of a
+// token that may not bind publicly, otherwise the port assignment's address
+// (see bindAddressFor). The handshake has already refused a public bind the token
+// may not have.
+func (s *Server) tunnelBindAddress(teamToken *database.TeamToken, portAssignment *database.PortAssignment, bind string) string {
+	if bind == protocol.BindLoopback || !teamToken.AllowPublicBind {
+		return loopbackAddress
 	}
+	return s.bindAddressFor(portAssignment)
+}
 
-	connID := parts[1]
-	log.Printf("📥 Received data connection for %s", connID)
+// listen opens the tunnel's public listener on its remote port
+func (t *Tunnel) listen() error {
+	address := net.JoinHostPort(t.BindAddress, t.RemotePort)
 
-	// Find the pending connection
-	s.mu.Lock()
-	connChan, exists := s.pendingConns[connID]
-	if !exists {
-		s.mu.Unlock()
-		log.Printf("❌ No pending connection found for %s", connID)
-		conn.Close()
-		return
+	if t.Protocol == "udp" {
+		packetConn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			if isAddrNotAvail(err) {
+				return fmt.Errorf("bind address %s is not assigned to any interface on this server: %w", t.BindAddress, err)
+			}
+			return fmt.Errorf("error creating udp tunnel listener on port %s: %w", t.RemotePort, err)
+		}
+		t.PacketConn = packetConn
+		return nil
 	}
-	s.mu.Unlock()
 
-	// Send the connection to the waiting handler
-	select {
-	case connChan <- conn:
-		log.Printf("✅ Data connection paired for %s", connID)
-	default:
-		log.Printf("❌ Failed to pair data connection for %s", connID)
-		conn.Close()
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		if isAddrNotAvail(err) {
+			return fmt.Errorf("bind address %s is not assigned to any interface on this server: %w", t.BindAddress, err)
+		}
+		return fmt.Errorf("error creating tunnel listener on port %s: %w", t.RemotePort, err)
 	}
+	t.Listener = listener
+	return nil
 }
 
-// createTunnel creates a new tunnel using database-assigned port
-func (s *Server) createTunnel(teamToken *database.TeamToken, portAssignment *database.PortAssignment, localPort string, client net.Conn) (*Tunnel, error) {
-	ctx := context.Background()
-
-	// Generate random tunnel ID
-	tunnelID, err := generateTunnelID()
-	if err != nil {
-		return nil, fmt.Errorf("error generating tunnel ID: %v", err)
+// closeListener closes the tunnel's public listener
+func (t *Tunnel) closeListener() {
+	if t.Listener != nil {
+		t.Listener.Close()
+	}
+	if t.PacketConn != nil {
+		t.PacketConn.Close()
 	}
+}
 
-	// Use the pre-assigned port from database
-	remotePort := strconv.Itoa(portAssignment.Port)
+// Client returns the tunnel's current control connection, or nil while a restored
+// tunnel waits for its client
+func (t *Tunnel) Client() *controlConn {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.client
+}
 
-	// Create listener for the tunnel on the assigned port
-	listener, err := net.Listen("tcp", net.JoinHostPort(s.config.BindAddress, remotePort))
-	if err != nil {
-		return nil, fmt.Errorf("error creating tunnel listener on port %s: %v", remotePort, err)
+// setClient replaces the tunnel's control connection and local port after the
+// client reconnects, returning the connection it replaced and the data connection
+// requests still waiting on it
+func (t *Tunnel) setClient(client *controlConn, localPort string) (*controlConn, []protocol.NewConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.client
+	t.client = client
+	t.LocalPort = localPort
+
+	awaiting := make([]protocol.NewConn, 0, len(t.awaiting))
+	for _, newConn := range t.awaiting {
+		awaiting = append(awaiting, newConn)
 	}
+	return old, awaiting
+}
 
-	tunnel := &Tunnel{
-		ID:           tunnelID,
-		Token:        teamToken.Token,
-		TeamID:       teamToken.TeamID,
-		TokenID:      teamToken.ID.String(),
-		PortAssignID: portAssignment.ID.String(),
-		LocalPort:    localPort,
-		RemotePort:   remotePort,
-		BindAddress:  s.config.BindAddress,
-		Client:       client,
-		Listener:     listener,
-		CreatedAt:    time.Now(),
-		stopChan:     make(chan struct{}),
-	}
+// setReconnectToken records the reconnect token issued to the tunnel's current client
+func (t *Tunnel) setReconnectToken(reconnectToken string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reconnectToken = reconnectToken
+}
 
-	// Create connection session in database
-	clientIP := client.RemoteAddr().(*net.TCPAddr).IP.String()
-	session, connLog, err := s.dbService.StartConnection(ctx,
-		teamToken.TeamID, teamToken.ID, portAssignment.ID,
-		clientIP, portAssignment.Port, "tcp")
+// heldByOtherClient reports whether a client other than the one presenting
+// reconnectToken is still connected to the tunnel
+func (t *Tunnel) heldByOtherClient(reconnectToken string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.client == nil || t.client.closed.Load() {
+		return false
+	}
+	return reconnectToken == "" || reconnectToken != t.reconnectToken
+}
 
-	if err != nil {
-		// Log error but don't fail tunnel creation
-		log.Printf("⚠️ Failed to create database session: %v", err)
-	} else {
-		tunnel.SessionID = session.ID.String()
-		if connLog != nil {
-			tunnel.ConnectionLog = connLog.ID.String()
-		}
-		log.Printf("📊 Database session created: %s", session.ID)
+// await records a request for a data connection until forget is called, returning
+// the client to send it to. A client that takes over the tunnel in the meantime
+// is sent the request as well.
+func (t *Tunnel) await(newConn protocol.NewConn) *controlConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.awaiting == nil {
+		t.awaiting = make(map[string]protocol.NewConn)
 	}
+	t.awaiting[newConn.ConnID] = newConn
+	return t.client
+}
 
-	// Add to tunnels map
-	s.mu.Lock()
-	s.tunnels[tunnelID] = tunnel
-	s.mu.Unlock()
+// forget drops a request recorded by await
+func (t *Tunnel) forget(connID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.awaiting, connID)
+}
 
-	return tunnel, nil
+// localPort returns the client's local port, which changes when the client reconnects
+func (t *Tunnel) localPort() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.LocalPort
 }
 
 // handleTunnel handles tunnel traffic
 func (t *Tunnel) handleTunnel() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Recovered from panic in tunnel %s: %v", t.ID, r)
+			t.logger().Error("recovered from panic in tunnel", "panic", r)
 		}
 		// Ensure stopChan is closed when client disconnects
 		t.stopOnce.Do(func() { close(t.stopChan) })
 	}()
 
-	defer t.Client.Close()
-	defer t.Listener.Close()
+	defer func() {
+		if client := t.Client(); client != nil {
+			client.Close()
+		}
+	}()
+	defer t.closeListener()
 
 	t.wg.Add(1)
-	go t.acceptConnections()
+	if t.Protocol == "udp" {
+		go t.servePackets()
+	} else {
+		go t.acceptConnections()
+	}
 
 	// Wait for stop signal or client disconnection
 	<-t.stopChan
 
 	// End database session
 	if t.SessionID != "" && t.ConnectionLog != "" {
-		ctx := context.Background()
 		server := getServerFromTunnel(t)
 		if server != nil && server.dbService != nil {
+			ctx, cancel := server.dbContext()
+			defer cancel()
 			sessionID, _ := uuid.Parse(t.SessionID)
 			logID, _ := uuid.Parse(t.ConnectionLog)
-			if err := server.dbService.EndConnection(ctx, sessionID, logID, "closed", nil); err != nil {
-				log.Printf("⚠️ Failed to end database session: %v", err)
+			var reason *string
+			if t.endReason != "" {
+				reason = &t.endReason
+			}
+			if err := server.dbService.EndConnection(ctx, sessionID, logID, "closed", reason); err != nil {
+				t.logger().Warn("failed to end database session", "session_id", t.SessionID, "error", err)
+			}
+		}
+	}
+
+	if t.clientDisconnected.Load() {
+		if server := getServerFromTunnel(t); server != nil && server.dbService != nil {
+			port, _ := strconv.Atoi(t.RemotePort)
+			tokenID, _ := uuid.Parse(t.TokenID)
+			if err := server.dbService.ReleasePortLock(port, tokenID); err != nil {
+				t.logger().Warn("failed to release port lock", "error", err)
 			}
 		}
+		t.logger().Info("tunnel closed by client")
+		return
 	}
 
-	log.Printf("🔚 Tunnel %s finished", t.ID)
+	t.logger().Info("tunnel finished")
 }
 
 // acceptConnections accepts and handles incoming connections on the tunnel port
@@ -572,99 +2006,190 @@ func (t *Tunnel) acceptConnections() {
 			conn, err := t.Listener.Accept()
 			if err != nil {
 				if !strings.Contains(err.Error(), "use of closed network connection") {
-					log.Printf("Error accepting connection on tunnel %s: %v", t.ID, err)
+					t.logger().Error("error accepting connection", "error", err)
 				}
 				return
 			}
 
-			// Apply security validation for external connections
-			server := getServerFromTunnel(t)
-			if server != nil && server.securityMiddleware != nil {
-				if err := server.securityMiddleware.ValidateConnection(conn); err != nil {
-					log.Printf("🚫 External connection rejected for tunnel %s from %s: %v", t.ID, conn.RemoteAddr(), err)
-					conn.Close()
-					continue
-				}
-				// Wrap with security features
-				conn = server.securityMiddleware.WrapConnection(conn)
-			}
-
 			t.wg.Add(1)
-			go t.handleConnection(conn)
+			go t.admitConnection(conn)
+		}
+	}
+}
+
+// admitConnection applies security validation to an external connection and
+// hands it to handleConnection. It runs off the accept loop because validation
+// may wait on Redis.
+func (t *Tunnel) admitConnection(conn net.Conn) {
+	server := getServerFromTunnel(t)
+	if server != nil {
+		server.setNoDelay(conn)
+	}
+	if server != nil && server.securityMiddleware != nil {
+		if err := server.securityMiddleware.ValidateConnection(conn); err != nil {
+			t.logger().Warn("external connection rejected", "client_ip", remoteIP(conn), "error", err)
+			conn.Close()
+			t.wg.Done()
+			return
 		}
+		// Wrap with security features
+		conn = server.securityMiddleware.WrapConnection(conn)
 	}
+
+	t.handleConnection(conn)
 }
 
 // handleConnection handles a single tunnel connection
 func (t *Tunnel) handleConnection(externalConn net.Conn) {
 	defer t.wg.Done()
 	defer externalConn.Close()
+	t.trackConn(externalConn)
+	defer t.untrackConn(externalConn)
+
+	// External peers owe the server no handshake; a protocol where the server
+	// speaks first can leave them silent for as long as they like
+	completeHandshake(externalConn)
 
 	// Extract client connection details
-	clientAddr := externalConn.RemoteAddr().(*net.TCPAddr)
-	clientIP := clientAddr.IP.String()
-	clientPort := clientAddr.Port
+	clientIP, clientPort := remoteEndpoint(externalConn)
+
+	var limit int
+	if s := getServerFromTunnel(t); s != nil {
+		limit = s.settings().MaxConnsPerTunnel
+	}
+	done, ok := t.tryTrackActivity(limit)
+	if !ok {
+		t.logger().Warn("external connection rejected: tunnel at connection limit", "client_ip", clientIP, "limit", limit)
+		if peeked, isHTTP := externalConn.(*peekedConn); isHTTP && !peeked.isTLS {
+			writeHTTPError(peeked.Conn, http.StatusServiceUnavailable, "tunnel connection limit reached")
+		}
+		t.logConnectionAttempt(clientIP, clientPort, "error", "per-tunnel limit")
+		return
+	}
+	defer done()
 
-	log.Printf("🔌 New connection to tunnel %s from %s:%d", t.ID, clientIP, clientPort)
+	t.logger().Debug("new external connection", "client_ip", clientIP, "client_port", clientPort)
 
-	// Send connect notification to client via control connection
-	_, err := fmt.Fprintf(t.Client, "CONNECT\n")
-	if err != nil {
-		log.Printf("Error sending connect notification: %v", err)
-		// Log failed connection attempt
-		t.logConnectionAttempt(clientIP, clientPort, "error", fmt.Sprintf("Control connection error: %v", err))
+	dataConn, connID, ok := t.requestDataConnection(clientIP, clientPort, externalConn.LocalAddr())
+	if !ok {
 		return
 	}
 
-	// Wait for client to establish data connection
+	t.logger().Debug("data connection established", "conn_id", connID)
+
+	// Create a connection log entry for this specific connection
+	connectionLogID := t.createConnectionLog(clientIP, clientPort)
+
+	// Bridge the connections and track statistics
+	var compression string
+	if client := t.Client(); client != nil {
+		compression = client.compression
+	}
+	t.bridgeConnectionsWithLogging(externalConn, dataConn, compression, connectionLogID)
+}
+
+// trackConn records an external connection until untrackConn is called
+func (t *Tunnel) trackConn(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.externalConns == nil {
+		t.externalConns = make(map[net.Conn]struct{})
+	}
+	t.externalConns[conn] = struct{}{}
+}
+
+// untrackConn drops a connection recorded by trackConn
+func (t *Tunnel) untrackConn(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.externalConns, conn)
+}
+
+// closeConnections closes every external connection the tunnel is handling,
+// which ends their bridges
+func (t *Tunnel) closeConnections() {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for conn := range t.externalConns {
+		conn.Close()
+	}
+}
+
+// completeHandshake lifts the security middleware's handshake deadline from an
+// external connection, looking through the replay wrapper of routed HTTP connections
+func completeHandshake(conn net.Conn) {
+	if peeked, ok := conn.(*peekedConn); ok {
+		conn = peeked.Conn
+	}
+	middleware.CompleteHandshake(conn)
+}
+
+// requestDataConnection asks the client to open a data connection for a new external
+// peer that reached the tunnel at serverAddr, and waits for it to arrive. Failures
+// are logged against the connection logs.
+func (t *Tunnel) requestDataConnection(clientIP string, clientPort int, serverAddr net.Addr) (net.Conn, string, bool) {
 	s := getServerFromTunnel(t)
 	if s == nil {
-		log.Printf("Could not get server reference")
+		t.logger().Error("could not get server reference")
 		t.logConnectionAttempt(clientIP, clientPort, "error", "No server reference available")
-		return
+		return nil, "", false
+	}
+
+	connID, err := generateConnID(t.ID, atomic.AddUint64(&s.connSeq, 1))
+	if err != nil {
+		t.logger().Error("failed to generate connection id", "error", err)
+		t.logConnectionAttempt(clientIP, clientPort, "error", fmt.Sprintf("Failed to generate connection ID: %v", err))
+		return nil, "", false
 	}
 
 	// Create a channel for this specific connection
 	connChan := make(chan net.Conn, 1)
-	connID := fmt.Sprintf("%s-%d", t.ID, time.Now().UnixNano())
-
-	s.mu.Lock()
-	s.pendingConns[connID] = connChan
-	s.mu.Unlock()
-
-	// Send the connection ID to the client
-	_, err = fmt.Fprintf(t.Client, "CONN_ID:%s\n", connID)
+	s.pendingConns.add(connID, connChan)
+
+	// Ask the client to open a data connection for this peer
+	remotePort, _ := strconv.Atoi(t.RemotePort)
+	newConn := protocol.NewConn{
+		ConnID:     connID,
+		RemotePort: remotePort,
+		ClientAddr: net.JoinHostPort(clientIP, strconv.Itoa(clientPort)),
+		ServerAddr: serverAddr.String(),
+	}
+	defer t.forget(connID)
+	err = errors.New("client not connected")
+	if client := t.await(newConn); client != nil {
+		err = client.writeMessage(protocol.MsgNewConn, newConn)
+		if err != nil && t.Client() != client {
+			// The client was replaced mid-send; the new one has been sent the request
+			t.logger().Info("connection request handed off to new client", "conn_id", connID, "error", err)
+			err = nil
+		}
+	}
 	if err != nil {
-		log.Printf("Error sending connection ID: %v", err)
-		s.mu.Lock()
-		delete(s.pendingConns, connID)
-		s.mu.Unlock()
-		t.logConnectionAttempt(clientIP, clientPort, "error", fmt.Sprintf("Connection ID send error: %v", err))
-		return
+		t.logger().Warn("error sending connection request", "conn_id", connID, "error", err)
+		if dataConn := s.cancelPendingConn(connID, connChan); dataConn != nil {
+			dataConn.Close()
+		}
+		t.logConnectionAttempt(clientIP, clientPort, "error", fmt.Sprintf("Control connection error: %v", err))
+		return nil, connID, false
 	}
 
 	// Wait for data connection with timeout
+	timeout := s.settings().DataConnTimeout
 	select {
 	case dataConn := <-connChan:
-		// Clean up the pending connection
-		s.mu.Lock()
-		delete(s.pendingConns, connID)
-		s.mu.Unlock()
+		// handleDataConnection already removed the pending entry
+		return dataConn, connID, true
 
-		log.Printf("🔄 Data connection established for %s", connID)
-
-		// Create a connection log entry for this specific connection
-		connectionLogID := t.createConnectionLog(clientIP, clientPort)
-
-		// Bridge the connections and track statistics
-		t.bridgeConnectionsWithLogging(externalConn, dataConn, connectionLogID)
-
-	case <-time.After(10 * time.Second):
-		log.Printf("⏰ Timeout waiting for data connection for %s", connID)
-		s.mu.Lock()
-		delete(s.pendingConns, connID)
-		s.mu.Unlock()
-		t.logConnectionAttempt(clientIP, clientPort, "timeout", "Timeout waiting for data connection")
+	case <-time.After(timeout):
+		// The data connection may have been claimed just as the timer fired
+		if dataConn := s.cancelPendingConn(connID, connChan); dataConn != nil {
+			return dataConn, connID, true
+		}
+		t.logger().Warn("timeout waiting for data connection",
+			"conn_id", connID, "client_ip", clientIP, "timeout", timeout.String())
+		t.logConnectionAttempt(clientIP, clientPort, "timeout",
+			fmt.Sprintf("Timeout waiting for data connection after %s", timeout))
+		return nil, connID, false
 	}
 }
 
@@ -679,11 +2204,12 @@ func (t *Tunnel) logConnectionAttempt(clientIP string, clientPort int, status st
 		return // Skip if we don't have proper IDs
 	}
 
-	ctx := context.Background()
 	server := getServerFromTunnel(t)
 	if server == nil || server.dbService == nil {
 		return
 	}
+	ctx, cancel := server.dbContext()
+	defer cancel()
 
 	tokenID, _ := uuid.Parse(t.TokenID)
 	portAssignID, _ := uuid.Parse(t.PortAssignID)
@@ -692,10 +2218,10 @@ func (t *Tunnel) logConnectionAttempt(clientIP string, clientPort int, status st
 
 	// Create connection log through service
 	session, connLog, err := server.dbService.StartConnection(ctx, t.TeamID, tokenID, portAssignID,
-		clientIP, serverPort, "tcp")
+		clientIP, serverPort, t.Protocol, t.BindAddress, "")
 
 	if err != nil {
-		log.Printf("⚠️ Failed to log connection attempt: %v", err)
+		t.logger().Warn("failed to log connection attempt", "client_ip", clientIP, "error", err)
 		return
 	}
 
@@ -706,9 +2232,9 @@ func (t *Tunnel) logConnectionAttempt(clientIP string, clientPort int, status st
 			errorMessage = &errorMsg
 		}
 		if err := server.dbService.EndConnection(ctx, session.ID, connLog.ID, status, errorMessage); err != nil {
-			log.Printf("⚠️ Failed to end failed connection log: %v", err)
+			t.logger().Warn("failed to end failed connection log", "client_ip", clientIP, "error", err)
 		}
-		log.Printf("📝 Logged connection attempt from %s:%d - %s", clientIP, clientPort, status)
+		t.logger().Debug("logged connection attempt", "client_ip", clientIP, "client_port", clientPort, "status", status)
 	}
 }
 
@@ -718,11 +2244,12 @@ func (t *Tunnel) createConnectionLog(clientIP string, clientPort int) uuid.UUID
 		return uuid.Nil
 	}
 
-	ctx := context.Background()
 	server := getServerFromTunnel(t)
 	if server == nil || server.dbService == nil {
 		return uuid.Nil
 	}
+	ctx, cancel := server.dbContext()
+	defer cancel()
 
 	tokenID, _ := uuid.Parse(t.TokenID)
 	portAssignID, _ := uuid.Parse(t.PortAssignID)
@@ -731,55 +2258,142 @@ func (t *Tunnel) createConnectionLog(clientIP string, clientPort int) uuid.UUID
 
 	// Create connection log through service
 	_, connLog, err := server.dbService.StartConnection(ctx, t.TeamID, tokenID, portAssignID,
-		clientIP, serverPort, "tcp")
+		clientIP, serverPort, t.Protocol, t.BindAddress, "")
 
 	if err != nil || connLog == nil {
-		log.Printf("⚠️ Failed to create connection log: %v", err)
+		t.logger().Warn("failed to create connection log", "client_ip", clientIP, "error", err)
 		return uuid.Nil
 	}
 
-	log.Printf("📊 Created connection log: %s (client: %s:%d)", connLog.ID, clientIP, clientPort)
+	t.logger().Debug("created connection log", "connection_log_id", connLog.ID, "client_ip", clientIP, "client_port", clientPort)
 	return connLog.ID
 }
 
-// bridgeConnectionsWithLogging bridges two connections bidirectionally with detailed logging
-func (t *Tunnel) bridgeConnectionsWithLogging(conn1, conn2 net.Conn, connectionLogID uuid.UUID) {
+// bridgeConnectionsWithLogging bridges two connections bidirectionally with detailed
+// logging. The data connection conn2 is compressed when compression is set.
+func (t *Tunnel) bridgeConnectionsWithLogging(conn1, conn2 net.Conn, compression string, connectionLogID uuid.UUID) {
 	defer conn1.Close()
 	defer conn2.Close()
 
+	var data io.ReadWriter = conn2
+	var stream *protocol.CompressedStream
+	if compression != "" {
+		var err error
+		stream, err = protocol.NewCompressedStream(conn2, compression)
+		if err != nil {
+			t.logger().Warn("failed to set up compression", "compression", compression, "error", err)
+			return
+		}
+		data = stream
+	}
+
 	startTime := time.Now()
-	done := make(chan struct{}, 2)
 	var bytesReceived, bytesSent int64
 	var bridgeErr error
+	var errMu sync.Mutex
+
+	// Once either direction ends, both connections are closed so the other copy
+	// returns too. Errors caused by that close are not failures of the bridge.
+	var closing atomic.Bool
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			closing.Store(true)
+			conn1.Close()
+			conn2.Close()
+		})
+	}
+	recordErr := func(err error) {
+		if err == nil || err == io.EOF || closing.Load() {
+			return
+		}
+		errMu.Lock()
+		if bridgeErr == nil {
+			bridgeErr = err
+		}
+		errMu.Unlock()
+	}
 
 	// Track connection start
-	log.Printf("🌉 Starting bridge for tunnel %s (log: %s)", t.ID, connectionLogID)
+	t.logger().Debug("starting bridge", "connection_log_id", connectionLogID)
+	clientIP := remoteIP(conn1)
+	opened := t.tunnelEvent(EventConnectionOpened)
+	opened.ClientIP = clientIP
+	t.publishEvent(opened)
+
+	var buffers *bufferPool
+	var accessLog *accessLog
+	var detectHTTP bool
+	if s := getServerFromTunnel(t); s != nil {
+		buffers = s.buffers
+		accessLog = s.accessLog
+		detectHTTP = s.config.DetectHTTP
+	}
+
+	// Peek at the first bytes the external peer sends; they are replayed to the
+	// bridge from the buffer. When they start an HTTP request, the connection is
+	// logged as http with the request's path and user agent, and with an access
+	// log configured every request on the connection is logged.
+	var external io.Reader = conn1
+	var sniffer *bufio.Reader
+	if detectHTTP || accessLog != nil {
+		sniffer = bufio.NewReader(conn1)
+		external = sniffer
+	}
+	var requestPath, userAgent *string
+	var observer atomic.Pointer[httpObserver]
+
+	var wg sync.WaitGroup
+	wg.Add(2)
 
 	go func() {
-		defer func() { done <- struct{}{} }()
-		n, err := io.Copy(conn1, conn2)
+		defer wg.Done()
+		defer closeBoth()
+		src := observeResponses(data, &observer)
+		n, err := buffers.copy(conn1, countReader(limitReader(src, t.outboundLimiter), &t.bytesReceived))
 		bytesReceived = n
 		if err != nil && err != io.EOF {
-			bridgeErr = err
-			log.Printf("Error copying to conn1: %v", err)
+			t.logger().Debug("error copying to external connection", "error", err)
 		}
+		recordErr(err)
 	}()
 
 	go func() {
-		defer func() { done <- struct{}{} }()
-		n, err := io.Copy(conn2, conn1)
+		defer wg.Done()
+		defer closeBoth()
+		src := external
+		if sniffer != nil {
+			if _, err := sniffer.Peek(1); err == nil {
+				head, _ := sniffer.Peek(sniffer.Buffered())
+				if path, agent, ok := sniffHTTPRequest(head); ok {
+					if detectHTTP {
+						requestPath = &path
+						if agent != "" {
+							userAgent = &agent
+						}
+					}
+					if accessLog != nil {
+						o := newHTTPObserver(accessLog, clientIP)
+						observer.Store(o)
+						src = o.requestReader(src)
+					}
+				}
+			}
+		}
+		n, err := buffers.copy(data, countReader(limitReader(src, t.inboundLimiter), &t.bytesSent))
 		bytesSent = n
 		if err != nil && err != io.EOF {
-			if bridgeErr == nil {
-				bridgeErr = err
-			}
-			log.Printf("Error copying to conn2: %v", err)
+			t.logger().Debug("error copying to data connection", "error", err)
 		}
+		recordErr(err)
 	}()
 
-	// Wait for one direction to finish
-	<-done
+	// Wait for both directions, so the byte counts are final
+	wg.Wait()
 	duration := time.Since(startTime)
+	if o := observer.Load(); o != nil {
+		o.close()
+	}
 
 	// Determine final status
 	status := "closed"
@@ -790,27 +2404,184 @@ func (t *Tunnel) bridgeConnectionsWithLogging(conn1, conn2 net.Conn, connectionL
 		errorMessage = &errMsg
 	}
 
-	// Update session activity and end the connection log
-	if t.SessionID != "" && connectionLogID != uuid.Nil {
-		ctx := context.Background()
-		server := getServerFromTunnel(t)
-		if server != nil && server.dbService != nil {
-			sessionID, _ := uuid.Parse(t.SessionID)
+	wireReceived, wireSent := bytesReceived, bytesSent
+	if stream != nil {
+		wireReceived, wireSent = stream.WireBytesRead(), stream.WireBytesWritten()
+	}
 
-			// Update connection activity (this will update stats)
-			if err := server.dbService.UpdateConnectionActivity(ctx, sessionID, connectionLogID, bytesReceived, bytesSent); err != nil {
-				log.Printf("⚠️ Failed to update session activity: %v", err)
-			}
+	protocol := "tcp"
+	if requestPath != nil {
+		protocol = "http"
+	}
+	t.recordConnectionResult(connectionLogID, bytesReceived, bytesSent, wireReceived, wireSent, status, errorMessage, userAgent, requestPath)
+
+	t.logger().Info("bridge finished", "connection_log_id", connectionLogID, "protocol", protocol, "duration_ms", duration.Milliseconds(),
+		"bytes_sent", bytesSent, "bytes_received", bytesReceived,
+		"wire_bytes_sent", wireSent, "wire_bytes_received", wireReceived, "status", status)
+
+	closed := t.tunnelEvent(EventConnectionClosed)
+	closed.ClientIP = clientIP
+	closed.BytesSent = bytesSent
+	closed.BytesReceived = bytesReceived
+	closed.DurationMs = duration.Milliseconds()
+	closed.Status = status
+	t.publishEvent(closed)
+}
 
-			// End the connection
-			if err := server.dbService.EndConnection(ctx, sessionID, connectionLogID, status, errorMessage); err != nil {
-				log.Printf("⚠️ Failed to end connection: %v", err)
-			}
+// countingReader adds every byte read through it to a running total
+type countingReader struct {
+	reader io.Reader
+	total  *atomic.Int64
+}
+
+// countReader wraps r so the bytes read from it are added to total as they flow
+func countReader(r io.Reader, total *atomic.Int64) io.Reader {
+	return &countingReader{reader: r, total: total}
+}
+
+// Read implements io.Reader
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.total.Add(int64(n))
+	return n, err
+}
+
+// TunnelStatus is a point-in-time view of a live tunnel
+type TunnelStatus struct {
+	TunnelID          string    `json:"tunnel_id"`
+	TeamID            string    `json:"team_id"`
+	TokenID           string    `json:"token_id"`
+	RemotePort        string    `json:"remote_port"`
+	BindAddress       string    `json:"bind_address"`
+	LocalPort         string    `json:"local_port"`
+	Protocol          string    `json:"protocol"`
+	Subdomain         string    `json:"subdomain,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	ClientConnected   bool      `json:"client_connected"`
+	ClientIP          string    `json:"client_ip,omitempty"`
+	ActiveConnections int32     `json:"active_connections"`
+	BytesSent         int64     `json:"bytes_sent"`     // External peers → client
+	BytesReceived     int64     `json:"bytes_received"` // Client → external peers
+}
+
+// ListTunnels returns a snapshot of the live tunnels, oldest first. Restored
+// tunnels whose client has not reconnected yet report ClientConnected false.
+func (s *Server) ListTunnels() []TunnelStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tunnels := make([]TunnelStatus, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		status := TunnelStatus{
+			TunnelID:          t.ID,
+			TeamID:            t.TeamID,
+			TokenID:           t.TokenID,
+			RemotePort:        t.RemotePort,
+			BindAddress:       t.BindAddress,
+			LocalPort:         t.localPort(),
+			Protocol:          t.Protocol,
+			Subdomain:         t.Subdomain,
+			CreatedAt:         t.CreatedAt,
+			ActiveConnections: t.activeConns.Load(),
+			BytesSent:         t.bytesSent.Load(),
+			BytesReceived:     t.bytesReceived.Load(),
+		}
+		if client := t.Client(); client != nil {
+			status.ClientConnected = true
+			status.ClientIP = remoteIP(client)
+		}
+		tunnels = append(tunnels, status)
+	}
+
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].CreatedAt.Before(tunnels[j].CreatedAt)
+	})
+	return tunnels
+}
+
+// trackActivity marks a connection as active for the idle timeout and returns a
+// function that marks it finished
+func (t *Tunnel) trackActivity() func() {
+	done, _ := t.tryTrackActivity(0)
+	return done
+}
+
+// tryTrackActivity is trackActivity for a tunnel limited to limit active connections
+// (0 = unlimited). At the limit it tracks nothing and reports false.
+func (t *Tunnel) tryTrackActivity(limit int) (func(), bool) {
+	for {
+		n := t.activeConns.Load()
+		if limit > 0 && int(n) >= limit {
+			return nil, false
 		}
+		if t.activeConns.CompareAndSwap(n, n+1) {
+			break
+		}
+	}
+	t.lastActivity.Store(time.Now().UnixNano())
+	return func() {
+		t.lastActivity.Store(time.Now().UnixNano())
+		t.activeConns.Add(-1)
+	}, true
+}
+
+// idleFor returns how long the tunnel has had no active connections, or zero while
+// a connection is being handled
+func (t *Tunnel) idleFor(now time.Time) time.Duration {
+	if t.activeConns.Load() > 0 {
+		return 0
+	}
+	last := t.CreatedAt
+	if nanos := t.lastActivity.Load(); nanos != 0 {
+		last = time.Unix(0, nanos)
+	}
+	return now.Sub(last)
+}
+
+// applyPortAssignment takes the assignment's subdomain and bandwidth cap
+func (t *Tunnel) applyPortAssignment(portAssignment *database.PortAssignment) {
+	if portAssignment.Subdomain != nil {
+		t.Subdomain = *portAssignment.Subdomain
+	}
+	t.setRateLimit(portAssignment.RateLimitBPS)
+}
+
+// setRateLimit caps the tunnel's throughput in each direction to bytesPerSecond (0 = unlimited)
+func (t *Tunnel) setRateLimit(bytesPerSecond int64) {
+	t.inboundLimiter = newBandwidthLimiter(bytesPerSecond)
+	t.outboundLimiter = newBandwidthLimiter(bytesPerSecond)
+	if bytesPerSecond > 0 {
+		t.logger().Info("tunnel bandwidth limited", "bytes_per_second", bytesPerSecond)
 	}
+}
 
-	log.Printf("📊 Bridge finished for tunnel %s - Duration: %v, Sent: %d bytes, Received: %d bytes, Status: %s",
-		t.ID, duration, bytesSent, bytesReceived, status)
+// recordConnectionResult queues the final byte counts and status of a bridged
+// connection, and its first HTTP request when it carried one, to be written to its
+// connection log. The wire counts are what crossed the data connection, which is
+// less than the byte counts when the connection was compressed.
+func (t *Tunnel) recordConnectionResult(connectionLogID uuid.UUID, bytesReceived, bytesSent, wireReceived, wireSent int64, status string, errorMessage, userAgent, requestPath *string) {
+	if t.SessionID == "" || connectionLogID == uuid.Nil {
+		return
+	}
+	server := getServerFromTunnel(t)
+	if server == nil || server.connLogs == nil {
+		return
+	}
+	sessionID, _ := uuid.Parse(t.SessionID)
+
+	server.connLogs.enqueue(database.ConnectionResult{
+		SessionID:         sessionID,
+		LogID:             connectionLogID,
+		EndedAt:           time.Now(),
+		BytesReceived:     bytesReceived,
+		BytesSent:         bytesSent,
+		WireBytesReceived: wireReceived,
+		WireBytesSent:     wireSent,
+		Status:            status,
+		ErrorMessage:      errorMessage,
+		UserAgent:         userAgent,
+		RequestPath:       requestPath,
+	})
 }
 
 // Helper function to get server reference from tunnel
@@ -822,18 +2593,55 @@ func getServerFromTunnel(_ *Tunnel) *Server {
 
 // stopTunnel stops a tunnel
 func (s *Server) stopTunnel(tunnel *Tunnel) {
-	tunnel.stopOnce.Do(func() { close(tunnel.stopChan) })
-	if tunnel.Listener != nil {
-		tunnel.Listener.Close()
-	}
-	if tunnel.Client != nil {
-		tunnel.Client.Close()
+	s.stopTunnelWithReason(tunnel, "")
+}
+
+// stopTunnelWithReason stops a tunnel, recording why its session ended
+func (s *Server) stopTunnelWithReason(tunnel *Tunnel, reason string) {
+	tunnel.stopOnce.Do(func() {
+		tunnel.endReason = reason
+		close(tunnel.stopChan)
+	})
+	tunnel.closeListener()
+	if client := tunnel.Client(); client != nil {
+		client.Close()
 	}
 
 	// Wait for all tunnel goroutines to finish
 	tunnel.wg.Wait()
 
+	s.mu.Lock()
+	delete(s.tunnels, tunnel.ID)
+	s.mu.Unlock()
+
+	closed := tunnel.tunnelEvent(EventTunnelClosed)
+	closed.Reason = tunnel.endReason
+	s.events.publish(closed)
+}
+
+// discardTunnel tears down a tunnel that was created but never handed to its client
+func (s *Server) discardTunnel(tunnel *Tunnel) {
+	tunnel.stopOnce.Do(func() { close(tunnel.stopChan) })
+	tunnel.closeListener()
+
+	s.mu.Lock()
 	delete(s.tunnels, tunnel.ID)
+	s.mu.Unlock()
+
+	closed := tunnel.tunnelEvent(EventTunnelClosed)
+	closed.Status = "error"
+	s.events.publish(closed)
+
+	if tunnel.SessionID != "" {
+		sessionID, _ := uuid.Parse(tunnel.SessionID)
+		logID, _ := uuid.Parse(tunnel.ConnectionLog)
+		errorMsg := "tunnel setup failed"
+		ctx, cancel := s.dbContext()
+		defer cancel()
+		if err := s.dbService.EndConnection(ctx, sessionID, logID, "error", &errorMsg); err != nil {
+			tunnel.logger().Warn("failed to end database session", "session_id", tunnel.SessionID, "error", err)
+		}
+	}
 }
 
 // generateTunnelID generates a random tunnel ID
@@ -845,19 +2653,31 @@ func generateTunnelID() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+// generateConnID generates the ID of a pending connection. The sequence number
+// keeps IDs unique; the random suffix keeps anyone who knows the tunnel ID from
+// guessing them and claiming another peer's connection with a data connection.
+func generateConnID(tunnelID string, seq uint64) (string, error) {
+	suffix, err := generateTunnelID()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%s", tunnelID, seq, suffix), nil
+}
+
 // restoreActiveConnections restores tunnel listeners for active connections from the database
 func (s *Server) restoreActiveConnections() error {
-	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(s.ctx, restoreTimeout)
+	defer cancel()
 
-	log.Printf("🔄 Checking for active connections to restore...")
+	slog.Info("checking for active connections to restore")
 
 	// First, cleanup stale sessions (older than 5 minutes)
 	staleThreshold := 5 * time.Minute
 	staleCount, err := s.dbService.CleanupStaleConnections(ctx, staleThreshold)
 	if err != nil {
-		log.Printf("⚠️ Failed to cleanup stale connections: %v", err)
+		slog.Warn("failed to clean up stale connections", "error", err)
 	} else if staleCount > 0 {
-		log.Printf("🧹 Cleaned up %d stale connection sessions", staleCount)
+		slog.Info("cleaned up stale connection sessions", "count", staleCount)
 	}
 
 	// Get active sessions grouped by port
@@ -867,7 +2687,7 @@ func (s *Server) restoreActiveConnections() error {
 	}
 
 	if len(portSessions) == 0 {
-		log.Printf("ℹ️ No active connections found to restore")
+		slog.Info("no active connections found to restore")
 		return nil
 	}
 
@@ -880,14 +2700,14 @@ func (s *Server) restoreActiveConnections() error {
 			// Get full session details including token and port assignment
 			sessionDetail, token, portAssignment, err := s.dbService.GetSessionWithDetails(ctx, session.ID)
 			if err != nil {
-				log.Printf("⚠️ Failed to get session details for port %d: %v", port, err)
+				slog.Warn("failed to get session details", "port", port, "error", err)
 				continue
 			}
 
 			// Create a restored tunnel listener for this port
 			err = s.createRestoredTunnelListener(sessionDetail, token, portAssignment)
 			if err != nil {
-				log.Printf("⚠️ Failed to restore tunnel listener on port %d: %v", port, err)
+				slog.Warn("failed to restore tunnel listener", "port", port, "error", err)
 				// Mark the session as inactive since we couldn't restore it
 				errorMsg := fmt.Sprintf("Failed to restore listener: %v", err)
 				s.dbService.EndConnection(ctx, session.ID, uuid.Nil, "error", &errorMsg)
@@ -895,12 +2715,12 @@ func (s *Server) restoreActiveConnections() error {
 			}
 
 			restoredCount++
-			log.Printf("✅ Restored tunnel listener on port %d (sessions: %d)", port, len(sessions))
+			slog.Info("restored tunnel listener", "port", port, "sessions", len(sessions))
 		}
 	}
 
 	if restoredCount > 0 {
-		log.Printf("🎉 Successfully restored %d tunnel listeners from %d active sessions", restoredCount, len(portSessions))
+		slog.Info("restored tunnel listeners", "count", restoredCount, "sessions", len(portSessions))
 	}
 
 	return nil
@@ -914,12 +2734,6 @@ func (s *Server) createRestoredTunnelListener(session *database.ConnectionSessio
 		return fmt.Errorf("failed to generate tunnel ID: %w", err)
 	}
 
-	// Create listener on the assigned port
-	listener, err := net.Listen("tcp", net.JoinHostPort(s.config.BindAddress, strconv.Itoa(portAssignment.Port)))
-	if err != nil {
-		return fmt.Errorf("failed to create listener on port %d: %w", portAssignment.Port, err)
-	}
-
 	// Create a restored tunnel object that can accept new client connections
 	tunnel := &Tunnel{
 		ID:           tunnelID,
@@ -929,22 +2743,43 @@ func (s *Server) createRestoredTunnelListener(session *database.ConnectionSessio
 		PortAssignID: portAssignment.ID.String(),
 		LocalPort:    "restored",
 		RemotePort:   strconv.Itoa(portAssignment.Port),
-		BindAddress:  s.config.BindAddress,
-		Client:       nil, // No client connection for restored tunnels initially
-		Listener:     listener,
+		BindAddress:  s.tunnelBindAddress(token, portAssignment, ""),
+		Protocol:     portAssignment.Protocol,
+		client:       nil, // No client connection for restored tunnels initially
 		CreatedAt:    time.Now(),
 		stopChan:     make(chan struct{}),
 		SessionID:    session.ID.String(),
 	}
+	// Listen where the session's tunnel did, e.g. on loopback only
+	if session.BindAddress != nil && token.AllowPublicBind {
+		tunnel.BindAddress = *session.BindAddress
+	}
+	tunnel.applyPortAssignment(portAssignment)
+
+	// Create listener on the assigned port. A port taken by another process is not
+	// reassigned here; that happens when the client reconnects and its tunnel is created.
+	if err := tunnel.listen(); err != nil {
+		if isAddrInUse(err) {
+			tunnel.logger().Warn("restored port is already bound by another process", "port", portAssignment.Port)
+		}
+		return fmt.Errorf("failed to create listener on port %d: %w", portAssignment.Port, err)
+	}
 
 	// Add to tunnels map
 	s.mu.Lock()
 	s.tunnels[tunnelID] = tunnel
 	s.mu.Unlock()
 
-	// Start accepting connections on the restored listener
-	tunnel.wg.Add(1)
-	go tunnel.acceptRestoredConnections(s)
+	created := tunnel.tunnelEvent(EventTunnelCreated)
+	created.Status = "restored"
+	s.events.publish(created)
+
+	// Start accepting connections on the restored listener. Datagrams sent to a
+	// restored udp port simply wait in the socket buffer until the client returns.
+	if tunnel.Protocol != "udp" {
+		tunnel.wg.Add(1)
+		go tunnel.acceptRestoredConnections(s)
+	}
 
 	return nil
 }
@@ -953,7 +2788,7 @@ func (s *Server) createRestoredTunnelListener(session *database.ConnectionSessio
 func (t *Tunnel) acceptRestoredConnections(_ *Server) {
 	defer t.wg.Done()
 
-	log.Printf("🎧 Restored port %s listening for external connections (waiting for client reconnection)", t.RemotePort)
+	t.logger().Info("restored port listening, waiting for client reconnection")
 
 	for {
 		select {
@@ -963,34 +2798,34 @@ func (t *Tunnel) acceptRestoredConnections(_ *Server) {
 			conn, err := t.Listener.Accept()
 			if err != nil {
 				if !strings.Contains(err.Error(), "use of closed network connection") {
-					log.Printf("Error accepting connection on restored tunnel %s: %v", t.ID, err)
+					t.logger().Error("error accepting connection on restored tunnel", "error", err)
 				}
 				return
 			}
 
-			// Apply security validation for external connections to restored ports
-			server := getServerFromTunnel(t)
-			if server != nil && server.securityMiddleware != nil {
-				if err := server.securityMiddleware.ValidateConnection(conn); err != nil {
-					log.Printf("🚫 External connection rejected for restored port %s from %s: %v", t.RemotePort, conn.RemoteAddr(), err)
-					conn.Close()
-					continue
+			go func(c net.Conn) {
+				// Apply security validation for external connections to restored
+				// ports, off the accept loop as it may wait on Redis
+				server := getServerFromTunnel(t)
+				if server != nil && server.securityMiddleware != nil {
+					if err := server.securityMiddleware.ValidateConnection(c); err != nil {
+						t.logger().Warn("external connection to restored port rejected", "client_ip", remoteIP(c), "error", err)
+						c.Close()
+						return
+					}
+					// Wrap with security features
+					c = server.securityMiddleware.WrapConnection(c)
 				}
-				// Wrap with security features
-				conn = server.securityMiddleware.WrapConnection(conn)
-			}
+				defer c.Close()
 
-			// For restored tunnels without clients, just send helpful message
-			clientAddr := conn.RemoteAddr().(*net.TCPAddr)
-			log.Printf("🌐 External connection attempt to restored port %s from %s:%d",
-				t.RemotePort, clientAddr.IP.String(), clientAddr.Port)
+				// For restored tunnels without clients, just send helpful message
+				clientIP, clientPort := remoteEndpoint(c)
+				t.logger().Info("external connection to restored port without client", "client_ip", clientIP, "client_port", clientPort)
 
-			go func(c net.Conn) {
-				defer c.Close()
 				t.sendRestoredPortMessage(c)
 
 				// Log the external connection attempt
-				t.logConnectionAttempt(clientAddr.IP.String(), clientAddr.Port, "closed",
+				t.logConnectionAttempt(clientIP, clientPort, "closed",
 					"External connection to restored port - waiting for tunnel client reconnection")
 			}(conn)
 		}
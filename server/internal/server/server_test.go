@@ -0,0 +1,336 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"rabbit.go/internal/database"
+	"rabbit.go/internal/middleware"
+	"rabbit.go/protocol"
+)
+
+// newTestTunnel sets up a server with an in-memory pending registry and a tunnel
+// whose client is the returned end of a pipe. The server is installed as
+// globalServer until the test ends.
+func newTestTunnel(t testing.TB, dataConnTimeout time.Duration) (*Server, *Tunnel, net.Conn) {
+	t.Helper()
+
+	s := &Server{
+		config:       Config{DataConnTimeout: dataConnTimeout, InstanceID: "test"},
+		tunnels:      make(map[string]*Tunnel),
+		opening:      make(map[tunnelKey]bool),
+		reserved:     make(map[string]int),
+		pendingConns: newMemoryPendingRegistry(),
+		events:       newEventBus(),
+		stopChan:     make(chan struct{}),
+	}
+	previous := globalServer
+	globalServer = s
+	t.Cleanup(func() { globalServer = previous })
+
+	serverEnd, clientEnd := net.Pipe()
+	t.Cleanup(func() {
+		serverEnd.Close()
+		clientEnd.Close()
+	})
+
+	tunnel := &Tunnel{
+		ID:         "tunnel",
+		RemotePort: "10000",
+		Protocol:   "tcp",
+		client:     newControlConn(serverEnd, time.Second),
+		stopChan:   make(chan struct{}),
+	}
+	return s, tunnel, clientEnd
+}
+
+// bridgeAsymmetric bridges an external peer sending toClient bytes with a client
+// sending toExternal bytes back, checks each side got exactly what the other
+// sent, and returns the connection result the bridge queued
+func bridgeAsymmetric(t *testing.T, compression string, toClient, toExternal []byte) database.ConnectionResult {
+	t.Helper()
+
+	s, tunnel, _ := newTestTunnel(t, time.Second)
+	tunnel.SessionID = uuid.NewString()
+	s.connLogs = &connLogWriter{queue: make(chan database.ConnectionResult, 1)}
+
+	external, externalPeer := net.Pipe()
+	data, dataPeer := net.Pipe()
+
+	// The client reads everything the external peer sent, answers, and drains the
+	// data connection until the bridge closes it. net.Pipe does not buffer, so a
+	// compressed stream's flush marker is only written once it is read.
+	clientDone := make(chan []byte, 1)
+	go func() {
+		defer dataPeer.Close()
+		var stream io.ReadWriter = dataPeer
+		if compression != "" {
+			stream, _ = protocol.NewCompressedStream(dataPeer, compression)
+		}
+		got := make([]byte, len(toClient))
+		if _, err := io.ReadFull(stream, got); err != nil {
+			t.Errorf("client read: %v", err)
+		}
+		if _, err := stream.Write(toExternal); err != nil {
+			t.Errorf("client write: %v", err)
+		}
+		io.Copy(io.Discard, dataPeer)
+		clientDone <- got
+	}()
+
+	// The external peer sends while reading the answer, and closes once it has it
+	externalDone := make(chan []byte, 1)
+	go func() {
+		defer externalPeer.Close()
+		got := make([]byte, len(toExternal))
+		if _, err := io.ReadFull(externalPeer, got); err != nil {
+			t.Errorf("external read: %v", err)
+		}
+		externalDone <- got
+	}()
+	go func() {
+		if _, err := externalPeer.Write(toClient); err != nil {
+			t.Errorf("external write: %v", err)
+		}
+	}()
+
+	logID := uuid.New()
+	tunnel.bridgeConnectionsWithLogging(external, data, compression, logID)
+
+	if got := <-clientDone; !bytes.Equal(got, toClient) {
+		t.Errorf("client received %d bytes that differ from the %d sent", len(got), len(toClient))
+	}
+	if got := <-externalDone; !bytes.Equal(got, toExternal) {
+		t.Errorf("external peer received %d bytes that differ from the %d sent", len(got), len(toExternal))
+	}
+
+	if tunnel.bytesSent.Load() != int64(len(toClient)) || tunnel.bytesReceived.Load() != int64(len(toExternal)) {
+		t.Errorf("tunnel counted %d bytes sent and %d received, want %d and %d",
+			tunnel.bytesSent.Load(), tunnel.bytesReceived.Load(), len(toClient), len(toExternal))
+	}
+
+	select {
+	case result := <-s.connLogs.queue:
+		if result.LogID != logID {
+			t.Errorf("result is for connection log %s, want %s", result.LogID, logID)
+		}
+		if result.Status != "closed" || result.ErrorMessage != nil {
+			t.Errorf("result status %q, want closed", result.Status)
+			if result.ErrorMessage != nil {
+				t.Errorf("error message: %s", *result.ErrorMessage)
+			}
+		}
+		return result
+	default:
+		t.Fatal("no connection result was queued")
+		return database.ConnectionResult{}
+	}
+}
+
+func TestBridgeCountsAsymmetricTraffic(t *testing.T) {
+	toClient := make([]byte, 1<<20)
+	rand.Read(toClient)
+	toExternal := make([]byte, 3000)
+	rand.Read(toExternal)
+
+	result := bridgeAsymmetric(t, "", toClient, toExternal)
+
+	if result.BytesSent != int64(len(toClient)) || result.BytesReceived != int64(len(toExternal)) {
+		t.Errorf("result has %d bytes sent and %d received, want %d and %d",
+			result.BytesSent, result.BytesReceived, len(toClient), len(toExternal))
+	}
+	if result.WireBytesSent != result.BytesSent || result.WireBytesReceived != result.BytesReceived {
+		t.Errorf("uncompressed wire counts %d/%d differ from byte counts %d/%d",
+			result.WireBytesSent, result.WireBytesReceived, result.BytesSent, result.BytesReceived)
+	}
+}
+
+func TestBridgeCountsCompressedTraffic(t *testing.T) {
+	toClient := bytes.Repeat([]byte("GET / HTTP/1.1\r\n"), 1<<14)
+	toExternal := bytes.Repeat([]byte("HTTP/1.1 200 OK\r\n"), 100)
+
+	result := bridgeAsymmetric(t, protocol.CompressionFlate, toClient, toExternal)
+
+	if result.BytesSent != int64(len(toClient)) || result.BytesReceived != int64(len(toExternal)) {
+		t.Errorf("result has %d bytes sent and %d received, want %d and %d",
+			result.BytesSent, result.BytesReceived, len(toClient), len(toExternal))
+	}
+	if result.WireBytesSent <= 0 || result.WireBytesSent >= result.BytesSent {
+		t.Errorf("compressed %d bytes to %d on the wire", result.BytesSent, result.WireBytesSent)
+	}
+	if result.WireBytesReceived <= 0 || result.WireBytesReceived >= result.BytesReceived {
+		t.Errorf("decompressed %d wire bytes to %d", result.WireBytesReceived, result.BytesReceived)
+	}
+}
+
+func TestConcurrentHandshakesCannotExceedTunnelQuota(t *testing.T) {
+	const limit = 3
+	s, _, _ := newTestTunnel(t, time.Second)
+	s.tunnels["existing"] = &Tunnel{ID: "existing", TeamID: "team"}
+	teamToken := &database.TeamToken{TeamID: "team", Team: &database.Team{MaxConcurrentTunnels: limit}}
+
+	var granted atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			held, err := s.reserveTunnelSlot(teamToken)
+			if held != (err == nil) {
+				t.Errorf("reserveTunnelSlot = %v, %v", held, err)
+			}
+			if held {
+				granted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := granted.Load(); got != limit-1 {
+		t.Fatalf("%d handshakes were given a slot next to one open tunnel, want %d", got, limit-1)
+	}
+
+	// Failed creations give their slots back
+	s.mu.Lock()
+	for i := 0; i < limit-1; i++ {
+		s.releaseTunnelSlot("team")
+	}
+	s.mu.Unlock()
+	if held, err := s.reserveTunnelSlot(teamToken); !held || err != nil {
+		t.Errorf("no slot after the others were released: %v", err)
+	}
+
+	// Teams without a quota are not tracked
+	unlimited := &database.TeamToken{TeamID: "other", Team: &database.Team{}}
+	if held, err := s.reserveTunnelSlot(unlimited); held || err != nil {
+		t.Errorf("reserveTunnelSlot without a quota = %v, %v", held, err)
+	}
+}
+
+func TestSilentConnectionTimesOutInHandshake(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	s, _, _ := newTestTunnel(t, time.Second)
+	s.config.MaxControlMessage = DefaultMaxControlMessage
+	s.config.ControlWriteTimeout = time.Second
+	security := middleware.DefaultSecurityConfig()
+	security.HandshakeTimeout = timeout
+	security.KeepAlive = 0
+	s.securityMiddleware = middleware.NewSecurityMiddleware(security, nil, "")
+	t.Cleanup(s.securityMiddleware.Stop)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client sends nothing
+	start := time.Now()
+	handled := make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		s.handleControlConnection(s.securityMiddleware.WrapConnection(conn))
+		close(handled)
+	}()
+
+	client.SetReadDeadline(time.Now().Add(timeout + 2*time.Second))
+	msgType, payload, err := protocol.ReadFrame(client)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("no AuthResult after %v: %v", elapsed, err)
+	}
+	var result protocol.AuthResult
+	if err := protocol.Decode(msgType, payload, &result); err != nil {
+		t.Fatalf("expected an AuthResult, got %s: %v", msgType, err)
+	}
+	if result.Error != "handshake timeout" || result.Code != protocol.ErrCodeHandshakeTimeout {
+		t.Errorf("got %+v, want a handshake timeout", result)
+	}
+	if elapsed < timeout-10*time.Millisecond || elapsed > timeout+time.Second {
+		t.Errorf("timed out after %v, want about %v", elapsed, timeout)
+	}
+
+	// The handler has returned and closed the connection
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("handler still running after the handshake timeout")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after the timeout: %v, want EOF", err)
+	}
+}
+
+func TestSecondClientOnOneToken(t *testing.T) {
+	for _, allowTakeover := range []bool{false, true} {
+		t.Run(fmt.Sprintf("AllowTakeover=%v", allowTakeover), func(t *testing.T) {
+			s, tunnel, _ := newTestTunnel(t, time.Second)
+			s.config.AllowTakeover = allowTakeover
+			key := tunnelKey{token: "token", port: 10000}
+
+			// Two clients handshake at once: one opens the tunnel, the other is
+			// turned away rather than opening a second one
+			var opened atomic.Int32
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if existing, ok := s.claimTunnel(key, ""); ok && existing == nil {
+						opened.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			if got := opened.Load(); got != 1 {
+				t.Fatalf("%d of two concurrent clients opened the tunnel", got)
+			}
+
+			// The first client now holds the tunnel
+			tunnel.Token = key.token
+			tunnel.setReconnectToken("first")
+			s.mu.Lock()
+			s.tunnels[tunnel.ID] = tunnel
+			delete(s.opening, key)
+			s.mu.Unlock()
+
+			existing, ok := s.claimTunnel(key, "")
+			if ok != allowTakeover || (ok && existing != tunnel) {
+				t.Errorf("second client: got tunnel %v, ok %v; want ok %v", existing, ok, allowTakeover)
+			}
+			existing, ok = s.claimTunnel(key, "stale")
+			if ok != allowTakeover {
+				t.Errorf("client with another reconnect token: ok %v, want %v", ok, allowTakeover)
+			}
+
+			// The holder reconnecting with its own reconnect token keeps the tunnel
+			if existing, ok = s.claimTunnel(key, "first"); !ok || existing != tunnel {
+				t.Errorf("first client reconnecting: got tunnel %v, ok %v", existing, ok)
+			}
+
+			// Once the holder's control connection has ended, anyone may take the tunnel
+			tunnel.Client().closed.Store(true)
+			if existing, ok = s.claimTunnel(key, ""); !ok || existing != tunnel {
+				t.Errorf("client after the holder disconnected: got tunnel %v, ok %v", existing, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// maxDatagramSize is the largest UDP payload that can be relayed
+	maxDatagramSize = 65535
+
+	// udpSessionIdleTimeout closes a UDP session after this long without traffic
+	udpSessionIdleTimeout = 60 * time.Second
+
+	// udpSessionQueueSize is the number of datagrams buffered per session while
+	// the client's data connection is being established
+	udpSessionQueueSize = 64
+)
+
+// udpSession relays datagrams for a single remote source address over one
+// data connection to the client
+type udpSession struct {
+	addr    net.Addr
+	packets chan []byte
+}
+
+// servePackets reads datagrams from the tunnel's UDP port and dispatches them to
+// per-source sessions, creating a session on the first datagram from a new address
+func (t *Tunnel) servePackets() {
+	defer t.wg.Done()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := t.PacketConn.ReadFrom(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				t.logger().Error("error reading datagram", "error", err)
+			}
+			return
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		t.udpMu.Lock()
+		if t.udpSessions == nil {
+			t.udpSessions = make(map[string]*udpSession)
+		}
+		session, exists := t.udpSessions[addr.String()]
+		if !exists {
+			session = &udpSession{
+				addr:    addr,
+				packets: make(chan []byte, udpSessionQueueSize),
+			}
+			t.udpSessions[addr.String()] = session
+			t.wg.Add(1)
+			go t.handleUDPSession(session)
+		}
+		t.udpMu.Unlock()
+
+		select {
+		case session.packets <- packet:
+		default:
+			t.logger().Warn("dropping datagram: session queue full", "client_addr", addr.String())
+		}
+	}
+}
+
+// handleUDPSession requests a data connection from the client and relays
+// datagrams in both directions until the session goes idle
+func (t *Tunnel) handleUDPSession(session *udpSession) {
+	defer t.wg.Done()
+	defer t.trackActivity()()
+	defer func() {
+		t.udpMu.Lock()
+		delete(t.udpSessions, session.addr.String())
+		t.udpMu.Unlock()
+	}()
+
+	clientIP, clientPort := session.addr.String(), 0
+	if udpAddr, ok := session.addr.(*net.UDPAddr); ok {
+		clientIP, clientPort = udpAddr.IP.String(), udpAddr.Port
+	}
+
+	t.logger().Debug("new udp session", "client_ip", clientIP, "client_port", clientPort)
+
+	dataConn, connID, ok := t.requestDataConnection(clientIP, clientPort, t.PacketConn.LocalAddr())
+	if !ok {
+		return
+	}
+	defer dataConn.Close()
+
+	t.logger().Debug("data connection established for udp session", "conn_id", connID)
+	connectionLogID := t.createConnectionLog(clientIP, clientPort)
+
+	opened := t.tunnelEvent(EventConnectionOpened)
+	opened.ClientIP, opened.ClientPort = clientIP, clientPort
+	t.publishEvent(opened)
+
+	startTime := time.Now()
+	var bytesReceived, bytesSent int64
+	var relayErr, replyErr error
+
+	// Client → external peer
+	replies := make(chan struct{})
+	go func() {
+		defer close(replies)
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := readDatagram(dataConn, buf)
+			if err != nil {
+				if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+					replyErr = err
+				}
+				return
+			}
+			if _, err := t.PacketConn.WriteTo(buf[:n], session.addr); err != nil {
+				replyErr = err
+				return
+			}
+			bytesReceived += int64(n)
+			t.bytesReceived.Add(int64(n))
+		}
+	}()
+
+	// External peer → client
+	idle := time.NewTimer(udpSessionIdleTimeout)
+	defer idle.Stop()
+
+relay:
+	for {
+		select {
+		case packet := <-session.packets:
+			if err := writeDatagram(dataConn, packet); err != nil {
+				relayErr = err
+				break relay
+			}
+			bytesSent += int64(len(packet))
+			t.bytesSent.Add(int64(len(packet)))
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(udpSessionIdleTimeout)
+		case <-idle.C:
+			break relay
+		case <-replies:
+			break relay
+		case <-t.stopChan:
+			break relay
+		}
+	}
+
+	dataConn.Close()
+	<-replies
+	if relayErr == nil {
+		relayErr = replyErr
+	}
+
+	status := "closed"
+	var errorMessage *string
+	if relayErr != nil {
+		status = "error"
+		errMsg := relayErr.Error()
+		errorMessage = &errMsg
+	}
+
+	t.recordConnectionResult(connectionLogID, bytesReceived, bytesSent, bytesReceived, bytesSent, status, errorMessage, nil, nil)
+
+	duration := time.Since(startTime)
+	t.logger().Info("udp session finished", "client_ip", clientIP, "connection_log_id", connectionLogID,
+		"duration_ms", duration.Milliseconds(), "bytes_sent", bytesSent, "bytes_received", bytesReceived, "status", status)
+
+	closed := t.tunnelEvent(EventConnectionClosed)
+	closed.ClientIP, closed.ClientPort = clientIP, clientPort
+	closed.BytesSent = bytesSent
+	closed.BytesReceived = bytesReceived
+	closed.DurationMs = duration.Milliseconds()
+	closed.Status = status
+	t.publishEvent(closed)
+}
+
+// writeDatagram writes a datagram to a stream as a 2-byte big-endian length followed by the payload
+func writeDatagram(w io.Writer, packet []byte) error {
+	if len(packet) > maxDatagramSize {
+		return fmt.Errorf("datagram too large: %d bytes", len(packet))
+	}
+
+	frame := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(frame, uint16(len(packet)))
+	copy(frame[2:], packet)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads a single length-prefixed datagram from a stream into buf
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(buf) {
+		return 0, fmt.Errorf("datagram too large: %d bytes", n)
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -9,6 +9,12 @@ echo "================================"
 API_BASE="http://localhost:8080"
 API_URL="$API_BASE/api/v1"
 
+# Management endpoints require the admin key when the server has one configured
+AUTH_ARGS=()
+if [ -n "$API_ADMIN_KEY" ]; then
+    AUTH_ARGS=(-H "Authorization: Bearer $API_ADMIN_KEY")
+fi
+
 # Colors for output
 RED='\033[0;31m'
 GREEN='\033[0;32m'
@@ -27,12 +33,12 @@ api_call() {
     echo -e "${YELLOW}$method $API_URL$endpoint${NC}"
     
     if [ "$method" = "POST" ] && [ -n "$data" ]; then
-        response=$(curl -s -w "\n%{http_code}" -X "$method" \
+        response=$(curl -s -w "\n%{http_code}" -X "$method" "${AUTH_ARGS[@]}" \
             -H "Content-Type: application/json" \
             -d "$data" \
             "$API_URL$endpoint")
     else
-        response=$(curl -s -w "\n%{http_code}" -X "$method" "$API_URL$endpoint")
+        response=$(curl -s -w "\n%{http_code}" -X "$method" "${AUTH_ARGS[@]}" "$API_URL$endpoint")
     fi
     
     # Split response and status code
@@ -101,6 +107,79 @@ test_stats() {
     api_call "GET" "/stats" "" "Database Statistics"
 }
 
+# Create a team with a token and print "<team_id> <token>"
+create_team_with_token() {
+    local name=$1
+    local team_id token
+
+    team_id=$(curl -s -X POST "${AUTH_ARGS[@]}" -H "Content-Type: application/json" \
+        -d '{"name": "'$name'"}' "$API_URL/teams" | jq -r '.data.team_id // empty')
+    [ -n "$team_id" ] || return 1
+
+    token=$(curl -s -X POST "${AUTH_ARGS[@]}" -H "Content-Type: application/json" \
+        -d '{"team_id": "'$team_id'", "name": "usage-test"}' "$API_URL/tokens/generate" | jq -r '.data.token // empty')
+    [ -n "$token" ] || return 1
+
+    echo "$team_id $token"
+}
+
+# Test that GET /usage only ever returns the token's own team
+test_usage_isolation() {
+    echo -e "${BLUE}🔒 Testing Usage Isolation Between Teams${NC}"
+
+    if ! command -v jq &> /dev/null; then
+        echo -e "${YELLOW}⚠️ Skipped: jq is required${NC}"
+        echo
+        return
+    fi
+
+    local suffix=$(date +%s)
+    local team_a team_b token_a token_b
+    read -r team_a token_a < <(create_team_with_token "usage-a-$suffix")
+    read -r team_b token_b < <(create_team_with_token "usage-b-$suffix")
+    if [ -z "$token_a" ] || [ -z "$token_b" ]; then
+        echo -e "${RED}❌ Failed to create test teams and tokens${NC}"
+        echo
+        return
+    fi
+
+    local failed=0
+    local body
+    body=$(curl -s -H "Authorization: Bearer $token_a" "$API_URL/usage")
+    if [ "$(echo "$body" | jq -r '.data.team_id')" != "$team_a" ]; then
+        echo -e "${RED}❌ Token A did not resolve to team A${NC}"
+        failed=1
+    fi
+    if echo "$body" | jq -e --arg team "$team_a" '[.data.stats[], .data.tunnels[]] | any(.team_id != $team)' > /dev/null; then
+        echo -e "${RED}❌ Team A's usage includes another team's data${NC}"
+        failed=1
+    fi
+    if echo "$body" | grep -q "$team_b"; then
+        echo -e "${RED}❌ Team A's usage mentions team B${NC}"
+        failed=1
+    fi
+
+    local code
+    code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer not-a-token" "$API_URL/usage")
+    if [ "$code" != "401" ]; then
+        echo -e "${RED}❌ Invalid token got $code instead of 401${NC}"
+        failed=1
+    fi
+    code=$(curl -s -o /dev/null -w "%{http_code}" "${AUTH_ARGS[@]}" "$API_URL/usage")
+    if [ -n "$API_ADMIN_KEY" ] && [ "$code" != "401" ]; then
+        echo -e "${RED}❌ The admin key was accepted as a tunnel token ($code)${NC}"
+        failed=1
+    fi
+
+    if [ "$failed" -eq 0 ]; then
+        echo -e "${GREEN}✅ Usage is scoped to the token's team${NC}"
+    fi
+
+    curl -s -o /dev/null -X DELETE "${AUTH_ARGS[@]}" "$API_URL/teams/$team_a"
+    curl -s -o /dev/null -X DELETE "${AUTH_ARGS[@]}" "$API_URL/teams/$team_b"
+    echo
+}
+
 # Main execution
 main() {
     echo "Prerequisites:"
@@ -122,6 +201,7 @@ main() {
     test_stats
     test_teams
     test_generate_token
+    test_usage_isolation
     
     echo -e "${BLUE}📋 Summary:${NC}"
     echo "• The token generation endpoint is: POST $API_URL/tokens/generate"
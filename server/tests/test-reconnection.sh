@@ -21,6 +21,12 @@ API_PORT="8080"
 TEST_TOKEN="test-token-123"
 LOCAL_PORT="5432"
 
+# Management endpoints require the admin key when the server has one configured
+AUTH_ARGS=()
+if [ -n "$API_ADMIN_KEY" ]; then
+    AUTH_ARGS=(-H "Authorization: Bearer $API_ADMIN_KEY")
+fi
+
 # Function to wait for server startup
 wait_for_server() {
     echo -n "⏳ Waiting for server to start..."
@@ -71,7 +77,7 @@ check_port_assignment() {
     echo -n "🔍 Checking port assignment via API..."
     
     # Generate token via API
-    TOKEN_RESPONSE=$(curl -s -X POST http://${SERVER_HOST}:${API_PORT}/api/v1/tokens/generate \
+    TOKEN_RESPONSE=$(curl -s -X POST "${AUTH_ARGS[@]}" http://${SERVER_HOST}:${API_PORT}/api/v1/tokens/generate \
         -H "Content-Type: application/json" \
         -d '{
             "team_name": "Test Team",
@@ -21,6 +21,12 @@ echo "📋 Environment loaded:"
 echo "   DATABASE_URL: ${DATABASE_URL:0:50}..."
 echo "   REDIS_URL: ${REDIS_URL:0:50}..."
 
+# Management endpoints require the admin key when the server has one configured
+AUTH_ARGS=()
+if [ -n "$API_ADMIN_KEY" ]; then
+    AUTH_ARGS=(-H "Authorization: Bearer $API_ADMIN_KEY")
+fi
+
 # Build the project
 echo ""
 echo "🔨 Building project..."
@@ -208,7 +214,7 @@ echo "============================================="
 
 # Check teams endpoint
 echo "👥 Testing teams endpoint..."
-TEAMS_RESPONSE=$(curl -s http://localhost:8080/api/v1/teams)
+TEAMS_RESPONSE=$(curl -s "${AUTH_ARGS[@]}" http://localhost:8080/api/v1/teams)
 if echo "$TEAMS_RESPONSE" | grep -q "Test Team"; then
     echo "✅ Teams API working correctly"
 else
@@ -218,7 +224,7 @@ fi
 
 # Check stats endpoint
 echo "📊 Testing stats endpoint..."
-STATS_RESPONSE=$(curl -s http://localhost:8080/api/v1/stats)
+STATS_RESPONSE=$(curl -s "${AUTH_ARGS[@]}" http://localhost:8080/api/v1/stats)
 if echo "$STATS_RESPONSE" | grep -q "connection_sessions"; then
     echo "✅ Stats API working correctly"
 else